@@ -0,0 +1,69 @@
+// Package audit works out what changed about a user, for recording in the audit log.
+package audit
+
+import (
+	"strconv"
+	"time"
+	"userapi/data"
+)
+
+// Redacted replaces sensitive values, so the audit log shows they changed without revealing them
+const Redacted = "[REDACTED]"
+
+// Fields lists every field Diff compares, in the order changes are reported
+var Fields = []string{"id", "first_name", "last_name", "nickname", "password", "email", "country", "version", "deleted_at"}
+
+// Diff lists every field that differs between two versions of a user, in a fixed order.
+// before is nil for a new user. Passwords are redacted.
+func Diff(before, after *data.User) []data.FieldChange {
+	var b, a data.User
+	if before != nil {
+		b = *before
+	}
+	if after != nil {
+		a = *after
+	}
+
+	changes := make([]data.FieldChange, 0)
+	add := func(field, before, after string) {
+		if before != after {
+			changes = append(changes, data.FieldChange{Field: field, Before: before, After: after})
+		}
+	}
+
+	add("id", b.ID, a.ID)
+	add("first_name", b.FirstName, a.FirstName)
+	add("last_name", b.LastName, a.LastName)
+	add("nickname", b.Nickname, a.Nickname)
+	if b.Password != a.Password {
+		changes = append(changes, data.FieldChange{Field: "password", Before: redact(b.Password), After: redact(a.Password)})
+	}
+	add("email", b.Email, a.Email)
+	add("country", b.Country, a.Country)
+	add("version", formatVersion(b.Version), formatVersion(a.Version))
+	add("deleted_at", formatTime(b.DeletedAt), formatTime(a.DeletedAt))
+
+	return changes
+}
+
+// redact hides a value, leaving unset values empty so it's clear when one was added or removed
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return Redacted
+}
+
+func formatVersion(version int64) string {
+	if version == 0 {
+		return ""
+	}
+	return strconv.FormatInt(version, 10)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"userapi/data"
+)
+
+// TestDiff tests the Diff function.
+func TestDiff(t *testing.T) {
+	deletedAt := time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)
+	user := data.User{ID: "1", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", Version: 1}
+
+	updated := user
+	updated.Nickname = "Meepo"
+	updated.Password = "d1gD1gD1g"
+	updated.Version = 2
+
+	deleted := user
+	deleted.Version = 2
+	deleted.DeletedAt = &deletedAt
+
+	tests := []struct {
+		name     string
+		before   *data.User
+		after    *data.User
+		expected []data.FieldChange
+	}{
+		{
+			name:  "Created",
+			after: &user,
+			expected: []data.FieldChange{
+				{Field: "id", After: "1"},
+				{Field: "first_name", After: "Razzil"},
+				{Field: "last_name", After: "Darkbrew"},
+				{Field: "nickname", After: "Alchemist"},
+				{Field: "password", After: Redacted},
+				{Field: "email", After: "Razzil.Darkbrew@example.com"},
+				{Field: "country", After: "UK"},
+				{Field: "version", After: "1"},
+			},
+		},
+		{
+			name:   "Updated, password redacted",
+			before: &user,
+			after:  &updated,
+			expected: []data.FieldChange{
+				{Field: "nickname", Before: "Alchemist", After: "Meepo"},
+				{Field: "password", Before: Redacted, After: Redacted},
+				{Field: "version", Before: "1", After: "2"},
+			},
+		},
+		{
+			name:   "Deleted",
+			before: &user,
+			after:  &deleted,
+			expected: []data.FieldChange{
+				{Field: "version", Before: "1", After: "2"},
+				{Field: "deleted_at", After: "2024-06-17T19:49:18Z"},
+			},
+		},
+		{
+			name:     "Unchanged",
+			before:   &user,
+			after:    &user,
+			expected: []data.FieldChange{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := Diff(tt.before, tt.after)
+			if !reflect.DeepEqual(changes, tt.expected) {
+				t.Errorf("unexpected changes, want: %+v, got: %+v", tt.expected, changes)
+			}
+		})
+	}
+}
+
+// TestFields tests that Fields lists every field Diff reports, in order.
+func TestFields(t *testing.T) {
+	deletedAt := time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)
+	user := data.User{ID: "1", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", Version: 1, DeletedAt: &deletedAt}
+
+	changes := Diff(nil, &user)
+	fields := make([]string, len(changes))
+	for i, change := range changes {
+		fields[i] = change.Field
+	}
+
+	if !reflect.DeepEqual(fields, Fields) {
+		t.Errorf("unexpected fields, want: %v, got: %v", Fields, fields)
+	}
+}
@@ -0,0 +1,196 @@
+// Package auth identifies the clients calling us by the API keys they've been given.
+// A client sends its key in the X-API-Key header, or x-api-key gRPC metadata. Only keys we've been configured with identify a client,
+// anyone else is anonymous, so sending made up keys gets a client nothing it wouldn't have had without one.
+// Admin routes and RPCs are only open to clients whose key is marked admin.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// APIKeyHeader carries the client's API key over HTTP
+	APIKeyHeader = "X-API-Key"
+	// APIKeyMetadataKey carries the client's API key over gRPC
+	APIKeyMetadataKey = "x-api-key"
+)
+
+var (
+	// ErrUnauthenticated is returned for an admin request without a known API key
+	ErrUnauthenticated = errors.New("a known API key is required")
+	// ErrNotAdmin is returned for an admin request from a client that isn't an admin
+	ErrNotAdmin = errors.New("only admin clients are allowed")
+)
+
+// Client is who a request comes from
+type Client struct {
+	// Name identifies the client in the rate limits
+	Name string
+	// Admin clients can use the admin routes and RPCs
+	Admin bool
+}
+
+// Keys are the API keys we accept, and the clients they belong to. A nil Keys accepts none.
+type Keys struct {
+	// clients are keyed by a hash of their API key, so the keys themselves aren't held once they're loaded
+	clients map[[sha256.Size]byte]Client
+}
+
+// ParseKeys reads a client a line, as name:key, or name:key:admin for an admin client.
+// Blank lines and those starting with # are skipped.
+func ParseKeys(r io.Reader) (*Keys, error) {
+	keys := &Keys{clients: make(map[[sha256.Size]byte]Client)}
+	names := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.Split(text, ":")
+		admin := len(parts) == 3 && parts[2] == "admin"
+		if (len(parts) != 2 && !admin) || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid API key on line %d, expected name:key or name:key:admin", line)
+		}
+		hash := sha256.Sum256([]byte(parts[1]))
+		if _, ok := keys.clients[hash]; ok || names[parts[0]] {
+			return nil, fmt.Errorf("duplicate API key or client name on line %d", line)
+		}
+		names[parts[0]] = true
+		keys.clients[hash] = Client{Name: parts[0], Admin: admin}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// LoadKeys reads the API keys from a file, as ParseKeys. No file accepts no keys.
+func LoadKeys(path string) (*Keys, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseKeys(f)
+}
+
+// Lookup returns the client an API key belongs to
+func (k *Keys) Lookup(key string) (Client, bool) {
+	if k == nil || key == "" {
+		return Client{}, false
+	}
+	client, ok := k.clients[sha256.Sum256([]byte(key))]
+	return client, ok
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the client
+func NewContext(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, contextKey{}, client)
+}
+
+// FromContext returns the client the request ctx belongs to came from, false for anonymous requests
+func FromContext(ctx context.Context) (Client, bool) {
+	client, ok := ctx.Value(contextKey{}).(Client)
+	return client, ok
+}
+
+// Middleware identifies the client by its API key, leaving the request anonymous if it doesn't have a known one
+func (k *Keys) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client, ok := k.Lookup(r.Header.Get(APIKeyHeader)); ok {
+			r = r.WithContext(NewContext(r.Context(), client))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UnaryServerInterceptor identifies the client by its API key, leaving the RPC anonymous if it doesn't have a known one
+func (k *Keys) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(k.identify(ctx), req)
+}
+
+// StreamServerInterceptor identifies the client by its API key, leaving the stream anonymous if it doesn't have a known one
+func (k *Keys) StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &serverStream{ServerStream: ss, ctx: k.identify(ss.Context())})
+}
+
+// identify adds the client to ctx, if the RPC's metadata has a known API key
+func (k *Keys) identify(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range md.Get(APIKeyMetadataKey) {
+		if client, ok := k.Lookup(key); ok {
+			return NewContext(ctx, client)
+		}
+	}
+	return ctx
+}
+
+// serverStream carries the client in the stream's context
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// CheckAdmin checks the request ctx belongs to came from an admin client
+func CheckAdmin(ctx context.Context) error {
+	client, ok := FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !client.Admin {
+		return ErrNotAdmin
+	}
+	return nil
+}
+
+// RequireAdmin turns away requests that don't come from an admin client,
+// with a 401 Unauthorized without a known API key and a 403 Forbidden for anyone else
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch err := CheckAdmin(r.Context()); {
+		case errors.Is(err, ErrUnauthenticated):
+			w.WriteHeader(http.StatusUnauthorized)
+		case err != nil:
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// GRPCError converts CheckAdmin's errors into gRPC's Unauthenticated and PermissionDenied
+func GRPCError(err error) error {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ErrNotAdmin):
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return err
+	}
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestParseKeys tests clients are read a line each, skipping blanks and comments, and rejecting anything malformed
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys(strings.NewReader("# support tooling\nsupport:key-1\n\n  ops:key-2:admin  \n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for key, name := range map[string]string{"key-1": "support", "key-2": "ops"} {
+		if client, ok := keys.Lookup(key); !ok || client.Name != name {
+			t.Errorf("expected %s to belong to %s, got %+v, %v", key, name, client, ok)
+		}
+	}
+	if client, _ := keys.Lookup("key-1"); client.Admin {
+		t.Error("expected support not to be an admin")
+	}
+	if client, _ := keys.Lookup("key-2"); !client.Admin {
+		t.Error("expected ops to be an admin")
+	}
+	if _, ok := keys.Lookup("key-3"); ok {
+		t.Error("expected an unknown key not to identify anyone")
+	}
+
+	for _, invalid := range []string{"support", "support:", ":key-1", "a:b:c", "a:b:admin:c", "support:key-1\nops:key-1", "support:key-1\nsupport:key-2"} {
+		if _, err := ParseKeys(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+
+	var none *Keys
+	if _, ok := none.Lookup("key-1"); ok {
+		t.Error("expected no keys to identify no one")
+	}
+}
+
+// TestMiddleware tests requests with a known key are identified, and the rest left anonymous
+func TestMiddleware(t *testing.T) {
+	keys, _ := ParseKeys(strings.NewReader("support:key-1"))
+
+	for key, want := range map[string]string{"key-1": "support", "made-up": "", "": ""} {
+		var got string
+		handler := keys.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _ := FromContext(r.Context())
+			got = client.Name
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/userapi/get", nil)
+		req.Header.Set(APIKeyHeader, key)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if got != want {
+			t.Errorf("unexpected client for key %q, want: %q, got: %q", key, want, got)
+		}
+	}
+}
+
+// TestServerInterceptors tests RPCs with a known key are identified, and the rest left anonymous
+func TestServerInterceptors(t *testing.T) {
+	keys, _ := ParseKeys(strings.NewReader("support:key-1"))
+
+	for key, want := range map[string]string{"key-1": "support", "made-up": ""} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(APIKeyMetadataKey, key))
+
+		var unary string
+		keys.UnaryServerInterceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			client, _ := FromContext(ctx)
+			unary = client.Name
+			return nil, nil
+		})
+		var stream string
+		keys.StreamServerInterceptor(nil, &fakeStream{ctx: ctx}, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+			client, _ := FromContext(ss.Context())
+			stream = client.Name
+			return nil
+		})
+
+		if unary != want || stream != want {
+			t.Errorf("unexpected client for key %q, want: %q, got unary: %q, stream: %q", key, want, unary, stream)
+		}
+	}
+}
+
+// TestRequireAdmin tests only admin clients get through, anonymous requests and RPCs being told to authenticate
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		wantStatus int
+		wantCode   codes.Code
+	}{
+		{name: "Anonymous", ctx: context.Background(), wantStatus: http.StatusUnauthorized, wantCode: codes.Unauthenticated},
+		{name: "Client", ctx: NewContext(context.Background(), Client{Name: "support"}), wantStatus: http.StatusForbidden, wantCode: codes.PermissionDenied},
+		{name: "Admin", ctx: NewContext(context.Background(), Client{Name: "ops", Admin: true}), wantStatus: http.StatusOK, wantCode: codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/userapi/admin/export", nil).WithContext(tt.ctx))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("unexpected status, want: %v, got: %v", tt.wantStatus, rr.Code)
+			}
+
+			if code := status.Code(GRPCError(CheckAdmin(tt.ctx))); code != tt.wantCode {
+				t.Errorf("unexpected code, want: %v, got: %v", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+// fakeStream is a server stream with a context
+type fakeStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,234 @@
+// Package broadcast fans values out to every subscriber, giving each one its own bounded buffer
+// so a slow subscriber can't hold up the publisher or anyone else.
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrSlowConsumer ends a subscription which fell too far behind, under the Disconnect policy
+	ErrSlowConsumer = errors.New("subscriber fell too far behind")
+	// ErrClosed ends every subscription once the broadcaster is closed
+	ErrClosed = errors.New("broadcaster closed")
+)
+
+// Policy decides what happens when a subscriber's buffer is full
+type Policy int
+
+const (
+	// DropOldest makes room by dropping the oldest buffered value, and signals the subscriber it has lagged
+	DropOldest Policy = iota
+	// Disconnect ends the subscription with ErrSlowConsumer
+	Disconnect
+)
+
+// ParsePolicy parses a policy from its name, "drop-oldest" or "disconnect"
+func ParsePolicy(name string) (Policy, error) {
+	switch name {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q, use drop-oldest or disconnect", name)
+}
+
+func (p Policy) String() string {
+	if p == Disconnect {
+		return "disconnect"
+	}
+	return "drop-oldest"
+}
+
+// Stats counts what the broadcaster has done, for metrics
+type Stats struct {
+	Subscribers  int   `json:"subscribers"`
+	Published    int64 `json:"published"`
+	Dropped      int64 `json:"dropped"`
+	Disconnected int64 `json:"disconnected"`
+}
+
+// Broadcaster sends every published value to all of its subscribers
+type Broadcaster[T any] struct {
+	bufferSize int
+	policy     Policy
+
+	mu          sync.RWMutex
+	subscribers map[*Subscription[T]]struct{}
+	closed      bool
+
+	published    atomic.Int64
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+}
+
+// New creates a broadcaster, buffering up to bufferSize values for each subscriber
+func New[T any](bufferSize int, policy Policy) *Broadcaster[T] {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	return &Broadcaster[T]{
+		bufferSize:  bufferSize,
+		policy:      policy,
+		subscribers: make(map[*Subscription[T]]struct{}),
+	}
+}
+
+// Subscription receives the values published after it was made
+// Its updates are never closed, so a publish can't race with the subscription ending.
+type Subscription[T any] struct {
+	b       *Broadcaster[T]
+	updates chan T
+	lagged  chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	err     error
+}
+
+// Subscribe adds a subscriber, which is removed once ctx is done or the subscription is closed
+func (b *Broadcaster[T]) Subscribe(ctx context.Context) *Subscription[T] {
+	s := &Subscription[T]{
+		b:       b,
+		updates: make(chan T, b.bufferSize),
+		lagged:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		s.end(ErrClosed)
+		return s
+	}
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+
+	// Clean up as soon as the subscriber goes away, or is disconnected
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.done:
+		}
+		s.Close()
+	}()
+
+	return s
+}
+
+// Publish sends a value to every subscriber, without ever blocking on them
+func (b *Broadcaster[T]) Publish(value T) {
+	b.published.Add(1)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subscribers {
+		b.send(s, value)
+	}
+}
+
+// send buffers a value for a subscriber, applying the overflow policy when their buffer is full
+func (b *Broadcaster[T]) send(s *Subscription[T], value T) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case s.updates <- value:
+			return
+		default:
+		}
+
+		if b.policy == Disconnect {
+			if s.end(ErrSlowConsumer) {
+				b.disconnected.Add(1)
+			}
+			return
+		}
+
+		// Make room, the subscriber may also have made some by reading in the meantime
+		select {
+		case <-s.updates:
+			b.dropped.Add(1)
+			select {
+			case s.lagged <- struct{}{}:
+			default:
+			}
+		default:
+		}
+	}
+}
+
+// Close ends every subscription with ErrClosed, and any made afterwards straight away.
+// Subscribers see their subscription end once they've read the values already buffered for them, if they want them.
+func (b *Broadcaster[T]) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for s := range b.subscribers {
+		s.end(ErrClosed)
+	}
+}
+
+// Stats counts the subscribers, and every value published, dropped, and every subscriber disconnected
+func (b *Broadcaster[T]) Stats() Stats {
+	b.mu.RLock()
+	subscribers := len(b.subscribers)
+	b.mu.RUnlock()
+
+	return Stats{
+		Subscribers:  subscribers,
+		Published:    b.published.Load(),
+		Dropped:      b.dropped.Load(),
+		Disconnected: b.disconnected.Load(),
+	}
+}
+
+// Updates receives the published values
+func (s *Subscription[T]) Updates() <-chan T {
+	return s.updates
+}
+
+// Lagged is signalled when values had to be dropped, because the subscriber fell behind
+func (s *Subscription[T]) Lagged() <-chan struct{} {
+	return s.lagged
+}
+
+// Done is closed once the subscription has ended
+func (s *Subscription[T]) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err is why the subscription ended, ErrSlowConsumer if it was disconnected, ErrClosed if the broadcaster was closed, otherwise nil
+func (s *Subscription[T]) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close ends the subscription, and removes it from the broadcaster
+func (s *Subscription[T]) Close() {
+	s.end(nil)
+
+	s.b.mu.Lock()
+	delete(s.b.subscribers, s)
+	s.b.mu.Unlock()
+}
+
+// end ends the subscription with the given error, reporting whether it was still running
+func (s *Subscription[T]) end(err error) bool {
+	ended := false
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		ended = true
+	})
+	return ended
+}
@@ -0,0 +1,190 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls until the condition holds, failing the test if it never does
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// drain reads every buffered value
+func drain(sub *Subscription[int]) []int {
+	var values []int
+	for {
+		select {
+		case value := <-sub.Updates():
+			values = append(values, value)
+		default:
+			return values
+		}
+	}
+}
+
+// TestParsePolicy tests the ParsePolicy function.
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{DropOldest, Disconnect} {
+		parsed, err := ParsePolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("ParsePolicy(%q) = %v, %v, want %v", policy.String(), parsed, err, policy)
+		}
+	}
+
+	if _, err := ParsePolicy("block"); err == nil {
+		t.Error("ParsePolicy(\"block\") should have failed")
+	}
+}
+
+// TestDropOldest tests that a full buffer keeps the newest values, and signals the subscriber.
+func TestDropOldest(t *testing.T) {
+	b := New[int](2, DropOldest)
+	sub := b.Subscribe(context.Background())
+	defer sub.Close()
+
+	for i := 1; i <= 5; i++ {
+		b.Publish(i)
+	}
+
+	if values := drain(sub); !reflect.DeepEqual(values, []int{4, 5}) {
+		t.Errorf("unexpected values, want: %v, got: %v", []int{4, 5}, values)
+	}
+
+	select {
+	case <-sub.Lagged():
+	default:
+		t.Error("subscriber wasn't told it lagged")
+	}
+
+	want := Stats{Subscribers: 1, Published: 5, Dropped: 3}
+	if stats := b.Stats(); stats != want {
+		t.Errorf("unexpected stats, want: %+v, got: %+v", want, stats)
+	}
+}
+
+// TestDisconnect tests that a full buffer ends the subscription, without holding up other subscribers.
+func TestDisconnect(t *testing.T) {
+	b := New[int](1, Disconnect)
+	slow := b.Subscribe(context.Background())
+	fast := b.Subscribe(context.Background())
+	defer fast.Close()
+
+	// The fast subscriber keeps up, the slow one never reads
+	for i := 1; i <= 3; i++ {
+		b.Publish(i)
+		if values := drain(fast); !reflect.DeepEqual(values, []int{i}) {
+			t.Errorf("unexpected values, want: %v, got: %v", []int{i}, values)
+		}
+	}
+
+	select {
+	case <-slow.Done():
+	default:
+		t.Fatal("slow subscriber wasn't disconnected")
+	}
+	if slow.Err() != ErrSlowConsumer {
+		t.Errorf("unexpected error, want: %v, got: %v", ErrSlowConsumer, slow.Err())
+	}
+
+	if fast.Err() != nil {
+		t.Errorf("fast subscriber shouldn't have ended, got: %v", fast.Err())
+	}
+
+	// The slow subscriber is cleaned up, without having to close it
+	waitFor(t, func() bool { return b.Stats().Subscribers == 1 })
+	if stats := b.Stats(); stats.Disconnected != 1 {
+		t.Errorf("unexpected disconnects, want: 1, got: %d", stats.Disconnected)
+	}
+}
+
+// TestContextCancelled tests that subscribers are removed once their context is done.
+func TestContextCancelled(t *testing.T) {
+	b := New[int](1, DropOldest)
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := b.Subscribe(ctx)
+
+	cancel()
+	waitFor(t, func() bool { return b.Stats().Subscribers == 0 })
+
+	select {
+	case <-sub.Done():
+	default:
+		t.Fatal("subscription didn't end")
+	}
+	if sub.Err() != nil {
+		t.Errorf("cancelled subscription shouldn't have an error, got: %v", sub.Err())
+	}
+
+	// Publishing to nobody is fine
+	b.Publish(1)
+}
+
+// TestClose tests closing the broadcaster ends every subscription, and any made afterwards, with ErrClosed.
+func TestClose(t *testing.T) {
+	b := New[int](1, DropOldest)
+	sub := b.Subscribe(context.Background())
+
+	b.Close()
+	select {
+	case <-sub.Done():
+	default:
+		t.Fatal("subscription didn't end")
+	}
+	if !errors.Is(sub.Err(), ErrClosed) {
+		t.Errorf("unexpected error, want: %v, got: %v", ErrClosed, sub.Err())
+	}
+	waitFor(t, func() bool { return b.Stats().Subscribers == 0 })
+
+	late := b.Subscribe(context.Background())
+	select {
+	case <-late.Done():
+	default:
+		t.Fatal("subscription made after closing didn't end")
+	}
+	if !errors.Is(late.Err(), ErrClosed) || b.Stats().Subscribers != 0 {
+		t.Errorf("unexpected subscription after closing, err: %v, subscribers: %d", late.Err(), b.Stats().Subscribers)
+	}
+}
+
+// TestConcurrentPublishAndClose tests subscribers coming and going while values are published, run with -race.
+func TestConcurrentPublishAndClose(t *testing.T) {
+	for _, policy := range []Policy{DropOldest, Disconnect} {
+		b := New[int](4, policy)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					b.Publish(j)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					sub := b.Subscribe(ctx)
+					drain(sub)
+					sub.Close()
+				}
+			}()
+		}
+		wg.Wait()
+		cancel()
+
+		waitFor(t, func() bool { return b.Stats().Subscribers == 0 })
+	}
+}
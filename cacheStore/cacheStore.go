@@ -6,12 +6,19 @@
 package cacheStore
 
 import (
+	"context"
 	"sync"
 	"time"
+
+	"userapi/metrics"
+	"userapi/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // NewStore creates a new generic store with a given name and duration.
-// The duration controls how long the data will be cached
+// The duration controls how long the data will be cached, and the name labels the store's metrics
 func NewStore[K comparable, V any](name string, duration time.Duration) *store[K, V] {
 	s := &store[K, V]{
 		name:            name,
@@ -19,6 +26,10 @@ func NewStore[K comparable, V any](name string, duration time.Duration) *store[K
 		duration:        duration,
 		cleanUpInterval: 1,
 		cleanUpActive:   true,
+		hits:            metrics.CacheHits.WithLabelValues(name),
+		misses:          metrics.CacheMisses.WithLabelValues(name),
+		loadDuration:    metrics.CacheLoadDuration.WithLabelValues(name),
+		size:            metrics.CacheSize.WithLabelValues(name),
 	}
 	s.cleanUpJob()
 	return s
@@ -39,6 +50,11 @@ type store[K comparable, V any] struct {
 	duration        time.Duration
 	cleanUpInterval int
 	cleanUpActive   bool
+
+	hits         prometheus.Counter
+	misses       prometheus.Counter
+	loadDuration prometheus.Observer
+	size         prometheus.Gauge
 }
 
 // cleanUpJob periodically cleans up expired cache items.
@@ -64,15 +80,18 @@ func (s *store[K, V]) cleanUpJob() {
 					delete(s.data, key)
 				}
 			}
+			s.size.Set(float64(len(s.data)))
 			s.lock.Unlock()
 		}
 	}()
 }
 
 // GetData retrieves data from the cache or loads it using dataFunction if not present.
-func (s *store[K, V]) GetData(key K, dataFunction func(key K) (V, error)) (V, error) {
+// Lookups that don't need to load the data are counted as hits, the rest as misses, with the load traced as part of ctx's trace.
+func (s *store[K, V]) GetData(ctx context.Context, key K, dataFunction func(ctx context.Context, key K) (V, error)) (V, error) {
 	var err error
 	var zeroValue V
+	loaded := false
 
 	// initial read lock
 	s.lock.RLock()
@@ -83,7 +102,8 @@ func (s *store[K, V]) GetData(key K, dataFunction func(key K) (V, error)) (V, er
 		s.lock.Lock()
 		item, ok = s.data[key]
 		if !ok {
-			item, err = s.addData(key, dataFunction)
+			item, err = s.addData(ctx, key, dataFunction)
+			loaded = true
 			s.lock.Unlock()
 			if err != nil {
 				return zeroValue, err
@@ -97,18 +117,27 @@ func (s *store[K, V]) GetData(key K, dataFunction func(key K) (V, error)) (V, er
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	if ok && time.Since(item.created) >= s.duration {
-		item, err = s.addData(key, dataFunction)
+		item, err = s.addData(ctx, key, dataFunction)
 		if err != nil {
 			return zeroValue, err
 		}
+		loaded = true
 	}
 
+	if !loaded {
+		s.hits.Inc()
+	}
 	return item.data, nil
 }
 
-// addData adds new data to the cache by invoking dataFunction.
-func (s *store[K, V]) addData(key K, dataFunction func(key K) (V, error)) (cacheItem[K, V], error) {
-	data, err := dataFunction(key)
+// addData adds new data to the cache by invoking dataFunction, counting a miss and timing the load.
+func (s *store[K, V]) addData(ctx context.Context, key K, dataFunction func(ctx context.Context, key K) (V, error)) (cacheItem[K, V], error) {
+	s.misses.Inc()
+	ctx, span := tracing.Start(ctx, "cache.load", attribute.String("userapi.cache.store", s.name))
+	start := time.Now()
+	data, err := dataFunction(ctx, key)
+	s.loadDuration.Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
 	if err != nil {
 		return cacheItem[K, V]{}, err
 	}
@@ -119,6 +148,7 @@ func (s *store[K, V]) addData(key K, dataFunction func(key K) (V, error)) (cache
 		data:    data,
 	}
 	s.data[key] = item
+	s.size.Set(float64(len(s.data)))
 	return item, nil
 }
 
@@ -127,4 +157,5 @@ func (s *store[K, V]) Clear() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	s.data = make(map[K]cacheItem[K, V])
+	s.size.Set(0)
 }
@@ -1,10 +1,17 @@
 package cacheStore
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"testing"
 	"time"
+
+	"userapi/metrics"
+	"userapi/tracing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // Test creating a new store and retrieving data from it.
@@ -12,7 +19,7 @@ func TestNewStoreAndRetrieveData(t *testing.T) {
 	store := NewStore[string, string]("exampleStore", 1*time.Second)
 
 	// Attempt to get data that's not yet cached.
-	val, err := store.GetData("key1", fetchMockData)
+	val, err := store.GetData(context.Background(), "key1", fetchMockData)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -21,7 +28,7 @@ func TestNewStoreAndRetrieveData(t *testing.T) {
 	}
 
 	// Attempt to get data that should now be cached.
-	val, err = store.GetData("key1", fetchMockData)
+	val, err = store.GetData(context.Background(), "key1", fetchMockData)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -35,7 +42,7 @@ func TestCacheExpiryAndCleanup(t *testing.T) {
 	store := NewStore[string, string]("exampleStore", 1*time.Second)
 
 	// Insert data into the cache.
-	_, err := store.GetData("key1", fetchMockData)
+	_, err := store.GetData(context.Background(), "key1", fetchMockData)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -44,7 +51,7 @@ func TestCacheExpiryAndCleanup(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 	// Attempt to get data again, which should reload it.
-	val, err := store.GetData("key1", fetchAlternateMockData)
+	val, err := store.GetData(context.Background(), "key1", fetchAlternateMockData)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -58,7 +65,7 @@ func TestFetchDataWithError(t *testing.T) {
 	store := NewStore[string, string]("exampleStore", 1*time.Second)
 
 	// Attempt to fetch data that will cause an error.
-	_, err := store.GetData("error", fetchMockData)
+	_, err := store.GetData(context.Background(), "error", fetchMockData)
 	if err == nil {
 		t.Fatalf("expected an error, but got none")
 	}
@@ -78,7 +85,7 @@ func TestConcurrentDataAccess(t *testing.T) {
 		wg.Add(1)
 		go func(k string) {
 			defer wg.Done()
-			_, err := store.GetData(k, fetchMockData)
+			_, err := store.GetData(context.Background(), k, fetchMockData)
 			if err != nil {
 				t.Errorf("unexpected error: %v", err)
 			}
@@ -88,8 +95,67 @@ func TestConcurrentDataAccess(t *testing.T) {
 	wg.Wait()
 }
 
+// Test lookups are counted as hits or misses, against the store's name.
+func TestStoreMetrics(t *testing.T) {
+	store := NewStore[string, string]("metricsStore", 1*time.Minute)
+
+	for _, key := range []string{"key1", "key1", "key2", "key1"} {
+		if _, err := store.GetData(context.Background(), key, fetchMockData); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := store.GetData(context.Background(), "error", fetchMockData); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if hits := testutil.ToFloat64(metrics.CacheHits.WithLabelValues("metricsStore")); hits != 2 {
+		t.Errorf("expected 2 hits, got %v", hits)
+	}
+	if misses := testutil.ToFloat64(metrics.CacheMisses.WithLabelValues("metricsStore")); misses != 3 {
+		t.Errorf("expected 3 misses, got %v", misses)
+	}
+	if size := testutil.ToFloat64(metrics.CacheSize.WithLabelValues("metricsStore")); size != 2 {
+		t.Errorf("expected 2 entries, got %v", size)
+	}
+
+	store.Clear()
+	if size := testutil.ToFloat64(metrics.CacheSize.WithLabelValues("metricsStore")); size != 0 {
+		t.Errorf("expected no entries after clearing, got %v", size)
+	}
+}
+
+// Test loads are traced as children of the caller's span, and hits aren't.
+func TestLoadTraced(t *testing.T) {
+	exporter := tracing.InitInMemory()
+	store := NewStore[string, string]("tracedStore", 1*time.Minute)
+
+	ctx, parent := tracing.Start(context.Background(), "parent")
+	for _, key := range []string{"key1", "key1", "error"} {
+		store.GetData(ctx, key, fetchMockData)
+	}
+	parent.End()
+
+	spans := exporter.GetSpans()
+	loads := 0
+	for _, span := range spans {
+		if span.Name != "cache.load" {
+			continue
+		}
+		loads++
+		if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("expected the load to be a child of the caller's span")
+		}
+	}
+	if loads != 2 {
+		t.Errorf("expected 2 loads traced, got %d", loads)
+	}
+	if last := spans[len(spans)-2]; last.Status.Code != codes.Error {
+		t.Errorf("expected the failed load to be recorded as an error, got %v", last.Status)
+	}
+}
+
 // Mock data function for testing.
-func fetchMockData(key string) (string, error) {
+func fetchMockData(ctx context.Context, key string) (string, error) {
 	if key == "error" {
 		return "", errors.New("mock error")
 	}
@@ -97,7 +163,7 @@ func fetchMockData(key string) (string, error) {
 }
 
 // Alternate mock data function for testing.
-func fetchAlternateMockData(key string) (string, error) {
+func fetchAlternateMockData(ctx context.Context, key string) (string, error) {
 	if key == "error" {
 		return "", errors.New("mock error")
 	}
@@ -0,0 +1,133 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReload tests a rotated certificate is picked up, and one that fails to load leaves the current one in place
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writePair(t, certFile, keyFile, "first", time.Now().Add(-time.Hour))
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, r); name != "first" {
+		t.Fatalf("expected the first certificate, got %q", name)
+	}
+
+	if reloaded, err := r.Reload(); reloaded || err != nil {
+		t.Errorf("expected nothing to reload, got %t, %v", reloaded, err)
+	}
+
+	writePair(t, certFile, keyFile, "second", time.Now())
+	if reloaded, err := r.Reload(); !reloaded || err != nil {
+		t.Fatalf("expected the rotated certificate to reload, got %t, %v", reloaded, err)
+	}
+	if name := commonName(t, r); name != "second" {
+		t.Errorf("expected the second certificate, got %q", name)
+	}
+
+	if err := os.WriteFile(certFile, []byte("half written"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reload(); err == nil {
+		t.Error("expected an error loading a broken certificate")
+	}
+	if name := commonName(t, r); name != "second" {
+		t.Errorf("expected the second certificate to still be served, got %q", name)
+	}
+}
+
+// handshake connects a client to a server over a pipe, returning the first error either side has
+func handshake(serverConfig, clientConfig *tls.Config) error {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn := tls.Server(serverConn, serverConfig)
+		err := conn.Handshake()
+		// TLS 1.3 clients finish before the server has checked their certificate, so wait to hear back
+		if err == nil {
+			_, err = conn.Write([]byte{1})
+		}
+		serverErr <- err
+	}()
+
+	conn := tls.Client(clientConn, clientConfig)
+	err := conn.Handshake()
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	// Closing the pipe rather than the TLS connection, which would wait to send close_notify to a server that's stopped reading
+	clientConn.Close()
+	if sErr := <-serverErr; sErr != nil && err == nil {
+		err = sErr
+	}
+	return err
+}
+
+// commonName returns the common name of the reloader's current certificate
+func commonName(t *testing.T, r *Reloader) string {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(r.Certificate().Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+// writePair writes a self signed certificate and its key, valid for both servers and clients, modified at modTime
+func writePair(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
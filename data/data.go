@@ -1,16 +1,220 @@
 package data
 
-import "time"
+import (
+	"log/slog"
+	"time"
+)
 
 // User stores our user information
+// Version is incremented on every update, allowing for optimistic concurrency control
+// DeletedAt is set when the user is soft deleted, they are hidden from reads until restored or purged
 type User struct {
-	ID        string    `json:"id" bson:"_id,omitempty"`
-	FirstName string    `json:"first_name" bson:"first_name"`
-	LastName  string    `json:"last_name" bson:"last_name"`
-	Nickname  string    `json:"nickname" bson:"nickname"`
-	Password  string    `json:"password" bson:"password"`
-	Email     string    `json:"email" bson:"email"`
-	Country   string    `json:"country" bson:"country"`
+	ID        string     `json:"id" bson:"_id,omitempty"`
+	FirstName string     `json:"first_name" bson:"first_name"`
+	LastName  string     `json:"last_name" bson:"last_name"`
+	Nickname  string     `json:"nickname" bson:"nickname"`
+	Password  string     `json:"password" bson:"password"`
+	Email     string     `json:"email" bson:"email"`
+	Country   string     `json:"country" bson:"country"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" bson:"updated_at"`
+	Version   int64      `json:"version" bson:"version"`
+	DeletedAt *time.Time `json:"deleted_at" bson:"deleted_at,omitempty"`
+}
+
+// LogValue logs the fields identifying a user, never their password or contact details
+func (u User) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("id", u.ID),
+		slog.String("nickname", u.Nickname),
+		slog.String("country", u.Country),
+		slog.Int64("version", u.Version),
+	)
+}
+
+// Redacted copies the user without their password
+func (u User) Redacted() User {
+	u.Password = ""
+	return u
+}
+
+// IdempotencyRecord remembers the user created for an idempotency key, so retried requests can be given the original response.
+// A record without a user is still being processed, until its lease runs out. The user is stored redacted, so replays leave out the password.
+type IdempotencyRecord struct {
+	Key  string `bson:"_id"`
+	User *User  `bson:"user,omitempty"`
+	// RequestHash fingerprints the request the key was first used with, so the key can't be reused for a different user
+	RequestHash string    `bson:"request_hash,omitempty"`
+	CreatedAt   time.Time `bson:"created_at"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+// Batch result statuses, reported for each user within a batch request
+const (
+	BatchCreated  = "created"
+	BatchUpdated  = "updated"
+	BatchDeleted  = "deleted"
+	BatchConflict = "conflict"
+	BatchInvalid  = "invalid"
+	BatchNotFound = "not_found"
+	BatchFailed   = "failed"
+)
+
+// BatchResult is the outcome for a single user within a batch request
+// Index is the position of the user within the request
+type BatchResult struct {
+	Index   int    `json:"index"`
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Error   string `json:"error,escape"`
+	Version int64  `json:"version"`
+}
+
+// Audit actions, recording what kind of change was made
+const (
+	AuditCreate    = "create"
+	AuditUpdate    = "update"
+	AuditDelete    = "delete"
+	AuditDeleteAll = "delete_all"
+	AuditRestore   = "restore"
+	AuditRevert    = "revert"
+)
+
+// Transports a change can arrive through
+const (
+	TransportHTTP = "http"
+	TransportGRPC = "grpc"
+	TransportCLI  = "cli"
+)
+
+// AuditEvent is an immutable record of a change made to a user, and who made it
+// UserID is empty for changes affecting every user
+type AuditEvent struct {
+	ID        string        `json:"id" bson:"_id"`
+	UserID    string        `json:"user_id" bson:"user_id"`
+	Action    string        `json:"action" bson:"action"`
+	Actor     string        `json:"actor,escape" bson:"actor"`
+	SourceIP  string        `json:"source_ip" bson:"source_ip"`
+	Transport string        `json:"transport" bson:"transport"`
+	RequestID string        `json:"request_id,escape" bson:"request_id"`
+	Changes   []FieldChange `json:"changes" bson:"changes"`
+	CreatedAt time.Time     `json:"created_at" bson:"created_at"`
+}
+
+// FieldChange is a single field that changed, with its value before and after the change
+type FieldChange struct {
+	Field  string `json:"field" bson:"field"`
+	Before string `json:"before,escape" bson:"before"`
+	After  string `json:"after,escape" bson:"after"`
+}
+
+// UserRevision is a snapshot of a user, taken every time they change
+// Action is empty for snapshots of users from before their history was recorded
+type UserRevision struct {
+	ID         string    `bson:"_id"`
+	UserID     string    `json:"user_id" bson:"user_id"`
+	Version    int64     `json:"version" bson:"version"`
+	Action     string    `json:"action" bson:"action"`
+	User       User      `json:"user" bson:"user"`
+	RecordedAt time.Time `json:"recorded_at" bson:"recorded_at"`
+}
+
+// Kinds of update made to users
+const (
+	UpdateCreated    = "CREATED"
+	UpdateDeleted    = "DELETED"
+	UpdateUpdated    = "UPDATED"
+	UpdateAllDeleted = "ALL_DELETED"
+	UpdateRestored   = "RESTORED"
+)
+
+// UserEvent is an update to a user, logged so watchers can replay the updates they missed
+// Sequence is handed out in the order events are logged, and is never reused
+// UserID is empty for updates made to every user, such as deleting them all
+// PreviousUser is the user before the update, nil for new users, and Actor is who made it in the request RequestID
+// DeliveredAt is set once the event has been relayed, it's only used internally so is never encoded
+type UserEvent struct {
+	Sequence      int64      `json:"sequence" bson:"_id"`
+	UserID        string     `json:"user_id" bson:"user_id"`
+	UpdateType    string     `json:"update_type" bson:"update_type"`
+	User          *User      `json:"user" bson:"user,omitempty"`
+	ChangedFields []string   `json:"changed_fields" bson:"changed_fields,omitempty"`
+	PreviousUser  *User      `json:"previous_user" bson:"previous_user,omitempty"`
+	Actor         string     `json:"actor,escape" bson:"actor,omitempty"`
+	RequestID     string     `json:"request_id,escape" bson:"request_id,omitempty"`
+	CreatedAt     time.Time  `json:"created_at" bson:"created_at"`
+	DeliveredAt   *time.Time `bson:"delivered_at,omitempty"`
+}
+
+// Redacted copies the event without either user's password hash, every event leaving the service is sent redacted
+func (e UserEvent) Redacted() UserEvent {
+	e.User = withoutPassword(e.User)
+	e.PreviousUser = withoutPassword(e.PreviousUser)
+	return e
+}
+
+// withoutPassword copies the user without their password, the user is left alone as the event it belongs to may be shared
+func withoutPassword(user *User) *User {
+	if user == nil {
+		return nil
+	}
+	redacted := user.Redacted()
+	return &redacted
+}
+
+// Webhook is a subscription to user updates, which are POSTed to URL as they happen
+// EventTypes limits which kinds of update are sent, every kind when empty
+// Secret signs every delivery so the receiver can trust it came from us, it is never returned once set
+type Webhook struct {
+	ID         string    `json:"id" bson:"_id"`
+	URL        string    `json:"url,escape" bson:"url"`
+	EventTypes []string  `json:"event_types" bson:"event_types"`
+	Secret     string    `bson:"secret"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// Webhook delivery statuses, recorded for every attempt
+const (
+	DeliverySucceeded = "succeeded"
+	DeliveryRetrying  = "retrying"
+	DeliveryDead      = "dead"
+)
+
+// WebhookDelivery is a single attempt at delivering an update to a webhook, kept in the delivery log
+// DeliveryID is shared by every attempt at the same delivery, so receivers can spot retries
+// StatusCode is 0 when no response was received
+type WebhookDelivery struct {
+	ID         string    `json:"id" bson:"_id"`
+	DeliveryID string    `json:"delivery_id" bson:"delivery_id"`
+	WebhookID  string    `json:"webhook_id" bson:"webhook_id"`
+	Sequence   int64     `json:"sequence" bson:"sequence"`
+	UpdateType string    `json:"update_type" bson:"update_type"`
+	Attempt    int       `json:"attempt" bson:"attempt"`
+	Status     string    `json:"status" bson:"status"`
+	StatusCode int       `json:"status_code" bson:"status_code"`
+	Error      string    `json:"error,escape" bson:"error"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+}
+
+// PendingWebhookDelivery is a delivery still to be made, kept until it succeeds or is dead-lettered so it outlives the instance that queued it
+// NextAttemptAt is when it's next due, the worker attempting it pushes this back so no one else attempts it at the same time
+type PendingWebhookDelivery struct {
+	ID            string    `json:"id" bson:"_id"`
+	Webhook       Webhook   `json:"webhook" bson:"webhook"`
+	Event         UserEvent `json:"event" bson:"event"`
+	Attempt       int       `json:"attempt" bson:"attempt"`
+	NextAttemptAt time.Time `json:"next_attempt_at" bson:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at" bson:"created_at"`
+}
+
+// WebhookDeadLetter is a delivery that was given up on, kept with its update so it can be redelivered
+// ID is the delivery's ID, which is kept when it's redelivered
+type WebhookDeadLetter struct {
+	ID        string    `json:"id" bson:"_id"`
+	WebhookID string    `json:"webhook_id" bson:"webhook_id"`
+	Event     UserEvent `json:"event" bson:"event"`
+	Attempts  int       `json:"attempts" bson:"attempts"`
+	LastError string    `json:"last_error,escape" bson:"last_error"`
 	CreatedAt time.Time `json:"created_at" bson:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
 }
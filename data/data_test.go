@@ -1,6 +1,9 @@
 package data
 
 import (
+	"bytes"
+	"log/slog"
+	"strings"
 	"testing"
 	"time"
 
@@ -63,3 +66,42 @@ func TestUserSliceMarshal(t *testing.T) {
 
 	encoder.Marshal(&user, &buf)
 }
+
+// TestUserLogValue Ensures passwords and emails never make it into the logs
+func TestUserLogValue(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	logger.Info("test", "user", User{ID: "0d0f9944-d902-4db1-b83b-6b25a61f89e2", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com"})
+
+	if strings.Contains(buf.String(), "moneyMoneyM0n3y") || strings.Contains(buf.String(), "Razzil.Darkbrew@example.com") {
+		t.Errorf("expected the password and email to be left out, got %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"nickname":"Alchemist"`) {
+		t.Errorf("expected the nickname to be logged, got %s", buf.String())
+	}
+}
+
+// TestUserEventRedacted Ensures neither user's password hash is left in a redacted event, without touching the original
+func TestUserEventRedacted(t *testing.T) {
+	event := UserEvent{
+		Sequence:     4,
+		User:         &User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Meepo", Password: "$2a$10$new"},
+		PreviousUser: &User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Alchemist", Password: "$2a$10$old"},
+	}
+
+	redacted := event.Redacted()
+	if redacted.User.Password != "" || redacted.PreviousUser.Password != "" {
+		t.Errorf("expected no password hashes, got %q and %q", redacted.User.Password, redacted.PreviousUser.Password)
+	}
+	if redacted.Sequence != 4 || redacted.User.Nickname != "Meepo" || redacted.PreviousUser.Nickname != "Alchemist" {
+		t.Errorf("expected the rest of the event to be kept, got %+v", redacted)
+	}
+	if event.User.Password != "$2a$10$new" || event.PreviousUser.Password != "$2a$10$old" {
+		t.Error("expected the original event to be left alone")
+	}
+
+	if created := (UserEvent{User: &User{Password: "$2a$10$new"}}).Redacted(); created.PreviousUser != nil {
+		t.Errorf("expected a missing previous user to stay missing, got %+v", created.PreviousUser)
+	}
+}
@@ -2,13 +2,17 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"regexp"
 	"time"
 
+	"userapi/audit"
 	"userapi/cacheStore"
 	"userapi/data"
+	"userapi/requestid"
+	"userapi/tracing"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -23,26 +27,125 @@ type MongoCollectionInt interface {
 	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
 	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
 	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+	UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
 }
 
 var client *mongo.Client
 var userCollection MongoCollectionInt
+var idempotencyCollection MongoCollectionInt
+var auditCollection MongoCollectionInt
+var revisionCollection MongoCollectionInt
+var eventCollection MongoCollectionInt
+var counterCollection MongoCollectionInt
+var webhookCollection MongoCollectionInt
+var deliveryCollection MongoCollectionInt
+var pendingDeliveryCollection MongoCollectionInt
+var deadLetterCollection MongoCollectionInt
+var leaseCollection MongoCollectionInt
+
+// IdempotencyWindow controls how long an idempotency key is remembered for
+var IdempotencyWindow = 24 * time.Hour
+
+// IdempotencyLease controls how long an idempotency key is held for a request still creating its user,
+// so a request that never finishes doesn't hold the key for the whole window
+var IdempotencyLease = time.Minute
+
+// EventRetention controls how long user update events are kept for watchers to resume from
+var EventRetention = 7 * 24 * time.Hour
+
+// DeliveryRetention controls how long the webhook delivery log is kept for
+var DeliveryRetention = 30 * 24 * time.Hour
+
+var (
+	// ErrUserNotFound is returned when no user exists with the given ID
+	ErrUserNotFound = errors.New("no user found with the given ID")
+	// ErrVersionMismatch is returned when the stored user has moved on from the version the caller expected
+	ErrVersionMismatch = errors.New("user version does not match the expected version")
+	// ErrIdempotencyKeyInUse is returned when another request holding the same idempotency key hasn't finished yet
+	ErrIdempotencyKeyInUse = errors.New("a request with this idempotency key is already in progress")
+	// ErrDuplicateUser is returned for a bulk insert of a user whose ID is already taken
+	ErrDuplicateUser = errors.New("user already exists")
+	// ErrNicknameTaken is returned when restoring a user whose nickname has been taken since they were deleted
+	ErrNicknameTaken = errors.New("a user with this username already exists")
+	// ErrRevisionNotFound is returned when a user has no revision matching the given version or time
+	ErrRevisionNotFound = errors.New("no revision found for the user")
+	// ErrNoEvents is returned when the event log is empty
+	ErrNoEvents = errors.New("no user events have been logged")
+	// ErrWebhookNotFound is returned when no webhook exists with the given ID
+	ErrWebhookNotFound = errors.New("no webhook found with the given ID")
+	// ErrNoDeliveryDue is returned when no pending webhook delivery has come due
+	ErrNoDeliveryDue = errors.New("no webhook delivery is due")
+	// ErrDeadLetterNotFound is returned when no dead letter exists with the given ID
+	ErrDeadLetterNotFound = errors.New("no dead letter found with the given ID")
+)
 
 // SetCollection allows setting a different MongoCollection, useful for testing.
 func SetCollection(collection MongoCollectionInt) {
 	userCollection = collection
 }
 
+// SetIdempotencyCollection allows setting a different MongoCollection for idempotency keys, useful for testing.
+func SetIdempotencyCollection(collection MongoCollectionInt) {
+	idempotencyCollection = collection
+}
+
+// SetAuditCollection allows setting a different MongoCollection for the audit log, useful for testing.
+func SetAuditCollection(collection MongoCollectionInt) {
+	auditCollection = collection
+}
+
+// SetEventCollection allows setting a different user event collection, useful for testing.
+func SetEventCollection(collection MongoCollectionInt) {
+	eventCollection = collection
+}
+
+// SetCounterCollection allows setting a different counter collection, useful for testing.
+func SetCounterCollection(collection MongoCollectionInt) {
+	counterCollection = collection
+}
+
+// SetWebhookCollection allows setting a different webhook collection, useful for testing.
+func SetWebhookCollection(collection MongoCollectionInt) {
+	webhookCollection = collection
+}
+
+// SetDeliveryCollection allows setting a different webhook delivery log collection, useful for testing.
+func SetDeliveryCollection(collection MongoCollectionInt) {
+	deliveryCollection = collection
+}
+
+// SetPendingDeliveryCollection allows setting a different pending webhook delivery collection, useful for testing.
+func SetPendingDeliveryCollection(collection MongoCollectionInt) {
+	pendingDeliveryCollection = collection
+}
+
+// SetDeadLetterCollection allows setting a different webhook dead letter collection, useful for testing.
+func SetDeadLetterCollection(collection MongoCollectionInt) {
+	deadLetterCollection = collection
+}
+
+// SetLeaseCollection allows setting a different lease collection, useful for testing.
+func SetLeaseCollection(collection MongoCollectionInt) {
+	leaseCollection = collection
+}
+
+// SetRevisionCollection allows setting a different MongoCollection for user revisions, useful for testing.
+func SetRevisionCollection(collection MongoCollectionInt) {
+	revisionCollection = collection
+}
+
 // Init initializes the MongoDB driver and connection
 func Init() error {
 	var err error
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	log.Printf("attempting to connect to mongoDB at mongodb://localhost:27017")
+	slog.Info("attempting to connect to mongoDB", "uri", "mongodb://localhost:27017")
 	// I wouldn't typically suggest connecting to the database directly, since its harder to protect, as well as other limitations.
 	// Due to the scale of this project, im sure its ok ;)
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	// Writes log their events in a transaction, which needs mongo to be running as a replica set
+	client, err = mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017/?directConnection=true"))
 	if err != nil {
 		return fmt.Errorf("failed to connect to mongoDB: %v, ensure the docker image has been ran", err)
 	}
@@ -51,21 +154,155 @@ func Init() error {
 	if err != nil {
 		return fmt.Errorf("failed to ping to mongoDB: %v, ensure the docker image has been ran", err)
 	}
-	log.Printf("successfully connected to mongoDB")
+	slog.Info("successfully connected to mongoDB")
+
+	users := client.Database("faceit").Collection("users")
+	// Lets the purge find soft deleted users without scanning everyone
+	_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"deleted_at": 1},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create deleted_at index: %v", err)
+	}
+	userCollection = &MongoCollection{collection: users}
+
+	// Let mongo clear out idempotency keys once they have expired
+	keys := client.Database("faceit").Collection("idempotency_keys")
+	_, err = keys.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expires_at": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create idempotency key index: %v", err)
+	}
+	idempotencyCollection = &MongoCollection{collection: keys}
+
+	// Audit events are listed per user, newest first
+	events := client.Database("faceit").Collection("audit_events")
+	_, err = events.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audit event index: %v", err)
+	}
+	auditCollection = &MongoCollection{collection: events}
+
+	// Revisions are listed by version, and looked up by time
+	revisions := client.Database("faceit").Collection("user_revisions")
+	_, err = revisions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "version", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "recorded_at", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create user revision indexes: %v", err)
+	}
+	revisionCollection = &MongoCollection{collection: revisions}
+
+	// Events are kept long enough for watchers to resume, then mongo clears them out
+	// The relay looks for the events it hasn't delivered yet, in sequence order
+	userEvents := client.Database("faceit").Collection("user_events")
+	_, err = userEvents.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "delivered_at", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create user event indexes: %v", err)
+	}
+	if err := ensureTTLIndex(ctx, userEvents, "created_at", EventRetention); err != nil {
+		return fmt.Errorf("failed to create user event indexes: %v", err)
+	}
+	eventCollection = &MongoCollection{collection: userEvents}
+	counterCollection = &MongoCollection{collection: client.Database("faceit").Collection("counters")}
+	leaseCollection = &MongoCollection{collection: client.Database("faceit").Collection("leases")}
+	webhookCollection = &MongoCollection{collection: client.Database("faceit").Collection("webhooks")}
+
+	// Deliveries are listed per webhook, newest first, until mongo clears them out
+	deliveries := client.Database("faceit").Collection("webhook_deliveries")
+	_, err = deliveries.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create webhook delivery indexes: %v", err)
+	}
+	if err := ensureTTLIndex(ctx, deliveries, "created_at", DeliveryRetention); err != nil {
+		return fmt.Errorf("failed to create webhook delivery indexes: %v", err)
+	}
+	deliveryCollection = &MongoCollection{collection: deliveries}
+
+	// Pending deliveries are claimed by whichever worker finds them due first
+	pending := client.Database("faceit").Collection("webhook_pending_deliveries")
+	_, err = pending.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"next_attempt_at": 1},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create pending webhook delivery index: %v", err)
+	}
+	pendingDeliveryCollection = &MongoCollection{collection: pending}
 
-	userCollection = &MongoCollection{
-		collection: client.Database("faceit").Collection("users"),
+	// Dead letters are kept until they're redelivered
+	deadLetters := client.Database("faceit").Collection("webhook_dead_letters")
+	_, err = deadLetters.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create webhook dead letter index: %v", err)
 	}
+	deadLetterCollection = &MongoCollection{collection: deadLetters}
 
 	return nil
 }
 
+// ensureTTLIndex has mongo clear out documents once field is older than ttl.
+// Creating the index again with a different ttl fails, so when the retention flag has changed since it was created, the existing index is changed in place.
+func ensureTTLIndex(ctx context.Context, collection *mongo.Collection, field string, ttl time.Duration) error {
+	seconds := int32(ttl.Seconds())
+	keys := bson.D{{Key: field, Value: 1}}
+
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	var indexes []struct {
+		Key bson.D `bson:"key"`
+		// Older servers may have stored this as a double
+		ExpireAfterSeconds *float64 `bson:"expireAfterSeconds"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		if len(index.Key) != 1 || index.Key[0].Key != field || index.ExpireAfterSeconds == nil {
+			continue
+		}
+		if int32(*index.ExpireAfterSeconds) == seconds {
+			return nil
+		}
+		slog.Info("changing TTL index", "collection", collection.Name(), "field", field, "from", *index.ExpireAfterSeconds, "to", seconds)
+		return collection.Database().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: collection.Name()},
+			{Key: "index", Value: bson.D{{Key: "keyPattern", Value: keys}, {Key: "expireAfterSeconds", Value: seconds}}},
+		}).Err()
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: options.Index().SetExpireAfterSeconds(seconds)})
+	return err
+}
+
+// Ping checks mongo can still be reached, for the readiness probe
+func Ping(ctx context.Context) error {
+	if client == nil {
+		return errors.New("not connected to mongoDB")
+	}
+	return client.Ping(ctx, nil)
+}
+
 // GetUser queries the user by username, this is needed for check for duplicates on new user creation.
-func GetUser(nickname string) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func GetUser(ctx context.Context, nickname string) (*data.User, error) {
+	ctx, cancel := newContext(ctx, "GetUser", 10*time.Second)
 	defer cancel()
 
-	filter := bson.M{"nickname": nickname}
+	filter := notDeleted(bson.M{"nickname": nickname})
 	var user data.User
 	err := userCollection.FindOne(ctx, filter).Decode(&user)
 	if err != nil && err != mongo.ErrNoDocuments {
@@ -76,11 +313,11 @@ func GetUser(nickname string) (*data.User, error) {
 }
 
 // GetUserByID queries user by ID, ID will be indexed. So quicker to search
-func GetUserByID(id string) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func GetUserByID(ctx context.Context, id string) (*data.User, error) {
+	ctx, cancel := newContext(ctx, "GetUserByID", 10*time.Second)
 	defer cancel()
 
-	filter := bson.M{"_id": id}
+	filter := notDeleted(bson.M{"_id": id})
 	var user data.User
 	err := userCollection.FindOne(ctx, filter).Decode(&user)
 	if err != nil && err != mongo.ErrNoDocuments {
@@ -96,14 +333,14 @@ var UserStore = cacheStore.NewStore[int, []data.User]("userStore", time.Second*2
 // Utilised a cache to reduce database hits
 // Cache lifetime is 20 seconds. It'll be missing recent users, but nessesary for large scale systems to protect database performance.
 // This is also where a softExpiry cache can be usefull.
-func GetUsers() ([]data.User, error) {
+func GetUsers(ctx context.Context) ([]data.User, error) {
 
 	// just key on 0, we're not using this cache for anything complex
-	users, err := UserStore.GetData(0, func(key int) ([]data.User, error) {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	users, err := UserStore.GetData(ctx, 0, func(ctx context.Context, key int) ([]data.User, error) {
+		ctx, cancel := newContext(ctx, "GetUsers", 10*time.Second)
 		defer cancel()
 
-		cursor, err := userCollection.Find(ctx, bson.M{})
+		cursor, err := userCollection.Find(ctx, notDeleted(bson.M{}))
 		if err != nil {
 			return nil, err
 		}
@@ -131,9 +368,9 @@ func GetUsers() ([]data.User, error) {
 }
 
 // GetUsersFiltered queries the database to find users matching the given query
-func GetUsersFiltered(country, nickname string, createdAfter time.Time, page, pageSize int) ([]data.User, error) {
+func GetUsersFiltered(ctx context.Context, country, nickname string, createdAfter time.Time, page, pageSize int) ([]data.User, error) {
 
-	filter := bson.M{}
+	filter := notDeleted(bson.M{})
 	if country != "" {
 		// country wild carded filter.
 		filter["country"] = bson.M{"$regex": regexp.QuoteMeta(country), "$options": "i"}
@@ -147,7 +384,7 @@ func GetUsersFiltered(country, nickname string, createdAfter time.Time, page, pa
 		filter["created_at"] = bson.M{"$gt": createdAfter}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := newContext(ctx, "GetUsersFiltered", 10*time.Second)
 	defer cancel()
 
 	findOptions := options.Find()
@@ -176,83 +413,1451 @@ func GetUsersFiltered(country, nickname string, createdAfter time.Time, page, pa
 	return users, nil
 }
 
-// InsertUser adds the given user to the database
-func InsertUser(user *data.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// InsertUser adds the given user to the database, logging, auditing and snapshotting the event in the same transaction
+func InsertUser(ctx context.Context, user *data.User, audit Auditor) error {
+	ctx, cancel := newContext(ctx, "InsertUser", 10*time.Second)
 	defer cancel()
 
-	_, err := userCollection.InsertOne(ctx, user)
-	if err != nil {
-		return fmt.Errorf("err when inserting user - err: %v", err)
-	}
+	return withTransaction(ctx, func(ctx context.Context) error {
+		_, err := userCollection.InsertOne(ctx, user)
+		if err != nil {
+			return fmt.Errorf("err when inserting user - err: %w", err)
+		}
 
-	return nil
+		return recordChanges(ctx, audit, newEvent(ctx, data.UpdateCreated, nil, user))
+	})
 }
 
-// UpdateUser updates the given user's details in the database
-func UpdateUser(user *data.User) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// UpdateUser updates the given user's details in the database, returning the user as it was before and after the update
+// Unless expectedVersion is AnyVersion, the update only applies if the stored user is still at that version,
+// 0 being the version of users stored before versions were introduced.
+// A user without a password keeps the one stored, as when reverting to a revision, which never holds one.
+// The version is incremented on every successful update, and the event logged, audited and snapshot in the same transaction.
+func UpdateUser(ctx context.Context, user *data.User, expectedVersion int64, audit Auditor) (*data.User, *data.User, error) {
+	ctx, cancel := newContext(ctx, "UpdateUser", 10*time.Second)
 	defer cancel()
 
 	// Create the update document
-	update := bson.M{
-		"$set": bson.M{
-			"first_name": user.FirstName,
-			"last_name":  user.LastName,
-			"nickname":   user.Nickname,
-			"password":   user.Password,
-			"email":      user.Email,
-			"country":    user.Country,
-			"updated_at": user.UpdatedAt,
-		},
-	}
-
-	// Options to return the updated document
-	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	update := userUpdate(user)
+
+	// Only match the document if it is still at the version the caller last saw
+	filter := notDeleted(bson.M{"_id": user.ID})
+	if expectedVersion != AnyVersion {
+		filter["version"] = versionFilter(expectedVersion)
+	}
+
+	// Options to return the document as it was before the update, the audit log needs to know what changed
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
 
 	// Perform the update operation
-	var updatedUser data.User
-	err := userCollection.FindOneAndUpdate(ctx, bson.M{"_id": user.ID}, update, opts).Decode(&updatedUser)
+	var previousUser, updatedUser data.User
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		// Start afresh if the transaction is retried
+		previousUser = data.User{}
+		err := userCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previousUser)
+		if err == mongo.ErrNoDocuments {
+			return missingUserError(ctx, user.ID, expectedVersion)
+		}
+		if err != nil {
+			return fmt.Errorf("error when updating user - err: %w", err)
+		}
+
+		// Apply the same update to our copy, rather than reading the user back
+		updatedUser = userUpdated(previousUser, user)
+
+		return recordChanges(ctx, audit, newEvent(ctx, data.UpdateUpdated, &previousUser, &updatedUser))
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error when updating user - err: %v", err)
+		return nil, nil, err
 	}
 
-	return &updatedUser, nil
+	return &previousUser, &updatedUser, nil
 }
 
-// DeleteUser deletes the user with the given ID from the database
-func DeleteUser(userID string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// DeleteUser soft deletes the user with the given ID, they are hidden from reads until restored or purged
+// Unless expectedVersion is AnyVersion, the delete only applies if the stored user is still at that version, 0 for users without one.
+// The user is returned as it was before and after being deleted, and the event logged, audited and snapshot in the same transaction.
+func DeleteUser(ctx context.Context, userID string, expectedVersion int64, deletedAt time.Time, audit Auditor) (*data.User, *data.User, error) {
+	ctx, cancel := newContext(ctx, "DeleteUser", 10*time.Second)
 	defer cancel()
 
 	// Create the filter to find the user by ID
-	filter := bson.M{"_id": userID}
+	filter := notDeleted(bson.M{"_id": userID})
+	if expectedVersion != AnyVersion {
+		filter["version"] = versionFilter(expectedVersion)
+	}
 
 	// Perform the delete operation
-	result, err := userCollection.DeleteOne(ctx, filter)
+	var previousUser, deletedUser data.User
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		// Start afresh if the transaction is retried
+		previousUser = data.User{}
+		err := userCollection.FindOneAndUpdate(ctx, filter, softDelete(deletedAt), opts).Decode(&previousUser)
+		if err == mongo.ErrNoDocuments {
+			return missingUserError(ctx, userID, expectedVersion)
+		}
+		if err != nil {
+			return fmt.Errorf("error when deleting user - err: %w", err)
+		}
+
+		// Apply the same update to our copy, rather than reading the user back
+		deletedUser = softDeleted(previousUser, deletedAt)
+
+		return recordChanges(ctx, audit, newEvent(ctx, data.UpdateDeleted, &previousUser, &deletedUser))
+	})
 	if err != nil {
-		return fmt.Errorf("error when deleting user - err: %v", err)
+		return nil, nil, err
 	}
 
-	if result.DeletedCount == 0 {
-		return fmt.Errorf("no user found with the given ID")
+	return &previousUser, &deletedUser, nil
+}
+
+// RestoreUser brings back a soft deleted user, as long as nobody has taken their nickname in the meantime.
+// The user is returned as it was before and after being restored, and the event logged, audited and snapshot in the same transaction.
+func RestoreUser(ctx context.Context, userID string, audit Auditor) (*data.User, *data.User, error) {
+	ctx, cancel := newContext(ctx, "RestoreUser", 10*time.Second)
+	defer cancel()
+
+	var deletedUser, restoredUser data.User
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		// Start afresh if the transaction is retried
+		deletedUser, restoredUser = data.User{}, data.User{}
+		err := userCollection.FindOne(ctx, bson.M{"_id": userID, "deleted_at": bson.M{"$ne": nil}}).Decode(&deletedUser)
+		if err == mongo.ErrNoDocuments {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("error when finding deleted user - err: %w", err)
+		}
+
+		// Nicknames are free to be reused once a user is deleted
+		err = userCollection.FindOne(ctx, notDeleted(bson.M{"nickname": deletedUser.Nickname})).Err()
+		if err == nil {
+			return ErrNicknameTaken
+		}
+		if err != mongo.ErrNoDocuments {
+			return fmt.Errorf("error when checking nickname - err: %w", err)
+		}
+
+		// Only restore the version we've just checked, in case it was purged or restored in the meantime
+		filter := bson.M{"_id": userID, "deleted_at": bson.M{"$ne": nil}, "version": versionFilter(deletedUser.Version)}
+		update := bson.M{
+			"$unset": bson.M{"deleted_at": ""},
+			"$set":   bson.M{"updated_at": time.Now()},
+			"$inc":   bson.M{"version": 1},
+		}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+		err = userCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&restoredUser)
+		if err == mongo.ErrNoDocuments {
+			return ErrVersionMismatch
+		}
+		if err != nil {
+			return fmt.Errorf("error when restoring user - err: %w", err)
+		}
+
+		return recordChanges(ctx, audit, newEvent(ctx, data.UpdateRestored, &deletedUser, &restoredUser))
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return nil
+	return &deletedUser, &restoredUser, nil
 }
 
-// DeleteAllUsers deletes all users from the database.
-func DeleteAllUsers() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// maxPurgeSize caps how many users are purged in a single transaction
+const maxPurgeSize = 1000
+
+// PurgeDeletedUsers permanently removes every user soft deleted before the given time, returning how many were removed.
+// Their history goes with them in the same transaction, so none of it can be read once they're gone.
+func PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	ctx, cancel := newContext(ctx, "PurgeDeletedUsers", 30*time.Second)
 	defer cancel()
 
-	// Empty filter matches all
-	filter := bson.M{}
+	filter := bson.M{"deleted_at": bson.M{"$lte": deletedBefore}}
+	findOptions := options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(maxPurgeSize)
 
-	// Perform the delete operation.
-	_, err := userCollection.DeleteMany(ctx, filter)
+	var purged int64
+	for {
+		var ids []string
+		var deleted int64
+		err := withTransaction(ctx, func(ctx context.Context) error {
+			// Start afresh if the transaction is retried
+			ids, deleted = nil, 0
+			cursor, err := userCollection.Find(ctx, filter, findOptions)
+			if err != nil {
+				return fmt.Errorf("error when finding deleted users - err: %w", err)
+			}
+			defer cursor.Close(ctx)
+
+			for cursor.Next(ctx) {
+				var user data.User
+				if err := cursor.Decode(&user); err != nil {
+					return err
+				}
+				ids = append(ids, user.ID)
+			}
+			if err := cursor.Err(); err != nil || len(ids) == 0 {
+				return err
+			}
+
+			result, err := userCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "deleted_at": bson.M{"$lte": deletedBefore}})
+			if err != nil {
+				return fmt.Errorf("error when purging deleted users - err: %w", err)
+			}
+			deleted = result.DeletedCount
+
+			_, err = revisionCollection.DeleteMany(ctx, bson.M{"user_id": bson.M{"$in": ids}})
+			if err != nil {
+				return fmt.Errorf("error when purging deleted users' revisions - err: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return purged, err
+		}
+
+		purged += deleted
+		if len(ids) < maxPurgeSize {
+			return purged, nil
+		}
+	}
+}
+
+// notDeleted adds a filter excluding soft deleted users, a missing deleted_at also matches null
+func notDeleted(filter bson.M) bson.M {
+	filter["deleted_at"] = nil
+	return filter
+}
+
+// userUpdate is the update that overwrites a user's details with the given user's, updating counts as a change so the version is incremented
+// The stored password is left alone when the given user doesn't have one.
+func userUpdate(user *data.User) bson.M {
+	set := bson.M{
+		"first_name": user.FirstName,
+		"last_name":  user.LastName,
+		"nickname":   user.Nickname,
+		"email":      user.Email,
+		"country":    user.Country,
+		"updated_at": user.UpdatedAt,
+	}
+	if user.Password != "" {
+		set["password"] = user.Password
+	}
+
+	return bson.M{
+		"$set": set,
+		"$inc": bson.M{"version": 1},
+	}
+}
+
+// userUpdated applies the userUpdate update to our copy of a user, rather than reading them back
+func userUpdated(user data.User, changes *data.User) data.User {
+	user.FirstName = changes.FirstName
+	user.LastName = changes.LastName
+	user.Nickname = changes.Nickname
+	if changes.Password != "" {
+		user.Password = changes.Password
+	}
+	user.Email = changes.Email
+	user.Country = changes.Country
+	user.UpdatedAt = changes.UpdatedAt
+	user.Version++
+	return user
+}
+
+// softDelete is the update that soft deletes a user, deleting counts as a change so the version is incremented
+func softDelete(deletedAt time.Time) bson.M {
+	return bson.M{
+		"$set": bson.M{"deleted_at": deletedAt, "updated_at": deletedAt},
+		"$inc": bson.M{"version": 1},
+	}
+}
+
+// softDeleted applies the softDelete update to our copy of a user, rather than reading them back
+func softDeleted(user data.User, deletedAt time.Time) data.User {
+	user.DeletedAt = &deletedAt
+	user.UpdatedAt = deletedAt
+	user.Version++
+	return user
+}
+
+// missingUserError works out why a write filtered on ID (and optionally version) matched nothing.
+// Without an expected version the user simply doesn't exist, otherwise we check whether it was the version that didn't match.
+func missingUserError(ctx context.Context, userID string, expectedVersion int64) error {
+	if expectedVersion == AnyVersion {
+		return ErrUserNotFound
+	}
+
+	var user data.User
+	err := userCollection.FindOne(ctx, notDeleted(bson.M{"_id": userID})).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error when checking user version - err: %w", err)
+	}
+
+	return ErrVersionMismatch
+}
+
+// DeleteAllUsers soft deletes all users, they can still be restored until they are purged.
+// Every user deleted is given the same deletedAt time, so they can be found again afterwards.
+// A single event is logged and audited for them all, and each of them snapshot, in the same transaction.
+func DeleteAllUsers(ctx context.Context, deletedAt time.Time, audit Auditor) error {
+	ctx, cancel := newContext(ctx, "DeleteAllUsers", 10*time.Second)
+	defer cancel()
+
+	return withTransaction(ctx, func(ctx context.Context) error {
+		// Perform the delete operation.
+		_, err := userCollection.UpdateMany(ctx, notDeleted(bson.M{}), softDelete(deletedAt))
+		if err != nil {
+			return fmt.Errorf("error deleting all users: %w", err)
+		}
+
+		if err := insertDeletedRevisions(ctx, deletedAt); err != nil {
+			return err
+		}
+
+		return recordChanges(ctx, audit, data.UserEvent{UpdateType: data.UpdateAllDeleted, ChangedFields: deleteAllChangedFields, RequestID: requestid.FromContext(ctx), CreatedAt: time.Now()})
+	})
+}
+
+// GetUsersByNicknames fetches every user holding one of the given nicknames
+func GetUsersByNicknames(ctx context.Context, nicknames []string) ([]data.User, error) {
+	ctx, cancel := newContext(ctx, "GetUsersByNicknames", 10*time.Second)
+	defer cancel()
+
+	return findUsers(ctx, notDeleted(bson.M{"nickname": bson.M{"$in": nicknames}}))
+}
+
+// GetUsersByIDs fetches every user with one of the given IDs
+func GetUsersByIDs(ctx context.Context, ids []string) ([]data.User, error) {
+	ctx, cancel := newContext(ctx, "GetUsersByIDs", 10*time.Second)
+	defer cancel()
+
+	return findUsers(ctx, notDeleted(bson.M{"_id": bson.M{"$in": ids}}))
+}
+
+// findUsers fetches all the users matching the given filter
+func findUsers(ctx context.Context, filter bson.M) ([]data.User, error) {
+	cursor, err := userCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("error when finding users - err: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	// pre-alloc everying in a single call
+	users := make([]data.User, 0, cursor.RemainingBatchLength())
+	for cursor.Next(ctx) {
+		var user data.User
+		if err := cursor.Decode(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// ExportUsers streams every user to fn in ID order, without holding them all in memory.
+// Exports can take a while, so the caller controls the timeout through ctx.
+func ExportUsers(ctx context.Context, fn func(user *data.User) error) error {
+	ctx = withFunction(ctx, "ExportUsers")
+	cursor, err := userCollection.Find(ctx, notDeleted(bson.M{}), options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("error when exporting users - err: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var user data.User
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// InsertUsers adds all the given users in a single unordered bulk write, so one bad user doesn't stop the rest.
+// An event is logged, audited and snapshot for every user added, in the same transaction.
+// The returned slice holds the error, if any, for the user at the same index.
+func InsertUsers(ctx context.Context, users []data.User, audit Auditor) ([]error, error) {
+	ctx, cancel := newContext(ctx, "InsertUsers", 30*time.Second)
+	defer cancel()
+
+	return bulkWriteUsers(ctx, len(users), func(ctx context.Context, indexes []int) ([]error, error) {
+		models := make([]mongo.WriteModel, len(indexes))
+		events := make([]data.UserEvent, len(indexes))
+		for j, i := range indexes {
+			models[j] = mongo.NewInsertOneModel().SetDocument(&users[i])
+			events[j] = newEvent(ctx, data.UpdateCreated, nil, &users[i])
+		}
+
+		_, err := userCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		writeErrs, err := bulkWriteErrors(err, len(indexes))
+		if err != nil || anyErrors(writeErrs) {
+			return writeErrs, err
+		}
+
+		return writeErrs, recordChanges(ctx, audit, events...)
+	})
+}
+
+// UpdateUsers applies all the given updates in a single unordered bulk write, logging, auditing and snapshotting an event for every user updated in the same transaction.
+// Each update only applies if the stored user is still the version at the same index in previous.
+// The updated users are returned, with the error for any user that wasn't updated at the same index.
+func UpdateUsers(ctx context.Context, users, previous []data.User, audit Auditor) ([]data.User, []error, error) {
+	ctx, cancel := newContext(ctx, "UpdateUsers", 30*time.Second)
+	defer cancel()
+
+	updated := make([]data.User, len(users))
+	missed := make([]error, len(users))
+	errs, err := bulkWriteUsers(ctx, len(users), func(ctx context.Context, indexes []int) ([]error, error) {
+		ids := make([]string, len(indexes))
+		for j, i := range indexes {
+			ids[j] = users[i].ID
+		}
+
+		// Check which users are still at the version we expect within the transaction, so only those are written.
+		// Anyone changing them after this conflicts with our writes, and the transaction is retried.
+		stored, err := findUsers(ctx, notDeleted(bson.M{"_id": bson.M{"$in": ids}}))
+		if err != nil {
+			return nil, err
+		}
+		storedByID := make(map[string]data.User, len(stored))
+		for _, user := range stored {
+			storedByID[user.ID] = user
+		}
+
+		models := make([]mongo.WriteModel, 0, len(indexes))
+		written := make([]int, 0, len(indexes))
+		for j, i := range indexes {
+			updated[i], missed[i] = data.User{}, nil
+			user, ok := storedByID[users[i].ID]
+			switch {
+			case !ok:
+				missed[i] = ErrUserNotFound
+			case user.Version != previous[i].Version:
+				missed[i] = ErrVersionMismatch
+			default:
+				models = append(models, mongo.NewUpdateOneModel().
+					SetFilter(notDeleted(bson.M{"_id": users[i].ID, "version": versionFilter(previous[i].Version)})).
+					SetUpdate(userUpdate(&users[i])))
+				written = append(written, j)
+			}
+		}
+
+		writeErrs := make([]error, len(indexes))
+		if len(models) == 0 {
+			return writeErrs, nil
+		}
+
+		result, err := userCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		modelErrs, err := bulkWriteErrors(err, len(models))
+		if err != nil {
+			return nil, err
+		}
+		for k, j := range written {
+			writeErrs[j] = modelErrs[k]
+		}
+		if anyErrors(writeErrs) {
+			return writeErrs, nil
+		}
+
+		// Every write is filtered on the version we've just checked, so they all match unless a user changed underneath us.
+		// Bulk writes don't say which missed, so they're all failed, aborting the transaction without any of them applied.
+		if result.MatchedCount != int64(len(models)) {
+			for _, j := range written {
+				writeErrs[j] = ErrVersionMismatch
+			}
+			return writeErrs, nil
+		}
+
+		events := make([]data.UserEvent, len(written))
+		for k, j := range written {
+			i := indexes[j]
+			updated[i] = userUpdated(previous[i], &users[i])
+			events[k] = newEvent(ctx, data.UpdateUpdated, &previous[i], &updated[i])
+		}
+
+		return writeErrs, recordChanges(ctx, audit, events...)
+	})
 	if err != nil {
-		return fmt.Errorf("error deleting all users: %v", err)
+		return nil, nil, err
+	}
+
+	return updated, mergeErrors(errs, missed), nil
+}
+
+// DeleteUsers soft deletes all the given users in a single unordered bulk write, logging, auditing and snapshotting an event for every user deleted in the same transaction.
+// Each delete only applies if the stored user is still the version at the same index in previous.
+// The deleted users are returned, with the error for any user that wasn't deleted at the same index.
+func DeleteUsers(ctx context.Context, previous []data.User, deletedAt time.Time, audit Auditor) ([]data.User, []error, error) {
+	ctx, cancel := newContext(ctx, "DeleteUsers", 30*time.Second)
+	defer cancel()
+
+	deleted := make([]data.User, len(previous))
+	missed := make([]error, len(previous))
+	errs, err := bulkWriteUsers(ctx, len(previous), func(ctx context.Context, indexes []int) ([]error, error) {
+		models := make([]mongo.WriteModel, len(indexes))
+		ids := make([]string, len(indexes))
+		for j, i := range indexes {
+			ids[j] = previous[i].ID
+			models[j] = mongo.NewUpdateOneModel().
+				SetFilter(notDeleted(bson.M{"_id": previous[i].ID, "version": versionFilter(previous[i].Version)})).
+				SetUpdate(softDelete(deletedAt))
+		}
+
+		_, err := userCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		writeErrs, err := bulkWriteErrors(err, len(indexes))
+		if err != nil || anyErrors(writeErrs) {
+			return writeErrs, err
+		}
+
+		// Bulk writes only report how many documents matched, so check which users are still around
+		remaining, err := findUsers(ctx, notDeleted(bson.M{"_id": bson.M{"$in": ids}}))
+		if err != nil {
+			return nil, err
+		}
+		remainingIDs := make(map[string]struct{}, len(remaining))
+		for _, user := range remaining {
+			remainingIDs[user.ID] = struct{}{}
+		}
+
+		events := make([]data.UserEvent, 0, len(indexes))
+		for _, i := range indexes {
+			deleted[i], missed[i] = data.User{}, nil
+			if _, ok := remainingIDs[previous[i].ID]; ok {
+				missed[i] = ErrVersionMismatch
+				continue
+			}
+
+			deleted[i] = softDeleted(previous[i], deletedAt)
+			events = append(events, newEvent(ctx, data.UpdateDeleted, &previous[i], &deleted[i]))
+		}
+
+		return writeErrs, recordChanges(ctx, audit, events...)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return deleted, mergeErrors(errs, missed), nil
+}
+
+// errWritesFailed aborts a bulk write's transaction, after some of its writes failed
+var errWritesFailed = errors.New("some of the bulk writes failed")
+
+// bulkWriteUsers runs write in a transaction with the indexes of every user, returning the error for the write at each index.
+// A failed write aborts the whole transaction, so the failed writes are dropped and write run again with the rest.
+func bulkWriteUsers(ctx context.Context, count int, write func(ctx context.Context, indexes []int) ([]error, error)) ([]error, error) {
+	errs := make([]error, count)
+	indexes := make([]int, count)
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	for len(indexes) > 0 {
+		var writeErrs []error
+		err := withTransaction(ctx, func(ctx context.Context) error {
+			var err error
+			writeErrs, err = write(ctx, indexes)
+			if err == nil && anyErrors(writeErrs) {
+				return errWritesFailed
+			}
+			return err
+		})
+		if err != errWritesFailed {
+			if err != nil {
+				return nil, err
+			}
+			return errs, nil
+		}
+
+		remaining := make([]int, 0, len(indexes))
+		for j, i := range indexes {
+			if writeErrs[j] != nil {
+				errs[i] = writeErrs[j]
+				continue
+			}
+			remaining = append(remaining, i)
+		}
+		indexes = remaining
+	}
+
+	return errs, nil
+}
+
+// anyErrors reports whether any of the errors are set
+func anyErrors(errs []error) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeErrors fills the gaps in errs with the error at the same index in others
+func mergeErrors(errs, others []error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = others[i]
+		}
+	}
+	return errs
+}
+
+// AnyVersion is the expected version for writes that don't care which version of the user they overwrite
+const AnyVersion int64 = -1
+
+// versionFilter matches a stored version, users written before versions were introduced have no version at all
+func versionFilter(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{int64(0), nil}}
+	}
+	return version
+}
+
+// bulkWriteErrors splits the error from an unordered bulk write into the errors for each individual write.
+// Anything other than per-write errors means the whole batch failed.
+func bulkWriteErrors(err error, count int) ([]error, error) {
+	errs := make([]error, count)
+	if err == nil {
+		return errs, nil
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return nil, fmt.Errorf("error when performing bulk write - err: %w", err)
+	}
+
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Index < 0 || writeErr.Index >= count {
+			continue
+		}
+
+		errs[writeErr.Index] = writeErr
+		if mongo.IsDuplicateKeyError(writeErr) {
+			errs[writeErr.Index] = fmt.Errorf("%w - err: %v", ErrDuplicateUser, writeErr)
+		}
+	}
+
+	return errs, nil
+}
+
+// GetIdempotencyRecord looks up a previously used idempotency key, returning nil if it is unknown or has expired.
+func GetIdempotencyRecord(ctx context.Context, key string) (*data.IdempotencyRecord, error) {
+	ctx, cancel := newContext(ctx, "GetIdempotencyRecord", 10*time.Second)
+	defer cancel()
+
+	// mongo only purges expired documents periodically, so we need to ignore them ourselves
+	filter := bson.M{"_id": key, "expires_at": bson.M{"$gt": time.Now()}}
+
+	var record data.IdempotencyRecord
+	err := idempotencyCollection.FindOne(ctx, filter).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when looking up idempotency key - err: %v", err)
+	}
+
+	return &record, nil
+}
+
+// ReserveIdempotencyKey claims an idempotency key before the user is created, so concurrent retries can't both create a user.
+// The key is only held for IdempotencyLease until the user is created. An expired key is taken over, a live one fails with ErrIdempotencyKeyInUse.
+func ReserveIdempotencyKey(ctx context.Context, key, requestHash string) error {
+	ctx, cancel := newContext(ctx, "ReserveIdempotencyKey", 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"_id": key, "expires_at": bson.M{"$lte": now}}
+	update := bson.M{
+		"$set":   bson.M{"request_hash": requestHash, "created_at": now, "expires_at": now.Add(IdempotencyLease)},
+		"$unset": bson.M{"user": ""},
+	}
+
+	// When a live key already exists the filter won't match, so the upsert collides with the existing _id
+	opts := options.FindOneAndUpdate().SetUpsert(true)
+	err := idempotencyCollection.FindOneAndUpdate(ctx, filter, update, opts).Err()
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrIdempotencyKeyInUse
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return fmt.Errorf("error when reserving idempotency key - err: %v", err)
+	}
+
+	return nil
+}
+
+// CompleteIdempotencyKey stores the created user against its idempotency key, so retries are given the original user.
+// The user is stored without their password, so the key doesn't keep a copy of it for the whole window.
+func CompleteIdempotencyKey(ctx context.Context, key string, user *data.User) error {
+	ctx, cancel := newContext(ctx, "CompleteIdempotencyKey", 10*time.Second)
+	defer cancel()
+
+	redacted := user.Redacted()
+	update := bson.M{"$set": bson.M{"user": &redacted, "expires_at": time.Now().Add(IdempotencyWindow)}}
+	err := idempotencyCollection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update).Err()
+	if err != nil {
+		return fmt.Errorf("error when completing idempotency key - err: %v", err)
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey frees an idempotency key whose request failed, so the client is able to retry it.
+// A key that's since been completed, by a request that took it over once the lease ran out, is kept.
+func ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	ctx, cancel := newContext(ctx, "ReleaseIdempotencyKey", 10*time.Second)
+	defer cancel()
+
+	_, err := idempotencyCollection.DeleteOne(ctx, bson.M{"_id": key, "user": bson.M{"$exists": false}})
+	if err != nil {
+		return fmt.Errorf("error when releasing idempotency key - err: %v", err)
+	}
+
+	return nil
+}
+
+// insertAuditEvents appends the given events to the audit log, events are never updated or removed once written
+func insertAuditEvents(ctx context.Context, events []data.AuditEvent) error {
+	models := make([]mongo.WriteModel, len(events))
+	for i := range events {
+		models[i] = mongo.NewInsertOneModel().SetDocument(&events[i])
+	}
+
+	_, err := auditCollection.BulkWrite(ctx, models)
+	if err != nil {
+		return fmt.Errorf("error when inserting audit events - err: %v", err)
+	}
+
+	return nil
+}
+
+// ListAuditEvents queries the audit log, newest first.
+// Filtering on a user also includes changes made to every user at once. Zero times leave that end of the range open.
+func ListAuditEvents(ctx context.Context, userID string, since, until time.Time, page, pageSize int) ([]data.AuditEvent, error) {
+	filter := bson.M{}
+	if userID != "" {
+		filter["$or"] = bson.A{
+			bson.M{"user_id": userID},
+			bson.M{"action": data.AuditDeleteAll},
+		}
+	}
+	createdAt := bson.M{}
+	if !since.IsZero() {
+		createdAt["$gte"] = since
+	}
+	if !until.IsZero() {
+		createdAt["$lt"] = until
+	}
+	if len(createdAt) > 0 {
+		filter["created_at"] = createdAt
+	}
+
+	ctx, cancel := newContext(ctx, "ListAuditEvents", 10*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip(int64((page - 1) * pageSize)).
+		SetLimit(int64(pageSize))
+
+	cursor, err := auditCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error when listing audit events - err: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	events := make([]data.AuditEvent, 0, cursor.RemainingBatchLength())
+	for cursor.Next(ctx) {
+		var event data.AuditEvent
+		if err := cursor.Decode(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// maxRevisionWriteSize caps how many revisions are written in a single bulk write
+const maxRevisionWriteSize = 1000
+
+// newRevision snapshots a user as of their last update.
+// Their password is left out, so it can never be read back through their history.
+func newRevision(action string, user *data.User) data.UserRevision {
+	return data.UserRevision{
+		ID:         revisionID(user.ID, user.Version),
+		UserID:     user.ID,
+		Version:    user.Version,
+		Action:     action,
+		User:       user.Redacted(),
+		RecordedAt: user.UpdatedAt,
+	}
+}
+
+// insertRevisions stores snapshots of users, within the transaction changing them.
+// A user only has one revision per version, so storing a revision that already exists leaves it untouched.
+func insertRevisions(ctx context.Context, revisions []data.UserRevision) error {
+	if len(revisions) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(revisions))
+	for i := range revisions {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": revisions[i].ID}).
+			SetUpdate(bson.M{"$setOnInsert": &revisions[i]}).
+			SetUpsert(true)
+	}
+
+	_, err := revisionCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("error when inserting user revisions - err: %w", err)
+	}
+
+	return nil
+}
+
+// insertDeletedRevisions snapshots every user deleted at exactly the given time, within the transaction deleting them all at once
+func insertDeletedRevisions(ctx context.Context, deletedAt time.Time) error {
+	cursor, err := userCollection.Find(ctx, bson.M{"deleted_at": deletedAt})
+	if err != nil {
+		return fmt.Errorf("error when finding deleted users - err: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	revisions := make([]data.UserRevision, 0, maxRevisionWriteSize)
+	for cursor.Next(ctx) {
+		var user data.User
+		if err := cursor.Decode(&user); err != nil {
+			return err
+		}
+		revisions = append(revisions, newRevision(data.AuditDeleteAll, &user))
+
+		if len(revisions) == maxRevisionWriteSize {
+			if err := insertRevisions(ctx, revisions); err != nil {
+				return err
+			}
+			revisions = revisions[:0]
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	return insertRevisions(ctx, revisions)
+}
+
+// GetUserHistory lists a user's revisions, newest first
+func GetUserHistory(ctx context.Context, userID string, page, pageSize int) ([]data.UserRevision, error) {
+	ctx, cancel := newContext(ctx, "GetUserHistory", 10*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "version", Value: -1}}).
+		SetSkip(int64((page - 1) * pageSize)).
+		SetLimit(int64(pageSize))
+
+	cursor, err := revisionCollection.Find(ctx, bson.M{"user_id": userID}, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error when listing user revisions - err: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	revisions := make([]data.UserRevision, 0, cursor.RemainingBatchLength())
+	for cursor.Next(ctx) {
+		var revision data.UserRevision
+		if err := cursor.Decode(&revision); err != nil {
+			return nil, err
+		}
+		// Revisions stored before passwords were left out of them still hold one
+		revision.User = revision.User.Redacted()
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+// GetUserAt finds the revision of a user that was current at the given time
+func GetUserAt(ctx context.Context, userID string, at time.Time) (*data.UserRevision, error) {
+	ctx, cancel := newContext(ctx, "GetUserAt", 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID, "recorded_at": bson.M{"$lte": at}}
+	opts := options.FindOne().SetSort(bson.D{{Key: "recorded_at", Value: -1}, {Key: "version", Value: -1}})
+
+	return findRevision(ctx, filter, opts)
+}
+
+// GetRevision finds a specific version of a user
+func GetRevision(ctx context.Context, userID string, version int64) (*data.UserRevision, error) {
+	ctx, cancel := newContext(ctx, "GetRevision", 10*time.Second)
+	defer cancel()
+
+	return findRevision(ctx, bson.M{"_id": revisionID(userID, version)})
+}
+
+// findRevision fetches a single revision
+func findRevision(ctx context.Context, filter bson.M, opts ...*options.FindOneOptions) (*data.UserRevision, error) {
+	var revision data.UserRevision
+	err := revisionCollection.FindOne(ctx, filter, opts...).Decode(&revision)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrRevisionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when finding user revision - err: %v", err)
+	}
+
+	// Revisions stored before passwords were left out of them still hold one
+	revision.User = revision.User.Redacted()
+	return &revision, nil
+}
+
+// revisionID identifies a version of a user, so each version is only stored once
+func revisionID(userID string, version int64) string {
+	return fmt.Sprintf("%s:%d", userID, version)
+}
+
+// eventCounter is the counter handing out user event sequence numbers
+const eventCounter = "user_events"
+
+// CurrentEventSequence finds the last user event sequence handed out, 0 if there hasn't been one yet
+func CurrentEventSequence(ctx context.Context) (int64, error) {
+	ctx, cancel := newContext(ctx, "CurrentEventSequence", 10*time.Second)
+	defer cancel()
+
+	var counter struct {
+		Sequence int64 `bson:"sequence"`
+	}
+	err := counterCollection.FindOne(ctx, bson.M{"_id": eventCounter}).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error when finding the event sequence - err: %v", err)
+	}
+
+	return counter.Sequence, nil
+}
+
+// functionKey carries the name of the db function calling mongo, so its calls are labelled with it in metrics
+type functionKey struct{}
+
+// newContext is for the calls to mongo made by the named db function, giving them timeout to finish.
+// The calls are traced under a span for the function, in ctx's trace, which is ended on cancel.
+// ctx's values, such as its request ID, are kept but it isn't waited on, so a write isn't abandoned halfway when the client goes away.
+func newContext(ctx context.Context, function string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, span := tracing.Start(context.WithoutCancel(ctx), "db."+function)
+	ctx, cancel := context.WithTimeout(withFunction(ctx, function), timeout)
+	return ctx, func() {
+		cancel()
+		span.End()
+	}
+}
+
+// withFunction labels the calls to mongo made with ctx as made by the named db function
+func withFunction(ctx context.Context, function string) context.Context {
+	return context.WithValue(ctx, functionKey{}, function)
+}
+
+// deleteAllChangedFields are the fields changed on every user when they are all deleted
+var deleteAllChangedFields = []string{"version", "deleted_at"}
+
+// withTransaction runs fn in a transaction, so a write and the event describing it are committed together or not at all.
+// fn must use the ctx it's given, and may be run more than once if the transaction is retried.
+// Transactions clashing with each other are retried, so errors from fn need to wrap mongo's with %w.
+// Without a client, as in tests, there's no transaction to run it in so fn is run on its own.
+func withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if client == nil {
+		return fn(ctx)
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		return fmt.Errorf("error when starting a session - err: %v", err)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// newEvent describes an update made to a user, in the request ctx belongs to. before is nil for a new user
+func newEvent(ctx context.Context, updateType string, before, after *data.User) data.UserEvent {
+	changes := audit.Diff(before, after)
+	fields := make([]string, len(changes))
+	for i, change := range changes {
+		fields[i] = change.Field
+	}
+
+	user := *after
+	event := data.UserEvent{UserID: user.ID, UpdateType: updateType, User: &user, ChangedFields: fields, RequestID: requestid.FromContext(ctx), CreatedAt: time.Now()}
+	if before != nil {
+		previous := *before
+		event.PreviousUser = &previous
+	}
+	return event
+}
+
+// Auditor builds the audit event for a change a write makes to a user, so it's stored in the same transaction as the write.
+// before is nil for a new user, both are nil when every user is deleted at once.
+type Auditor func(userID string, before, after *data.User) data.AuditEvent
+
+// recordChanges logs the given events, audits the changes they describe, and snapshots the changed users into their history, within the transaction making them.
+// If the changes can't be recorded, the transaction is aborted so nothing is changed without a record of who did it, or a gap in the user's history.
+func recordChanges(ctx context.Context, audit Auditor, events ...data.UserEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	auditEvents := make([]data.AuditEvent, len(events))
+	revisions := make([]data.UserRevision, 0, 2*len(events))
+	for i := range events {
+		auditEvents[i] = audit(events[i].UserID, events[i].PreviousUser, events[i].User)
+		events[i].Actor = auditEvents[i].Actor
+
+		// The user as it was before is normally already in their history,
+		// storing it again fills in users that were last changed before history was recorded
+		if events[i].PreviousUser != nil {
+			revisions = append(revisions, newRevision("", events[i].PreviousUser))
+		}
+		if events[i].User != nil {
+			revisions = append(revisions, newRevision(auditEvents[i].Action, events[i].User))
+		}
+	}
+
+	if err := recordEvents(ctx, events...); err != nil {
+		return err
+	}
+	if err := insertAuditEvents(ctx, auditEvents); err != nil {
+		return err
+	}
+	return insertRevisions(ctx, revisions)
+}
+
+// recordEvents sequences the given events and logs them, within the transaction making the updates they describe.
+// Every transaction increments the same counter, so they commit one at a time and events are never logged out of sequence.
+func recordEvents(ctx context.Context, events ...data.UserEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var counter struct {
+		Sequence int64 `bson:"sequence"`
+	}
+	err := counterCollection.FindOneAndUpdate(ctx, bson.M{"_id": eventCounter}, bson.M{"$inc": bson.M{"sequence": int64(len(events))}}, opts).Decode(&counter)
+	if err != nil {
+		return fmt.Errorf("error when incrementing the event sequence - err: %w", err)
+	}
+
+	// The counter now holds the last of the sequences handed out
+	models := make([]mongo.WriteModel, len(events))
+	for i := range events {
+		events[i].Sequence = counter.Sequence - int64(len(events)-1-i)
+		models[i] = mongo.NewInsertOneModel().SetDocument(events[i])
+	}
+
+	_, err = eventCollection.BulkWrite(ctx, models)
+	if err != nil {
+		return fmt.Errorf("error when logging user events - err: %w", err)
+	}
+
+	return nil
+}
+
+// GetEventsAfter lists up to limit logged events with a sequence after the given one, oldest first
+func GetEventsAfter(ctx context.Context, sequence, limit int64) ([]data.UserEvent, error) {
+	ctx, cancel := newContext(ctx, "GetEventsAfter", 10*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit)
+
+	return findEvents(ctx, bson.M{"_id": bson.M{"$gt": sequence}}, findOptions)
+}
+
+// GetUndeliveredEvents lists up to limit logged events the relay hasn't delivered yet, oldest first
+func GetUndeliveredEvents(ctx context.Context, limit int64) ([]data.UserEvent, error) {
+	ctx, cancel := newContext(ctx, "GetUndeliveredEvents", 10*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit)
+
+	return findEvents(ctx, bson.M{"delivered_at": nil}, findOptions)
+}
+
+// findEvents lists the logged events matching the given filter
+func findEvents(ctx context.Context, filter bson.M, findOptions *options.FindOptions) ([]data.UserEvent, error) {
+	cursor, err := eventCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error when listing user events - err: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	events := make([]data.UserEvent, 0, cursor.RemainingBatchLength())
+	for cursor.Next(ctx) {
+		var event data.UserEvent
+		if err := cursor.Decode(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// MarkEventsDelivered records the events with the given sequences as delivered, so the relay doesn't deliver them again
+func MarkEventsDelivered(ctx context.Context, sequences []int64, deliveredAt time.Time) error {
+	ctx, cancel := newContext(ctx, "MarkEventsDelivered", 10*time.Second)
+	defer cancel()
+
+	_, err := eventCollection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": sequences}}, bson.M{"$set": bson.M{"delivered_at": deliveredAt}})
+	if err != nil {
+		return fmt.Errorf("error when marking user events delivered - err: %v", err)
+	}
+
+	return nil
+}
+
+// AcquireLease takes the named lease for owner until ttl from now, or extends it if they already hold it.
+// It reports false while the lease is held by someone else.
+func AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	ctx, cancel := newContext(ctx, "AcquireLease", 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"_id": name, "$or": bson.A{bson.M{"owner": owner}, bson.M{"expires_at": bson.M{"$lte": now}}}}
+	update := bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(ttl)}}
+
+	// Someone else holds the lease when it doesn't match, so the upsert clashes with their _id
+	err := leaseCollection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetUpsert(true)).Err()
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	// Nothing is returned when the lease is taken for the first time
+	if err != nil && err != mongo.ErrNoDocuments {
+		return false, fmt.Errorf("error when acquiring the %s lease - err: %v", name, err)
+	}
+
+	return true, nil
+}
+
+// OldestEventSequence finds the sequence of the oldest event still in the log
+func OldestEventSequence(ctx context.Context) (int64, error) {
+	ctx, cancel := newContext(ctx, "OldestEventSequence", 10*time.Second)
+	defer cancel()
+
+	var event data.UserEvent
+	err := eventCollection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: 1}})).Decode(&event)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrNoEvents
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error when finding the oldest user event - err: %v", err)
+	}
+
+	return event.Sequence, nil
+}
+
+// InsertWebhook stores a new webhook
+func InsertWebhook(ctx context.Context, hook data.Webhook) error {
+	ctx, cancel := newContext(ctx, "InsertWebhook", 10*time.Second)
+	defer cancel()
+
+	_, err := webhookCollection.InsertOne(ctx, hook)
+	if err != nil {
+		return fmt.Errorf("error when inserting webhook - err: %v", err)
+	}
+
+	return nil
+}
+
+// UpdateWebhook changes where a webhook is delivered, and which updates it's sent.
+// The secret is only changed when a new one is given.
+func UpdateWebhook(ctx context.Context, hook data.Webhook) (*data.Webhook, error) {
+	ctx, cancel := newContext(ctx, "UpdateWebhook", 10*time.Second)
+	defer cancel()
+
+	set := bson.M{"url": hook.URL, "event_types": hook.EventTypes, "updated_at": hook.UpdatedAt}
+	if hook.Secret != "" {
+		set["secret"] = hook.Secret
+	}
+
+	var updated data.Webhook
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := webhookCollection.FindOneAndUpdate(ctx, bson.M{"_id": hook.ID}, bson.M{"$set": set}, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when updating webhook - err: %v", err)
+	}
+
+	return &updated, nil
+}
+
+// DeleteWebhook removes a webhook, its delivery log and dead letters are kept
+func DeleteWebhook(ctx context.Context, id string) error {
+	ctx, cancel := newContext(ctx, "DeleteWebhook", 10*time.Second)
+	defer cancel()
+
+	result, err := webhookCollection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("error when deleting webhook - err: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+// GetWebhook finds a webhook by ID
+func GetWebhook(ctx context.Context, id string) (*data.Webhook, error) {
+	ctx, cancel := newContext(ctx, "GetWebhook", 10*time.Second)
+	defer cancel()
+
+	var hook data.Webhook
+	err := webhookCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&hook)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when finding webhook - err: %v", err)
+	}
+
+	return &hook, nil
+}
+
+// ListWebhooks lists every webhook, oldest first
+func ListWebhooks(ctx context.Context) ([]data.Webhook, error) {
+	ctx, cancel := newContext(ctx, "ListWebhooks", 10*time.Second)
+	defer cancel()
+
+	cursor, err := webhookCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("error when listing webhooks - err: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	hooks := make([]data.Webhook, 0, cursor.RemainingBatchLength())
+	for cursor.Next(ctx) {
+		var hook data.Webhook
+		if err := cursor.Decode(&hook); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// InsertWebhookDelivery adds an attempt to the delivery log
+func InsertWebhookDelivery(ctx context.Context, delivery data.WebhookDelivery) error {
+	ctx, cancel := newContext(ctx, "InsertWebhookDelivery", 10*time.Second)
+	defer cancel()
+
+	_, err := deliveryCollection.InsertOne(ctx, delivery)
+	if err != nil {
+		return fmt.Errorf("error when logging webhook delivery - err: %v", err)
+	}
+
+	return nil
+}
+
+// ListWebhookDeliveries lists a webhook's delivery attempts, newest first
+func ListWebhookDeliveries(ctx context.Context, webhookID string, page, pageSize int) ([]data.WebhookDelivery, error) {
+	ctx, cancel := newContext(ctx, "ListWebhookDeliveries", 10*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip(int64((page - 1) * pageSize)).
+		SetLimit(int64(pageSize))
+
+	cursor, err := deliveryCollection.Find(ctx, bson.M{"webhook_id": webhookID}, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error when listing webhook deliveries - err: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := make([]data.WebhookDelivery, 0, cursor.RemainingBatchLength())
+	for cursor.Next(ctx) {
+		var delivery data.WebhookDelivery
+		if err := cursor.Decode(&delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// AddPendingDeliveries stores webhook deliveries still to be made.
+// A delivery already stored is left as it is, so storing the same one again doesn't have it made twice.
+func AddPendingDeliveries(ctx context.Context, deliveries []data.PendingWebhookDelivery) error {
+	ctx, cancel := newContext(ctx, "AddPendingDeliveries", 10*time.Second)
+	defer cancel()
+
+	models := make([]mongo.WriteModel, len(deliveries))
+	for i, delivery := range deliveries {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": delivery.ID}).
+			SetUpdate(bson.M{"$setOnInsert": delivery}).
+			SetUpsert(true)
+	}
+
+	_, err := pendingDeliveryCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("error when storing pending webhook deliveries - err: %v", err)
+	}
+
+	return nil
+}
+
+// ClaimPendingDelivery takes the webhook delivery that's been due longest, pushing it back until lease from now so no other worker takes it meanwhile
+func ClaimPendingDelivery(ctx context.Context, now time.Time, lease time.Duration) (*data.PendingWebhookDelivery, error) {
+	ctx, cancel := newContext(ctx, "ClaimPendingDelivery", 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"next_attempt_at": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}})
+
+	var delivery data.PendingWebhookDelivery
+	err := pendingDeliveryCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&delivery)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNoDeliveryDue
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when claiming pending webhook delivery - err: %v", err)
+	}
+
+	return &delivery, nil
+}
+
+// ReschedulePendingDelivery has a webhook delivery attempted again at the given time
+func ReschedulePendingDelivery(ctx context.Context, id string, attempt int, at time.Time) error {
+	ctx, cancel := newContext(ctx, "ReschedulePendingDelivery", 10*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"attempt": attempt, "next_attempt_at": at}}
+	err := pendingDeliveryCollection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update).Err()
+	if err != nil && err != mongo.ErrNoDocuments {
+		return fmt.Errorf("error when rescheduling pending webhook delivery - err: %v", err)
+	}
+
+	return nil
+}
+
+// RemovePendingDelivery drops a webhook delivery once it's been made or dead-lettered
+func RemovePendingDelivery(ctx context.Context, id string) error {
+	ctx, cancel := newContext(ctx, "RemovePendingDelivery", 10*time.Second)
+	defer cancel()
+
+	_, err := pendingDeliveryCollection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("error when removing pending webhook delivery - err: %v", err)
+	}
+
+	return nil
+}
+
+// InsertDeadLetter stores a delivery that was given up on.
+// A redelivery keeps its ID, so giving up on it again replaces the old dead letter.
+func InsertDeadLetter(ctx context.Context, deadLetter data.WebhookDeadLetter) error {
+	ctx, cancel := newContext(ctx, "InsertDeadLetter", 10*time.Second)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().SetUpsert(true)
+	err := deadLetterCollection.FindOneAndUpdate(ctx, bson.M{"_id": deadLetter.ID}, bson.M{"$set": deadLetter}, opts).Err()
+	if err != nil && err != mongo.ErrNoDocuments {
+		return fmt.Errorf("error when storing webhook dead letter - err: %v", err)
+	}
+
+	return nil
+}
+
+// ListDeadLetters lists the deliveries that were given up on, newest first.
+// An empty webhookID lists them for every webhook.
+func ListDeadLetters(ctx context.Context, webhookID string, page, pageSize int) ([]data.WebhookDeadLetter, error) {
+	filter := bson.M{}
+	if webhookID != "" {
+		filter["webhook_id"] = webhookID
+	}
+
+	ctx, cancel := newContext(ctx, "ListDeadLetters", 10*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSkip(int64((page - 1) * pageSize)).
+		SetLimit(int64(pageSize))
+
+	cursor, err := deadLetterCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error when listing webhook dead letters - err: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	deadLetters := make([]data.WebhookDeadLetter, 0, cursor.RemainingBatchLength())
+	for cursor.Next(ctx) {
+		var deadLetter data.WebhookDeadLetter
+		if err := cursor.Decode(&deadLetter); err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	return deadLetters, nil
+}
+
+// GetDeadLetter finds a dead letter by ID
+func GetDeadLetter(ctx context.Context, id string) (*data.WebhookDeadLetter, error) {
+	ctx, cancel := newContext(ctx, "GetDeadLetter", 10*time.Second)
+	defer cancel()
+
+	var deadLetter data.WebhookDeadLetter
+	err := deadLetterCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&deadLetter)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when finding webhook dead letter - err: %v", err)
+	}
+
+	return &deadLetter, nil
+}
+
+// DeleteDeadLetter removes a dead letter once it's been redelivered.
+// Only one caller gets to delete it, anyone else is told it wasn't found.
+func DeleteDeadLetter(ctx context.Context, id string) error {
+	ctx, cancel := newContext(ctx, "DeleteDeadLetter", 10*time.Second)
+	defer cancel()
+
+	result, err := deadLetterCollection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("error when deleting webhook dead letter - err: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrDeadLetterNotFound
 	}
 
 	return nil
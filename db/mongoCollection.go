@@ -2,36 +2,103 @@ package db
 
 import (
 	"context"
+	"errors"
+	"time"
+
+	"userapi/metrics"
+	"userapi/tracing"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 )
 
 // MongoCollection implements MongoCollectionInt using a real MongoDB collection.
+// Every call is traced and timed, and failures counted, labelled with the db function that made it.
 type MongoCollection struct {
 	collection *mongo.Collection
 }
 
 func (r *MongoCollection) InsertOne(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
-	return r.collection.InsertOne(ctx, document)
+	ctx, done := r.observe(ctx, "InsertOne")
+	result, err := r.collection.InsertOne(ctx, document)
+	done(err)
+	return result, err
 }
 
 func (r *MongoCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
-	return r.collection.Find(ctx, filter, opts...)
+	ctx, done := r.observe(ctx, "Find")
+	cursor, err := r.collection.Find(ctx, filter, opts...)
+	done(err)
+	return cursor, err
 }
 
 func (r *MongoCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
-	return r.collection.FindOne(ctx, filter, opts...)
+	ctx, done := r.observe(ctx, "FindOne")
+	result := r.collection.FindOne(ctx, filter, opts...)
+	done(result.Err())
+	return result
 }
 
 func (r *MongoCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
-	return r.collection.FindOneAndUpdate(ctx, filter, update, opts...)
+	ctx, done := r.observe(ctx, "FindOneAndUpdate")
+	result := r.collection.FindOneAndUpdate(ctx, filter, update, opts...)
+	done(result.Err())
+	return result
 }
 
 func (r *MongoCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
-	return r.collection.DeleteOne(ctx, filter, opts...)
+	ctx, done := r.observe(ctx, "DeleteOne")
+	result, err := r.collection.DeleteOne(ctx, filter, opts...)
+	done(err)
+	return result, err
 }
 
 func (r *MongoCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
-	return r.collection.DeleteMany(ctx, filter, opts...)
+	ctx, done := r.observe(ctx, "DeleteMany")
+	result, err := r.collection.DeleteMany(ctx, filter, opts...)
+	done(err)
+	return result, err
+}
+
+func (r *MongoCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	ctx, done := r.observe(ctx, "BulkWrite")
+	result, err := r.collection.BulkWrite(ctx, models, opts...)
+	done(err)
+	return result, err
+}
+
+func (r *MongoCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	ctx, done := r.observe(ctx, "UpdateMany")
+	result, err := r.collection.UpdateMany(ctx, filter, update, opts...)
+	done(err)
+	return result, err
+}
+
+// observe starts a span for a call to mongo, the returned done ends it and records the call's metrics.
+// Finding no documents is an answer rather than a failure, so it isn't counted or recorded as an error.
+func (r *MongoCollection) observe(ctx context.Context, operation string) (context.Context, func(err error)) {
+	function, ok := ctx.Value(functionKey{}).(string)
+	if !ok {
+		function = "unknown"
+	}
+
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, operation+" "+r.collection.Name(),
+		semconv.DBSystemMongoDB,
+		semconv.DBOperation(operation),
+		semconv.DBMongoDBCollection(r.collection.Name()),
+		attribute.String("userapi.db.function", function),
+	)
+	return ctx, func(err error) {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			err = nil
+		}
+		metrics.DBDuration.WithLabelValues(function, operation).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.DBErrors.WithLabelValues(function, operation).Inc()
+		}
+		tracing.End(span, err)
+	}
 }
@@ -2,40 +2,59 @@ package health
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"time"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
-var (
-	// GRPCAddress is the address that the gRPC server is listening on
-	GRPCAddress  = ":9090" // Update this if necessary or use an environment variable
-	healthClient healthpb.HealthClient
-)
+// Client asks a gRPC health service for its status, healthpb.HealthClient is one
+type Client interface {
+	Check(ctx context.Context, in *healthpb.HealthCheckRequest, opts ...grpc.CallOption) (*healthpb.HealthCheckResponse, error)
+}
 
-func init() {
-	var err error
+// Checker checks the gRPC server reports SERVING, for the HTTP health check
+type Checker struct {
+	client  Client
+	timeout time.Duration
+}
 
-	conn, err := grpc.NewClient(GRPCAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		log.Fatalf("Failed to connect to gRPC server: %v", err)
+// NewChecker checks the health service client calls, giving each check up to timeout
+func NewChecker(client Client, timeout time.Duration) *Checker {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
 	}
+	return &Checker{client: client, timeout: timeout}
+}
 
-	healthClient = healthpb.NewHealthClient(conn)
+// Local calls a health service in the same process. Checking our own health that way doesn't need a connection,
+// or the credentials, such as a client certificate under mTLS, that any other client would need to make one.
+func Local(server healthpb.HealthServer) Client {
+	return localClient{server: server}
 }
 
-// CheckHandler verifies the health of HTTP and gRPC
-func CheckHandler(w http.ResponseWriter, r *http.Request) {
+// localClient calls the health service directly
+type localClient struct {
+	server healthpb.HealthServer
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+func (c localClient) Check(ctx context.Context, in *healthpb.HealthCheckRequest, opts ...grpc.CallOption) (*healthpb.HealthCheckResponse, error) {
+	return c.server.Check(ctx, in)
+}
+
+// Check reports whether the gRPC server answers, and is SERVING
+func (c *Checker) Check(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 
-	resp, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{})
-	if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+	resp, err := c.client.Check(ctx, &healthpb.HealthCheckRequest{})
+	return err == nil && resp.Status == healthpb.HealthCheckResponse_SERVING
+}
+
+// CheckHandler verifies the health of HTTP and gRPC
+func (c *Checker) CheckHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.Check(r.Context()) {
 		http.Error(w, "gRPC health check failed", http.StatusServiceUnavailable)
 		return
 	}
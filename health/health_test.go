@@ -0,0 +1,64 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// fakeClient answers every check with its status, or err
+type fakeClient struct {
+	status healthpb.HealthCheckResponse_ServingStatus
+	err    error
+}
+
+func (c fakeClient) Check(ctx context.Context, in *healthpb.HealthCheckRequest, opts ...grpc.CallOption) (*healthpb.HealthCheckResponse, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &healthpb.HealthCheckResponse{Status: c.status}, nil
+}
+
+// TestCheckHandler tests the HTTP health check only passes while the gRPC server answers SERVING.
+func TestCheckHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   fakeClient
+		wantCode int
+	}{
+		{name: "serving", client: fakeClient{status: healthpb.HealthCheckResponse_SERVING}, wantCode: http.StatusOK},
+		{name: "not serving", client: fakeClient{status: healthpb.HealthCheckResponse_NOT_SERVING}, wantCode: http.StatusServiceUnavailable},
+		{name: "unreachable", client: fakeClient{err: errors.New("connection refused")}, wantCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			NewChecker(tt.client, time.Second).CheckHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("unexpected status code, want: %d, got: %d", tt.wantCode, rec.Code)
+			}
+		})
+	}
+}
+
+// TestLocal tests a local checker follows the health service in the same process
+func TestLocal(t *testing.T) {
+	healthSrv := health.NewServer()
+	checker := NewChecker(Local(healthSrv), time.Second)
+
+	if !checker.Check(context.Background()) {
+		t.Error("expected the check to pass while SERVING")
+	}
+	healthSrv.Shutdown()
+	if checker.Check(context.Background()) {
+		t.Error("expected the check to fail once NOT_SERVING")
+	}
+}
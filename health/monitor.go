@@ -0,0 +1,248 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bet365/jingo"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// ErrNotChecked is a check's error until it has been run for the first time
+var ErrNotChecked = errors.New("not checked yet")
+
+// Check is a dependency we can't serve without, such as the database
+type Check struct {
+	// Name identifies the check in the readiness report
+	Name string
+	// Services are the gRPC services which report NOT_SERVING while the check fails. The overall ("") service depends on every check
+	Services []string
+	// Run checks the dependency, failing if it isn't usable
+	Run func(ctx context.Context) error
+}
+
+// Result is the outcome of the last time a check was run
+type Result struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMS float64   `json:"latency_ms"`
+	Error     string    `json:"error,escape"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the body of the readiness and liveness endpoints
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+var reportEncoder = jingo.NewStructEncoder(Report{})
+
+// Monitor runs the checks every interval, keeping the gRPC health service's statuses in step with their results.
+// Until every check has passed once, and from when we start shutting down, we aren't ready.
+type Monitor struct {
+	server   *health.Server
+	checks   []Check
+	interval time.Duration
+	timeout  time.Duration
+
+	mu           sync.RWMutex
+	results      map[string]Result
+	lastRound    time.Time
+	shuttingDown bool
+}
+
+// NewMonitor reports the checks' results through server, running each every interval for up to timeout.
+// Every service starts off NOT_SERVING, until the checks it depends on pass.
+func NewMonitor(server *health.Server, interval, timeout time.Duration, checks ...Check) *Monitor {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	if timeout <= 0 || timeout > interval {
+		timeout = interval
+	}
+
+	m := &Monitor{
+		server:    server,
+		checks:    checks,
+		interval:  interval,
+		timeout:   timeout,
+		results:   make(map[string]Result, len(checks)),
+		lastRound: time.Now(),
+	}
+	for _, check := range checks {
+		m.results[check.Name] = Result{Name: check.Name, Error: ErrNotChecked.Error()}
+	}
+	m.updateStatuses()
+	return m
+}
+
+// Run checks straight away, then every interval until ctx is done
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.CheckNow(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckNow runs every check at once, and updates the gRPC health statuses with their results
+func (m *Monitor) CheckNow(ctx context.Context) {
+	results := make([]Result, len(m.checks))
+	var wg sync.WaitGroup
+	for i, check := range m.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = m.run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	for _, result := range results {
+		if previous := m.results[result.Name]; previous.Healthy != result.Healthy {
+			slog.Info("health check changed", "check", result.Name, "healthy", result.Healthy, "error", result.Error)
+		}
+		m.results[result.Name] = result
+	}
+	m.lastRound = time.Now()
+	m.mu.Unlock()
+
+	m.updateStatuses()
+}
+
+// run runs a check, timing it
+func (m *Monitor) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Run(ctx)
+	result := Result{
+		Name:      check.Name,
+		Healthy:   err == nil,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: start,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// updateStatuses sets each gRPC service SERVING while every check it depends on passes, and we aren't shutting down
+func (m *Monitor) updateStatuses() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.shuttingDown {
+		return
+	}
+
+	serving := map[string]bool{"": true}
+	for _, check := range m.checks {
+		healthy := m.results[check.Name].Healthy
+		serving[""] = serving[""] && healthy
+		for _, service := range check.Services {
+			if _, ok := serving[service]; !ok {
+				serving[service] = true
+			}
+			serving[service] = serving[service] && healthy
+		}
+	}
+
+	for service, ok := range serving {
+		status := healthpb.HealthCheckResponse_NOT_SERVING
+		if ok {
+			status = healthpb.HealthCheckResponse_SERVING
+		}
+		m.server.SetServingStatus(service, status)
+	}
+}
+
+// Shutdown sets every service NOT_SERVING for good, so load balancers stop sending us requests
+func (m *Monitor) Shutdown() {
+	m.mu.Lock()
+	m.shuttingDown = true
+	m.mu.Unlock()
+
+	m.server.Shutdown()
+}
+
+// Ready reports whether every check passed the last time it was run, and we aren't shutting down
+func (m *Monitor) Ready() (bool, Report) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ready := !m.shuttingDown
+	report := Report{Checks: make([]Result, 0, len(m.checks))}
+	for _, check := range m.checks {
+		result := m.results[check.Name]
+		ready = ready && result.Healthy
+		report.Checks = append(report.Checks, result)
+	}
+
+	switch {
+	case m.shuttingDown:
+		report.Status = "shutting down"
+	case ready:
+		report.Status = "ready"
+	default:
+		report.Status = "not ready"
+	}
+	return ready, report
+}
+
+// Alive reports whether the checks are still being run. A round of checks which hasn't finished long after it was due
+// means we're stuck, and need restarting. A failing dependency doesn't, as restarting wouldn't fix it, and neither does
+// shutting down, when the checks stop.
+func (m *Monitor) Alive() (bool, Report) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.shuttingDown && time.Since(m.lastRound) > 3*m.interval+m.timeout {
+		return false, Report{Status: "checks stalled"}
+	}
+	return true, Report{Status: "alive"}
+}
+
+// ReadyHandler serves the readiness report, with a 503 while we aren't ready
+func (m *Monitor) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, r, m.Ready)
+}
+
+// LiveHandler serves the liveness report, with a 503 once we're stuck
+func (m *Monitor) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, r, m.Alive)
+}
+
+// writeReport writes the report as JSON, with a 503 unless ok
+func writeReport(w http.ResponseWriter, r *http.Request, report func() (bool, Report)) {
+	ok, body := report()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	reportEncoder.Marshal(&body, buf)
+	if _, err := buf.WriteTo(w); err != nil {
+		slog.WarnContext(r.Context(), "failed to write the health report", "error", err)
+	}
+}
@@ -0,0 +1,219 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// toggle is a check which fails until it's set healthy
+type toggle struct {
+	mu      sync.Mutex
+	healthy bool
+}
+
+func (t *toggle) set(healthy bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.healthy = healthy
+}
+
+func (t *toggle) run(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.healthy {
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+// servingStatus is the status the health server reports for service
+func servingStatus(t *testing.T, server *health.Server, service string) healthpb.HealthCheckResponse_ServingStatus {
+	t.Helper()
+	resp, err := server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		t.Fatalf("failed to check %q: %v", service, err)
+	}
+	return resp.Status
+}
+
+// TestMonitorStatuses tests each gRPC service only reports SERVING while the checks it depends on pass, until we shut down.
+func TestMonitorStatuses(t *testing.T) {
+	server := health.NewServer()
+	mongo, cache := &toggle{}, &toggle{}
+	m := NewMonitor(server, time.Hour, time.Second,
+		Check{Name: "mongo", Services: []string{"user.UserService"}, Run: mongo.run},
+		Check{Name: "cache", Run: cache.run},
+	)
+
+	tests := []struct {
+		name         string
+		mongo, cache bool
+		want         map[string]healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{
+			name: "nothing passing",
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"":                 healthpb.HealthCheckResponse_NOT_SERVING,
+				"user.UserService": healthpb.HealthCheckResponse_NOT_SERVING,
+			},
+		},
+		{
+			name:  "only mongo passing",
+			mongo: true,
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"":                 healthpb.HealthCheckResponse_NOT_SERVING,
+				"user.UserService": healthpb.HealthCheckResponse_SERVING,
+			},
+		},
+		{
+			name:  "everything passing",
+			mongo: true,
+			cache: true,
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"":                 healthpb.HealthCheckResponse_SERVING,
+				"user.UserService": healthpb.HealthCheckResponse_SERVING,
+			},
+		},
+		{
+			name:  "mongo gone away",
+			cache: true,
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"":                 healthpb.HealthCheckResponse_NOT_SERVING,
+				"user.UserService": healthpb.HealthCheckResponse_NOT_SERVING,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mongo.set(tt.mongo)
+			cache.set(tt.cache)
+			m.CheckNow(context.Background())
+
+			for service, want := range tt.want {
+				if got := servingStatus(t, server, service); got != want {
+					t.Errorf("unexpected status for %q, want: %v, got: %v", service, want, got)
+				}
+			}
+			if ready, _ := m.Ready(); ready != (tt.mongo && tt.cache) {
+				t.Errorf("unexpected readiness, want: %v, got: %v", tt.mongo && tt.cache, ready)
+			}
+		})
+	}
+
+	mongo.set(true)
+	cache.set(true)
+	m.Shutdown()
+	m.CheckNow(context.Background())
+	if got := servingStatus(t, server, "user.UserService"); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("expected NOT_SERVING once shut down, got: %v", got)
+	}
+	if ready, report := m.Ready(); ready || report.Status != "shutting down" {
+		t.Errorf("expected not to be ready once shut down, got: %v, %q", ready, report.Status)
+	}
+	if alive, _ := m.Alive(); !alive {
+		t.Error("expected to still be alive while shutting down")
+	}
+}
+
+// TestReadyHandler tests the readiness report lists every check, with a 503 until they've all passed.
+func TestReadyHandler(t *testing.T) {
+	mongo := &toggle{}
+	m := NewMonitor(health.NewServer(), time.Hour, time.Second,
+		Check{Name: "mongo", Run: mongo.run},
+		Check{Name: "cache", Run: func(ctx context.Context) error { return nil }},
+	)
+
+	// Before the checks have run
+	code, report := serveReport(t, m.ReadyHandler)
+	if code != http.StatusServiceUnavailable || report.Status != "not ready" {
+		t.Errorf("unexpected response before checking, code: %d, status: %q", code, report.Status)
+	}
+	for _, result := range report.Checks {
+		if result.Healthy || result.Error != ErrNotChecked.Error() {
+			t.Errorf("expected %s not to have been checked, got: %+v", result.Name, result)
+		}
+	}
+
+	m.CheckNow(context.Background())
+	code, report = serveReport(t, m.ReadyHandler)
+	if code != http.StatusServiceUnavailable || len(report.Checks) != 2 {
+		t.Fatalf("unexpected response with mongo down, code: %d, report: %+v", code, report)
+	}
+	if mongoResult := report.Checks[0]; mongoResult.Name != "mongo" || mongoResult.Healthy || mongoResult.Error != "unreachable" {
+		t.Errorf("unexpected mongo result: %+v", mongoResult)
+	}
+	if cacheResult := report.Checks[1]; cacheResult.Name != "cache" || !cacheResult.Healthy || cacheResult.CheckedAt.IsZero() {
+		t.Errorf("unexpected cache result: %+v", cacheResult)
+	}
+
+	// Errors are escaped, so the report stays valid JSON
+	quoted := NewMonitor(health.NewServer(), time.Hour, time.Second,
+		Check{Name: "mongo", Run: func(ctx context.Context) error { return errors.New(`dial "mongo:27017" failed`) }},
+	)
+	quoted.CheckNow(context.Background())
+	if _, quotedReport := serveReport(t, quoted.ReadyHandler); len(quotedReport.Checks) != 1 || quotedReport.Checks[0].Error != `dial "mongo:27017" failed` {
+		t.Errorf("unexpected report with a quoted error: %+v", quotedReport)
+	}
+
+	mongo.set(true)
+	m.CheckNow(context.Background())
+	if code, report = serveReport(t, m.ReadyHandler); code != http.StatusOK || report.Status != "ready" {
+		t.Errorf("unexpected response once ready, code: %d, status: %q", code, report.Status)
+	}
+}
+
+// TestLiveHandler tests liveness only fails once the checks have stalled.
+func TestLiveHandler(t *testing.T) {
+	m := NewMonitor(health.NewServer(), 10*time.Millisecond, time.Millisecond,
+		Check{Name: "mongo", Run: func(ctx context.Context) error { return errors.New("unreachable") }},
+	)
+
+	m.CheckNow(context.Background())
+	if code, report := serveReport(t, m.LiveHandler); code != http.StatusOK || report.Status != "alive" {
+		t.Errorf("expected to be alive with a failing check, code: %d, status: %q", code, report.Status)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if code, report := serveReport(t, m.LiveHandler); code != http.StatusServiceUnavailable || report.Status != "checks stalled" {
+		t.Errorf("expected the checks to have stalled, code: %d, status: %q", code, report.Status)
+	}
+}
+
+// TestCheckTimeout tests a check which hangs is cut off after the timeout.
+func TestCheckTimeout(t *testing.T) {
+	m := NewMonitor(health.NewServer(), time.Hour, 10*time.Millisecond,
+		Check{Name: "mongo", Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	)
+
+	m.CheckNow(context.Background())
+	_, report := m.Ready()
+	if result := report.Checks[0]; result.Healthy || result.Error != context.DeadlineExceeded.Error() || result.LatencyMS < 10 {
+		t.Errorf("expected the check to time out, got: %+v", result)
+	}
+}
+
+// serveReport calls handler, decoding the report it writes
+func serveReport(t *testing.T, handler http.HandlerFunc) (int, Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode the report: %v", err)
+	}
+	return rec.Code, report
+}
@@ -0,0 +1,116 @@
+// Package logging sets up structured logging with log/slog, and carries the fields describing a request in its context.
+// Records logged with a request's context are tagged with its fields and trace, and anything sensitive is redacted.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Formats records can be written in
+const (
+	Text = "text"
+	JSON = "json"
+)
+
+// Redacted replaces the value of any sensitive field
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are the fields that are never logged, matched ignoring case
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"password_hash": true,
+	"email":         true,
+}
+
+// Level converts a -v verbosity to the lowest level logged. 0 logs info and above, every step up logs a level more, down to debug,
+// and every step down a level less, so -v=-1 only logs warnings and errors.
+func Level(verbosity int) slog.Level {
+	return slog.LevelInfo - slog.Level(4*verbosity)
+}
+
+// New creates a logger writing records in the given format to w, at the level given by verbosity
+func New(w io.Writer, format string, verbosity int) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: Level(verbosity), ReplaceAttr: redact}
+
+	var handler slog.Handler
+	switch format {
+	case Text:
+		handler = slog.NewTextHandler(w, opts)
+	case JSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected %q or %q", format, Text, JSON)
+	}
+	return slog.New(&contextHandler{handler}), nil
+}
+
+// redact hides the value of sensitive fields, wherever they're nested
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// scope holds the fields describing a request, more can be added as the request is handled
+type scope struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+type scopeKey struct{}
+
+// NewContext returns a context whose records are tagged with attrs, along with any fields ctx already has
+func NewContext(ctx context.Context, attrs ...slog.Attr) context.Context {
+	s := &scope{attrs: append(Attrs(ctx), attrs...)}
+	return context.WithValue(ctx, scopeKey{}, s)
+}
+
+// AddAttrs tags the records logged for the rest of ctx's request with attrs, such as the ID of the user it turns out to be about.
+// It does nothing for a context without a request scope.
+func AddAttrs(ctx context.Context, attrs ...slog.Attr) {
+	if s, ok := ctx.Value(scopeKey{}).(*scope); ok {
+		s.mu.Lock()
+		s.attrs = append(s.attrs, attrs...)
+		s.mu.Unlock()
+	}
+}
+
+// Attrs returns a copy of the fields ctx's records are tagged with
+func Attrs(ctx context.Context) []slog.Attr {
+	s, ok := ctx.Value(scopeKey{}).(*scope)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]slog.Attr(nil), s.attrs...)
+}
+
+// contextHandler tags records with the fields and trace of the context they're logged with
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(Attrs(ctx)...)
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		r.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()), slog.String("span_id", spanContext.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
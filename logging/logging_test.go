@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"userapi/requestid"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestLogger sets the default logger to write JSON records to the returned buffer, until the test ends
+func newTestLogger(t *testing.T, verbosity int) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger, err := New(&buf, JSON, verbosity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// records decodes every JSON record written to buf
+func records(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("failed to decode record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// TestLevel tests -v steps through the levels, from errors only up to debug.
+func TestLevel(t *testing.T) {
+	tests := []struct {
+		verbosity int
+		want      slog.Level
+	}{
+		{verbosity: -2, want: slog.LevelError},
+		{verbosity: -1, want: slog.LevelWarn},
+		{verbosity: 0, want: slog.LevelInfo},
+		{verbosity: 1, want: slog.LevelDebug},
+	}
+
+	for _, tt := range tests {
+		if got := Level(tt.verbosity); got != tt.want {
+			t.Errorf("expected -v=%d to log %v and above, got %v", tt.verbosity, tt.want, got)
+		}
+	}
+
+	if _, err := New(&bytes.Buffer{}, "xml", 0); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
+
+// TestRedaction tests passwords and emails are redacted, however they're nested.
+func TestRedaction(t *testing.T) {
+	buf := newTestLogger(t, 0)
+
+	slog.Info("test", "password", "moneyMoneyM0n3y", slog.Group("user", "Email", "Razzil.Darkbrew@example.com", "nickname", "Alchemist"))
+
+	out := buf.String()
+	if strings.Contains(out, "moneyMoneyM0n3y") || strings.Contains(out, "Razzil.Darkbrew@example.com") {
+		t.Errorf("expected the password and email to be redacted, got %s", out)
+	}
+	if !strings.Contains(out, "Alchemist") {
+		t.Errorf("expected the nickname to be logged, got %s", out)
+	}
+}
+
+// TestMiddleware tests records logged while handling a request carry its fields, including those added by the handler.
+func TestMiddleware(t *testing.T) {
+	buf := newTestLogger(t, 1)
+
+	handler := requestid.Middleware(Middleware("/userapi/update", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddAttrs(r.Context(), slog.String("user_id", "8711e364-c83d-46fc-a3db-d6b2aee00d0f"))
+		slog.ErrorContext(r.Context(), "update failed")
+		w.WriteHeader(http.StatusConflict)
+	})))
+
+	req := httptest.NewRequest(http.MethodPost, "/userapi/update", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	logged := records(t, buf)
+	if len(logged) != 2 {
+		t.Fatalf("expected the error and the request to be logged, got %v", logged)
+	}
+	for _, record := range logged {
+		if record["route"] != "/userapi/update" || record["request_id"] != "req-1" || record["user_id"] != "8711e364-c83d-46fc-a3db-d6b2aee00d0f" {
+			t.Errorf("expected the request's fields to be logged, got %v", record)
+		}
+	}
+	if logged[1]["msg"] != "request served" || logged[1]["status"] != float64(http.StatusConflict) {
+		t.Errorf("unexpected request record: %v", logged[1])
+	}
+}
+
+// TestUnaryServerInterceptor tests failed RPCs are logged with the request's fields, and successful ones only at debug level.
+func TestUnaryServerInterceptor(t *testing.T) {
+	buf := newTestLogger(t, 0)
+
+	ctx := requestid.NewContext(context.Background(), "req-2")
+	info := &grpc.UnaryServerInfo{FullMethod: "/userapi.UserService/AddUser"}
+	UnaryServerInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	UnaryServerInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.AlreadyExists, "a user with this username already exists")
+	})
+
+	logged := records(t, buf)
+	if len(logged) != 1 {
+		t.Fatalf("expected only the failed RPC to be logged, got %v", logged)
+	}
+	if logged[0]["rpc_method"] != info.FullMethod || logged[0]["request_id"] != "req-2" || logged[0]["code"] != "AlreadyExists" {
+		t.Errorf("unexpected record: %v", logged[0])
+	}
+}
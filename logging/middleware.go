@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"userapi/requestid"
+
+	"github.com/felixge/httpsnoop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Middleware tags the records logged while handling a request with its route, method, remote address and request ID,
+// and logs every request served at debug level. The response writer keeps the interfaces it had, so streaming still works.
+// The request ID is set by requestid.Middleware, which must run first.
+func Middleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := NewContext(r.Context(),
+			slog.String("route", route),
+			slog.String("method", r.Method),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("request_id", requestid.FromContext(r.Context())),
+		)
+
+		m := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+		slog.DebugContext(ctx, "request served", "status", m.Code, "duration", m.Duration, "bytes", m.Written)
+	})
+}
+
+// UnaryServerInterceptor tags the records logged while handling an RPC with its method, remote address and request ID
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx = newRPCContext(ctx, info.FullMethod)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logRPC(ctx, start, err)
+	return resp, err
+}
+
+// StreamServerInterceptor tags the records logged while handling a streaming RPC with its method, remote address and request ID
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := newRPCContext(ss.Context(), info.FullMethod)
+	start := time.Now()
+	err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	logRPC(ctx, start, err)
+	return err
+}
+
+// newRPCContext scopes ctx to the RPC being served, whose request ID is set by the requestid interceptors
+func newRPCContext(ctx context.Context, method string) context.Context {
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+
+	return NewContext(ctx,
+		slog.String("rpc_method", method),
+		slog.String("remote_addr", remoteAddr),
+		slog.String("request_id", requestid.FromContext(ctx)),
+	)
+}
+
+// logRPC logs a failed RPC as an error, and every other one at debug level
+func logRPC(ctx context.Context, start time.Time, err error) {
+	code := status.Code(err).String()
+	if err != nil {
+		slog.ErrorContext(ctx, "rpc failed", "code", code, "duration", time.Since(start), "error", err)
+		return
+	}
+	slog.DebugContext(ctx, "rpc served", "code", code, "duration", time.Since(start))
+}
+
+// serverStream carries the RPC's scoped context to its handler
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
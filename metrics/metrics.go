@@ -0,0 +1,150 @@
+// Package metrics holds the Prometheus metrics served at /metrics, along with the middleware recording requests as they're served.
+// Metrics are registered with the default registry, so the Go runtime and process metrics are served alongside them.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"userapi/broadcast"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "userapi"
+
+var (
+	// HTTPRequests counts HTTP requests by the route they were served by, their method and the status code returned
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	// HTTPDuration times HTTP requests, streamed responses are timed until the stream ends
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "How long HTTP requests took to serve, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	// GRPCRequests counts RPCs by their full method name, and the status code returned
+	GRPCRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grpc_requests_total",
+		Help:      "RPCs served, by method and status code.",
+	}, []string{"method", "code"})
+	// GRPCDuration times RPCs, streams are timed until they end
+	GRPCDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "How long RPCs took to serve, by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	// DBDuration times the calls made to mongo, by the db function making them and the collection operation called
+	DBDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "How long mongo operations took, by db function and operation.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"function", "operation"})
+	// DBErrors counts the calls made to mongo that failed, finding nothing isn't counted as a failure
+	DBErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_operation_errors_total",
+		Help:      "Mongo operations that failed, by db function and operation.",
+	}, []string{"function", "operation"})
+
+	// CacheHits and CacheMisses count cache lookups by store name, a miss loads the data
+	CacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "Cache lookups served from the cache, by store.",
+	}, []string{"store"})
+	CacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_misses_total",
+		Help:      "Cache lookups that had to load the data, by store.",
+	}, []string{"store"})
+	// CacheLoadDuration times loading data into a cache, including loads that fail
+	CacheLoadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cache_load_duration_seconds",
+		Help:      "How long loading data into the cache took, by store.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"store"})
+	// CacheSize is how many entries each store holds
+	CacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_entries",
+		Help:      "Entries held in the cache, by store.",
+	}, []string{"store"})
+)
+
+// RegisterWatchers reports how many watchers are connected, and the updates dropped for those that fell behind.
+// stats is read whenever metrics are scraped, it can only be registered once.
+func RegisterWatchers(stats func() broadcast.Stats) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "watch_subscribers",
+		Help:      "Watchers currently connected, over every transport.",
+	}, func() float64 {
+		return float64(stats().Subscribers)
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_updates_dropped_total",
+		Help:      "Updates dropped for watchers that fell behind, they catch up from the event log.",
+	}, func() float64 {
+		return float64(stats().Dropped)
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_disconnected_total",
+		Help:      "Watchers disconnected for falling behind.",
+	}, func() float64 {
+		return float64(stats().Disconnected)
+	})
+}
+
+// Handler serves every registered metric, in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// InstrumentHandler counts and times the requests served by handler, labelled with the route it's registered under.
+// The response writer keeps the interfaces it had, so streaming and WebSocket handlers still work.
+func InstrumentHandler(route string, handler http.Handler) http.Handler {
+	labels := prometheus.Labels{"route": route}
+	return promhttp.InstrumentHandlerCounter(HTTPRequests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(HTTPDuration.MustCurryWith(labels), handler))
+}
+
+// UnaryServerInterceptor counts and times every unary RPC
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+// StreamServerInterceptor counts and times every streaming RPC
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, start, err)
+	return err
+}
+
+// observeRPC records an RPC that has finished, labelled with the status code it returned
+func observeRPC(method string, start time.Time, err error) {
+	code := status.Code(err).String()
+	GRPCRequests.WithLabelValues(method, code).Inc()
+	GRPCDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+}
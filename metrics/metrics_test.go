@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestInstrumentHandler tests requests are counted by route, and streaming handlers can still flush.
+func TestInstrumentHandler(t *testing.T) {
+	handler := InstrumentHandler("/test/stream", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("expected the response writer to be a flusher")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/stream", nil))
+	}
+
+	if count := testutil.ToFloat64(HTTPRequests.WithLabelValues("/test/stream", "get", "202")); count != 2 {
+		t.Errorf("expected 2 requests counted, got %v", count)
+	}
+}
+
+// TestUnaryServerInterceptor tests RPCs are counted by the status code they returned.
+func TestUnaryServerInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Test"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+
+	if _, err := UnaryServerInterceptor(context.Background(), nil, info, handler); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected the handler's error to be returned, got %v", err)
+	}
+
+	if count := testutil.ToFloat64(GRPCRequests.WithLabelValues("/test.Service/Test", "NotFound")); count != 1 {
+		t.Errorf("expected 1 RPC counted, got %v", count)
+	}
+}
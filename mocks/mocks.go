@@ -16,6 +16,8 @@ type MongoCollection struct {
 	FindOneAndUpdateFunc func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
 	DeleteOneFunc        func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
 	DeleteManyFunc       func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	BulkWriteFunc        func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+	UpdateManyFunc       func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
 }
 
 // InsertOne mocks the InsertOne method of a MongoDB collection.
@@ -48,6 +50,16 @@ func (m *MongoCollection) DeleteMany(ctx context.Context, filter interface{}, op
 	return m.DeleteManyFunc(ctx, filter, opts...)
 }
 
+// BulkWrite mocks the BulkWrite method of a MongoDB collection.
+func (m *MongoCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	return m.BulkWriteFunc(ctx, models, opts...)
+}
+
+// UpdateMany mocks the UpdateMany method of a MongoDB collection.
+func (m *MongoCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return m.UpdateManyFunc(ctx, filter, update, opts...)
+}
+
 // MockCursor is a mock implementation of mongo.Cursor.
 // It is used to simulate the behavior of a MongoDB cursor for testing purposes.
 type MockCursor struct {
@@ -0,0 +1,147 @@
+// Package outbox relays the user events logged alongside every write, to everyone who needs to hear about them.
+// Events are only marked delivered once they have been relayed, so any left behind when the service stops are
+// relayed when it starts again, giving at-least-once delivery. Receivers can use the sequence to ignore repeats.
+//
+// Only one relay runs at a time across every instance, whichever holds the lease, so events are relayed in sequence order.
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+	"userapi/data"
+)
+
+// Config controls where a Relay finds events, and where it sends them
+type Config struct {
+	// Owner identifies this relay while it holds the lease
+	Owner string
+	// Interval is how often the relay looks for events, without being woken
+	Interval time.Duration
+	// Lease is how long the relay holds on to the lease for, it's renewed every time the relay looks for events
+	Lease time.Duration
+	// BatchSize is how many events are relayed before they are marked delivered
+	BatchSize int64
+	// Acquire takes or renews the lease, reporting false while another relay holds it
+	Acquire func(owner string, lease time.Duration) (bool, error)
+	// Pending lists up to limit events that haven't been delivered yet, oldest first
+	Pending func(limit int64) ([]data.UserEvent, error)
+	// Deliver relays an event, it's retried until it succeeds so must cope with seeing an event more than once
+	Deliver func(event data.UserEvent) error
+	// MarkDelivered records the events with the given sequences as delivered
+	MarkDelivered func(sequences []int64) error
+}
+
+// Stats counts what the relay has done, for metrics
+type Stats struct {
+	Leader    bool  `json:"leader"`
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+}
+
+// Relay delivers the events logged by every instance, while it holds the lease
+type Relay struct {
+	cfg  Config
+	wake chan struct{}
+
+	leader    atomic.Bool
+	delivered atomic.Int64
+	failed    atomic.Int64
+}
+
+// New creates a relay, which relays nothing until it's Run
+func New(cfg Config) *Relay {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.Lease < cfg.Interval {
+		cfg.Lease = 10 * cfg.Interval
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 100
+	}
+
+	return &Relay{cfg: cfg, wake: make(chan struct{}, 1)}
+}
+
+// Run relays events until ctx is done, every interval or whenever it's woken.
+// Once ctx is done it relays one last time, so the events logged by the last writes made aren't left until the service starts again.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.relay()
+
+		select {
+		case <-ctx.Done():
+			r.relay()
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// Wake has the relay look for events straight away, rather than waiting for the next interval.
+// It never blocks, wakes made while the relay is already busy are folded together.
+func (r *Relay) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stats reports whether the relay holds the lease, and counts the events it has delivered and failed to deliver
+func (r *Relay) Stats() Stats {
+	return Stats{
+		Leader:    r.leader.Load(),
+		Delivered: r.delivered.Load(),
+		Failed:    r.failed.Load(),
+	}
+}
+
+// relay delivers pending events in batches until there are none left, or one fails
+func (r *Relay) relay() {
+	leader, err := r.cfg.Acquire(r.cfg.Owner, r.cfg.Lease)
+	if err != nil {
+		slog.Error("outbox relay failed to acquire the lease", "error", err)
+	}
+	r.leader.Store(leader)
+	if !leader {
+		return
+	}
+
+	for {
+		events, err := r.cfg.Pending(r.cfg.BatchSize)
+		if err != nil {
+			slog.Error("outbox relay failed to list pending events", "error", err)
+			return
+		}
+
+		delivered := make([]int64, 0, len(events))
+		for _, event := range events {
+			// Stop at the first failure, so later events aren't delivered ahead of it
+			if err = r.cfg.Deliver(event); err != nil {
+				r.failed.Add(1)
+				slog.Error("outbox relay failed to deliver event, it will be retried", "sequence", event.Sequence, "error", err)
+				break
+			}
+			delivered = append(delivered, event.Sequence)
+		}
+
+		if len(delivered) > 0 {
+			// The events will be delivered again if they can't be marked, which receivers have to cope with anyway
+			if err := r.cfg.MarkDelivered(delivered); err != nil {
+				slog.Error("outbox relay failed to mark events delivered, they will be delivered again", "count", len(delivered), "error", err)
+				return
+			}
+			r.delivered.Add(int64(len(delivered)))
+		}
+
+		if err != nil || int64(len(events)) < r.cfg.BatchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"userapi/data"
+)
+
+// store is an in memory event log, with a lease that's held by whoever took it first
+type store struct {
+	mu        sync.Mutex
+	holder    string
+	events    []data.UserEvent
+	delivered map[int64]bool
+	failMark  bool
+	// looks counts the times pending events were listed
+	looks int
+}
+
+func newStore(count int) *store {
+	s := &store{delivered: map[int64]bool{}}
+	for i := 1; i <= count; i++ {
+		s.events = append(s.events, data.UserEvent{Sequence: int64(i)})
+	}
+	return s
+}
+
+func (s *store) acquire(owner string, lease time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holder == "" {
+		s.holder = owner
+	}
+	return s.holder == owner, nil
+}
+
+func (s *store) pending(limit int64) ([]data.UserEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.looks++
+	var events []data.UserEvent
+	for _, event := range s.events {
+		if !s.delivered[event.Sequence] && int64(len(events)) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (s *store) markDelivered(sequences []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failMark {
+		return errors.New("mock error")
+	}
+	for _, sequence := range sequences {
+		s.delivered[sequence] = true
+	}
+	return nil
+}
+
+func (s *store) relay(owner string, deliver func(event data.UserEvent) error) *Relay {
+	return New(Config{
+		Owner:         owner,
+		Interval:      time.Hour,
+		BatchSize:     2,
+		Acquire:       s.acquire,
+		Pending:       s.pending,
+		Deliver:       deliver,
+		MarkDelivered: s.markDelivered,
+	})
+}
+
+// TestRelay tests events are delivered in order, and retried from the first one that fails.
+func TestRelay(t *testing.T) {
+	s := newStore(5)
+
+	var delivered []int64
+	failOn := int64(4)
+	r := s.relay("instance-1", func(event data.UserEvent) error {
+		if event.Sequence == failOn {
+			return errors.New("mock error")
+		}
+		delivered = append(delivered, event.Sequence)
+		return nil
+	})
+
+	// Batches carry on until one fails
+	r.relay()
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(delivered, want) {
+		t.Fatalf("unexpected deliveries, want: %v, got: %v", want, delivered)
+	}
+
+	// The failed event is tried again, ahead of the rest
+	failOn = 0
+	r.relay()
+	if want := []int64{1, 2, 3, 4, 5}; !reflect.DeepEqual(delivered, want) {
+		t.Fatalf("unexpected deliveries, want: %v, got: %v", want, delivered)
+	}
+
+	want := Stats{Leader: true, Delivered: 5, Failed: 1}
+	if stats := r.Stats(); stats != want {
+		t.Errorf("unexpected stats, want: %+v, got: %+v", want, stats)
+	}
+}
+
+// TestRelayRedelivers tests events are delivered again, when they couldn't be marked delivered.
+func TestRelayRedelivers(t *testing.T) {
+	s := newStore(1)
+	s.failMark = true
+
+	deliveries := 0
+	r := s.relay("instance-1", func(event data.UserEvent) error {
+		deliveries++
+		return nil
+	})
+
+	r.relay()
+	s.failMark = false
+	r.relay()
+	r.relay()
+
+	if deliveries != 2 {
+		t.Errorf("expected the event to be delivered twice, got %d", deliveries)
+	}
+}
+
+// TestRelayLease tests only the relay holding the lease delivers events.
+func TestRelayLease(t *testing.T) {
+	s := newStore(3)
+	s.holder = "instance-1"
+
+	delivered := 0
+	r := s.relay("instance-2", func(event data.UserEvent) error {
+		delivered++
+		return nil
+	})
+
+	r.relay()
+	if delivered != 0 || r.Stats().Leader {
+		t.Errorf("a relay without the lease shouldn't deliver, delivered %d", delivered)
+	}
+
+	// Once the lease is free, it takes over
+	s.holder = ""
+	r.relay()
+	if delivered != 3 || !r.Stats().Leader {
+		t.Errorf("expected the relay to take over, delivered %d", delivered)
+	}
+}
+
+// TestRelayWake tests a running relay delivers events as soon as it's woken.
+func TestRelayWake(t *testing.T) {
+	s := newStore(0)
+
+	delivered := make(chan int64, 10)
+	r := s.relay("instance-1", func(event data.UserEvent) error {
+		delivered <- event.Sequence
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go r.Run(ctx)
+
+	for i := int64(1); i <= 3; i++ {
+		s.mu.Lock()
+		s.events = append(s.events, data.UserEvent{Sequence: i})
+		s.mu.Unlock()
+		r.Wake()
+
+		select {
+		case sequence := <-delivered:
+			if sequence != i {
+				t.Errorf("unexpected delivery, want: %d, got: %d", i, sequence)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+}
+
+// TestRelayStop tests a relay delivers the events logged since it last looked, when it's stopped.
+func TestRelayStop(t *testing.T) {
+	s := newStore(0)
+
+	var mu sync.Mutex
+	var delivered []int64
+	r := s.relay("instance-1", func(event data.UserEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, event.Sequence)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(stopped)
+	}()
+
+	// Logged after the relay's first look, with the next not due for an hour
+	waitForLook(t, s)
+	s.mu.Lock()
+	s.events = append(s.events, data.UserEvent{Sequence: 1})
+	s.mu.Unlock()
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay didn't stop")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(delivered, []int64{1}) {
+		t.Errorf("unexpected deliveries, want: [1], got: %v", delivered)
+	}
+}
+
+// waitForLook waits for a relay to have listed the pending events
+func waitForLook(t *testing.T, s *store) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		looks := s.looks
+		s.mu.Unlock()
+		if looks > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relay never looked for events")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
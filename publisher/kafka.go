@@ -0,0 +1,56 @@
+package publisher
+
+import (
+	"context"
+	"time"
+	"userapi/pb"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka publishes updates to a Kafka topic, partitioned by the user's ID
+type Kafka struct {
+	topic    string
+	encoding Encoding
+	writer   *kafka.Writer
+}
+
+// NewKafka creates a publisher for the topic on the given brokers, connections are made as updates are published
+func NewKafka(brokers []string, topic string, encoding Encoding) *Kafka {
+	return &Kafka{
+		topic:    topic,
+		encoding: encoding,
+		writer: &kafka.Writer{
+			Addr:  kafka.TCP(brokers...),
+			Topic: topic,
+			// Updates to the same user go to the same partition, so they're consumed in order
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// Updates are published one at a time, so don't hold them back waiting for a batch to fill
+			BatchTimeout: 10 * time.Millisecond,
+		},
+	}
+}
+
+// Publish writes the update to the topic, returning once every in-sync replica has it
+func (k *Kafka) Publish(ctx context.Context, update *pb.UserUpdate) error {
+	message, err := newMessage(k.topic, k.encoding, update)
+	if err != nil {
+		return err
+	}
+	return k.writer.WriteMessages(ctx, kafkaMessage(message))
+}
+
+// Close flushes any pending writes, and closes the connections to the brokers
+func (k *Kafka) Close() error {
+	return k.writer.Close()
+}
+
+// kafkaMessage converts a message to Kafka's, the topic is set by the writer
+func kafkaMessage(message Message) kafka.Message {
+	return kafka.Message{
+		Key:     []byte(message.Key),
+		Value:   message.Value,
+		Headers: []kafka.Header{{Key: ContentTypeHeader, Value: []byte(message.ContentType)}},
+	}
+}
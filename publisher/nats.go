@@ -0,0 +1,55 @@
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"userapi/pb"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS publishes updates to a NATS subject.
+// NATS has no message keys, so the user's ID is sent in the KeyHeader, and the sequence as the message ID so JetStream streams drop repeats.
+type NATS struct {
+	subject  string
+	encoding Encoding
+	conn     *nats.Conn
+}
+
+// NewNATS connects to the NATS server at url, to publish updates to the subject
+func NewNATS(url, subject string, encoding Encoding) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("userapi"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS at %s: %w", url, err)
+	}
+	return &NATS{subject: subject, encoding: encoding, conn: conn}, nil
+}
+
+// Publish sends the update to the subject, returning once the server has it
+func (n *NATS) Publish(ctx context.Context, update *pb.UserUpdate) error {
+	message, err := newMessage(n.subject, n.encoding, update)
+	if err != nil {
+		return err
+	}
+	if err := n.conn.PublishMsg(natsMessage(message, update.Sequence)); err != nil {
+		return err
+	}
+	// Publishing only buffers the message, a round trip to the server makes sure it arrived
+	return n.conn.FlushWithContext(ctx)
+}
+
+// Close sends any buffered messages, and closes the connection
+func (n *NATS) Close() error {
+	return n.conn.Drain()
+}
+
+// natsMessage converts a message to NATS's
+func natsMessage(message Message, sequence int64) *nats.Msg {
+	msg := nats.NewMsg(message.Topic)
+	msg.Data = message.Value
+	msg.Header.Set(ContentTypeHeader, message.ContentType)
+	msg.Header.Set(KeyHeader, message.Key)
+	msg.Header.Set(nats.MsgIdHdr, strconv.FormatInt(sequence, 10))
+	return msg
+}
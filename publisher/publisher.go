@@ -0,0 +1,141 @@
+// Package publisher publishes user updates to a message broker, for the services consuming them from our bus rather than watching over gRPC.
+// Every update is published as a pb.UserUpdate, encoded as protobuf or JSON, and keyed by the user's ID so updates to the same user stay in order.
+//
+// Updates are published at least once, consumers can use the update's sequence to ignore repeats.
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"userapi/pb"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Headers sent with every message, brokers without message keys get the key as a header instead
+const (
+	ContentTypeHeader = "Content-Type"
+	KeyHeader         = "Userapi-Key"
+)
+
+// Publisher sends user updates to a message broker
+type Publisher interface {
+	// Publish sends the update, returning once the broker has it
+	Publish(ctx context.Context, update *pb.UserUpdate) error
+	// Close releases the connection to the broker
+	Close() error
+}
+
+// Encoding is how updates are encoded in messages
+type Encoding int
+
+const (
+	// Protobuf encodes updates in protobuf's binary wire format
+	Protobuf Encoding = iota
+	// JSON encodes updates as protobuf JSON
+	JSON
+)
+
+// ParseEncoding parses an encoding from its name, protobuf or json
+func ParseEncoding(name string) (Encoding, error) {
+	switch name {
+	case "protobuf":
+		return Protobuf, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, fmt.Errorf("unknown publisher encoding %q, expected protobuf or json", name)
+}
+
+// String returns the encoding's name, as understood by ParseEncoding
+func (e Encoding) String() string {
+	if e == JSON {
+		return "json"
+	}
+	return "protobuf"
+}
+
+// ContentType is the MIME type of updates in this encoding
+func (e Encoding) ContentType() string {
+	if e == JSON {
+		return "application/json"
+	}
+	return "application/x-protobuf"
+}
+
+// Encode encodes the update
+func (e Encoding) Encode(update *pb.UserUpdate) ([]byte, error) {
+	if e == JSON {
+		return protojson.Marshal(update)
+	}
+	return proto.Marshal(update)
+}
+
+// Message is an update as it's sent to the broker
+type Message struct {
+	Topic       string
+	Key         string
+	ContentType string
+	Value       []byte
+}
+
+// newMessage encodes the update, keyed by the user's ID
+func newMessage(topic string, encoding Encoding, update *pb.UserUpdate) (Message, error) {
+	value, err := encoding.Encode(update)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to encode update %d: %w", update.Sequence, err)
+	}
+	return Message{Topic: topic, Key: update.UserId, ContentType: encoding.ContentType(), Value: value}, nil
+}
+
+// Memory keeps every message it's given, for tests
+type Memory struct {
+	topic    string
+	encoding Encoding
+
+	mu       sync.Mutex
+	messages []Message
+	err      error
+}
+
+// NewMemory creates an in memory publisher, encoding updates as they would be for a broker
+func NewMemory(topic string, encoding Encoding) *Memory {
+	return &Memory{topic: topic, encoding: encoding}
+}
+
+// Publish keeps the update, unless FailWith has set an error to return instead
+func (m *Memory) Publish(ctx context.Context, update *pb.UserUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+
+	message, err := newMessage(m.topic, m.encoding, update)
+	if err != nil {
+		return err
+	}
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// FailWith has every Publish return err, until it's called again with nil
+func (m *Memory) FailWith(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+// Messages lists every message published so far, oldest first
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Close does nothing, messages are kept after closing
+func (m *Memory) Close() error {
+	return nil
+}
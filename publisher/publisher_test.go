@@ -0,0 +1,113 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"userapi/pb"
+
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var testUpdate = &pb.UserUpdate{
+	UserId:     "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+	UpdateType: "UPDATED",
+	User:       &pb.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Meepo", Version: 2},
+	Sequence:   42,
+}
+
+// TestEncoding tests updates decode back to what was published, in either encoding.
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		unmarshal   func(b []byte, m proto.Message) error
+	}{
+		{name: "protobuf", contentType: "application/x-protobuf", unmarshal: proto.Unmarshal},
+		{name: "json", contentType: "application/json", unmarshal: protojson.Unmarshal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoding, err := ParseEncoding(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding.String() != tt.name || encoding.ContentType() != tt.contentType {
+				t.Errorf("unexpected encoding %q with content type %q", encoding, encoding.ContentType())
+			}
+
+			value, err := encoding.Encode(testUpdate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := &pb.UserUpdate{}
+			if err := tt.unmarshal(value, decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(decoded, testUpdate) {
+				t.Errorf("unexpected update decoded, want: %v, got: %v", testUpdate, decoded)
+			}
+		})
+	}
+
+	if _, err := ParseEncoding("avro"); err == nil {
+		t.Error("expected an unknown encoding to fail")
+	}
+}
+
+// TestMemory tests messages are keyed by user ID, and kept in order.
+func TestMemory(t *testing.T) {
+	m := NewMemory("user.updates", JSON)
+
+	m.FailWith(errors.New("mock error"))
+	if err := m.Publish(context.Background(), testUpdate); err == nil {
+		t.Fatal("expected Publish to fail")
+	}
+	m.FailWith(nil)
+
+	second := proto.Clone(testUpdate).(*pb.UserUpdate)
+	second.UserId, second.Sequence = "0d0f9944-d902-4db1-b83b-6b25a61f89e2", 43
+	for _, update := range []*pb.UserUpdate{testUpdate, second} {
+		if err := m.Publish(context.Background(), update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages := m.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	for i, update := range []*pb.UserUpdate{testUpdate, second} {
+		if messages[i].Topic != "user.updates" || messages[i].Key != update.UserId || messages[i].ContentType != "application/json" {
+			t.Errorf("unexpected message %d: %+v", i, messages[i])
+		}
+	}
+}
+
+// TestBrokerMessages tests messages carry their key and content type, in whatever way each broker supports.
+func TestBrokerMessages(t *testing.T) {
+	message, err := newMessage("user.updates", Protobuf, testUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	km := kafkaMessage(message)
+	if string(km.Key) != testUpdate.UserId || !bytes.Equal(km.Value, message.Value) {
+		t.Errorf("unexpected kafka message: %+v", km)
+	}
+	if len(km.Headers) != 1 || km.Headers[0].Key != ContentTypeHeader || string(km.Headers[0].Value) != "application/x-protobuf" {
+		t.Errorf("unexpected kafka headers: %+v", km.Headers)
+	}
+
+	nm := natsMessage(message, testUpdate.Sequence)
+	if nm.Subject != "user.updates" || !bytes.Equal(nm.Data, message.Value) {
+		t.Errorf("unexpected nats message: %+v", nm)
+	}
+	if nm.Header.Get(KeyHeader) != testUpdate.UserId || nm.Header.Get(ContentTypeHeader) != "application/x-protobuf" || nm.Header.Get(nats.MsgIdHdr) != "42" {
+		t.Errorf("unexpected nats headers: %v", nm.Header)
+	}
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// sweepInterval is how often idle buckets are dropped from a MemoryStore
+	sweepInterval = time.Minute
+	// DefaultMaxBuckets caps how many buckets a MemoryStore holds, unless it's given its own cap
+	DefaultMaxBuckets = 100_000
+)
+
+// MemoryStore keeps buckets in memory, limiting clients of this instance only.
+// Once it holds its most buckets, the one taken from least recently is dropped for each new one, so a flood of clients
+// can't exhaust memory. A dropped client starts again with a full bucket.
+type MemoryStore struct {
+	// now is stubbed in tests
+	now        func() time.Time
+	maxBuckets int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// recent orders the buckets by when they were last taken from, most recent first
+	recent    *list.List
+	lastSweep time.Time
+}
+
+// bucket holds the tokens left, as of when it was last taken from
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled, after which it's the same as a new one and can be dropped
+	full time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store, holding up to maxBuckets buckets, or DefaultMaxBuckets if it's 0
+func NewMemoryStore(maxBuckets int) *MemoryStore {
+	if maxBuckets <= 0 {
+		maxBuckets = DefaultMaxBuckets
+	}
+	return &MemoryStore{now: time.Now, maxBuckets: maxBuckets, buckets: make(map[string]*list.Element), recent: list.New()}
+}
+
+// Take takes a token from key's bucket, refilling it for the time since it was last taken from
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	var b *bucket
+	if element, ok := s.buckets[key]; ok {
+		b = element.Value.(*bucket)
+		s.recent.MoveToFront(element)
+	} else {
+		if len(s.buckets) >= s.maxBuckets {
+			s.remove(s.recent.Back())
+		}
+		b = &bucket{key: key, tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = s.recent.PushFront(b)
+	}
+
+	b.tokens = min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), nil
+	}
+
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second)))
+	return true, 0, nil
+}
+
+// Len returns how many buckets are held
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// sweep drops the buckets that have refilled, so clients that have gone away don't build up
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for _, element := range s.buckets {
+		if !now.Before(element.Value.(*bucket).full) {
+			s.remove(element)
+		}
+	}
+}
+
+// remove drops a bucket
+func (s *MemoryStore) remove(element *list.Element) {
+	delete(s.buckets, element.Value.(*bucket).key)
+	s.recent.Remove(element)
+}
@@ -0,0 +1,188 @@
+// Package ratelimit limits how often each client can call each route or RPC, with a token bucket per client and route.
+// Clients identified by auth share a bucket wherever they call from, anyone else is limited by IP.
+// Clients are told when to retry, with a 429 and Retry-After header over HTTP, or ResourceExhausted and retry-after metadata over gRPC.
+// Buckets are kept in a Store, in memory for a single instance, or shared between instances by implementing Store over Redis or similar.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"userapi/auth"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RetryAfterMetadataKey tells a gRPC client how many seconds to wait, as the Retry-After header does over HTTP
+const RetryAfterMetadataKey = "retry-after"
+
+// Limit is how many requests a second a client's bucket refills by, and how many it holds, so how many can be made at once.
+// A zero Rate is unlimited.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited lets every request through
+var Unlimited = Limit{}
+
+// ParseLimit parses a limit written as rate:burst, such as "10:20" for 10 requests a second in bursts of up to 20.
+// "0" is unlimited, and the burst defaults to the rate rounded up.
+func ParseLimit(s string) (Limit, error) {
+	rateText, burstText, hasBurst := strings.Cut(strings.TrimSpace(s), ":")
+	rate, err := strconv.ParseFloat(rateText, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, expected rate:burst", s)
+	}
+	if rate == 0 {
+		return Unlimited, nil
+	}
+
+	burst := int(math.Ceil(rate))
+	if hasBurst {
+		if burst, err = strconv.Atoi(burstText); err != nil || burst < 1 {
+			return Limit{}, fmt.Errorf("invalid rate limit %q, the burst must be at least 1", s)
+		}
+	}
+	return Limit{Rate: rate, Burst: burst}, nil
+}
+
+// ParseRoutes parses comma separated route=rate:burst limits, routes are HTTP paths or full gRPC method names
+func ParseRoutes(s string) (map[string]Limit, error) {
+	routes := make(map[string]Limit)
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		route, limitText, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(route) == "" {
+			return nil, fmt.Errorf("invalid route rate limit %q, expected route=rate:burst", entry)
+		}
+		limit, err := ParseLimit(limitText)
+		if err != nil {
+			return nil, err
+		}
+		routes[strings.TrimSpace(route)] = limit
+	}
+	return routes, nil
+}
+
+// Store keeps the token buckets, taking a token from a key's bucket if it has one
+type Store interface {
+	// Take takes a token from key's bucket, creating it full if it doesn't exist.
+	// If the bucket's empty, it returns false and how long until it next has a token.
+	Take(ctx context.Context, key string, limit Limit) (ok bool, retryAfter time.Duration, err error)
+}
+
+// Limiter limits requests by route and client, with a default limit for routes that don't have their own
+type Limiter struct {
+	store  Store
+	limit  Limit
+	routes map[string]Limit
+}
+
+// NewLimiter creates a limiter keeping its buckets in store
+func NewLimiter(store Store, defaultLimit Limit, routes map[string]Limit) *Limiter {
+	return &Limiter{store: store, limit: defaultLimit, routes: routes}
+}
+
+// Limit returns the limit for a route
+func (l *Limiter) Limit(route string) Limit {
+	if limit, ok := l.routes[route]; ok {
+		return limit
+	}
+	return l.limit
+}
+
+// allow takes a token from the client's bucket for the route. If the store fails, the request is let through,
+// rather than failing every request for as long as it's down.
+func (l *Limiter) allow(ctx context.Context, route, client string) (bool, time.Duration) {
+	limit := l.Limit(route)
+	if limit.Rate == 0 {
+		return true, 0
+	}
+
+	ok, retryAfter, err := l.store.Take(ctx, route+" "+client, limit)
+	if err != nil {
+		slog.WarnContext(ctx, "rate limit store failed, letting the request through", "route", route, "error", err)
+		return true, 0
+	}
+	return ok, retryAfter
+}
+
+// Middleware rejects requests over the route's limit with a 429, and a Retry-After header in whole seconds
+func (l *Limiter) Middleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := l.allow(r.Context(), route, httpClient(r)); !ok {
+			w.Header().Set("Retry-After", retrySeconds(retryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UnaryServerInterceptor rejects RPCs over the method's limit with ResourceExhausted, and retry-after header metadata
+func (l *Limiter) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if ok, retryAfter := l.allow(ctx, info.FullMethod, grpcClient(ctx)); !ok {
+		grpc.SetHeader(ctx, metadata.Pairs(RetryAfterMetadataKey, retrySeconds(retryAfter)))
+		return nil, exhausted(retryAfter)
+	}
+	return handler(ctx, req)
+}
+
+// StreamServerInterceptor rejects streams opened over the method's limit, a stream that's open isn't limited
+func (l *Limiter) StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if ok, retryAfter := l.allow(ss.Context(), info.FullMethod, grpcClient(ss.Context())); !ok {
+		ss.SetHeader(metadata.Pairs(RetryAfterMetadataKey, retrySeconds(retryAfter)))
+		return exhausted(retryAfter)
+	}
+	return handler(srv, ss)
+}
+
+// exhausted is the error returned to gRPC clients over their limit
+func exhausted(retryAfter time.Duration) error {
+	return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %ss", retrySeconds(retryAfter))
+}
+
+// retrySeconds rounds the wait up to whole seconds, as Retry-After doesn't allow fractions, so at least 1
+func retrySeconds(retryAfter time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// httpClient identifies the client by who auth says it is, or its IP for anonymous requests
+func httpClient(r *http.Request) string {
+	if client, ok := auth.FromContext(r.Context()); ok {
+		return "client:" + client.Name
+	}
+	return ipClient(r.RemoteAddr)
+}
+
+// grpcClient identifies the client by who auth says it is, or its IP for anonymous RPCs
+func grpcClient(ctx context.Context) string {
+	if client, ok := auth.FromContext(ctx); ok {
+		return "client:" + client.Name
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return ipClient(p.Addr.String())
+	}
+	return ipClient("")
+}
+
+// ipClient drops the port, so every connection from an IP shares its bucket
+func ipClient(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "ip:" + addr
+}
@@ -0,0 +1,244 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"userapi/auth"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TestParseLimit tests limits are parsed from rate:burst, with the burst defaulting to the rate
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected Limit
+		wantErr  bool
+	}{
+		{name: "Rate and burst", text: "10:20", expected: Limit{Rate: 10, Burst: 20}},
+		{name: "Rate only", text: "2.5", expected: Limit{Rate: 2.5, Burst: 3}},
+		{name: "Unlimited", text: "0", expected: Unlimited},
+		{name: "Negative rate", text: "-1:5", wantErr: true},
+		{name: "No burst", text: "1:0", wantErr: true},
+		{name: "Not a number", text: "fast", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, err := ParseLimit(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if limit != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, limit)
+			}
+		})
+	}
+}
+
+// TestParseRoutes tests per route limits are parsed, and malformed entries rejected
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes("/userapi/add=5:10, /user.UserService/AddUser=5:10,/healthz=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 3 || routes["/userapi/add"] != (Limit{Rate: 5, Burst: 10}) || routes["/healthz"] != Unlimited {
+		t.Errorf("unexpected routes %+v", routes)
+	}
+
+	if _, err := ParseRoutes("/userapi/add"); err == nil {
+		t.Error("expected an error for a route without a limit")
+	}
+}
+
+// TestMemoryStore tests a bucket allows its burst, then refills at its rate, and idle buckets are dropped
+func TestMemoryStore(t *testing.T) {
+	now := time.Date(2024, 6, 17, 19, 0, 0, 0, time.UTC)
+	store := NewMemoryStore(0)
+	store.now = func() time.Time { return now }
+	limit := Limit{Rate: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := store.Take(context.Background(), "client", limit); !ok {
+			t.Fatalf("expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, retryAfter, _ := store.Take(context.Background(), "client", limit)
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Fatalf("expected the bucket to be empty for 500ms, got %t, %s", ok, retryAfter)
+	}
+
+	if ok, _, _ := store.Take(context.Background(), "other", limit); !ok {
+		t.Error("expected another client's bucket to be separate")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _, _ := store.Take(context.Background(), "client", limit); !ok {
+		t.Error("expected a token to have refilled")
+	}
+
+	now = now.Add(sweepInterval)
+	store.Take(context.Background(), "new", limit)
+	if store.Len() != 1 {
+		t.Errorf("expected refilled buckets to be swept, %d left", store.Len())
+	}
+}
+
+// TestMiddleware tests clients over their limit get a 429 with Retry-After, keyed by client or IP
+func TestMiddleware(t *testing.T) {
+	limiter := NewLimiter(NewMemoryStore(0), Limit{Rate: 1, Burst: 1}, map[string]Limit{"/healthz": Unlimited})
+	handler := func(route string) http.Handler {
+		return testKeys.Middleware(limiter.Middleware(route, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	}
+	serve := func(route, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, route, nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set(auth.APIKeyHeader, apiKey)
+		}
+		rr := httptest.NewRecorder()
+		handler(route).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve("/userapi/add", "192.0.2.10:52100", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected the first request to be allowed, got %d", rr.Code)
+	}
+
+	rr := serve("/userapi/add", "192.0.2.10:52101", "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected another connection from the same IP to be limited, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After 1, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	if rr := serve("/userapi/add", "192.0.2.10:52102", "key-1"); rr.Code != http.StatusOK {
+		t.Errorf("expected a known API key to have its own bucket, got %d", rr.Code)
+	}
+	if rr := serve("/userapi/add", "198.51.100.7:40000", "key-1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a client's bucket to be shared wherever it calls from, got %d", rr.Code)
+	}
+	if rr := serve("/userapi/get", "192.0.2.10:52103", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected every route to have its own bucket, got %d", rr.Code)
+	}
+	for i := 0; i < 5; i++ {
+		if rr := serve("/healthz", "192.0.2.10:52104", ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected an unlimited route to allow every request, got %d", rr.Code)
+		}
+	}
+}
+
+// TestUnaryServerInterceptor tests RPCs over their limit fail with ResourceExhausted
+func TestUnaryServerInterceptor(t *testing.T) {
+	limiter := NewLimiter(NewMemoryStore(0), Limit{Rate: 1, Burst: 1}, nil)
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/AddUser"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 52100}})
+	if _, err := limiter.UnaryServerInterceptor(ctx, nil, info, handler); err != nil {
+		t.Fatalf("expected the first RPC to be allowed, got %v", err)
+	}
+	if _, err := limiter.UnaryServerInterceptor(ctx, nil, info, handler); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted, got %v", err)
+	}
+
+	limited := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return testKeys.UnaryServerInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return limiter.UnaryServerInterceptor(ctx, req, info, handler)
+		})
+	}
+	keyed := metadata.NewIncomingContext(ctx, metadata.Pairs(auth.APIKeyMetadataKey, "key-1"))
+	if _, err := limited(keyed, nil, info, handler); err != nil {
+		t.Errorf("expected a known API key to have its own bucket, got %v", err)
+	}
+	unknown := metadata.NewIncomingContext(ctx, metadata.Pairs(auth.APIKeyMetadataKey, "made-up"))
+	if _, err := limited(unknown, nil, info, handler); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected an unknown API key to share its IP's bucket, got %v", err)
+	}
+}
+
+// TestRotatingAPIKeys tests a client can't dodge its limit by sending a new made up API key with every request,
+// and that doing so doesn't build up buckets
+func TestRotatingAPIKeys(t *testing.T) {
+	store := NewMemoryStore(0)
+	limiter := NewLimiter(store, Limit{Rate: 1, Burst: 1}, nil)
+	handler := testKeys.Middleware(limiter.Middleware("/userapi/add", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	responses := map[int]int{}
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/userapi/add", nil)
+		req.RemoteAddr = "192.0.2.10:52100"
+		req.Header.Set(auth.APIKeyHeader, fmt.Sprintf("random-%d", i))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		responses[rr.Code]++
+	}
+
+	if responses[http.StatusOK] != 1 || responses[http.StatusTooManyRequests] != 9 {
+		t.Errorf("expected every request after the first to be limited, got %v", responses)
+	}
+	if store.Len() != 1 {
+		t.Errorf("expected a single bucket for the IP, got %d", store.Len())
+	}
+}
+
+// TestMemoryStoreCap tests the least recently used bucket is dropped for a new one, once the store is full
+func TestMemoryStoreCap(t *testing.T) {
+	store := NewMemoryStore(2)
+	limit := Limit{Rate: 1, Burst: 1}
+	ctx := context.Background()
+
+	store.Take(ctx, "a", limit)
+	store.Take(ctx, "b", limit)
+	// a is now the most recently used, so b goes
+	store.Take(ctx, "a", limit)
+	store.Take(ctx, "c", limit)
+
+	if store.Len() != 2 {
+		t.Fatalf("expected the store to hold 2 buckets, got %d", store.Len())
+	}
+	if ok, _, _ := store.Take(ctx, "a", limit); ok {
+		t.Error("expected a's empty bucket to have been kept")
+	}
+	if ok, _, _ := store.Take(ctx, "b", limit); !ok {
+		t.Error("expected b's bucket to have been dropped, starting again full")
+	}
+}
+
+// testKeys identifies the client with key-1
+var testKeys = func() *auth.Keys {
+	keys, err := auth.ParseKeys(strings.NewReader("client-1:key-1"))
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}()
+
+// TestStoreFailure tests requests are let through when the store fails
+func TestStoreFailure(t *testing.T) {
+	limiter := NewLimiter(failingStore{}, Limit{Rate: 1, Burst: 1}, nil)
+	ok, _ := limiter.allow(context.Background(), "/userapi/add", "ip:192.0.2.10")
+	if !ok {
+		t.Error("expected the request to be let through")
+	}
+}
+
+// failingStore is a store that's down
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	return false, 0, errors.New("connection refused")
+}
@@ -0,0 +1,106 @@
+// Package requestid gives every request an ID, tying together what a client saw with our logs, audit entries and the updates it caused.
+// A client can send its own ID in the X-Request-ID header, or x-request-id gRPC metadata, otherwise one is generated.
+// Either way it's echoed back in the response.
+package requestid
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// Header carries the request ID over HTTP
+	Header = "X-Request-ID"
+	// MetadataKey carries the request ID over gRPC
+	MetadataKey = "x-request-id"
+	// MaxLength caps the IDs accepted from clients, longer ones are replaced
+	MaxLength = 128
+)
+
+// New generates a request ID, it can be stubbed in tests
+var New = uuid.NewString
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the ID of the request ctx belongs to, or "" outside of a request
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// valid reports whether a client's request ID is safe to log and echo back, printable ASCII without spaces
+func valid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// accept returns the client's request ID if it's valid, or a new one
+func accept(id string) string {
+	if valid(id) {
+		return id
+	}
+	return New()
+}
+
+// Middleware gives the request an ID, putting it in the request's context and the response's X-Request-ID header
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := accept(r.Header.Get(Header))
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// UnaryServerInterceptor gives the RPC an ID, putting it in the RPC's context and the response's x-request-id header metadata
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := accept(fromMetadata(ctx))
+	if err := grpc.SetHeader(ctx, metadata.Pairs(MetadataKey, id)); err != nil {
+		return nil, err
+	}
+	return handler(NewContext(ctx, id), req)
+}
+
+// StreamServerInterceptor gives the streaming RPC an ID, putting it in the stream's context and its x-request-id header metadata
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id := accept(fromMetadata(ss.Context()))
+	if err := ss.SetHeader(metadata.Pairs(MetadataKey, id)); err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ServerStream: ss, ctx: NewContext(ss.Context(), id)})
+}
+
+// fromMetadata reads the request ID sent by the client, if there is one
+func fromMetadata(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(MetadataKey); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// serverStream carries the stream's request ID to its handler
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
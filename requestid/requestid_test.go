@@ -0,0 +1,93 @@
+package requestid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// TestMiddleware tests a client's request ID is kept and echoed, and replaced when it's missing or unsafe.
+func TestMiddleware(t *testing.T) {
+	New = func() string { return "generated" }
+	defer func() { New = defaultNew }()
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "Client ID", header: "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10", want: "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10"},
+		{name: "Missing", want: "generated"},
+		{name: "Spaces", header: "not an id", want: "generated"},
+		{name: "Too long", header: strings.Repeat("a", MaxLength+1), want: "generated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = FromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/userapi/getall", nil)
+			if tt.header != "" {
+				req.Header.Set(Header, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if got != tt.want {
+				t.Errorf("expected request ID %q in the context, got %q", tt.want, got)
+			}
+			if echoed := rr.Header().Get(Header); echoed != tt.want {
+				t.Errorf("expected request ID %q to be echoed, got %q", tt.want, echoed)
+			}
+		})
+	}
+}
+
+// TestStreamServerInterceptor tests a stream's request ID is read from its metadata, and sent back in its header.
+func TestStreamServerInterceptor(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetadataKey, "req-1"))
+	stream := &testStream{ctx: ctx}
+
+	var got string
+	err := StreamServerInterceptor(nil, stream, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+		got = FromContext(ss.Context())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "req-1" {
+		t.Errorf("expected request ID %q in the context, got %q", "req-1", got)
+	}
+	if echoed := stream.header.Get(MetadataKey); len(echoed) != 1 || echoed[0] != "req-1" {
+		t.Errorf("expected the request ID to be sent back, got %v", echoed)
+	}
+}
+
+// defaultNew is the generator tests restore once they've stubbed it
+var defaultNew = New
+
+// testStream records the header set on it
+type testStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	header metadata.MD
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
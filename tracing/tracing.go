@@ -0,0 +1,90 @@
+// Package tracing sets up OpenTelemetry tracing, and the helpers used to start and end spans.
+// Trace context is propagated in the W3C traceparent and tracestate headers, over both HTTP and gRPC.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName names the service, and the tracer its spans are started with
+const ServiceName = "userapi"
+
+// Exporters that spans can be sent to
+const (
+	// None records no spans, trace context is still propagated to the services called
+	None = "none"
+	// OTLP sends spans to an OpenTelemetry collector over gRPC
+	OTLP = "otlp"
+)
+
+// Init sets the global tracer provider to export spans with the named exporter, and the W3C trace context propagator.
+// endpoint is the collector's host:port, empty for the exporter's default of localhost:4317.
+// The returned shutdown flushes any spans not yet exported, and should be called before exiting.
+func Init(ctx context.Context, exporter, endpoint string) (shutdown func(context.Context) error, err error) {
+	setPropagator()
+
+	switch exporter {
+	case None, "":
+		return func(context.Context) error { return nil }, nil
+	case OTLP:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithInsecure()}
+		if endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		client, err := otlptracegrpc.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the OTLP exporter: %w", err)
+		}
+		provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(client), sdktrace.WithResource(newResource()))
+		otel.SetTracerProvider(provider)
+		return provider.Shutdown, nil
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, expected %q or %q", exporter, None, OTLP)
+	}
+}
+
+// InitInMemory sets the global tracer provider to keep every span in memory as soon as it ends, for tests to check.
+// The global provider can only be delegated to once, so tests share the exporter returned by the first call.
+func InitInMemory() *tracetest.InMemoryExporter {
+	setPropagator()
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithResource(newResource())))
+	return exporter
+}
+
+// setPropagator propagates trace context and baggage in the W3C headers
+func setPropagator() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// newResource describes the service every span comes from
+func newResource() *resource.Resource {
+	return resource.NewSchemaless(semconv.ServiceName(ServiceName))
+}
+
+// Start starts a span as a child of any span in ctx, the span must be ended
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(ServiceName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End ends the span, recording err on it if there was one
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// TestInit tests unknown exporters are rejected, and none needs nothing flushed.
+func TestInit(t *testing.T) {
+	if _, err := Init(context.Background(), "zipkin", ""); err == nil {
+		t.Error("expected an unknown exporter to fail")
+	}
+
+	shutdown, err := Init(context.Background(), None, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestStart tests spans are parented to the span in ctx, and errors are recorded on them.
+func TestStart(t *testing.T) {
+	exporter := InitInMemory()
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("mock error"))
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Name != "child" || spans[0].Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("expected the child to be parented to the span in ctx, got %+v", spans[0].Parent)
+	}
+	if spans[0].Status.Code != codes.Error {
+		t.Errorf("expected the error to be recorded, got %v", spans[0].Status)
+	}
+	if spans[1].Status.Code == codes.Error {
+		t.Errorf("expected the parent not to be recorded as an error")
+	}
+}
@@ -0,0 +1,119 @@
+package transfer
+
+import (
+	"errors"
+	"io"
+	"userapi/data"
+)
+
+// DefaultBatchSize is how many users are written at once, unless told otherwise
+const DefaultBatchSize = 500
+
+// Rejection is a row that wasn't imported, and why
+type Rejection struct {
+	Row      int    `json:"row"`
+	ID       string `json:"id"`
+	Nickname string `json:"nickname"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,escape"`
+}
+
+// Report summarises an import
+type Report struct {
+	// Rows is how many rows were read, including any skipped
+	Rows     int `json:"rows"`
+	Skipped  int `json:"skipped"`
+	Imported int `json:"imported"`
+	Rejected int `json:"rejected"`
+	// LastRow is the last row that was fully processed, pass it as ResumeAfter to carry on an interrupted import
+	LastRow int `json:"last_row"`
+}
+
+// InsertFunc writes a batch of users, returning a result per user
+type InsertFunc func(users []data.User) ([]data.BatchResult, error)
+
+// ImportOptions changes how an import is run
+type ImportOptions struct {
+	// ResumeAfter skips every row up to and including this row, as they were imported by a previous run
+	ResumeAfter int
+	BatchSize   int
+	// OnRejected is called for every row that isn't imported
+	OnRejected func(Rejection)
+}
+
+// Import reads every user from the reader, and writes them in batches using insert.
+// Rows that can't be read or inserted are rejected, without stopping the import.
+// If an error is returned, the report is still valid up to Report.LastRow.
+func Import(r *Reader, insert InsertFunc, opts ImportOptions) (*Report, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+
+	report := &Report{LastRow: opts.ResumeAfter}
+	reject := func(rejection Rejection) {
+		report.Rejected++
+		if opts.OnRejected != nil {
+			opts.OnRejected(rejection)
+		}
+	}
+
+	users := make([]data.User, 0, opts.BatchSize)
+	rows := make([]int, 0, opts.BatchSize)
+	flush := func() error {
+		if len(users) > 0 {
+			results, err := insert(users)
+			if err != nil {
+				return err
+			}
+
+			for _, result := range results {
+				if result.Status == data.BatchCreated {
+					report.Imported++
+					continue
+				}
+
+				user := users[result.Index]
+				reject(Rejection{Row: rows[result.Index], ID: user.ID, Nickname: user.Nickname, Status: result.Status, Reason: result.Error})
+			}
+		}
+
+		if r.Row() > report.LastRow {
+			report.LastRow = r.Row()
+		}
+		users = users[:0]
+		rows = rows[:0]
+		return nil
+	}
+
+	for {
+		user, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+
+		report.Rows = r.Row()
+		if r.Row() <= opts.ResumeAfter {
+			report.Skipped++
+			continue
+		}
+
+		var rowErr *RowError
+		if errors.As(err, &rowErr) {
+			reject(Rejection{Row: rowErr.Row, Status: data.BatchInvalid, Reason: rowErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+
+		users = append(users, user)
+		rows = append(rows, r.Row())
+		if len(users) == opts.BatchSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	return report, flush()
+}
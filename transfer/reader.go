@@ -0,0 +1,163 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"userapi/data"
+)
+
+// maxLineSize caps the length of a single NDJSON line
+const maxLineSize = 1024 * 1024
+
+// RowError is returned for a row that couldn't be read, reading can carry on with the next row
+type RowError struct {
+	Row int
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads users from CSV or NDJSON, one row at a time.
+// Rows are numbered from 1, not counting the CSV header or blank NDJSON lines.
+type Reader struct {
+	format  Format
+	mapping Mapping
+	row     int
+
+	csv    *csv.Reader
+	fields []string
+
+	scanner *bufio.Scanner
+}
+
+// NewReader creates a reader, CSV headers are read straight away so unknown columns are caught before anything is imported
+func NewReader(r io.Reader, format Format, mapping Mapping) (*Reader, error) {
+	if _, err := ParseFormat(string(format)); err != nil {
+		return nil, err
+	}
+
+	reader := &Reader{format: format, mapping: mapping}
+	if format == NDJSON {
+		reader.scanner = bufio.NewScanner(r)
+		reader.scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+		return reader, nil
+	}
+
+	reader.csv = csv.NewReader(r)
+	header, err := reader.csv.Read()
+	if err == io.EOF {
+		return reader, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when reading csv header - err: %v", err)
+	}
+
+	reader.fields = make([]string, len(header))
+	for i, column := range header {
+		reader.fields[i] = mapping.field(column)
+		if !isField(reader.fields[i]) {
+			return nil, fmt.Errorf("unknown column %q, map it to a user field", column)
+		}
+	}
+
+	return reader, nil
+}
+
+// Read returns the next user, or io.EOF once every row has been read.
+// A *RowError is returned for a row that couldn't be read.
+func (r *Reader) Read() (data.User, error) {
+	if r.format == CSV {
+		return r.readCSV()
+	}
+	return r.readNDJSON()
+}
+
+// Row is the number of the row last returned by Read
+func (r *Reader) Row() int {
+	return r.row
+}
+
+func (r *Reader) readCSV() (data.User, error) {
+	var user data.User
+	if r.fields == nil {
+		return user, io.EOF
+	}
+
+	record, err := r.csv.Read()
+	if err == io.EOF {
+		return user, err
+	}
+	r.row++
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return user, &RowError{Row: r.row, Err: parseErr.Err}
+	}
+	if err != nil {
+		return user, err
+	}
+
+	for i, value := range record {
+		if err := setField(&user, r.fields[i], value); err != nil {
+			return data.User{}, &RowError{Row: r.row, Err: err}
+		}
+	}
+
+	return user, nil
+}
+
+func (r *Reader) readNDJSON() (data.User, error) {
+	var user data.User
+
+	var line []byte
+	for len(line) == 0 {
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				return user, fmt.Errorf("error when reading row %d - err: %v", r.row+1, err)
+			}
+			return user, io.EOF
+		}
+		line = bytes.TrimSpace(r.scanner.Bytes())
+	}
+	r.row++
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(line, &object); err != nil {
+		return user, &RowError{Row: r.row, Err: err}
+	}
+
+	for column, raw := range object {
+		field := r.mapping.field(column)
+		if !isField(field) {
+			return data.User{}, &RowError{Row: r.row, Err: fmt.Errorf("unknown column %q", column)}
+		}
+
+		// Strings are unquoted, anything else (version numbers) is used as is
+		value := string(raw)
+		if value == "null" {
+			continue
+		}
+		if len(raw) > 0 && raw[0] == '"' {
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return data.User{}, &RowError{Row: r.row, Err: err}
+			}
+		}
+
+		if err := setField(&user, field, value); err != nil {
+			return data.User{}, &RowError{Row: r.row, Err: err}
+		}
+	}
+
+	return user, nil
+}
@@ -0,0 +1,188 @@
+// Package transfer moves users in and out of the service as CSV or NDJSON, so they can be copied between environments.
+package transfer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"userapi/data"
+)
+
+// Format is a file format users can be transferred in
+type Format string
+
+// Supported formats
+const (
+	CSV    Format = "csv"
+	NDJSON Format = "ndjson"
+)
+
+// ParseFormat checks the given format is supported
+func ParseFormat(format string) (Format, error) {
+	switch Format(strings.ToLower(format)) {
+	case CSV:
+		return CSV, nil
+	case NDJSON, "jsonl":
+		return NDJSON, nil
+	}
+	return "", fmt.Errorf("unsupported format %q, expected csv or ndjson", format)
+}
+
+// ContentType is the http content type for the format
+func (f Format) ContentType() string {
+	if f == CSV {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+// Fields are the user fields that can be transferred
+var Fields = []string{"id", "first_name", "last_name", "nickname", "password", "email", "country", "created_at", "updated_at", "version"}
+
+// DefaultFields are the fields exported when none are asked for, in order. Passwords are only exported when asked for by name.
+var DefaultFields = []string{"id", "first_name", "last_name", "nickname", "email", "country", "created_at", "updated_at", "version"}
+
+// Mapping renames columns in a file to the user fields they hold, keyed by column name.
+// Columns without a mapping must already be named after a user field.
+type Mapping map[string]string
+
+// ParseMapping parses a mapping in the form "column=field,column=field"
+func ParseMapping(mapping string) (Mapping, error) {
+	m := Mapping{}
+	if mapping == "" {
+		return m, nil
+	}
+
+	for _, pair := range strings.Split(mapping, ",") {
+		column, field, ok := strings.Cut(pair, "=")
+		column, field = strings.TrimSpace(column), strings.TrimSpace(field)
+		if !ok || column == "" {
+			return nil, fmt.Errorf("invalid column mapping %q, expected column=field", pair)
+		}
+		if !isField(field) {
+			return nil, fmt.Errorf("invalid column mapping %q, unknown user field %q", pair, field)
+		}
+		m[column] = field
+	}
+
+	return m, nil
+}
+
+// ParseFields parses a comma separated list of user fields, returning the DefaultFields if the list is empty
+func ParseFields(fields string) ([]string, error) {
+	if fields == "" {
+		return DefaultFields, nil
+	}
+
+	parsed := strings.Split(fields, ",")
+	for i := range parsed {
+		parsed[i] = strings.TrimSpace(parsed[i])
+		if !isField(parsed[i]) {
+			return nil, fmt.Errorf("unknown user field %q", parsed[i])
+		}
+	}
+
+	return parsed, nil
+}
+
+// field returns the user field held in a column
+func (m Mapping) field(column string) string {
+	if field, ok := m[column]; ok {
+		return field
+	}
+	return column
+}
+
+// column returns the column a user field is written to
+func (m Mapping) column(field string) string {
+	for column, f := range m {
+		if f == field {
+			return column
+		}
+	}
+	return field
+}
+
+// isField checks the name is a known user field
+func isField(name string) bool {
+	for _, field := range Fields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldValue formats a user field as a string
+func fieldValue(user *data.User, field string) string {
+	switch field {
+	case "id":
+		return user.ID
+	case "first_name":
+		return user.FirstName
+	case "last_name":
+		return user.LastName
+	case "nickname":
+		return user.Nickname
+	case "password":
+		return user.Password
+	case "email":
+		return user.Email
+	case "country":
+		return user.Country
+	case "created_at":
+		return formatTime(user.CreatedAt)
+	case "updated_at":
+		return formatTime(user.UpdatedAt)
+	case "version":
+		return strconv.FormatInt(user.Version, 10)
+	}
+	return ""
+}
+
+// setField parses a string into a user field, empty values are left unset
+func setField(user *data.User, field, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	var err error
+	switch field {
+	case "id":
+		user.ID = value
+	case "first_name":
+		user.FirstName = value
+	case "last_name":
+		user.LastName = value
+	case "nickname":
+		user.Nickname = value
+	case "password":
+		user.Password = value
+	case "email":
+		user.Email = value
+	case "country":
+		user.Country = value
+	case "created_at":
+		user.CreatedAt, err = time.Parse(time.RFC3339Nano, value)
+	case "updated_at":
+		user.UpdatedAt, err = time.Parse(time.RFC3339Nano, value)
+	case "version":
+		user.Version, err = strconv.ParseInt(value, 10, 64)
+	default:
+		err = fmt.Errorf("unknown user field")
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s %q - err: %v", field, value, err)
+	}
+	return nil
+}
+
+// formatTime formats a time for export, leaving unset times empty
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,285 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"userapi/data"
+)
+
+var testUsers = []data.User{
+	{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com",
+		Country: "UK", CreatedAt: time.Date(2024, time.June, 16, 17, 32, 28, 213617100, time.UTC), UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), Version: 3},
+	{ID: "0d0f9944-d902-4db1-b83b-6b25a61f89e2", FirstName: "Meepo", LastName: "Geomancer, the \"first\"", Nickname: "Meepo", Password: "d1gD1gD1g", Email: "meepo@example.com",
+		Country: "UK", CreatedAt: time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), UpdatedAt: time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), Version: 1},
+}
+
+// TestRoundTrip writes users out and reads them back in, in every format
+func TestRoundTrip(t *testing.T) {
+	mapping := Mapping{"surname": "last_name", "handle": "nickname"}
+
+	for _, format := range []Format{CSV, NDJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, err := NewWriter(&buf, format, Fields, mapping)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for i := range testUsers {
+				if err := writer.Write(&testUsers[i]); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !strings.Contains(buf.String(), "surname") || strings.Contains(buf.String(), "last_name") {
+				t.Errorf("expected last_name to be written as surname, got: %s", buf.String())
+			}
+
+			reader, err := NewReader(&buf, format, mapping)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var users []data.User
+			for {
+				user, err := reader.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				users = append(users, user)
+			}
+
+			if !reflect.DeepEqual(users, testUsers) {
+				t.Errorf("users did not survive the round trip, want: %#v, got: %#v", testUsers, users)
+			}
+		})
+	}
+}
+
+// TestWriteNDJSON checks the NDJSON output keeps the requested fields in order
+func TestWriteNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, NDJSON, []string{"nickname", "version", "email"}, Mapping{"handle": "nickname"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	writer.Write(&testUsers[0])
+	writer.Flush()
+
+	want := `{"handle":"Alchemist","version":3,"email":"Razzil.Darkbrew@example.com"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("unexpected output, want: %s, got: %s", want, buf.String())
+	}
+}
+
+// TestParseFields checks passwords are left out of exports unless they're asked for
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		fields string
+		want   []string
+	}{
+		{fields: "", want: DefaultFields},
+		{fields: "nickname, password", want: []string{"nickname", "password"}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseFields(tt.fields)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("unexpected fields for %q, want: %v, got: %v", tt.fields, tt.want, got)
+		}
+	}
+	for _, field := range DefaultFields {
+		if field == "password" {
+			t.Error("expected passwords not to be exported by default")
+		}
+	}
+
+	if _, err := ParseFields("nickname,shoe_size"); err == nil {
+		t.Error("expected an unknown field to be rejected")
+	}
+}
+
+// TestReaderErrors checks bad rows are reported without stopping the reader, and bad headers stop it straight away
+func TestReaderErrors(t *testing.T) {
+	t.Run("unknown csv column", func(t *testing.T) {
+		_, err := NewReader(strings.NewReader("nickname,shoe_size\n"), CSV, Mapping{})
+		if err == nil {
+			t.Fatal("expected an error for an unknown column")
+		}
+	})
+
+	tests := []struct {
+		name      string
+		format    Format
+		input     string
+		wantRows  []int
+		wantNames []string
+	}{
+		{
+			name:      "csv",
+			format:    CSV,
+			input:     "nickname,version\nAlchemist,1\nMeepo,one\nCrystal\nEnchantress,2\n",
+			wantRows:  []int{2, 3},
+			wantNames: []string{"Alchemist", "Enchantress"},
+		},
+		{
+			name:      "ndjson",
+			format:    NDJSON,
+			input:     "{\"nickname\":\"Alchemist\"}\n\n{not json}\n{\"shoe_size\":9}\n{\"nickname\":\"Enchantress\",\"version\":2,\"email\":null}\n",
+			wantRows:  []int{2, 3},
+			wantNames: []string{"Alchemist", "Enchantress"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := NewReader(strings.NewReader(tt.input), tt.format, Mapping{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var rows []int
+			var names []string
+			for {
+				user, err := reader.Read()
+				if err == io.EOF {
+					break
+				}
+
+				var rowErr *RowError
+				if errors.As(err, &rowErr) {
+					rows = append(rows, rowErr.Row)
+					continue
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				names = append(names, user.Nickname)
+			}
+
+			if !reflect.DeepEqual(rows, tt.wantRows) {
+				t.Errorf("unexpected rejected rows, want: %v, got: %v", tt.wantRows, rows)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("unexpected users, want: %v, got: %v", tt.wantNames, names)
+			}
+		})
+	}
+}
+
+// TestParseMapping tests the ParseMapping function.
+func TestParseMapping(t *testing.T) {
+	mapping, err := ParseMapping("surname=last_name, handle = nickname")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (Mapping{"surname": "last_name", "handle": "nickname"}); !reflect.DeepEqual(mapping, want) {
+		t.Errorf("unexpected mapping, want: %v, got: %v", want, mapping)
+	}
+
+	for _, invalid := range []string{"surname", "=last_name", "surname=shoe_size"} {
+		if _, err := ParseMapping(invalid); err == nil {
+			t.Errorf("expected an error for mapping %q", invalid)
+		}
+	}
+}
+
+// TestImport checks rows are batched, rejections are reported with their row, and imports can be resumed
+func TestImport(t *testing.T) {
+	input := "nickname\nAlchemist\nMeepo\nCrystal\n\"bad\"quote\nEnchantress\nTaken\nRubick\n"
+
+	tests := []struct {
+		name          string
+		resumeAfter   int
+		insertErr     error
+		wantReport    Report
+		wantBatches   [][]string
+		wantRejection []Rejection
+		wantErr       bool
+	}{
+		{
+			name:        "full import",
+			wantReport:  Report{Rows: 7, Imported: 5, Rejected: 2, LastRow: 7},
+			wantBatches: [][]string{{"Alchemist", "Meepo", "Crystal"}, {"Enchantress", "Taken", "Rubick"}},
+			wantRejection: []Rejection{
+				{Row: 4, Status: data.BatchInvalid, Reason: `extraneous or missing " in quoted-field`},
+				{Row: 6, Nickname: "Taken", Status: data.BatchConflict, Reason: "nickname taken"},
+			},
+		},
+		{
+			name:        "resumed import",
+			resumeAfter: 4,
+			wantReport:  Report{Rows: 7, Skipped: 4, Imported: 2, Rejected: 1, LastRow: 7},
+			wantBatches: [][]string{{"Enchantress", "Taken", "Rubick"}},
+			wantRejection: []Rejection{
+				{Row: 6, Nickname: "Taken", Status: data.BatchConflict, Reason: "nickname taken"},
+			},
+		},
+		{
+			name:        "failed insert",
+			insertErr:   errors.New("mock error"),
+			wantReport:  Report{Rows: 3, LastRow: 0},
+			wantBatches: [][]string{{"Alchemist", "Meepo", "Crystal"}},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := NewReader(strings.NewReader(input), CSV, Mapping{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var batches [][]string
+			insert := func(users []data.User) ([]data.BatchResult, error) {
+				var batch []string
+				results := make([]data.BatchResult, len(users))
+				for i, user := range users {
+					batch = append(batch, user.Nickname)
+					results[i] = data.BatchResult{Index: i, Status: data.BatchCreated}
+					if user.Nickname == "Taken" {
+						results[i] = data.BatchResult{Index: i, Status: data.BatchConflict, Error: "nickname taken"}
+					}
+				}
+				batches = append(batches, batch)
+				return results, tt.insertErr
+			}
+
+			var rejections []Rejection
+			report, err := Import(reader, insert, ImportOptions{
+				ResumeAfter: tt.resumeAfter,
+				BatchSize:   3,
+				OnRejected: func(rejection Rejection) {
+					rejections = append(rejections, rejection)
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if *report != tt.wantReport {
+				t.Errorf("unexpected report, want: %+v, got: %+v", tt.wantReport, *report)
+			}
+			if !reflect.DeepEqual(batches, tt.wantBatches) {
+				t.Errorf("unexpected batches, want: %v, got: %v", tt.wantBatches, batches)
+			}
+			if !reflect.DeepEqual(rejections, tt.wantRejection) {
+				t.Errorf("unexpected rejections, want: %+v, got: %+v", tt.wantRejection, rejections)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"userapi/data"
+)
+
+// Writer writes users out as CSV or NDJSON
+type Writer struct {
+	format  Format
+	fields  []string
+	columns []string
+
+	buf         *bufio.Writer
+	csv         *csv.Writer
+	wroteHeader bool
+}
+
+// NewWriter creates a writer for the given user fields, fields are written to the column given by the mapping
+func NewWriter(w io.Writer, format Format, fields []string, mapping Mapping) (*Writer, error) {
+	if _, err := ParseFormat(string(format)); err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		if !isField(field) {
+			return nil, fmt.Errorf("unknown user field %q", field)
+		}
+		columns[i] = mapping.column(field)
+	}
+
+	writer := &Writer{
+		format:  format,
+		fields:  fields,
+		columns: columns,
+		buf:     bufio.NewWriter(w),
+	}
+	if format == CSV {
+		writer.csv = csv.NewWriter(writer.buf)
+	}
+
+	return writer, nil
+}
+
+// Write writes a single user
+func (w *Writer) Write(user *data.User) error {
+	if w.format == CSV {
+		return w.writeCSV(user)
+	}
+	return w.writeNDJSON(user)
+}
+
+// Flush writes any buffered users to the underlying writer
+func (w *Writer) Flush() error {
+	// An export with no users still gets a header
+	if w.format == CSV && !w.wroteHeader {
+		if err := w.csv.Write(w.columns); err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+func (w *Writer) writeCSV(user *data.User) error {
+	if !w.wroteHeader {
+		if err := w.csv.Write(w.columns); err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+
+	record := make([]string, len(w.fields))
+	for i, field := range w.fields {
+		record[i] = fieldValue(user, field)
+	}
+	return w.csv.Write(record)
+}
+
+// writeNDJSON writes the user as a json object on a single line, keeping the fields in order
+func (w *Writer) writeNDJSON(user *data.User) error {
+	w.buf.WriteByte('{')
+	for i, field := range w.fields {
+		if i > 0 {
+			w.buf.WriteByte(',')
+		}
+
+		column, _ := json.Marshal(w.columns[i])
+		w.buf.Write(column)
+		w.buf.WriteByte(':')
+
+		if field == "version" {
+			w.buf.WriteString(fieldValue(user, field))
+			continue
+		}
+		value, _ := json.Marshal(fieldValue(user, field))
+		w.buf.Write(value)
+	}
+	w.buf.WriteString("}\n")
+
+	return nil
+}
@@ -1,40 +1,75 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"userapi/audit"
+	"userapi/auth"
+	"userapi/broadcast"
+	"userapi/certs"
 	"userapi/data"
 	"userapi/db"
 	uhealth "userapi/health"
+	"userapi/logging"
+	"userapi/metrics"
+	"userapi/outbox"
 	"userapi/pb"
+	"userapi/publisher"
+	"userapi/ratelimit"
+	"userapi/requestid"
+	"userapi/tracing"
+	"userapi/transfer"
 	"userapi/validation"
+	"userapi/watchfilter"
+	"userapi/webhook"
 
 	"github.com/bet365/jingo"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-// log verbosity level
+// log verbosity level, and the format records are written in, text or json
 var (
 	logVerbosity = 0
+	logFormat    = logging.Text
 	HTTPPort     = 0
 	GRPCPort     = 0
 
@@ -45,65 +80,421 @@ var (
 
 	// set our newUUID function, to allow us to stub it later
 	newUUID = uuid.NewString
+
+	// Deleted users can be restored, until they are purged once the retention period is up
+	deletedRetention = 30 * 24 * time.Hour
+	purgeInterval    = time.Hour
+
+	// tracingExporter is where spans are sent, otlp or none. Incoming trace context is propagated either way
+	tracingExporter = tracing.None
+	// tracingEndpoint is the OpenTelemetry collector's host:port, empty uses localhost:4317
+	tracingEndpoint = ""
+
+	// rateLimit is the limit for every route and RPC without its own, as rate:burst, 0 is unlimited
+	rateLimit = "50:100"
+	// routeRateLimits are the routes and RPCs with their own limits, the -ratelimits flag adds to or overrides them
+	routeRateLimits = map[string]ratelimit.Limit{
+		"/userapi/add":                    {Rate: 5, Burst: 10},
+		"/userapi/deleteall":              {Rate: 0.1, Burst: 1},
+		"/userapi/batch/add":              {Rate: 1, Burst: 2},
+		"/userapi/admin/import":           {Rate: 0.1, Burst: 1},
+		"/user.UserService/AddUser":       {Rate: 5, Burst: 10},
+		"/user.UserService/BatchAddUsers": {Rate: 1, Burst: 2},
+		"/user.UserService/ImportUsers":   {Rate: 0.1, Burst: 1},
+		"/grpc.health.v1.Health/Check":    ratelimit.Unlimited,
+		"/grpc.health.v1.Health/Watch":    ratelimit.Unlimited,
+	}
+	limiter *ratelimit.Limiter
+	// rateLimitBuckets caps how many clients' buckets are held, dropping the least recently used
+	rateLimitBuckets = ratelimit.DefaultMaxBuckets
+
+	// apiKeysFile lists the clients we know, as name:key lines. Requests with one of the keys are identified as its client
+	apiKeysFile = ""
+	apiKeys     *auth.Keys
+
+	// The HTTP server's timeouts. The watch and transfer routes lift the read and write timeouts, as their streams run for as long as they need
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+
+	// Both servers serve TLS when given a certificate and key, which are reloaded every tlsReloadInterval if they've been rotated.
+	// gRPC clients must present a certificate issued by tlsClientCA, when it's set.
+	tlsCert           = ""
+	tlsKey            = ""
+	tlsClientCA       = ""
+	tlsReloadInterval = time.Minute
+
+	// The gRPC server pings connections quiet for grpcKeepaliveTime, closing them if there's no answer within grpcKeepaliveTimeout,
+	// and closes those of clients pinging more often than grpcKeepaliveMinTime
+	grpcKeepaliveTime    = time.Minute
+	grpcKeepaliveTimeout = 20 * time.Second
+	grpcKeepaliveMinTime = 10 * time.Second
+	// The largest gRPC messages received and sent, in bytes
+	grpcMaxRecvBytes = 4 << 20
+	grpcMaxSendBytes = 16 << 20
+
+	// On shutdown, the health service reports NOT_SERVING for shutdownDrainDelay before we stop taking requests,
+	// then the requests, watchers and background jobs still running have shutdownTimeout to finish
+	shutdownDrainDelay = 5 * time.Second
+	shutdownTimeout    = 30 * time.Second
+
+	// Mongo is pinged, and the user cache checked, every healthInterval, with each check given healthTimeout
+	healthInterval = 5 * time.Second
+	healthTimeout  = 2 * time.Second
 )
 
 func main() {
-	flag.IntVar(&logVerbosity, "v", logVerbosity, "set the logging verbosity level")
+	flag.IntVar(&logVerbosity, "v", logVerbosity, "set the logging verbosity level, 1 logs debug messages and -1 only warnings and errors")
+	flag.StringVar(&logFormat, "logformat", logFormat, "the format log records are written in, text or json")
 	flag.IntVar(&HTTPPort, "httpport", 8080, "the main http server port to listen on")
 	flag.IntVar(&GRPCPort, "grpcport", 9090, "the main grpc server port to listen on")
+	flag.DurationVar(&db.IdempotencyWindow, "idempotencywindow", db.IdempotencyWindow, "how long an idempotency key is remembered for")
+	flag.DurationVar(&db.IdempotencyLease, "idempotencylease", db.IdempotencyLease, "how long an idempotency key is held for a request that is still creating its user")
+	flag.DurationVar(&deletedRetention, "deletedretention", deletedRetention, "how long deleted users can be restored for, before they are purged")
+	flag.DurationVar(&purgeInterval, "purgeinterval", purgeInterval, "how often to purge deleted users, 0 disables purging")
+	flag.DurationVar(&db.EventRetention, "eventretention", db.EventRetention, "how long user updates are kept for watchers to resume from")
+	flag.IntVar(&watchBufferSize, "watchbuffer", watchBufferSize, "how many updates can queue up for a watcher before the overflow policy kicks in")
+	flag.IntVar(&webhookAttempts, "webhookattempts", webhookAttempts, "how many times a webhook delivery is tried, before it's dead-lettered")
+	flag.DurationVar(&webhookBackoff, "webhookbackoff", webhookBackoff, "how long to wait before retrying a webhook delivery, doubling with every attempt")
+	flag.DurationVar(&webhookTimeout, "webhooktimeout", webhookTimeout, "how long webhook receivers have to respond")
+	flag.BoolVar(&webhookAllowPrivate, "webhookallowprivate", webhookAllowPrivate, "allow webhooks to be delivered to localhost and private addresses, for local development")
+	flag.StringVar(&publisherKind, "publisher", publisherKind, "the message broker to publish user updates to, kafka or nats, empty publishes nowhere")
+	flag.StringVar(&publisherAddr, "publisheraddr", publisherAddr, "comma separated Kafka brokers, or NATS server URLs, defaults to the broker on localhost")
+	flag.StringVar(&publisherTopic, "publishertopic", publisherTopic, "the Kafka topic or NATS subject user updates are published to")
+	encoding := flag.String("publisherencoding", publisherEncoding.String(), "how published user updates are encoded, protobuf or json")
+	flag.StringVar(&tracingExporter, "tracing", tracingExporter, "where to send trace spans, otlp or none")
+	flag.StringVar(&tracingEndpoint, "otlpendpoint", tracingEndpoint, "the OpenTelemetry collector's host:port spans are sent to, defaults to localhost:4317")
+	flag.StringVar(&rateLimit, "ratelimit", rateLimit, "requests a second each client can make to a route, and the burst allowed, as rate:burst, 0 is unlimited")
+	flag.IntVar(&rateLimitBuckets, "ratelimitbuckets", rateLimitBuckets, "the most clients rate limits are held for, the least recently seen are dropped first")
+	flag.StringVar(&apiKeysFile, "apikeys", apiKeysFile, "a file of name:key lines, identifying the clients that send one of the API keys")
+	routeLimits := flag.String("ratelimits", "", "comma separated route=rate:burst limits for HTTP paths or full gRPC method names, overriding -ratelimit")
+	flag.DurationVar(&readHeaderTimeout, "readheadertimeout", readHeaderTimeout, "how long HTTP clients have to send a request's headers")
+	flag.DurationVar(&readTimeout, "readtimeout", readTimeout, "how long HTTP clients have to send a whole request, except to the streaming routes")
+	flag.DurationVar(&writeTimeout, "writetimeout", writeTimeout, "how long an HTTP response can take to write, except on the streaming routes")
+	flag.DurationVar(&idleTimeout, "idletimeout", idleTimeout, "how long an idle HTTP keep-alive connection is kept open")
+	flag.StringVar(&tlsCert, "tlscert", tlsCert, "the PEM certificate file both servers serve TLS with, empty serves plaintext")
+	flag.StringVar(&tlsKey, "tlskey", tlsKey, "the PEM private key file for -tlscert")
+	flag.StringVar(&tlsClientCA, "tlsclientca", tlsClientCA, "the PEM CA certificates gRPC client certificates must be issued by, empty doesn't ask clients for one")
+	flag.DurationVar(&tlsReloadInterval, "tlsreload", tlsReloadInterval, "how often to check whether the certificate and key have been rotated")
+	flag.DurationVar(&grpcKeepaliveTime, "grpckeepalive", grpcKeepaliveTime, "how long a gRPC connection can be quiet before it's pinged")
+	flag.DurationVar(&grpcKeepaliveTimeout, "grpckeepalivetimeout", grpcKeepaliveTimeout, "how long a gRPC client has to answer a ping, before it's disconnected")
+	flag.DurationVar(&grpcKeepaliveMinTime, "grpckeepaliveminimum", grpcKeepaliveMinTime, "the most often gRPC clients can ping, those pinging more often are disconnected")
+	flag.IntVar(&grpcMaxRecvBytes, "grpcmaxrecv", grpcMaxRecvBytes, "the largest gRPC message received, in bytes")
+	flag.IntVar(&grpcMaxSendBytes, "grpcmaxsend", grpcMaxSendBytes, "the largest gRPC message sent, in bytes")
+	flag.DurationVar(&shutdownDrainDelay, "shutdowndelay", shutdownDrainDelay, "how long health checks report NOT_SERVING before shutting down, for load balancers to stop sending requests")
+	flag.DurationVar(&healthInterval, "healthinterval", healthInterval, "how often readiness is checked, pinging mongo and checking the user cache")
+	flag.DurationVar(&healthTimeout, "healthtimeout", healthTimeout, "how long each readiness check has to pass")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", shutdownTimeout, "how long requests, watchers and background jobs have to finish when shutting down, before they're cut off")
+	overflowPolicy := flag.String("watchoverflow", watchOverflowPolicy.String(), "what to do with watchers that fall behind, drop-oldest or disconnect")
 
 	flag.Parse()
 
-	log.Printf("Starting version %v of userapi, httpport=%d, grpcport=%d", 1, HTTPPort, GRPCPort)
-
-	err := db.Init()
+	logger, err := logging.New(os.Stderr, logFormat, logVerbosity)
 	if err != nil {
 		log.Fatal(err)
 	}
+	slog.SetDefault(logger)
+
+	if watchOverflowPolicy, err = broadcast.ParsePolicy(*overflowPolicy); err != nil {
+		fatal("invalid -watchoverflow", "error", err)
+	}
+	if publisherEncoding, err = publisher.ParseEncoding(*encoding); err != nil {
+		fatal("invalid -publisherencoding", "error", err)
+	}
+
+	if apiKeys, err = auth.LoadKeys(apiKeysFile); err != nil {
+		fatal("invalid -apikeys", "error", err)
+	}
+	if limiter, err = newLimiter(*routeLimits); err != nil {
+		fatal("invalid rate limits", "error", err)
+	}
+
+	shutdownTracing, err := tracing.Init(context.Background(), tracingExporter, tracingEndpoint)
+	if err != nil {
+		fatal("failed to set up tracing", "error", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("failed to flush trace spans", "error", err)
+		}
+	}()
+
+	// Subcommands run a one-off task against the database, instead of starting the servers
+	switch flag.Arg(0) {
+	case "export":
+		if err := runExport(flag.Args()[1:]); err != nil {
+			fatal("export failed", "error", err)
+		}
+		return
+	case "import":
+		if err := runImport(flag.Args()[1:]); err != nil {
+			fatal("import failed", "error", err)
+		}
+		return
+	}
+
+	slog.Info("starting userapi", "version", 1, "httpport", HTTPPort, "grpcport", GRPCPort)
+
+	err = db.Init()
+	if err != nil {
+		fatal("failed to connect to mongoDB", "error", err)
+	}
 
 	// start our server
 	if err := start(); err != nil {
-		log.Fatalf("error starting userapi service: %v", err)
+		fatal("error starting userapi service", "error", err)
+	}
+
+}
+
+// newLimiter limits clients in memory, with the default route limits overridden by those given
+func newLimiter(routeLimits string) (*ratelimit.Limiter, error) {
+	defaultLimit, err := ratelimit.ParseLimit(rateLimit)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := ratelimit.ParseRoutes(routeLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string]ratelimit.Limit, len(routeRateLimits)+len(overrides))
+	for route, limit := range routeRateLimits {
+		routes[route] = limit
+	}
+	for route, limit := range overrides {
+		routes[route] = limit
+	}
+	return ratelimit.NewLimiter(ratelimit.NewMemoryStore(rateLimitBuckets), defaultLimit, routes), nil
+}
+
+// newServerTLS loads the certificate the servers present, reloading it as it's rotated until ctx is done.
+// The configs are nil when serving plaintext.
+func newServerTLS(ctx context.Context) (httpTLS, grpcTLS *tls.Config, err error) {
+	if tlsCert == "" && tlsKey == "" {
+		if tlsClientCA != "" {
+			return nil, nil, errors.New("-tlsclientca needs -tlscert and -tlskey")
+		}
+		return nil, nil, nil
+	}
+	if tlsCert == "" || tlsKey == "" {
+		return nil, nil, errors.New("-tlscert and -tlskey must be given together")
+	}
+
+	reloader, err := certs.NewReloader(tlsCert, tlsKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	go reloader.Watch(ctx, tlsReloadInterval)
+
+	if httpTLS, err = certs.ServerConfig(reloader, ""); err != nil {
+		return nil, nil, err
+	}
+	if grpcTLS, err = certs.ServerConfig(reloader, tlsClientCA); err != nil {
+		return nil, nil, err
 	}
+	return httpTLS, grpcTLS, nil
+}
+
+// newHealthChecker backs /healthz. It asks the health service directly, rather than dialling our own gRPC server as a client would,
+// which under -tlsclientca would need a client certificate.
+func newHealthChecker(healthSrv *health.Server) *uhealth.Checker {
+	return uhealth.NewChecker(uhealth.Local(healthSrv), healthTimeout)
+}
+
+// liftDeadlines stops the server's read and write timeouts cutting off a stream, which runs for as long as the client wants.
+// It has to wrap the server's own response writer, as the deadlines can't be reached through the metrics middleware's.
+func liftDeadlines(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Time{}); err != nil {
+			slog.WarnContext(r.Context(), "failed to lift the read deadline", "path", r.URL.Path, "error", err)
+		}
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			slog.WarnContext(r.Context(), "failed to lift the write deadline", "path", r.URL.Path, "error", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
+// fatal logs an error the service can't carry on from, and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 func start() error {
 
 	mux := http.NewServeMux()
 
+	// Requests are given an ID, then traced, logged, counted and timed under the pattern they were registered with,
+	// before the client is identified and rate limited, so rejected requests show up too
+	observe := func(pattern string, handler http.Handler) http.Handler {
+		return otelhttp.NewHandler(requestid.Middleware(logging.Middleware(pattern, metrics.InstrumentHandler(pattern, handler))), pattern)
+	}
+	instrument := func(pattern string, handler http.HandlerFunc) http.Handler {
+		return observe(pattern, apiKeys.Middleware(limiter.Middleware(pattern, handler)))
+	}
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, instrument(pattern, handler))
+	}
+	// Probes are never rate limited, as a kubelet or load balancer turned away with a 429 would take a healthy instance out of service
+	handleProbe := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, observe(pattern, handler))
+	}
+	// Streams aren't cut off by the read and write timeouts
+	handleStream := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, liftDeadlines(instrument(pattern, handler)))
+	}
+	// Admin routes and streams are only open to admin clients
+	handleAdmin := func(pattern string, handler http.HandlerFunc) {
+		handle(pattern, auth.RequireAdmin(handler).ServeHTTP)
+	}
+	handleAdminStream := func(pattern string, handler http.HandlerFunc) {
+		handleStream(pattern, auth.RequireAdmin(handler).ServeHTTP)
+	}
+
 	// register http handlers
-	mux.HandleFunc("/userapi/getall", getAllUsersHandler)
-	mux.HandleFunc("/userapi/get", getUsersHandler)
-	mux.HandleFunc("/userapi/add", addUserHandler)
-	mux.HandleFunc("/userapi/update", updateUserHandler)
-	mux.HandleFunc("/userapi/delete", deleteUserHandler)
-	mux.HandleFunc("/userapi/deleteall", deleteAllUsersHandler)
+	handle("/userapi/getall", getAllUsersHandler)
+	handle("/userapi/get", getUsersHandler)
+	handle("/userapi/add", addUserHandler)
+	handle("/userapi/update", updateUserHandler)
+	handle("/userapi/delete", deleteUserHandler)
+	handle("/userapi/deleteall", deleteAllUsersHandler)
+	handle("/userapi/restore", restoreUserHandler)
+	handle("/userapi/batch/add", batchAddUsersHandler)
+	handle("/userapi/batch/update", batchUpdateUsersHandler)
+	handle("/userapi/batch/delete", batchDeleteUsersHandler)
+	handleAdminStream("/userapi/admin/export", exportUsersHandler)
+	handleAdminStream("/userapi/admin/import", importUsersHandler)
+	handle("/userapi/audit", listAuditEventsHandler)
+	handle("/userapi/history", userHistoryHandler)
+	handle("/userapi/history/at", userAtHandler)
+	handle("/userapi/revert", revertUserHandler)
+	handleStream("/userapi/watch", watchUsersHandler)
+	handleStream("/userapi/watch/ws", watchUsersWebSocketHandler)
+	handleAdmin("/userapi/webhooks", listWebhooksHandler)
+	handleAdmin("/userapi/webhooks/add", addWebhookHandler)
+	handleAdmin("/userapi/webhooks/update", updateWebhookHandler)
+	handleAdmin("/userapi/webhooks/delete", deleteWebhookHandler)
+	handleAdmin("/userapi/webhooks/deliveries", webhookDeliveriesHandler)
+	handleAdmin("/userapi/webhooks/deadletters", webhookDeadLettersHandler)
+	handleAdmin("/userapi/webhooks/redeliver", redeliverWebhookHandler)
+
+	// Serve TLS if we've been given a certificate, picking it up again whenever it's rotated, until we shut down
+	tlsCtx, stopTLS := context.WithCancel(context.Background())
+	defer stopTLS()
+	httpTLS, grpcTLS, err := newServerTLS(tlsCtx)
+	if err != nil {
+		return fmt.Errorf("failed to set up TLS: %w", err)
+	}
 
-	// Only returns OK when http & grpc is ready for serving connections
-	mux.HandleFunc("/healthz", uhealth.CheckHandler)
+	// Register health service. Nothing is served until mongo answers and the user cache has been loaded,
+	// and from when we start shutting down
+	healthSrv := health.NewServer()
+	checker := newHealthChecker(healthSrv)
+	monitor := uhealth.NewMonitor(healthSrv, healthInterval, healthTimeout,
+		uhealth.Check{Name: "mongo", Services: []string{pb.UserService_ServiceDesc.ServiceName}, Run: db.Ping},
+		uhealth.Check{Name: "user_cache", Services: []string{pb.UserService_ServiceDesc.ServiceName}, Run: warmUserCache()},
+	)
 
-	httpServer := &http.Server{Addr: fmt.Sprintf(":%d", HTTPPort), Handler: mux}
+	// Only returns OK when http & grpc is ready for serving connections
+	handleProbe("/healthz", checker.CheckHandler)
+	// Whether we should be restarted, and whether we should be sent requests, with the result of every check
+	handleProbe("/livez", monitor.LiveHandler)
+	handleProbe("/readyz", monitor.ReadyHandler)
+	// Neither is rate limited, so scrapes aren't turned away when we're busiest.
+	// Counters, such as how many updates were dropped for watchers that fell behind, webhook deliveries given up on, or updates relayed
+	mux.Handle("/debug/vars", expvar.Handler())
+	// Request counts and latencies, mongo, cache and watcher metrics, in the Prometheus format
+	mux.Handle("/metrics", metrics.Handler())
+
+	httpServer := &http.Server{
+		Addr:              fmt.Sprintf(":%d", HTTPPort),
+		Handler:           mux,
+		TLSConfig:         httpTLS,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
 
 	// Set up the gRPC server
-	grpcServer := grpc.NewServer()
+	grpcOptions := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: grpcKeepaliveTime, Timeout: grpcKeepaliveTimeout}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: grpcKeepaliveMinTime, PermitWithoutStream: true}),
+		grpc.MaxRecvMsgSize(grpcMaxRecvBytes),
+		grpc.MaxSendMsgSize(grpcMaxSendBytes),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(requestid.UnaryServerInterceptor, logging.UnaryServerInterceptor, metrics.UnaryServerInterceptor, apiKeys.UnaryServerInterceptor, limiter.UnaryServerInterceptor),
+		grpc.ChainStreamInterceptor(requestid.StreamServerInterceptor, logging.StreamServerInterceptor, metrics.StreamServerInterceptor, apiKeys.StreamServerInterceptor, limiter.StreamServerInterceptor),
+	}
+	if grpcTLS != nil {
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(grpcTLS)))
+	}
+	grpcServer := grpc.NewServer(grpcOptions...)
 	userService = NewUserService()
 	pb.RegisterUserServiceServer(grpcServer, userService)
 
-	// Register health service
-	healthSrv := health.NewServer()
+	// Publish updates to the message broker, if there is one
+	if userService.publisher, err = newPublisher(); err != nil {
+		return err
+	}
+	if userService.publisher != nil {
+		defer userService.publisher.Close()
+	}
+	expvar.Publish("watch_updates", expvar.Func(func() interface{} {
+		return userService.updates.Stats()
+	}))
+	expvar.Publish("webhook_deliveries", expvar.Func(func() interface{} {
+		return userService.webhooks.Stats()
+	}))
+	expvar.Publish("outbox_relay", expvar.Func(func() interface{} {
+		return userService.relay.Stats()
+	}))
+	metrics.RegisterWatchers(userService.updates.Stats)
+
 	healthpb.RegisterHealthServer(grpcServer, healthSrv)
-	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 
 	reflection.Register(grpcServer)
 
-	uhealth.GRPCAddress = fmt.Sprintf(":%d", GRPCPort)
-	grpcLis, err := net.Listen("tcp", uhealth.GRPCAddress)
+	grpcLis, err := net.Listen("tcp", fmt.Sprintf(":%d", GRPCPort))
 	if err != nil {
 		err = fmt.Errorf("failed to listen: %v", err)
 		return err
 	}
 
+	// Background jobs run until we've stopped serving. The relay is stopped first, and makes one last pass as it stops,
+	// so the updates logged by the last requests served are relayed before anything they're relayed to is stopped.
+	var relayJob, jobs, webhookJobs sync.WaitGroup
+	background := func(wg *sync.WaitGroup, run func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run()
+		}()
+	}
+
+	// Relay logged updates to our watchers, webhooks and the broker
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	background(&relayJob, func() { userService.relay.Run(relayCtx) })
+
+	// Purge deleted users, and follow the updates relayed by other instances
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	if purgeInterval > 0 {
+		background(&jobs, func() { purgeDeletedUsers(jobsCtx, deletedRetention, purgeInterval) })
+	}
+	background(&jobs, func() { userService.followUpdates(jobsCtx) })
+	background(&jobs, func() { monitor.Run(jobsCtx) })
+
+	// Deliver updates to webhooks
+	webhookCtx, stopWebhooks := context.WithCancel(context.Background())
+	defer stopWebhooks()
+	background(&webhookJobs, func() { userService.webhooks.Run(webhookCtx) })
+
 	// WaitGroup to handle graceful shutdown of both servers
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -111,23 +502,28 @@ func start() error {
 	go func() {
 		defer func() {
 			wg.Done()
-			log.Println("httpServer has finished shutting down")
+			slog.Info("httpServer has finished shutting down")
 		}()
 
-		log.Println("Starting HTTP server on port 8080")
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("HTTP server ListenAndServe: %v", err)
+		slog.Info("starting HTTP server", "port", HTTPPort, "tls", httpServer.TLSConfig != nil)
+		serve := httpServer.ListenAndServe
+		if httpServer.TLSConfig != nil {
+			// The certificate comes from the TLS config, so isn't loaded from a file here
+			serve = func() error { return httpServer.ListenAndServeTLS("", "") }
+		}
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			fatal("HTTP server ListenAndServe failed", "error", err)
 		}
 	}()
 
 	go func() {
 		defer func() {
 			wg.Done()
-			log.Println("gRPC Server has finished shutting down")
+			slog.Info("gRPC server has finished shutting down")
 		}()
-		log.Println("Starting gRPC server on port 9090")
+		slog.Info("starting gRPC server", "port", GRPCPort, "tls", grpcTLS != nil, "mtls", tlsClientCA != "")
 		if err := grpcServer.Serve(grpcLis); err != nil {
-			log.Fatalf("gRPC server Serve: %v", err)
+			fatal("gRPC server Serve failed", "error", err)
 		}
 	}()
 
@@ -135,25 +531,150 @@ func start() error {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
-	log.Println("Stop Signal received, shutting down")
+	slog.Info("stop signal received, shutting down", "timeout", shutdownTimeout)
+
+	// Report we're going, then give the load balancers time to notice, while still serving what they send us
+	monitor.Shutdown()
+	slog.Info("health set to NOT_SERVING, draining", "delay", shutdownDrainDelay)
+	time.Sleep(shutdownDrainDelay)
 
-	// Gracefully shutdown the HTTP server
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
-	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Fatalf("HTTP server Shutdown: %v", err)
+
+	// Turn new watchers away and end every watch, telling the watchers to resume elsewhere, otherwise their streams would hold up the servers stopping
+	userService.closeWatches()
+	if !waitFor(ctx, func() bool { return userService.updates.Stats().Subscribers == 0 }) {
+		slog.Warn("watchers didn't all stop in time", "watchers", userService.updates.Stats().Subscribers)
 	}
 
-	// stop the gRPC server
-	grpcServer.Stop()
+	stopServers(ctx, httpServer, grpcServer)
 
 	// Wait for the servers to gracefully shutdown
 	wg.Wait()
-	log.Println("Servers gracefully stopped")
+	slog.Info("servers gracefully stopped")
+
+	// Stopping the relay has it make one last pass, relaying the updates logged by the last requests served to the broker and webhooks.
+	// The watchers have already gone, and resume them from the event log. Anything it doesn't get to is relayed when we start again.
+	stopRelay()
+	if !waitGroup(ctx, &relayJob) {
+		slog.Warn("the relay didn't finish its last pass in time, the remaining updates are relayed when we start again")
+	}
+	stopJobs()
+	if !waitGroup(ctx, &jobs) {
+		slog.Warn("background jobs didn't stop in time")
+	}
+	// Webhook deliveries still waiting, or cut off mid attempt, are kept and made once we're back
+	stopWebhooks()
+	if !waitGroup(ctx, &webhookJobs) {
+		slog.Warn("webhook deliveries didn't stop in time")
+	}
+	slog.Info("background jobs stopped")
 
 	return nil
 }
 
+// stopServers stops both servers taking new requests, and waits for those in flight to finish.
+// Any still running once ctx is done are cut off.
+func stopServers(ctx context.Context, httpServer *http.Server, grpcServer *grpc.Server) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			slog.Warn("HTTP requests didn't finish in time, closing their connections", "error", err)
+			httpServer.Close()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			slog.Warn("RPCs didn't finish in time, cutting them off")
+			// Stop also ends the graceful stop still waiting
+			grpcServer.Stop()
+			<-stopped
+		}
+	}()
+
+	wg.Wait()
+}
+
+// waitGroup waits for wg, reporting false if ctx is done first
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// waitFor polls until condition is true, reporting false if ctx is done first
+func waitFor(ctx context.Context, condition func() bool) bool {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !condition() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// warmUserCache is a readiness check loading every user into the cache, until it has been loaded once
+func warmUserCache() func(ctx context.Context) error {
+	var warm atomic.Bool
+	return func(ctx context.Context) error {
+		if warm.Load() {
+			return nil
+		}
+		if _, err := db.GetUsers(ctx); err != nil {
+			return err
+		}
+		warm.Store(true)
+		return nil
+	}
+}
+
+// purgeDeletedUsers permanently removes users once they've been deleted for longer than the retention period.
+// Runs straight away, then every interval until ctx is cancelled.
+func purgeDeletedUsers(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := db.PurgeDeletedUsers(ctx, timeNow().Add(-retention))
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to purge deleted users", "error", err)
+		} else if purged > 0 {
+			slog.InfoContext(ctx, "purged deleted users", "purged", purged, "retention", retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 //################################################################
 // http rest Handlers
 // why are all my handlers in main?
@@ -164,8 +685,18 @@ func start() error {
 //################################################################
 
 var (
-	userEncoder  = jingo.NewStructEncoder(data.User{})
-	usersEncoder = jingo.NewSliceEncoder([]data.User{})
+	userEncoder         = jingo.NewStructEncoder(data.User{})
+	usersEncoder        = jingo.NewSliceEncoder([]data.User{})
+	batchResultsEncoder = jingo.NewSliceEncoder([]data.BatchResult{})
+	importEncoder       = jingo.NewStructEncoder(importResponse{})
+	auditEventsEncoder  = jingo.NewSliceEncoder([]data.AuditEvent{})
+	revisionEncoder     = jingo.NewStructEncoder(data.UserRevision{})
+	revisionsEncoder    = jingo.NewSliceEncoder([]data.UserRevision{})
+	userEventEncoder    = jingo.NewStructEncoder(data.UserEvent{})
+	webhookEncoder      = jingo.NewStructEncoder(data.Webhook{})
+	webhooksEncoder     = jingo.NewSliceEncoder([]data.Webhook{})
+	deliveriesEncoder   = jingo.NewSliceEncoder([]data.WebhookDelivery{})
+	deadLettersEncoder  = jingo.NewSliceEncoder([]data.WebhookDeadLetter{})
 )
 
 // getAllUsersHandler fetches all users from the DB
@@ -184,7 +715,7 @@ func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err != nil {
-			log.Printf("getUserHandler >>> '%s', IP: %v, error: %v", r.URL.Path, r.RemoteAddr, err)
+			slog.ErrorContext(r.Context(), "getUserHandler failed", "path", r.URL.Path, "error", err)
 			// If this is a customer facing API, we dont really want to expose the errors.
 			// This can lead to vulnerabilities, if the client knows what happened serverside.
 			w.WriteHeader(http.StatusInternalServerError)
@@ -196,7 +727,7 @@ func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, err := db.GetUsers()
+	users, err := db.GetUsers(r.Context())
 	if err != nil {
 		return
 	}
@@ -226,7 +757,7 @@ func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err != nil {
-			log.Printf("getUserHandler >>> '%s', IP: %v, error: %v", r.URL.Path, r.RemoteAddr, err)
+			slog.ErrorContext(r.Context(), "getUserHandler failed", "path", r.URL.Path, "error", err)
 			// If this is a customer facing API, we dont really want to expose the errors.
 			// This can lead to vulnerabilities, if the client knows what happened serverside.
 			w.WriteHeader(http.StatusInternalServerError)
@@ -263,7 +794,7 @@ func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	users, err := db.GetUsersFiltered(country, nickname, createdAfter, page, limit)
+	users, err := db.GetUsersFiltered(r.Context(), country, nickname, createdAfter, page, limit)
 	if err != nil {
 		return
 	}
@@ -280,6 +811,7 @@ func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 // addUserHandler creates a new user in the database, ensuring no username clashes
 // POST method is required
 // The user object must be on the post body in the standard user json format
+// An Idempotency-Key header can be supplied to make retries safe, a repeated key returns the originally created user
 func addUserHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		err error
@@ -291,10 +823,10 @@ func addUserHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err != nil {
-			log.Printf("addUserHandler >>> '%s', IP: %v, error: %v", r.URL.Path, r.RemoteAddr, err)
+			slog.ErrorContext(r.Context(), "addUserHandler failed", "path", r.URL.Path, "error", err)
 			// If this is a customer facing API, we dont really want to expose the errors.
 			// This can lead to vulnerabilities, if the client knows what happened serverside.
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(httpStatus(err))
 		}
 	}()
 
@@ -303,44 +835,87 @@ func addUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user data.User
-	if err = json.NewDecoder(r.Body).Decode(&user); err != nil {
-		err = fmt.Errorf("error when decoding json body - err: %v", err)
+	var req addUserRequest
+	if err = decodeJSON(w, r, maxBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
 		return
 	}
+	user := req.user()
 
-	err = validation.User(user.FirstName, user.LastName, user.Nickname, user.Password, user.Country, user.Email)
+	err = validateUser(r.Context(), user.FirstName, user.LastName, user.Nickname, user.Password, user.Country, user.Email)
 	if err != nil {
-		err = fmt.Errorf("user failed validation - err: %v, user:%+v", err, user)
+		err = fmt.Errorf("user %q failed validation - err: %v", user.Nickname, err)
 		return
 	}
 
-	existingUser, err := db.GetUser(user.Nickname)
+	// Retries carrying the same Idempotency-Key are given the user that was originally created
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		idempotencyKey, err = scopeIdempotencyKey(r.Context(), idempotencyKey)
+		if err != nil {
+			return
+		}
+
+		var replayedUser *data.User
+		replayedUser, err = reserveIdempotencyKey(r.Context(), idempotencyKey, idempotencyHash(&user))
+		if err != nil {
+			return
+		}
+
+		if replayedUser != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", etag(replayedUser.Version))
+			w.Header().Set("Idempotent-Replayed", "true")
+
+			buf := jingo.NewBufferFromPool()
+			defer buf.ReturnToPool()
+
+			userEncoder.Marshal(replayedUser, buf)
+			buf.WriteTo(w)
+			return
+		}
+
+		// Free the key up again if we fail to create the user, so the client is able to retry
+		defer func() {
+			if err != nil {
+				releaseIdempotencyKey(r.Context(), idempotencyKey)
+			}
+		}()
+	}
+
+	existingUser, err := db.GetUser(r.Context(), user.Nickname)
 	if err != nil {
-		err = fmt.Errorf("errored when attempting to lookup existing users - err: %v, user:%+v", err, user)
+		err = fmt.Errorf("errored when attempting to lookup existing users - err: %v, nickname: %q", err, user.Nickname)
 		return
 	}
 
 	if existingUser != nil && existingUser.Nickname != "" && existingUser.Nickname == user.Nickname {
-		err = fmt.Errorf("a user with this username already exists - user:%+v", user)
+		err = fmt.Errorf("a user with this username already exists - nickname: %q", user.Nickname)
 		return
 	}
 
 	user.ID = newUUID()
+	logUserID(r.Context(), user.ID)
 	user.CreatedAt = timeNow().UTC()
 	user.UpdatedAt = user.CreatedAt
+	user.Version = 1
+	user.DeletedAt = nil
 
-	err = db.InsertUser(&user)
+	src := httpAuditSource(r)
+	err = db.InsertUser(r.Context(), &user, src.auditor(data.AuditCreate))
 	if err != nil {
 		return
 	}
 
-	// Spawn a go routine, so we dont impact the request
-	go func() {
-		userService.NotifyUpdate(user.ID, updateCREATED, convertToProtoUser(&user))
-	}()
+	if idempotencyKey != "" {
+		completeIdempotencyKey(r.Context(), idempotencyKey, &user)
+	}
+
+	// The update was logged with the write, have the relay deliver it now
+	userService.relay.Wake()
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(user.Version))
 
 	buf := jingo.NewBufferFromPool()
 	defer buf.ReturnToPool()
@@ -352,6 +927,7 @@ func addUserHandler(w http.ResponseWriter, r *http.Request) {
 // updateUserHandler updates the user from the database with a given id, ensuring no username clashes
 // POST method is required
 // The user object must be on the post body in the standard user json format
+// An If-Match header containing the users ETag can be supplied, to prevent overwriting someone elses changes
 func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		err error
@@ -363,10 +939,10 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err != nil {
-			log.Printf("updateUserHandler >>> '%s', IP: %v, error: %v", r.URL.Path, r.RemoteAddr, err)
+			slog.ErrorContext(r.Context(), "updateUserHandler failed", "path", r.URL.Path, "error", err)
 			// If this is a customer facing API, we dont really want to expose the errors.
 			// This can lead to vulnerabilities, if the client knows what happened serverside.
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(httpStatus(err))
 		}
 	}()
 
@@ -375,18 +951,25 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user data.User
-	if err = json.NewDecoder(r.Body).Decode(&user); err != nil {
-		err = fmt.Errorf("error when decoding json body - err: %v", err)
+	expectedVersion, err := parseIfMatch(r)
+	if err != nil {
+		return
+	}
+
+	var req updateUserRequest
+	if err = decodeJSON(w, r, maxBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
 		return
 	}
+	user := req.user()
 
-	err = validation.User(user.FirstName, user.LastName, user.Nickname, user.Password, user.Country, user.Email)
+	err = validateUser(r.Context(), user.FirstName, user.LastName, user.Nickname, user.Password, user.Country, user.Email)
 	if err != nil {
-		err = fmt.Errorf("user failed validation - err: %v, user:%+v", err, user)
+		err = fmt.Errorf("user %q failed validation - err: %v", user.Nickname, err)
 		return
 	}
 
+	logUserID(r.Context(), user.ID)
 	// ensure we have a correctly formatted uuid string
 	err = uuid.Validate(user.ID)
 	if err != nil {
@@ -394,32 +977,32 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Look up for users with this username, We want to prevent usernames being updated to usernames that already exist
-	existingUser, err := db.GetUser(user.Nickname)
+	existingUser, err := db.GetUser(r.Context(), user.Nickname)
 	if err != nil {
-		err = fmt.Errorf("errored when attempting to lookup existing users - err: %v, user:%+v", err, user)
+		err = fmt.Errorf("errored when attempting to lookup existing users - err: %v, nickname: %q", err, user.Nickname)
 		return
 	}
 
 	// If the username matches an existing users, check we havn't matched with ourself
 	if existingUser != nil && existingUser.ID != user.ID {
-		err = fmt.Errorf("no users found with the given users, cannot update user, inputted user: %v", user)
+		err = fmt.Errorf("no users found with the given users, cannot update user %s", user.ID)
 		return
 	}
 
 	// Set the UpdatedAt field
 	user.UpdatedAt = timeNow()
 
-	updatedUser, err := db.UpdateUser(&user)
+	src := httpAuditSource(r)
+	_, updatedUser, err := db.UpdateUser(r.Context(), &user, expectedVersion, src.auditor(data.AuditUpdate))
 	if err != nil {
 		return
 	}
 
-	// Spawn a go routine, so we dont impact the request
-	go func() {
-		userService.NotifyUpdate(user.ID, updateUPDATED, convertToProtoUser(updatedUser))
-	}()
+	// The update was logged with the write, have the relay deliver it now
+	userService.relay.Wake()
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(updatedUser.Version))
 
 	buf := jingo.NewBufferFromPool()
 	defer buf.ReturnToPool()
@@ -431,6 +1014,7 @@ func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 // deleteUserHandler deletes the user from the database with a given id
 // POST method is required
 // The ID must be provided on the post body in the standard user json format
+// An If-Match header containing the users ETag can be supplied, to prevent deleting a user that has since changed
 func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		err error
@@ -442,10 +1026,10 @@ func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err != nil {
-			log.Printf("deleteUserHandler >>> '%s', IP: %v, error: %v", r.URL.Path, r.RemoteAddr, err)
+			slog.ErrorContext(r.Context(), "deleteUserHandler failed", "path", r.URL.Path, "error", err)
 			// If this is a customer facing API, we dont really want to expose the errors.
 			// This can lead to vulnerabilities, if the client knows what happened serverside.
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(httpStatus(err))
 		}
 	}()
 
@@ -454,32 +1038,37 @@ func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user pb.User
-	if err = json.NewDecoder(r.Body).Decode(&user); err != nil {
-		err = fmt.Errorf("error when decoding json body - err: %v", err)
+	expectedVersion, err := parseIfMatch(r)
+	if err != nil {
+		return
+	}
+
+	var req idRequest
+	if err = decodeJSON(w, r, maxBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
 		return
 	}
 
-	if user.ID == "" {
-		err = fmt.Errorf("no userid provided to delete, user: %v", &user)
+	if req.ID == "" {
+		err = fmt.Errorf("no userid provided to delete")
 		return
 	}
 
+	logUserID(r.Context(), req.ID)
 	// ensure we have a correctly formatted uuid string
-	err = uuid.Validate(user.ID)
+	err = uuid.Validate(req.ID)
 	if err != nil {
 		return
 	}
 
-	err = db.DeleteUser(user.ID)
+	src := httpAuditSource(r)
+	_, _, err = db.DeleteUser(r.Context(), req.ID, expectedVersion, timeNow(), src.auditor(data.AuditDelete))
 	if err != nil {
 		return
 	}
 
-	// Spawn a go routine, so we dont impact the request
-	go func() {
-		userService.NotifyUpdate(user.ID, updateDELETED, &user)
-	}()
+	// The update was logged with the write, have the relay deliver it now
+	userService.relay.Wake()
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -498,7 +1087,7 @@ func deleteAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err != nil {
-			log.Printf("deleteUserHandler >>> '%s', IP: %v, error: %v", r.URL.Path, r.RemoteAddr, err)
+			slog.ErrorContext(r.Context(), "deleteUserHandler failed", "path", r.URL.Path, "error", err)
 			// If this is a customer facing API, we dont really want to expose the errors.
 			// This can lead to vulnerabilities, if the client knows what happened serverside.
 			w.WriteHeader(http.StatusInternalServerError)
@@ -510,263 +1099,3284 @@ func deleteAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = db.DeleteAllUsers()
+	src := httpAuditSource(r)
+	deletedAt := timeNow()
+	err = db.DeleteAllUsers(r.Context(), deletedAt, src.auditor(data.AuditDeleteAll))
 	if err != nil {
 		return
 	}
 
-	// Spawn a go routine, so we dont impact the request
-	go func() {
-		userService.NotifyUpdate("", updateALLDELETED, nil)
-	}()
+	// The update was logged with the write, have the relay deliver it now
+	userService.relay.Wake()
 
 	w.WriteHeader(http.StatusOK)
 }
 
-//################################################################
-// gRPC Handlers
-//################################################################
+// restoreUserHandler brings back a deleted user, until they are purged
+// POST method is required
+// The ID must be provided on the post body in the standard user json format
+// Fails with a conflict if someone has taken the user's nickname since they were deleted
+func restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
 
-// UserService contains our handlers for our gRPC service
-type UserService struct {
-	pb.UnimplementedUserServiceServer
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
 
-	userUpdates chan *pb.UserUpdate
-	mu          sync.RWMutex
-	watchers    map[chan *pb.UserUpdate]struct{}
-}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "restoreUserHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
 
-// NewUserService creates a new gRPC user server instance
-func NewUserService() *UserService {
-	return &UserService{
-		userUpdates: make(chan *pb.UserUpdate),
-		watchers:    make(map[chan *pb.UserUpdate]struct{}),
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
 	}
-}
 
-// GetAllUsers fetches all users from the DB
-// this endpoint is designed to be performant. No queries used. And caching is utilised
-func (s *UserService) GetAllUsers(ctx context.Context, in *emptypb.Empty) (*pb.GetUsersResponse, error) {
-	users, err := db.GetUsers()
+	var req idRequest
+	if err = decodeJSON(w, r, maxBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
+		return
+	}
+
+	logUserID(r.Context(), req.ID)
+	// ensure we have a correctly formatted uuid string
+	err = uuid.Validate(req.ID)
 	if err != nil {
-		return nil, err
+		return
 	}
 
-	// Due to the way the users are stored in the database, we cant directly take protoUser out. (Dates....)
-	protoUsers := make([]*pb.User, len(users))
-	for i := range users {
-		protoUsers[i] = convertToProtoUser(&users[i])
+	src := httpAuditSource(r)
+	_, restoredUser, err := db.RestoreUser(r.Context(), req.ID, src.auditor(data.AuditRestore))
+	if err != nil {
+		return
 	}
 
-	return &pb.GetUsersResponse{Users: protoUsers}, nil
+	// The update was logged with the write, have the relay deliver it now
+	userService.relay.Wake()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(restoredUser.Version))
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	userEncoder.Marshal(restoredUser, buf)
+	buf.WriteTo(w)
 }
 
-// GetUsers finds users with a given query from the database
-func (s *UserService) GetUsers(ctx context.Context, req *pb.GetUsersRequest) (*pb.GetUsersResponse, error) {
+// batchAddUsersHandler creates many users at once, reporting a result per user rather than failing the whole batch
+// POST method is required
+// The post body must be a json array of users in the standard user json format
+func batchAddUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
 
-	if req.Page < 1 || req.Page > 1000 {
-		req.Page = 1
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "batchAddUsersHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
 	}
-	if req.Limit < 1 || req.Limit > 50 {
-		req.Page = 1
+
+	var req []addUserRequest
+	if err = decodeJSON(w, r, maxBatchBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
+		return
+	}
+	users := make([]data.User, len(req))
+	for i := range req {
+		users[i] = req[i].user()
 	}
 
-	users, err := db.GetUsersFiltered(req.Country, req.Nickname, req.CreatedAfter.AsTime(), int(req.Page), int(req.Limit))
+	results, err := userService.batchAddUsers(r.Context(), httpAuditSource(r), users, batchAddOptions{})
 	if err != nil {
-		return nil, err
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	batchResultsEncoder.Marshal(&results, buf)
+	buf.WriteTo(w)
+}
+
+// batchUpdateUsersHandler updates many users at once, reporting a result per user rather than failing the whole batch
+// POST method is required
+// The post body must be a json array of users in the standard user json format
+// A version on a user, only applies the update if the stored user is still at that version, 0 for users without one
+func batchUpdateUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "batchUpdateUsersHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	var req []batchUpdateUserRequest
+	if err = decodeJSON(w, r, maxBatchBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
+		return
+	}
+	users := make([]data.User, len(req))
+	for i := range req {
+		users[i] = req[i].user()
+	}
+
+	results, err := userService.batchUpdateUsers(r.Context(), httpAuditSource(r), users)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	batchResultsEncoder.Marshal(&results, buf)
+	buf.WriteTo(w)
+}
+
+// batchDeleteUsersHandler deletes many users at once, reporting a result per user rather than failing the whole batch
+// POST method is required
+// The post body must be a json array of users, only the id (and optionally version) is required
+// A version on a user, only applies the delete if the stored user is still at that version, 0 for users without one
+func batchDeleteUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "batchDeleteUsersHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	var req []batchDeleteUserRequest
+	if err = decodeJSON(w, r, maxBatchBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
+		return
+	}
+	users := make([]data.User, len(req))
+	for i := range req {
+		users[i] = data.User{ID: req[i].ID, Version: batchVersion(req[i].Version)}
+	}
+
+	results, err := userService.batchDeleteUsers(r.Context(), httpAuditSource(r), users)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	batchResultsEncoder.Marshal(&results, buf)
+	buf.WriteTo(w)
+}
+
+// exportUsersHandler streams every user out as CSV or NDJSON, for copying users to another environment
+// GET method is required
+// Query parameters: format (csv or ndjson, defaults to ndjson), fields (comma separated user fields), map (column=field,column=field)
+func exportUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "exportUsersHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+	format, err := transfer.ParseFormat(queryDefault(query.Get("format"), string(transfer.NDJSON)))
+	if err != nil {
+		return
+	}
+	fields, err := transfer.ParseFields(query.Get("fields"))
+	if err != nil {
+		return
+	}
+	mapping, err := transfer.ParseMapping(query.Get("map"))
+	if err != nil {
+		return
+	}
+
+	writer, err := transfer.NewWriter(w, format, fields, mapping)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=users.%s", format))
+
+	// Users are streamed, so a failure part way through can only be logged
+	if err = db.ExportUsers(r.Context(), writer.Write); err != nil {
+		return
+	}
+	err = writer.Flush()
+}
+
+// importResponse reports the outcome of an import over http
+type importResponse struct {
+	DryRun     bool                 `json:"dry_run"`
+	Report     transfer.Report      `json:"report"`
+	Rejections []transfer.Rejection `json:"rejections"`
+}
+
+// importUsersHandler imports users from a CSV or NDJSON body, keeping their IDs, timestamps and versions.
+// POST method is required
+// Query parameters: format (csv or ndjson, defaults to ndjson), map (column=field,column=field), dryrun, passwordhashes, resumeafter
+// The response reports every rejected row and why, and the last row processed, to resume from should the import fail
+func importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "importUsersHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+	format, err := transfer.ParseFormat(queryDefault(query.Get("format"), string(transfer.NDJSON)))
+	if err != nil {
+		return
+	}
+	mapping, err := transfer.ParseMapping(query.Get("map"))
+	if err != nil {
+		return
+	}
+
+	var opts batchAddOptions
+	opts.preserve = true
+	if opts.dryRun, err = strconv.ParseBool(queryDefault(query.Get("dryrun"), "false")); err != nil {
+		return
+	}
+	if opts.passwordHashes, err = strconv.ParseBool(queryDefault(query.Get("passwordhashes"), "false")); err != nil {
+		return
+	}
+
+	var resumeAfter int
+	if resumeAfter, err = strconv.Atoi(queryDefault(query.Get("resumeafter"), "0")); err != nil {
+		return
+	}
+
+	reader, err := transfer.NewReader(r.Body, format, mapping)
+	if err != nil {
+		return
+	}
+
+	src := httpAuditSource(r)
+	response := importResponse{DryRun: opts.dryRun, Rejections: []transfer.Rejection{}}
+	report, importErr := transfer.Import(reader, func(users []data.User) ([]data.BatchResult, error) {
+		return userService.batchAddUsers(r.Context(), src, users, opts)
+	}, transfer.ImportOptions{
+		ResumeAfter: resumeAfter,
+		OnRejected: func(rejection transfer.Rejection) {
+			response.Rejections = append(response.Rejections, rejection)
+		},
+	})
+	response.Report = *report
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// The report is still sent when the import fails part way, so the caller knows where to resume from
+	if importErr != nil {
+		slog.ErrorContext(r.Context(), "importUsersHandler stopped", "path", r.URL.Path, "last_row", report.LastRow, "error", importErr)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	importEncoder.Marshal(&response, buf)
+	buf.WriteTo(w)
+}
+
+// listAuditEventsHandler lists the changes made to users, and who made them, newest first
+// GET method is required
+// parameters are to be supplied has url params.
+// ?userId=1a2b...&since=2024-06-14T18:37:47Z&until=2024-06-15T18:37:47Z&page=1&limit=50
+// no params are required, changes made to every user at once are included when filtering on a user
+func listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "listAuditEventsHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID := query.Get("userId")
+	if userID != "" {
+		logUserID(r.Context(), userID)
+		// ensure we have a correctly formatted uuid string
+		if err = uuid.Validate(userID); err != nil {
+			return
+		}
+	}
+
+	var since, until time.Time
+	if sinceStr := query.Get("since"); sinceStr != "" {
+		if since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			return
+		}
+	}
+	if untilStr := query.Get("until"); untilStr != "" {
+		if until, err = time.Parse(time.RFC3339, untilStr); err != nil {
+			return
+		}
+	}
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	page, limit = pageParams(page, limit, maxAuditPageSize)
+
+	events, err := db.ListAuditEvents(r.Context(), userID, since, until, page, limit)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	auditEventsEncoder.Marshal(&events, buf)
+	buf.WriteTo(w)
+}
+
+// userHistoryHandler lists every revision of a user, newest first
+// GET method is required
+// parameters are to be supplied has url params.
+// ?id=8711e364-c83d-46fc-a3db-d6b2aee00d0f&page=1&limit=50
+func userHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "userHistoryHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID := query.Get("id")
+	logUserID(r.Context(), userID)
+	// ensure we have a correctly formatted uuid string
+	if err = uuid.Validate(userID); err != nil {
+		return
+	}
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	page, limit = pageParams(page, limit, maxHistoryPageSize)
+
+	revisions, err := db.GetUserHistory(r.Context(), userID, page, limit)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	revisionsEncoder.Marshal(&revisions, buf)
+	buf.WriteTo(w)
+}
+
+// userAtHandler shows what a user looked like at a point in time
+// GET method is required
+// parameters are to be supplied has url params.
+// ?id=8711e364-c83d-46fc-a3db-d6b2aee00d0f&at=2024-06-17T19:49:18Z
+// Responds with not found if the user didn't exist yet
+func userAtHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "userAtHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID := query.Get("id")
+	logUserID(r.Context(), userID)
+	// ensure we have a correctly formatted uuid string
+	if err = uuid.Validate(userID); err != nil {
+		return
+	}
+
+	at, err := time.Parse(time.RFC3339, query.Get("at"))
+	if err != nil {
+		return
+	}
+
+	revision, err := db.GetUserAt(r.Context(), userID, at)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	revisionEncoder.Marshal(revision, buf)
+	buf.WriteTo(w)
+}
+
+// revertRequest is the body of a revert, naming the revision to put the user back to
+type revertRequest struct {
+	ID      string `json:"id"`
+	Version int64  `json:"version"`
+}
+
+// revertUserHandler puts a user back the way they were at a previous revision, as a new revision
+// POST method is required
+// The body must hold the user's id and the version to revert to, e.g. {"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 2}
+// An If-Match header containing the users ETag can be supplied, to prevent overwriting someone elses changes
+func revertUserHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "revertUserHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	expectedVersion, err := parseIfMatch(r)
+	if err != nil {
+		return
+	}
+
+	var req revertRequest
+	if err = decodeJSON(w, r, maxBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
+		return
+	}
+
+	logUserID(r.Context(), req.ID)
+	// ensure we have a correctly formatted uuid string
+	if err = uuid.Validate(req.ID); err != nil {
+		return
+	}
+
+	revertedUser, err := userService.revertUser(r.Context(), httpAuditSource(r), req.ID, req.Version, expectedVersion)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(revertedUser.Version))
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	userEncoder.Marshal(revertedUser, buf)
+	buf.WriteTo(w)
+}
+
+// listWebhooksHandler lists every webhook, their secrets are never shown
+// GET method is required
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "listWebhooksHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	hooks, err := db.ListWebhooks(r.Context())
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	webhooksEncoder.Marshal(&hooks, buf)
+	buf.WriteTo(w)
+}
+
+// addWebhookHandler subscribes a URL to user updates
+// POST method is required
+// The body holds the url, the secret deliveries are signed with, and optionally which event_types to send, e.g.
+// {"url": "https://hooks.example.com/users", "event_types": ["CREATED", "DELETED"], "secret": "at least 16 characters"}
+func addWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "addWebhookHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	var req webhookRequest
+	if err = decodeJSON(w, r, maxBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
+		return
+	}
+
+	hook, err := req.webhook(true)
+	if err != nil {
+		return
+	}
+	hook.ID = newUUID()
+	hook.CreatedAt = timeNow()
+	hook.UpdatedAt = hook.CreatedAt
+
+	if err = db.InsertWebhook(r.Context(), hook); err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	webhookEncoder.Marshal(&hook, buf)
+	buf.WriteTo(w)
+}
+
+// updateWebhookHandler changes where a webhook is delivered, and which updates it's sent
+// POST method is required
+// The body takes the same fields as adding a webhook, along with its id. Leave out the secret to keep the current one.
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "updateWebhookHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	var req webhookRequest
+	if err = decodeJSON(w, r, maxBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
+		return
+	}
+
+	// ensure we have a correctly formatted uuid string
+	if err = uuid.Validate(req.ID); err != nil {
+		return
+	}
+
+	hook, err := req.webhook(false)
+	if err != nil {
+		return
+	}
+	hook.UpdatedAt = timeNow()
+
+	updatedHook, err := db.UpdateWebhook(r.Context(), hook)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	webhookEncoder.Marshal(updatedHook, buf)
+	buf.WriteTo(w)
+}
+
+// deleteWebhookHandler stops a webhook from being sent any more updates
+// POST method is required
+// The body must hold the webhook's id, e.g. {"id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f"}
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "deleteWebhookHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	var req idRequest
+	if err = decodeJSON(w, r, maxBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
+		return
+	}
+
+	// ensure we have a correctly formatted uuid string
+	if err = uuid.Validate(req.ID); err != nil {
+		return
+	}
+
+	err = db.DeleteWebhook(r.Context(), req.ID)
+}
+
+// webhookDeliveriesHandler lists every attempt at delivering updates to a webhook, newest first
+// GET method is required
+// parameters are to be supplied has url params.
+// ?id=3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f&page=1&limit=50
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "webhookDeliveriesHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+
+	webhookID := query.Get("id")
+	// ensure we have a correctly formatted uuid string
+	if err = uuid.Validate(webhookID); err != nil {
+		return
+	}
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	page, limit = pageParams(page, limit, maxDeliveryPageSize)
+
+	deliveries, err := db.ListWebhookDeliveries(r.Context(), webhookID, page, limit)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	deliveriesEncoder.Marshal(&deliveries, buf)
+	buf.WriteTo(w)
+}
+
+// webhookDeadLettersHandler lists the deliveries that were given up on, newest first
+// GET method is required
+// parameters are to be supplied has url params, the id is optional and limits the list to one webhook.
+// ?id=3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f&page=1&limit=50
+func webhookDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "webhookDeadLettersHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	query := r.URL.Query()
+
+	webhookID := query.Get("id")
+	// ensure we have a correctly formatted uuid string
+	if webhookID != "" {
+		if err = uuid.Validate(webhookID); err != nil {
+			return
+		}
+	}
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	page, limit = pageParams(page, limit, maxDeliveryPageSize)
+
+	deadLetters, err := db.ListDeadLetters(r.Context(), webhookID, page, limit)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	deadLettersEncoder.Marshal(&deadLetters, buf)
+	buf.WriteTo(w)
+}
+
+// redeliverWebhookHandler tries a dead letter again, using the webhook's current url and secret
+// POST method is required
+// The body must hold the dead letter's id, e.g. {"id": "9b2e4f7a-1c3d-4e5f-8a9b-0c1d2e3f4a5b"}
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "redeliverWebhookHandler failed", "path", r.URL.Path, "error", err)
+			// If this is a customer facing API, we dont really want to expose the errors.
+			// This can lead to vulnerabilities, if the client knows what happened serverside.
+			w.WriteHeader(httpStatus(err))
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	var req idRequest
+	if err = decodeJSON(w, r, maxBodyBytes, &req); err != nil {
+		err = fmt.Errorf("error when decoding json body - err: %w", err)
+		return
+	}
+
+	deadLetter, err := db.GetDeadLetter(r.Context(), req.ID)
+	if err != nil {
+		return
+	}
+
+	hook, err := db.GetWebhook(r.Context(), deadLetter.WebhookID)
+	if err != nil {
+		return
+	}
+
+	// Whoever deletes the dead letter gets to redeliver it, so it's only sent once
+	if err = db.DeleteDeadLetter(r.Context(), deadLetter.ID); err != nil {
+		return
+	}
+
+	if err = userService.webhooks.Redeliver(r.Context(), *hook, *deadLetter); err != nil {
+		// Put the dead letter back, so it can be redelivered again later
+		if insertErr := db.InsertDeadLetter(context.Background(), *deadLetter); insertErr != nil {
+			slog.ErrorContext(r.Context(), "failed to restore dead letter", "dead_letter_id", deadLetter.ID, "error", insertErr)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// queryDefault returns the query value, or the fallback if it wasn't given
+func queryDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// etag formats a user version as a strong ETag
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseIfMatch reads the expected user version from the If-Match header.
+// No header, or a wildcard, means the caller doesn't care which version they are overwriting, db.AnyVersion.
+// Users stored before versions were introduced are version 0, the ETag they're served with.
+func parseIfMatch(r *http.Request) (int64, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return db.AnyVersion, nil
+	}
+
+	// If-Match only ever matches strong ETags, which are all we issue, so a weak one can't match
+	unquoted, quoted := strings.CutPrefix(ifMatch, `"`)
+	unquoted, closed := strings.CutSuffix(unquoted, `"`)
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if !quoted || !closed || err != nil || version < 0 {
+		// An ETag we could never have issued, can never match
+		return 0, fmt.Errorf("invalid If-Match header %q - err: %w", ifMatch, db.ErrVersionMismatch)
+	}
+
+	return version, nil
+}
+
+// expectedVersion reads the version a gRPC request expects the user to be at.
+// proto3 can't tell an unset version from 0, so 0 doesn't check the version, as before versions were introduced.
+func expectedVersion(version int64) int64 {
+	if version == 0 {
+		return db.AnyVersion
+	}
+	return version
+}
+
+// httpStatus maps a handler error onto the status code returned to the client
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, db.ErrIdempotencyKeyInUse), errors.Is(err, db.ErrNicknameTaken), errors.Is(err, errRevisionDeleted):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrUserNotFound), errors.Is(err, db.ErrRevisionNotFound), errors.Is(err, db.ErrWebhookNotFound), errors.Is(err, db.ErrDeadLetterNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errBatchTooLarge), errors.Is(err, errBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errInvalidBody), errors.Is(err, errInvalidIdempotencyKey):
+		return http.StatusBadRequest
+	case errors.Is(err, errIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, watchfilter.ErrInvalidFilter), errors.Is(err, errInvalidResume):
+		return http.StatusBadRequest
+	case errors.Is(err, validation.ErrInvalidWebhookURL), errors.Is(err, validation.ErrInvalidEventType), errors.Is(err, validation.ErrInvalidWebhookSecret):
+		return http.StatusBadRequest
+	case errors.Is(err, errResumeExpired):
+		return http.StatusGone
+	case errors.Is(err, errEventLog), errors.Is(err, errShuttingDown):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// validateUser checks a user's fields, traced so slow validation shows up in the request's trace
+func validateUser(ctx context.Context, firstName, lastName, nickname, password, country, email string) error {
+	_, span := tracing.Start(ctx, "validation.User")
+	err := validation.User(firstName, lastName, nickname, password, country, email)
+	tracing.End(span, err)
+	return err
+}
+
+// logUserID tags the records logged for the rest of the request with the ID of the user it's about
+func logUserID(ctx context.Context, userID string) {
+	logging.AddAttrs(ctx, slog.String("user_id", userID))
+}
+
+// maxIdempotencyKeyLength stops clients from using us as free storage
+const maxIdempotencyKeyLength = 255
+
+var (
+	errInvalidIdempotencyKey = fmt.Errorf("idempotency key must be at most %d characters", maxIdempotencyKeyLength)
+	errIdempotencyKeyReused  = errors.New("idempotency key was already used for a different user")
+)
+
+// scopeIdempotencyKey checks the key the client sent, and scopes it to the client so one client can never be replayed another's user.
+// Anonymous clients share a scope, client names can't be empty so it's never confused with a named client's.
+func scopeIdempotencyKey(ctx context.Context, key string) (string, error) {
+	if len(key) > maxIdempotencyKeyLength {
+		return "", errInvalidIdempotencyKey
+	}
+
+	client, _ := auth.FromContext(ctx)
+	return client.Name + ":" + key, nil
+}
+
+// idempotencyHash fingerprints the user a create asks for, whichever transport it came over.
+// The hash is stored with the key, so the password is left out rather than giving away a way to check guesses at it.
+func idempotencyHash(user *data.User) string {
+	hash := sha256.New()
+	for _, field := range []string{user.FirstName, user.LastName, user.Nickname, user.Email, user.Country} {
+		fmt.Fprintf(hash, "%q", field)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// reserveIdempotencyKey checks whether a create carrying this idempotency key has already been handled.
+// The originally created user is returned for a replay, otherwise the key is reserved for the current request.
+// A key already used for a different user fails with errIdempotencyKeyReused.
+func reserveIdempotencyKey(ctx context.Context, key, requestHash string) (*data.User, error) {
+	record, err := db.GetIdempotencyRecord(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if record != nil {
+		// Records stored before requests were fingerprinted don't have a hash to compare
+		if record.RequestHash != "" && record.RequestHash != requestHash {
+			return nil, errIdempotencyKeyReused
+		}
+		// The original request hasn't finished creating the user yet
+		if record.User == nil {
+			return nil, db.ErrIdempotencyKeyInUse
+		}
+		return record.User, nil
+	}
+
+	return nil, db.ReserveIdempotencyKey(ctx, key, requestHash)
+}
+
+// completeIdempotencyKey stores the created user against the key.
+// The user has already been created by this point, so a failure here is only logged.
+func completeIdempotencyKey(ctx context.Context, key string, user *data.User) {
+	if err := db.CompleteIdempotencyKey(ctx, key, user); err != nil {
+		slog.ErrorContext(ctx, "failed to complete idempotency key", "idempotency_key", key, "user_id", user.ID, "error", err)
+	}
+}
+
+// releaseIdempotencyKey frees a reserved key after a failed create
+func releaseIdempotencyKey(ctx context.Context, key string) {
+	if err := db.ReleaseIdempotencyKey(ctx, key); err != nil {
+		slog.ErrorContext(ctx, "failed to release idempotency key", "idempotency_key", key, "error", err)
+	}
+}
+
+// grpcIdempotencyKey reads the idempotency key from the request, falling back to the "idempotency-key" metadata
+func grpcIdempotencyKey(ctx context.Context, req *pb.AddUserRequest) string {
+	if req.IdempotencyKey != "" {
+		return req.IdempotencyKey
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	if keys := md.Get("idempotency-key"); len(keys) > 0 {
+		return keys[0]
+	}
+
+	return ""
+}
+
+//################################################################
+// gRPC Handlers
+//################################################################
+
+// UserService contains our handlers for our gRPC service
+type UserService struct {
+	pb.UnimplementedUserServiceServer
+
+	// updates fans logged updates out to every watcher
+	updates *broadcast.Broadcaster[*data.UserEvent]
+	// webhooks delivers updates to other services
+	webhooks *webhook.Dispatcher
+	// relay delivers updates once they've been logged, to the watchers and webhooks
+	relay *outbox.Relay
+	// publisher sends updates to the message broker, it's nil without one
+	publisher publisher.Publisher
+	// watchesClosed turns new watchers away once we've started shutting down
+	watchesClosed atomic.Bool
+}
+
+// NewUserService creates a new gRPC user server instance
+func NewUserService() *UserService {
+	s := &UserService{
+		updates:  broadcast.New[*data.UserEvent](watchBufferSize, watchOverflowPolicy),
+		webhooks: newWebhookDispatcher(),
+	}
+	s.relay = s.newRelay()
+	return s
+}
+
+// GetAllUsers fetches all users from the DB
+// this endpoint is designed to be performant. No queries used. And caching is utilised
+func (s *UserService) GetAllUsers(ctx context.Context, in *emptypb.Empty) (*pb.GetUsersResponse, error) {
+	users, err := db.GetUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Due to the way the users are stored in the database, we cant directly take protoUser out. (Dates....)
+	protoUsers := make([]*pb.User, len(users))
+	for i := range users {
+		protoUsers[i] = convertToProtoUser(&users[i])
+	}
+
+	return &pb.GetUsersResponse{Users: protoUsers}, nil
+}
+
+// GetUsers finds users with a given query from the database
+func (s *UserService) GetUsers(ctx context.Context, req *pb.GetUsersRequest) (*pb.GetUsersResponse, error) {
+
+	if req.Page < 1 || req.Page > 1000 {
+		req.Page = 1
+	}
+	if req.Limit < 1 || req.Limit > 50 {
+		req.Page = 1
+	}
+
+	users, err := db.GetUsersFiltered(ctx, req.Country, req.Nickname, req.CreatedAfter.AsTime(), int(req.Page), int(req.Limit))
+	if err != nil {
+		return nil, err
 	}
 
 	// Due to the way the users are stored in the database, we cant directly take protoUser out. (Dates....)
 	protoUsers := make([]*pb.User, len(users))
 	for i := range users {
-		protoUsers[i] = convertToProtoUser(&users[i])
+		protoUsers[i] = convertToProtoUser(&users[i])
+	}
+
+	return &pb.GetUsersResponse{Users: protoUsers}, nil
+}
+
+// AddUser creates a new user in the database, ensuring no username clashes
+// An idempotency key can be supplied to make retries safe, a repeated key returns the originally created user
+func (s *UserService) AddUser(ctx context.Context, req *pb.AddUserRequest) (*pb.User, error) {
+	err := validateUser(ctx, req.FirstName, req.LastName, req.Nickname, req.Password, req.Country, req.Email)
+	if err != nil {
+		err = fmt.Errorf("user %q failed validation - err: %v", req.Nickname, err)
+		return nil, err
+	}
+
+	// Retries carrying the same idempotency key are given the user that was originally created
+	idempotencyKey := grpcIdempotencyKey(ctx, req)
+	if idempotencyKey != "" {
+		idempotencyKey, err = scopeIdempotencyKey(ctx, idempotencyKey)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		requestHash := idempotencyHash(&data.User{FirstName: req.FirstName, LastName: req.LastName, Nickname: req.Nickname, Email: req.Email, Country: req.Country})
+		replayedUser, err := reserveIdempotencyKey(ctx, idempotencyKey, requestHash)
+		if errors.Is(err, db.ErrIdempotencyKeyInUse) {
+			return nil, status.Error(codes.Aborted, err.Error())
+		}
+		if errors.Is(err, errIdempotencyKeyReused) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if replayedUser != nil {
+			return convertToProtoUser(replayedUser), nil
+		}
+	}
+
+	// Free the key up again if we fail to create the user, so the client is able to retry
+	created := false
+	defer func() {
+		if idempotencyKey != "" && !created {
+			releaseIdempotencyKey(ctx, idempotencyKey)
+		}
+	}()
+
+	existingUser, err := db.GetUser(ctx, req.Nickname)
+	if err != nil {
+		err = fmt.Errorf("errored when attempting to lookup existing users - err: %v, nickname: %q", err, req.Nickname)
+		return nil, err
+	}
+
+	if existingUser != nil && existingUser.Nickname != "" && existingUser.Nickname == req.Nickname {
+		err = fmt.Errorf("a user with this username already exists - nickname: %q", req.Nickname)
+		return nil, err
+	}
+
+	user := data.User{
+		ID:        newUUID(),
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Nickname:  req.Nickname,
+		Password:  req.Password,
+		Country:   req.Country,
+		Email:     req.Email,
+		CreatedAt: timeNow().UTC(),
+		Version:   1,
+	}
+	user.UpdatedAt = user.CreatedAt
+	logUserID(ctx, user.ID)
+
+	src := grpcAuditSource(ctx)
+	err = db.InsertUser(ctx, &user, src.auditor(data.AuditCreate))
+	if err != nil {
+		return nil, err
+	}
+	created = true
+
+	if idempotencyKey != "" {
+		completeIdempotencyKey(ctx, idempotencyKey, &user)
+	}
+
+	// The update was logged with the write, have the relay deliver it now
+	s.relay.Wake()
+
+	return convertToProtoUser(&user), nil
+}
+
+// UpdateUser updates the user from the database with a given id, ensuring no username clashes
+func (s *UserService) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.User, error) {
+	err := validateUser(ctx, req.FirstName, req.LastName, req.Nickname, req.Password, req.Country, req.Email)
+	if err != nil {
+		err = fmt.Errorf("user %q failed validation - err: %v", req.Nickname, err)
+		return nil, err
+	}
+
+	// Look up for users with this username, We want to prevent usernames being updated to usernames that already exist
+	existingUser, err := db.GetUser(ctx, req.Nickname)
+	if err != nil {
+		err = fmt.Errorf("errored when attempting to lookup existing users - err: %v, nickname: %q", err, req.Nickname)
+		return nil, err
+	}
+
+	// If the username matches an existing users, check we havn't matched with ourself
+	if existingUser != nil && existingUser.ID != req.ID {
+		err = fmt.Errorf("no users found with the given users, cannot update user, inputted user: %v", req)
+		return nil, err
+	}
+
+	logUserID(ctx, req.ID)
+	// ensure we have a correctly formatted uuid string
+	err = uuid.Validate(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	user := data.User{
+		ID:        req.ID,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Nickname:  req.Nickname,
+		Password:  req.Password,
+		Country:   req.Country,
+		Email:     req.Email,
+	}
+
+	// Set the UpdatedAt field
+	user.UpdatedAt = timeNow()
+
+	src := grpcAuditSource(ctx)
+	_, updatedUser, err := db.UpdateUser(ctx, &user, expectedVersion(req.ExpectedVersion), src.auditor(data.AuditUpdate))
+	if errors.Is(err, db.ErrVersionMismatch) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The update was logged with the write, have the relay deliver it now
+	s.relay.Wake()
+
+	return convertToProtoUser(updatedUser), nil
+}
+
+// DeleteUser deletes the user from the database with a given id
+func (s *UserService) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.Empty, error) {
+	if req.ID == "" {
+		err := fmt.Errorf("no userid provided to delete, user: %v", &req)
+		return nil, err
+	}
+
+	logUserID(ctx, req.ID)
+	// ensure we have a correctly formatted uuid string
+	err := uuid.Validate(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	src := grpcAuditSource(ctx)
+	_, _, err = db.DeleteUser(ctx, req.ID, expectedVersion(req.ExpectedVersion), timeNow(), src.auditor(data.AuditDelete))
+	if errors.Is(err, db.ErrVersionMismatch) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The update was logged with the write, have the relay deliver it now
+	s.relay.Wake()
+
+	return nil, nil
+}
+
+// RestoreUser brings back a deleted user, until they are purged
+func (s *UserService) RestoreUser(ctx context.Context, req *pb.RestoreUserRequest) (*pb.User, error) {
+	logUserID(ctx, req.ID)
+	// ensure we have a correctly formatted uuid string
+	err := uuid.Validate(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	src := grpcAuditSource(ctx)
+	_, restoredUser, err := db.RestoreUser(ctx, req.ID, src.auditor(data.AuditRestore))
+	switch {
+	case errors.Is(err, db.ErrUserNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, db.ErrNicknameTaken):
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, db.ErrVersionMismatch):
+		return nil, status.Error(codes.Aborted, err.Error())
+	case err != nil:
+		return nil, err
+	}
+
+	protoUser := convertToProtoUser(restoredUser)
+
+	// The update was logged with the write, have the relay deliver it now
+	s.relay.Wake()
+
+	return protoUser, nil
+}
+
+// BatchAddUsers creates many users at once, reporting a result per user rather than failing the whole batch
+func (s *UserService) BatchAddUsers(ctx context.Context, req *pb.BatchAddUsersRequest) (*pb.BatchResponse, error) {
+	users := make([]data.User, len(req.Users))
+	for i, user := range req.Users {
+		users[i] = convertAddUserRequest(user)
+	}
+
+	results, err := s.batchAddUsers(ctx, grpcAuditSource(ctx), users, batchAddOptions{})
+	if errors.Is(err, errBatchTooLarge) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return convertToProtoBatchResponse(results), nil
+}
+
+// BatchUpdateUsers updates many users at once, reporting a result per user rather than failing the whole batch
+func (s *UserService) BatchUpdateUsers(ctx context.Context, req *pb.BatchUpdateUsersRequest) (*pb.BatchResponse, error) {
+	users := make([]data.User, len(req.Users))
+	for i, user := range req.Users {
+		users[i] = data.User{
+			ID:        user.ID,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Nickname:  user.Nickname,
+			Password:  user.Password,
+			Country:   user.Country,
+			Email:     user.Email,
+			Version:   expectedVersion(user.ExpectedVersion),
+		}
+	}
+
+	results, err := s.batchUpdateUsers(ctx, grpcAuditSource(ctx), users)
+	if errors.Is(err, errBatchTooLarge) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return convertToProtoBatchResponse(results), nil
+}
+
+// BatchDeleteUsers deletes many users at once, reporting a result per user rather than failing the whole batch
+func (s *UserService) BatchDeleteUsers(ctx context.Context, req *pb.BatchDeleteUsersRequest) (*pb.BatchResponse, error) {
+	users := make([]data.User, len(req.Users))
+	for i, user := range req.Users {
+		users[i] = data.User{ID: user.ID, Version: expectedVersion(user.ExpectedVersion)}
+	}
+
+	results, err := s.batchDeleteUsers(ctx, grpcAuditSource(ctx), users)
+	if errors.Is(err, errBatchTooLarge) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return convertToProtoBatchResponse(results), nil
+}
+
+// ImportUsers creates every user streamed in by the client, reporting a result per user once the stream is closed.
+// Users are written in batches as they arrive, so an import can be far larger than a single batch.
+// Only admin clients can import.
+func (s *UserService) ImportUsers(stream pb.UserService_ImportUsersServer) error {
+	ctx := stream.Context()
+	if err := auth.CheckAdmin(ctx); err != nil {
+		return auth.GRPCError(err)
+	}
+
+	var results []data.BatchResult
+	batch := make([]data.User, 0, maxBatchSize)
+	src := grpcAuditSource(ctx)
+
+	flush := func() error {
+		batchResults, err := s.batchAddUsers(ctx, src, batch, batchAddOptions{})
+		if err != nil {
+			return err
+		}
+
+		// Report indexes relative to the whole stream, rather than the batch
+		for i := range batchResults {
+			batchResults[i].Index += len(results)
+		}
+		results = append(results, batchResults...)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, convertAddUserRequest(req))
+		if len(batch) == maxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(convertToProtoBatchResponse(results))
+}
+
+// ListAuditEvents lists the changes made to users, and who made them, newest first
+// Changes made to every user at once are included when filtering on a user
+func (s *UserService) ListAuditEvents(ctx context.Context, req *pb.ListAuditEventsRequest) (*pb.ListAuditEventsResponse, error) {
+	if req.UserId != "" {
+		logUserID(ctx, req.UserId)
+		// ensure we have a correctly formatted uuid string
+		if err := uuid.Validate(req.UserId); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	// An unset timestamp leaves that end of the range open, rather than meaning 1970
+	var since, until time.Time
+	if req.Since != nil {
+		since = req.Since.AsTime()
+	}
+	if req.Until != nil {
+		until = req.Until.AsTime()
+	}
+
+	page, limit := pageParams(int(req.Page), int(req.Limit), maxAuditPageSize)
+
+	events, err := db.ListAuditEvents(ctx, req.UserId, since, until, page, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	protoEvents := make([]*pb.AuditEvent, len(events))
+	for i := range events {
+		protoEvents[i] = convertToProtoAuditEvent(&events[i])
+	}
+
+	return &pb.ListAuditEventsResponse{Events: protoEvents}, nil
+}
+
+// GetUserHistory lists every revision of a user, newest first
+func (s *UserService) GetUserHistory(ctx context.Context, req *pb.GetUserHistoryRequest) (*pb.GetUserHistoryResponse, error) {
+	logUserID(ctx, req.UserId)
+	// ensure we have a correctly formatted uuid string
+	if err := uuid.Validate(req.UserId); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	page, limit := pageParams(int(req.Page), int(req.Limit), maxHistoryPageSize)
+
+	revisions, err := db.GetUserHistory(ctx, req.UserId, page, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	protoRevisions := make([]*pb.UserRevision, len(revisions))
+	for i := range revisions {
+		protoRevisions[i] = convertToProtoRevision(&revisions[i])
+	}
+
+	return &pb.GetUserHistoryResponse{Revisions: protoRevisions}, nil
+}
+
+// GetUserAt finds the revision of a user that was current at the given time
+func (s *UserService) GetUserAt(ctx context.Context, req *pb.GetUserAtRequest) (*pb.UserRevision, error) {
+	logUserID(ctx, req.UserId)
+	// ensure we have a correctly formatted uuid string
+	if err := uuid.Validate(req.UserId); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.At == nil {
+		return nil, status.Error(codes.InvalidArgument, "a time to look the user up at is required")
+	}
+
+	revision, err := db.GetUserAt(ctx, req.UserId, req.At.AsTime())
+	if errors.Is(err, db.ErrRevisionNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return convertToProtoRevision(revision), nil
+}
+
+// RevertUser puts a user back the way they were at a previous revision, as a new revision
+func (s *UserService) RevertUser(ctx context.Context, req *pb.RevertUserRequest) (*pb.User, error) {
+	logUserID(ctx, req.UserId)
+	// ensure we have a correctly formatted uuid string
+	if err := uuid.Validate(req.UserId); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	revertedUser, err := s.revertUser(ctx, grpcAuditSource(ctx), req.UserId, req.Version, expectedVersion(req.ExpectedVersion))
+	switch {
+	case errors.Is(err, db.ErrRevisionNotFound), errors.Is(err, db.ErrUserNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errRevisionDeleted):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, db.ErrNicknameTaken):
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, db.ErrVersionMismatch):
+		return nil, status.Error(codes.Aborted, err.Error())
+	case err != nil:
+		return nil, err
+	}
+
+	return convertToProtoUser(revertedUser), nil
+}
+
+// WatchUsers is the gRPC user update watcher, which notifies any watchers of updates to users
+// Watchers resuming from a sequence are first sent the updates they missed from the event log
+// Only updates matching the watcher's filter are sent, see the watchfilter package for the syntax
+func (s *UserService) WatchUsers(req *pb.WatchRequest, stream pb.UserService_WatchUsersServer) error {
+	if err := s.acceptWatch(); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	filter, err := watchfilter.Parse(req.Filter, updateTypes)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	w := &watcher{filter: filter, send: func(event *data.UserEvent) error {
+		return stream.Send(convertToProtoUpdate(event))
+	}}
+
+	err = s.watch(stream.Context(), w, req.ResumeAfter)
+	switch {
+	case errors.Is(err, errResumeExpired):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, broadcast.ErrSlowConsumer):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, errEventLog), errors.Is(err, errShuttingDown):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
+
+// acceptWatch fails with errShuttingDown once we've started shutting down, so new watchers are sent elsewhere
+// before their stream has started, rather than having it end straight away
+func (s *UserService) acceptWatch() error {
+	if s.watchesClosed.Load() {
+		return errShuttingDown
+	}
+	return nil
+}
+
+// closeWatches turns away new watchers, then ends every watch, telling the watchers to resume elsewhere
+func (s *UserService) closeWatches() {
+	s.watchesClosed.Store(true)
+	s.updates.Close()
+}
+
+// watch sends the watcher every update until ctx is done, it's shared by every transport we can watch over.
+// resumeAfter replays the logged updates after that sequence first, otherwise only live updates are sent.
+func (s *UserService) watch(ctx context.Context, w *watcher, resumeAfter *int64) error {
+	// Subscribe the connected client to our updates, until they disconnect
+	sub := s.updates.Subscribe(ctx)
+	defer sub.Close()
+
+	// We're registered before looking at the log, so nothing can slip between the replay and the live updates
+	var last int64
+	var err error
+	if resumeAfter != nil {
+		last, err = s.resumeUpdates(ctx, w, *resumeAfter)
+	} else if last, err = db.CurrentEventSequence(ctx); err != nil {
+		err = fmt.Errorf("%w - err: %v", errEventLog, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Listen and distribute updates
+	for {
+		select {
+		case <-sub.Done():
+			switch {
+			case errors.Is(sub.Err(), broadcast.ErrSlowConsumer):
+				return fmt.Errorf("%w, resume after sequence %d", sub.Err(), last)
+			case errors.Is(sub.Err(), broadcast.ErrClosed):
+				return fmt.Errorf("%w, resume after sequence %d", errShuttingDown, last)
+			}
+			return nil
+		case <-sub.Lagged():
+			// Updates were dropped while we were busy, catch up from the event log
+			if last, err = s.replayUpdates(ctx, w, last); err != nil {
+				return err
+			}
+		case event := <-sub.Updates():
+			// The subscription may have ended with updates still buffered, don't send them
+			select {
+			case <-sub.Done():
+				continue
+			default:
+			}
+
+			// Fill any gap first, from dropped updates, or ones made by other instances
+			if event.Sequence > last+1 {
+				if last, err = s.replayUpdates(ctx, w, last); err != nil {
+					return err
+				}
+			}
+
+			// Already sent from the event log
+			if event.Sequence <= last {
+				continue
+			}
+
+			if err := w.deliver(event); err != nil {
+				return err
+			}
+			last = event.Sequence
+		}
+	}
+}
+
+// watcher is a client watching for updates, send writes an update out over their transport
+type watcher struct {
+	filter *watchfilter.Filter
+	send   func(event *data.UserEvent) error
+}
+
+// deliver sends an update to the watcher, if it matches their filter
+func (w *watcher) deliver(event *data.UserEvent) error {
+	if !w.filter.Match(event) {
+		return nil
+	}
+	// Watchers never need the password hashes
+	redacted := event.Redacted()
+	return w.send(&redacted)
+}
+
+var (
+	// watchBufferSize is how many updates can queue up for a watcher, before the overflow policy kicks in
+	watchBufferSize = 64
+	// watchOverflowPolicy decides what happens to watchers that fall behind.
+	// Dropped updates are caught up from the event log, disconnected watchers can resume from their last sequence.
+	watchOverflowPolicy = broadcast.DropOldest
+)
+
+// replayPageSize is how many logged updates are read at a time when replaying
+const replayPageSize = 100
+
+var (
+	errResumeExpired = errors.New("updates after the resume sequence are no longer in the event log")
+	errEventLog      = errors.New("failed to read the event log")
+	// errShuttingDown ends every watch when we shut down, watchers can resume from another instance
+	errShuttingDown = errors.New("the server is shutting down")
+)
+
+// resumeUpdates replays the updates after the given sequence, as long as none of them have expired from the event log
+func (s *UserService) resumeUpdates(ctx context.Context, w *watcher, after int64) (int64, error) {
+	if err := checkResume(ctx, after); err != nil {
+		return after, err
+	}
+
+	return s.replayUpdates(ctx, w, after)
+}
+
+// checkResume makes sure every update after the given sequence is still in the event log
+func checkResume(ctx context.Context, after int64) error {
+	oldest, err := db.OldestEventSequence(ctx)
+	if err != nil && err != db.ErrNoEvents {
+		return fmt.Errorf("%w - err: %v", errEventLog, err)
+	}
+	if err == nil && after < oldest-1 {
+		return errResumeExpired
+	}
+	return nil
+}
+
+// replayUpdates sends the watcher every logged update after the given sequence, returning the last sequence replayed
+func (s *UserService) replayUpdates(ctx context.Context, w *watcher, after int64) (int64, error) {
+	for {
+		events, err := db.GetEventsAfter(ctx, after, replayPageSize)
+		if err != nil {
+			return after, fmt.Errorf("%w - err: %v", errEventLog, err)
+		}
+
+		for i := range events {
+			if err := w.deliver(&events[i]); err != nil {
+				return after, err
+			}
+			after = events[i].Sequence
+		}
+
+		if len(events) < replayPageSize {
+			return after, nil
+		}
+	}
+}
+
+const (
+	updateCREATED    = data.UpdateCreated
+	updateDELETED    = data.UpdateDeleted
+	updateUPDATED    = data.UpdateUpdated
+	updateALLDELETED = data.UpdateAllDeleted
+	updateRESTORED   = data.UpdateRestored
+)
+
+// updateTypes lists every kind of update, for watchers to filter on
+var updateTypes = []string{updateCREATED, updateDELETED, updateUPDATED, updateALLDELETED, updateRESTORED}
+
+// convertToProtoUpdate converts a logged data.UserEvent to the update sent to watchers
+func convertToProtoUpdate(event *data.UserEvent) *pb.UserUpdate {
+	update := &pb.UserUpdate{
+		UserId: event.UserID,
+		// Still sent for consumers that compare the type as a string
+		UpdateType:    event.UpdateType,
+		Type:          convertToProtoUpdateType(event.UpdateType),
+		User:          convertToProtoUpdateUser(event.User),
+		PreviousUser:  convertToProtoUpdateUser(event.PreviousUser),
+		ChangedFields: event.ChangedFields,
+		Actor:         event.Actor,
+		RequestId:     event.RequestID,
+		Sequence:      event.Sequence,
+	}
+	if !event.CreatedAt.IsZero() {
+		update.Timestamp = timestamppb.New(event.CreatedAt)
+	}
+	return update
+}
+
+// convertToProtoUpdateType converts one of the update* kinds to its proto enum, which shares its name after the prefix
+func convertToProtoUpdateType(updateType string) pb.UpdateType {
+	return pb.UpdateType(pb.UpdateType_value["UPDATE_TYPE_"+updateType])
+}
+
+// convertToProtoUpdateUser converts a user sent with an update, which may be nil
+func convertToProtoUpdateUser(user *data.User) *pb.User {
+	if user == nil {
+		return nil
+	}
+
+	converted := convertToProtoUser(user)
+	// Users only known by their ID have no times, leave them out
+	if user.CreatedAt.IsZero() {
+		converted.CreatedAt = nil
+	}
+	if user.UpdatedAt.IsZero() {
+		converted.UpdatedAt = nil
+	}
+	return converted
+}
+
+// Convert a data.User to a protobuf User.
+func convertToProtoUser(user *data.User) *pb.User {
+	return &pb.User{
+		ID:        user.ID,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Nickname:  user.Nickname,
+		Password:  user.Password,
+		Email:     user.Email,
+		Country:   user.Country,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+		UpdatedAt: timestamppb.New(user.UpdatedAt),
+		Version:   user.Version,
+	}
+}
+
+//################################################################
+// Request bodies
+// Every route taking a JSON body decodes it with decodeJSON, into a type holding only the fields the route uses.
+// Anything else in the body is rejected, rather than silently ignored.
+//################################################################
+
+const (
+	// maxBodyBytes caps the body of a route taking a single user or webhook
+	maxBodyBytes = 64 << 10
+	// maxBatchBodyBytes caps the body of a batch route, allowing a full batch of users
+	maxBatchBodyBytes = 4 << 20
+)
+
+var (
+	errUnsupportedMediaType = errors.New("request body must be application/json")
+	errBodyTooLarge         = errors.New("request body is too large")
+	errInvalidBody          = errors.New("invalid request body")
+)
+
+// decodeJSON decodes a request's JSON body into v, which must be the whole body.
+// The body must be sent as application/json, be at most maxBytes, and hold no fields v doesn't have.
+func decodeJSON(w http.ResponseWriter, r *http.Request, maxBytes int64, v interface{}) error {
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+		return fmt.Errorf("%w, got %q", errUnsupportedMediaType, contentType)
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return bodyError(err, maxBytes)
+	}
+
+	// Anything after the value, other than whitespace, is an error
+	if _, err := decoder.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after the json value")
+		}
+		return bodyError(err, maxBytes)
+	}
+	return nil
+}
+
+// bodyError wraps an error reading the body, telling a body that's too large apart from one that's malformed
+func bodyError(err error, maxBytes int64) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return fmt.Errorf("%w, the limit is %d bytes", errBodyTooLarge, maxBytes)
+	}
+	return fmt.Errorf("%w - err: %v", errInvalidBody, err)
+}
+
+// addUserRequest is the body used to add a user, with the fields a client can set
+type addUserRequest struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Nickname  string `json:"nickname"`
+	Password  string `json:"password"`
+	Email     string `json:"email"`
+	Country   string `json:"country"`
+}
+
+func (req *addUserRequest) user() data.User {
+	return data.User{FirstName: req.FirstName, LastName: req.LastName, Nickname: req.Nickname, Password: req.Password, Email: req.Email, Country: req.Country}
+}
+
+// updateUserRequest is the body used to update a user, the expected version is sent as If-Match
+type updateUserRequest struct {
+	ID string `json:"id"`
+	addUserRequest
+}
+
+func (req *updateUserRequest) user() data.User {
+	user := req.addUserRequest.user()
+	user.ID = req.ID
+	return user
+}
+
+// batchUpdateUserRequest is a user in a batch update, the version acting like If-Match
+type batchUpdateUserRequest struct {
+	updateUserRequest
+	Version *int64 `json:"version"`
+}
+
+func (req *batchUpdateUserRequest) user() data.User {
+	user := req.updateUserRequest.user()
+	user.Version = batchVersion(req.Version)
+	return user
+}
+
+// batchDeleteUserRequest is a user in a batch delete, the version acting like If-Match
+type batchDeleteUserRequest struct {
+	ID      string `json:"id"`
+	Version *int64 `json:"version"`
+}
+
+// batchVersion reads the version a user in a batch expects to be at, like If-Match leaving it out doesn't check the version
+func batchVersion(version *int64) int64 {
+	if version == nil {
+		return db.AnyVersion
+	}
+	return *version
+}
+
+// idRequest is the body of the routes that only need an ID, such as deleting or restoring a user
+type idRequest struct {
+	ID string `json:"id"`
+}
+
+//################################################################
+// Batch operations
+// Shared by the http and gRPC batch handlers.
+// Every user gets its own result, so one bad user doesn't fail the whole batch.
+//################################################################
+
+// maxBatchSize caps how many users can be sent in a single batch
+const maxBatchSize = 1000
+
+var errBatchTooLarge = fmt.Errorf("batches are limited to %d users", maxBatchSize)
+
+// batchAddOptions changes how batchAddUsers creates users, for importing users from another environment
+type batchAddOptions struct {
+	// preserve keeps any ID, timestamps and version on the users, rather than treating them as brand new
+	preserve bool
+	// passwordHashes stores passwords as they are, they have already been hashed so our password policy can't be checked
+	passwordHashes bool
+	// dryRun reports what would happen, without writing anything
+	dryRun bool
+}
+
+// batchAddUsers validates and creates the given users
+func (s *UserService) batchAddUsers(ctx context.Context, src auditSource, users []data.User, opts batchAddOptions) ([]data.BatchResult, error) {
+	if len(users) > maxBatchSize {
+		return nil, errBatchTooLarge
+	}
+
+	results := make([]data.BatchResult, len(users))
+	if len(users) == 0 {
+		return results, nil
+	}
+
+	// Look up every nickname (and ID) in one go, so we can spot clashes without a query per user
+	nicknames := make([]string, len(users))
+	ids := make([]string, 0, len(users))
+	for i := range users {
+		nicknames[i] = users[i].Nickname
+		if opts.preserve && users[i].ID != "" {
+			ids = append(ids, users[i].ID)
+		}
+	}
+
+	existingUsers, err := db.GetUsersByNicknames(ctx, nicknames)
+	if err != nil {
+		return nil, err
+	}
+
+	takenNicknames := make(map[string]struct{}, len(existingUsers)+len(users))
+	for _, user := range existingUsers {
+		takenNicknames[user.Nickname] = struct{}{}
+	}
+
+	takenIDs := make(map[string]struct{}, len(ids))
+	if len(ids) > 0 {
+		existingUsers, err := db.GetUsersByIDs(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range existingUsers {
+			takenIDs[user.ID] = struct{}{}
+		}
+	}
+
+	now := timeNow().UTC()
+	toInsert := make([]data.User, 0, len(users))
+	toInsertIndexes := make([]int, 0, len(users))
+	for i := range users {
+		user := users[i]
+		results[i].Index = i
+
+		var err error
+		if opts.passwordHashes {
+			err = validation.UserWithPasswordHash(user.FirstName, user.LastName, user.Nickname, user.Password, user.Country, user.Email)
+		} else {
+			err = validation.User(user.FirstName, user.LastName, user.Nickname, user.Password, user.Country, user.Email)
+		}
+		if err == nil && opts.preserve && user.ID != "" {
+			// ensure we have a correctly formatted uuid string
+			err = uuid.Validate(user.ID)
+		}
+		if err != nil {
+			results[i].ID = user.ID
+			results[i].Status = data.BatchInvalid
+			results[i].Error = err.Error()
+			continue
+		}
+
+		// Clashes with either an existing user, or one earlier in this batch
+		if _, ok := takenNicknames[user.Nickname]; ok {
+			results[i].ID = user.ID
+			results[i].Status = data.BatchConflict
+			results[i].Error = "a user with this username already exists"
+			continue
+		}
+		if _, ok := takenIDs[user.ID]; ok && opts.preserve {
+			results[i].ID = user.ID
+			results[i].Status = data.BatchConflict
+			results[i].Error = "a user with this id already exists"
+			continue
+		}
+		takenNicknames[user.Nickname] = struct{}{}
+
+		if !opts.preserve || user.ID == "" {
+			user.ID = newUUID()
+		}
+		takenIDs[user.ID] = struct{}{}
+		user.DeletedAt = nil
+
+		if !opts.preserve || user.CreatedAt.IsZero() {
+			user.CreatedAt = now
+		}
+		if !opts.preserve || user.UpdatedAt.IsZero() {
+			user.UpdatedAt = user.CreatedAt
+		}
+		if !opts.preserve || user.Version < 1 {
+			user.Version = 1
+		}
+
+		toInsert = append(toInsert, user)
+		toInsertIndexes = append(toInsertIndexes, i)
+	}
+
+	if len(toInsert) == 0 {
+		return results, nil
+	}
+
+	insertErrs := make([]error, len(toInsert))
+	if !opts.dryRun {
+		insertErrs, err = db.InsertUsers(ctx, toInsert, src.auditor(data.AuditCreate))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for j, i := range toInsertIndexes {
+		user := toInsert[j]
+		results[i].ID = user.ID
+
+		if insertErrs[j] != nil {
+			results[i].Status = data.BatchFailed
+			// Someone else beat us to it, since we checked
+			if errors.Is(insertErrs[j], db.ErrDuplicateUser) {
+				results[i].Status = data.BatchConflict
+			}
+			results[i].Error = insertErrs[j].Error()
+			continue
+		}
+
+		results[i].Status = data.BatchCreated
+		results[i].Version = user.Version
+	}
+
+	// The updates were logged with the writes, have the relay deliver them now
+	s.relay.Wake()
+
+	return results, nil
+}
+
+// batchUpdateUsers validates and applies the given updates
+// Unless a user's version is db.AnyVersion, the update only applies if the stored user is still at that version, 0 for users without one
+func (s *UserService) batchUpdateUsers(ctx context.Context, src auditSource, users []data.User) ([]data.BatchResult, error) {
+	if len(users) > maxBatchSize {
+		return nil, errBatchTooLarge
+	}
+
+	results := make([]data.BatchResult, len(users))
+	if len(users) == 0 {
+		return results, nil
+	}
+
+	ids := make([]string, 0, len(users))
+	nicknames := make([]string, 0, len(users))
+	seenIDs := make(map[string]struct{}, len(users))
+	valid := make([]int, 0, len(users))
+	for i := range users {
+		user := &users[i]
+		results[i].Index = i
+		results[i].ID = user.ID
+
+		err := validation.User(user.FirstName, user.LastName, user.Nickname, user.Password, user.Country, user.Email)
+		if err == nil {
+			// ensure we have a correctly formatted uuid string
+			err = uuid.Validate(user.ID)
+		}
+		if err != nil {
+			results[i].Status = data.BatchInvalid
+			results[i].Error = err.Error()
+			continue
+		}
+
+		// We cant tell which of two updates to the same user should win
+		if _, ok := seenIDs[user.ID]; ok {
+			results[i].Status = data.BatchInvalid
+			results[i].Error = "user appears more than once in the batch"
+			continue
+		}
+		seenIDs[user.ID] = struct{}{}
+
+		ids = append(ids, user.ID)
+		nicknames = append(nicknames, user.Nickname)
+		valid = append(valid, i)
+	}
+
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	storedUsers, err := db.GetUsersByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	storedByID := make(map[string]data.User, len(storedUsers))
+	for _, user := range storedUsers {
+		storedByID[user.ID] = user
+	}
+
+	// Look up every nickname in one go, so we can spot clashes without a query per user
+	nicknameOwners, err := db.GetUsersByNicknames(ctx, nicknames)
+	if err != nil {
+		return nil, err
+	}
+	ownerByNickname := make(map[string]string, len(nicknameOwners)+len(valid))
+	for _, user := range nicknameOwners {
+		ownerByNickname[user.Nickname] = user.ID
+	}
+
+	now := timeNow()
+	toUpdate := make([]data.User, 0, len(valid))
+	toUpdateStored := make([]data.User, 0, len(valid))
+	toUpdateIndexes := make([]int, 0, len(valid))
+	for _, i := range valid {
+		user := users[i]
+
+		storedUser, ok := storedByID[user.ID]
+		if !ok {
+			results[i].Status = data.BatchNotFound
+			results[i].Error = db.ErrUserNotFound.Error()
+			continue
+		}
+
+		if user.Version != db.AnyVersion && user.Version != storedUser.Version {
+			results[i].Status = data.BatchConflict
+			results[i].Error = db.ErrVersionMismatch.Error()
+			continue
+		}
+
+		// Clashes with either an existing user, or one earlier in this batch
+		if owner, ok := ownerByNickname[user.Nickname]; ok && owner != user.ID {
+			results[i].Status = data.BatchConflict
+			results[i].Error = "a user with this username already exists"
+			continue
+		}
+		ownerByNickname[user.Nickname] = user.ID
+
+		user.UpdatedAt = now
+		toUpdate = append(toUpdate, user)
+		// Always update against the version we've just read, so we never overwrite a change made since
+		toUpdateStored = append(toUpdateStored, storedUser)
+		toUpdateIndexes = append(toUpdateIndexes, i)
+	}
+
+	if len(toUpdate) == 0 {
+		return results, nil
+	}
+
+	updatedUsers, updateErrs, err := db.UpdateUsers(ctx, toUpdate, toUpdateStored, src.auditor(data.AuditUpdate))
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range toUpdateIndexes {
+		switch {
+		case errors.Is(updateErrs[j], db.ErrUserNotFound):
+			results[i].Status = data.BatchNotFound
+			results[i].Error = updateErrs[j].Error()
+			continue
+		// Someone else got to the user between us reading it and writing to it
+		case errors.Is(updateErrs[j], db.ErrVersionMismatch):
+			results[i].Status = data.BatchConflict
+			results[i].Error = updateErrs[j].Error()
+			continue
+		case updateErrs[j] != nil:
+			results[i].Status = data.BatchFailed
+			results[i].Error = updateErrs[j].Error()
+			continue
+		}
+
+		results[i].Status = data.BatchUpdated
+		results[i].Version = updatedUsers[j].Version
+	}
+
+	// The updates were logged with the writes, have the relay deliver them now
+	s.relay.Wake()
+
+	return results, nil
+}
+
+// batchDeleteUsers deletes the given users, only the ID (and optionally version) of each user is used
+// Unless a user's version is db.AnyVersion, the delete only applies if the stored user is still at that version, 0 for users without one
+func (s *UserService) batchDeleteUsers(ctx context.Context, src auditSource, users []data.User) ([]data.BatchResult, error) {
+	if len(users) > maxBatchSize {
+		return nil, errBatchTooLarge
+	}
+
+	results := make([]data.BatchResult, len(users))
+	if len(users) == 0 {
+		return results, nil
+	}
+
+	ids := make([]string, 0, len(users))
+	seenIDs := make(map[string]struct{}, len(users))
+	valid := make([]int, 0, len(users))
+	for i := range users {
+		user := &users[i]
+		results[i].Index = i
+		results[i].ID = user.ID
+
+		// ensure we have a correctly formatted uuid string
+		if err := uuid.Validate(user.ID); err != nil {
+			results[i].Status = data.BatchInvalid
+			results[i].Error = err.Error()
+			continue
+		}
+
+		if _, ok := seenIDs[user.ID]; ok {
+			results[i].Status = data.BatchInvalid
+			results[i].Error = "user appears more than once in the batch"
+			continue
+		}
+		seenIDs[user.ID] = struct{}{}
+
+		ids = append(ids, user.ID)
+		valid = append(valid, i)
+	}
+
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	storedUsers, err := db.GetUsersByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	storedByID := make(map[string]data.User, len(storedUsers))
+	for _, user := range storedUsers {
+		storedByID[user.ID] = user
+	}
+
+	toDelete := make([]data.User, 0, len(valid))
+	toDeleteIndexes := make([]int, 0, len(valid))
+	for _, i := range valid {
+		user := users[i]
+
+		storedUser, ok := storedByID[user.ID]
+		if !ok {
+			results[i].Status = data.BatchNotFound
+			results[i].Error = db.ErrUserNotFound.Error()
+			continue
+		}
+
+		if user.Version != db.AnyVersion && user.Version != storedUser.Version {
+			results[i].Status = data.BatchConflict
+			results[i].Error = db.ErrVersionMismatch.Error()
+			continue
+		}
+
+		// Always delete against the version we've just read, so we never delete a user that has changed since
+		toDelete = append(toDelete, storedUser)
+		toDeleteIndexes = append(toDeleteIndexes, i)
+	}
+
+	if len(toDelete) == 0 {
+		return results, nil
+	}
+
+	deletedAt := timeNow()
+	_, deleteErrs, err := db.DeleteUsers(ctx, toDelete, deletedAt, src.auditor(data.AuditDelete))
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range toDeleteIndexes {
+		switch {
+		// Someone else got to the user between us reading it and deleting it
+		case errors.Is(deleteErrs[j], db.ErrVersionMismatch):
+			results[i].Status = data.BatchConflict
+			results[i].Error = deleteErrs[j].Error()
+			continue
+		case deleteErrs[j] != nil:
+			results[i].Status = data.BatchFailed
+			results[i].Error = deleteErrs[j].Error()
+			continue
+		}
+
+		results[i].Status = data.BatchDeleted
+	}
+
+	// The updates were logged with the writes, have the relay deliver them now
+	s.relay.Wake()
+
+	return results, nil
+}
+
+// convertAddUserRequest converts a protobuf AddUserRequest into a data.User
+func convertAddUserRequest(req *pb.AddUserRequest) data.User {
+	return data.User{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Nickname:  req.Nickname,
+		Password:  req.Password,
+		Country:   req.Country,
+		Email:     req.Email,
+	}
+}
+
+// batchStatuses maps our batch result statuses onto their protobuf equivalent
+var batchStatuses = map[string]pb.BatchItemStatus{
+	data.BatchCreated:  pb.BatchItemStatus_BATCH_ITEM_STATUS_CREATED,
+	data.BatchUpdated:  pb.BatchItemStatus_BATCH_ITEM_STATUS_UPDATED,
+	data.BatchDeleted:  pb.BatchItemStatus_BATCH_ITEM_STATUS_DELETED,
+	data.BatchConflict: pb.BatchItemStatus_BATCH_ITEM_STATUS_CONFLICT,
+	data.BatchInvalid:  pb.BatchItemStatus_BATCH_ITEM_STATUS_INVALID,
+	data.BatchNotFound: pb.BatchItemStatus_BATCH_ITEM_STATUS_NOT_FOUND,
+	data.BatchFailed:   pb.BatchItemStatus_BATCH_ITEM_STATUS_FAILED,
+}
+
+// convertToProtoBatchResponse converts our batch results into a protobuf BatchResponse
+func convertToProtoBatchResponse(results []data.BatchResult) *pb.BatchResponse {
+	protoResults := make([]*pb.BatchItemResult, len(results))
+	for i, result := range results {
+		protoResults[i] = &pb.BatchItemResult{
+			Index:   int64(result.Index),
+			ID:      result.ID,
+			Status:  batchStatuses[result.Status],
+			Error:   result.Error,
+			Version: result.Version,
+		}
+	}
+
+	return &pb.BatchResponse{Results: protoResults}
+}
+
+//################################################################
+// Audit log
+// Every change made to a user is recorded, along with who made it and how it reached us.
+//################################################################
+
+// anonymousActor is recorded when the caller doesn't have a known API key
+const anonymousActor = "anonymous"
+
+// maxAuditPageSize caps how many audit events can be listed at once
+const maxAuditPageSize = 100
+
+// auditSource describes who made a change, and how it reached us
+type auditSource struct {
+	actor     string
+	sourceIP  string
+	transport string
+	requestID string
+}
+
+// httpAuditSource attributes the request to the client its API key belongs to, under the request ID given to the request
+func httpAuditSource(r *http.Request) auditSource {
+	return newAuditSource(authenticatedActor(r.Context()), r.RemoteAddr, data.TransportHTTP, requestid.FromContext(r.Context()))
+}
+
+// grpcAuditSource attributes the RPC to the client its API key belongs to, under the request ID given to the RPC
+func grpcAuditSource(ctx context.Context) auditSource {
+	var sourceIP string
+	if p, ok := peer.FromContext(ctx); ok {
+		sourceIP = p.Addr.String()
+	}
+
+	return newAuditSource(authenticatedActor(ctx), sourceIP, data.TransportGRPC, requestid.FromContext(ctx))
+}
+
+// authenticatedActor is the client the request ctx belongs to came from, which they can't claim to be without its API key.
+// Requests without a known key are anonymous.
+func authenticatedActor(ctx context.Context) string {
+	client, _ := auth.FromContext(ctx)
+	return client.Name
+}
+
+// cliAuditSource attributes changes made by a subcommand to whoever is running it, under the subcommand's request ID
+func cliAuditSource(ctx context.Context) auditSource {
+	return newAuditSource(os.Getenv("USER"), "", data.TransportCLI, requestid.FromContext(ctx))
+}
+
+// newAuditSource fills in the blanks, every event from the same request shares a request ID so they can be tied together
+func newAuditSource(actor, sourceIP, transport, requestID string) auditSource {
+	if actor == "" {
+		actor = anonymousActor
+	}
+	if requestID == "" {
+		requestID = newUUID()
+	}
+
+	return auditSource{actor: actor, sourceIP: sourceIP, transport: transport, requestID: requestID}
+}
+
+// userChange is a change made to a user, before is nil for a new user
+type userChange struct {
+	action string
+	userID string
+	before *data.User
+	after  *data.User
+}
+
+// event builds the audit event for a change to a user
+func (src auditSource) event(change userChange) data.AuditEvent {
+	return data.AuditEvent{
+		ID:        newUUID(),
+		UserID:    change.userID,
+		Action:    change.action,
+		Actor:     src.actor,
+		SourceIP:  src.sourceIP,
+		Transport: src.transport,
+		RequestID: src.requestID,
+		Changes:   audit.Diff(change.before, change.after),
+		CreatedAt: timeNow().UTC(),
+	}
+}
+
+// auditor builds the audit events for changes of the given kind, for the db package to store in the same transaction as the changes
+func (src auditSource) auditor(action string) db.Auditor {
+	return func(userID string, before, after *data.User) data.AuditEvent {
+		return src.event(userChange{action: action, userID: userID, before: before, after: after})
+	}
+}
+
+// pageParams clamps the page and page size asked for, falling back to the first page and the largest page size
+func pageParams(page, limit, maxLimit int) (int, int) {
+	if page < 1 || page > 1000 {
+		page = 1
+	}
+	if limit < 1 || limit > maxLimit {
+		limit = maxLimit
+	}
+
+	return page, limit
+}
+
+// convertToProtoAuditEvent converts a data.AuditEvent to a protobuf AuditEvent
+func convertToProtoAuditEvent(event *data.AuditEvent) *pb.AuditEvent {
+	changes := make([]*pb.FieldChange, len(event.Changes))
+	for i, change := range event.Changes {
+		changes[i] = &pb.FieldChange{Field: change.Field, Before: change.Before, After: change.After}
+	}
+
+	return &pb.AuditEvent{
+		ID:        event.ID,
+		UserId:    event.UserID,
+		Action:    event.Action,
+		Actor:     event.Actor,
+		SourceIp:  event.SourceIP,
+		Transport: event.Transport,
+		RequestId: event.RequestID,
+		Changes:   changes,
+		CreatedAt: timestamppb.New(event.CreatedAt),
+	}
+}
+
+//################################################################
+// User history
+// Every version of a user is kept, so we can see what they looked like at any point in time.
+//################################################################
+
+// maxHistoryPageSize caps how many revisions can be listed at once
+const maxHistoryPageSize = 100
+
+// errRevisionDeleted is returned when reverting to a revision where the user had been deleted
+var errRevisionDeleted = errors.New("the user was deleted at this revision, delete them instead")
+
+// revertUser puts a user back the way they were at the given version, which is recorded as a new version.
+// Unless expectedVersion is db.AnyVersion, the revert only applies if the user is still at that version.
+func (s *UserService) revertUser(ctx context.Context, src auditSource, userID string, version, expectedVersion int64) (*data.User, error) {
+	revision, err := db.GetRevision(ctx, userID, version)
+	if err != nil {
+		return nil, err
+	}
+	if revision.User.DeletedAt != nil {
+		return nil, errRevisionDeleted
+	}
+
+	// Nicknames are free to be reused once a user changes theirs, someone may have taken it since
+	existingUser, err := db.GetUser(ctx, revision.User.Nickname)
+	if err != nil {
+		return nil, fmt.Errorf("errored when attempting to lookup existing users - err: %v", err)
+	}
+	if existingUser.Nickname != "" && existingUser.ID != userID {
+		return nil, db.ErrNicknameTaken
+	}
+
+	user := revision.User
+	user.UpdatedAt = timeNow()
+
+	_, revertedUser, err := db.UpdateUser(ctx, &user, expectedVersion, src.auditor(data.AuditRevert))
+	if err != nil {
+		return nil, err
+	}
+
+	// The update was logged with the write, have the relay deliver it now
+	s.relay.Wake()
+
+	return revertedUser, nil
+}
+
+// convertToProtoRevision converts a data.UserRevision to a protobuf UserRevision
+func convertToProtoRevision(revision *data.UserRevision) *pb.UserRevision {
+	protoRevision := &pb.UserRevision{
+		UserId:     revision.UserID,
+		Version:    revision.Version,
+		Action:     revision.Action,
+		User:       convertToProtoUser(&revision.User),
+		RecordedAt: timestamppb.New(revision.RecordedAt),
+	}
+	if revision.User.DeletedAt != nil {
+		protoRevision.DeletedAt = timestamppb.New(*revision.User.DeletedAt)
+	}
+
+	return protoRevision
+}
+
+//################################################################
+// Watching users over HTTP
+// Browsers can't use the gRPC WatchUsers stream, so the same updates are also sent as Server-Sent Events, or over a WebSocket.
+//################################################################
+
+// watchKeepAlive is how often an idle feed is pinged, so proxies don't close it
+var watchKeepAlive = 30 * time.Second
+
+// watchWriteTimeout limits how long sending a single update over a WebSocket can take
+const watchWriteTimeout = 10 * time.Second
+
+var errInvalidResume = errors.New("resume sequence must be a positive number")
+
+// watchUpgrader upgrades requests to WebSockets, only pages served from our own origin may connect
+var watchUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// watchParams reads the filter and resume sequence shared by the HTTP feeds.
+// A reconnecting EventSource sends the Last-Event-ID header, which takes priority over the resume_after parameter.
+func watchParams(r *http.Request) (*watchfilter.Filter, *int64, error) {
+	query := r.URL.Query()
+
+	filter, err := watchfilter.Parse(query.Get("filter"), updateTypes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = query.Get("resume_after")
+	}
+	if resume == "" {
+		return filter, nil, nil
+	}
+
+	sequence, err := strconv.ParseInt(resume, 10, 64)
+	if err != nil || sequence < 0 {
+		return nil, nil, fmt.Errorf("%w, got %q", errInvalidResume, resume)
+	}
+	if err := checkResume(r.Context(), sequence); err != nil {
+		return nil, nil, err
+	}
+
+	return filter, &sequence, nil
+}
+
+// watchUsersHandler streams user updates as Server-Sent Events.
+// Each event's ID is the update's sequence, so an EventSource picks up where it left off when it reconnects.
+func watchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err       error
+		streaming bool
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "watchUsersHandler failed", "path", r.URL.Path, "error", err)
+			// Once the stream has started, the client can only tell from it ending
+			if !streaming {
+				w.WriteHeader(httpStatus(err))
+			}
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		err = errors.New("streaming is not supported")
+		return
+	}
+
+	filter, resumeAfter, err := watchParams(r)
+	if err != nil {
+		return
+	}
+	if err = userService.acceptWatch(); err != nil {
+		return
 	}
 
-	return &pb.GetUsersResponse{Users: protoUsers}, nil
-}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	streaming = true
 
-// AddUser creates a new user in the database, ensuring no username clashes
-func (s *UserService) AddUser(ctx context.Context, req *pb.AddUserRequest) (*pb.User, error) {
-	err := validation.User(req.FirstName, req.LastName, req.Nickname, req.Password, req.Country, req.Email)
-	if err != nil {
-		err = fmt.Errorf("user failed validation - err: %v, user:%+v", err, req)
-		return nil, err
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Updates and keep alives are written from different goroutines
+	var mu sync.Mutex
+	write := func(event []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := w.Write(event); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
 	}
 
-	existingUser, err := db.GetUser(req.Nickname)
-	if err != nil {
-		err = fmt.Errorf("errored when attempting to lookup existing users - err: %v, user:%+v", err, req)
-		return nil, err
+	// The response can't be written once the handler returns, so wait for the keep alives to stop first
+	var keepAlives sync.WaitGroup
+	defer func() {
+		cancel()
+		keepAlives.Wait()
+	}()
+	keepAlives.Add(1)
+	go func() {
+		defer keepAlives.Done()
+		ticker := time.NewTicker(watchKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := write([]byte(": keep-alive\n\n")); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	sse := &watcher{filter: filter, send: func(update *data.UserEvent) error {
+		buf := jingo.NewBufferFromPool()
+		defer buf.ReturnToPool()
+		userEventEncoder.Marshal(update, buf)
+
+		// Updates which couldn't be logged have no ID, so the client keeps its place
+		var event bytes.Buffer
+		if update.Sequence > 0 {
+			fmt.Fprintf(&event, "id: %d\n", update.Sequence)
+		}
+		// A line break would end the data early, so each line gets its own data field
+		for _, line := range bytes.Split(buf.Bytes, []byte("\n")) {
+			fmt.Fprintf(&event, "data: %s\n", line)
+		}
+		event.WriteString("\n")
+
+		return write(event.Bytes())
+	}}
+
+	err = userService.watch(ctx, sse, resumeAfter)
+
+	// Tell the client we're going, so it reconnects to another instance from its last event rather than treating it as a failure
+	if errors.Is(err, errShuttingDown) {
+		err = write([]byte(fmt.Sprintf("event: shutdown\ndata: %s\n\n", err)))
 	}
+}
 
-	if existingUser != nil && existingUser.Nickname != "" && existingUser.Nickname == req.Nickname {
-		err = fmt.Errorf("a user with this username already exists - user:%+v", req)
-		return nil, err
+// watchUsersWebSocketHandler streams user updates over a WebSocket, as JSON text messages.
+// Clients resume by reconnecting with resume_after set to the last sequence they received.
+func watchUsersWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err       error
+		streaming bool
+	)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%s\n%s", rec, debug.Stack())
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "watchUsersWebSocketHandler failed", "path", r.URL.Path, "error", err)
+			// The upgrader writes its own errors, and once upgraded we can only close the connection
+			if !streaming {
+				w.WriteHeader(httpStatus(err))
+			}
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		err = fmt.Errorf("incorrect method %s", r.Method)
+		return
 	}
 
-	user := data.User{
-		ID:        newUUID(),
-		FirstName: req.FirstName,
-		LastName:  req.LastName,
-		Nickname:  req.Nickname,
-		Password:  req.Password,
-		Country:   req.Country,
-		Email:     req.Email,
-		CreatedAt: timeNow().UTC(),
+	filter, resumeAfter, err := watchParams(r)
+	if err != nil {
+		return
+	}
+	if err = userService.acceptWatch(); err != nil {
+		return
 	}
-	user.UpdatedAt = user.CreatedAt
 
-	err = db.InsertUser(&user)
+	streaming = true
+	conn, err := watchUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		return nil, err
+		return
 	}
+	defer conn.Close()
 
-	// Spawn a go routine, so we dont impact the request
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// We don't expect any messages, but have to read to answer pings, and to notice the client going away
 	go func() {
-		s.NotifyUpdate(user.ID, updateCREATED, convertToProtoUser(&user))
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
 	}()
 
-	return convertToProtoUser(&user), nil
+	go func() {
+		ticker := time.NewTicker(watchKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(watchWriteTimeout)); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	ws := &watcher{filter: filter, send: func(update *data.UserEvent) error {
+		buf := jingo.NewBufferFromPool()
+		defer buf.ReturnToPool()
+		userEventEncoder.Marshal(update, buf)
+
+		conn.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+		return conn.WriteMessage(websocket.TextMessage, buf.Bytes)
+	}}
+
+	err = userService.watch(ctx, ws, resumeAfter)
+
+	// Tell the client why we stopped, unless they were the ones to go
+	code, reason := websocket.CloseNormalClosure, ""
+	switch {
+	case ctx.Err() != nil:
+		return
+	case errors.Is(err, broadcast.ErrSlowConsumer):
+		code, reason = websocket.CloseTryAgainLater, err.Error()
+	case errors.Is(err, errShuttingDown):
+		code, reason = websocket.CloseServiceRestart, err.Error()
+	case err != nil:
+		code = websocket.CloseInternalServerErr
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(watchWriteTimeout))
 }
 
-// UpdateUser updates the user from the database with a given id, ensuring no username clashes
-func (s *UserService) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.User, error) {
-	err := validation.User(req.FirstName, req.LastName, req.Nickname, req.Password, req.Country, req.Email)
-	if err != nil {
-		err = fmt.Errorf("user failed validation - err: %v, user:%+v", err, req)
-		return nil, err
+//################################################################
+// Outbox
+// Every write logs its update in the same transaction, the relay then delivers them from the log.
+//################################################################
+
+var (
+	// relayInterval is how often the relay looks for updates logged by other instances, or that it failed to deliver
+	relayInterval = time.Second
+	// relayLease is how long an instance stays the relay for, without renewing it
+	relayLease = 30 * time.Second
+)
+
+// relayLeaseName is the lease held by whichever instance is relaying updates
+const relayLeaseName = "outbox_relay"
+
+// newRelay creates the relay delivering our logged updates, identified by a new ID every time the service starts
+func (s *UserService) newRelay() *outbox.Relay {
+	return outbox.New(outbox.Config{
+		Owner:    uuid.NewString(),
+		Interval: relayInterval,
+		Lease:    relayLease,
+		Acquire: func(owner string, lease time.Duration) (bool, error) {
+			return db.AcquireLease(context.Background(), relayLeaseName, owner, lease)
+		},
+		Pending: func(limit int64) ([]data.UserEvent, error) {
+			return db.GetUndeliveredEvents(context.Background(), limit)
+		},
+		Deliver: s.deliverUpdate,
+		MarkDelivered: func(sequences []int64) error {
+			return db.MarkEventsDelivered(context.Background(), sequences, timeNow())
+		},
+	})
+}
+
+// deliverUpdate publishes a logged update to the message broker, then sends it to our watchers and queues it for the webhooks that want it.
+// Updates the broker doesn't take are retried by the relay before anyone else hears about them.
+func (s *UserService) deliverUpdate(event data.UserEvent) error {
+	if s.publisher != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		defer cancel()
+		// The broker's consumers never need the password hashes
+		redacted := event.Redacted()
+		if err := s.publisher.Publish(ctx, convertToProtoUpdate(&redacted)); err != nil {
+			return fmt.Errorf("failed to publish update %d - err: %w", event.Sequence, err)
+		}
 	}
 
-	// Look up for users with this username, We want to prevent usernames being updated to usernames that already exist
-	existingUser, err := db.GetUser(req.Nickname)
-	if err != nil {
-		err = fmt.Errorf("errored when attempting to lookup existing users - err: %v, user:%+v", err, req)
-		return nil, err
+	// Queue the webhook deliveries before the watchers hear about it, so an update the relay has to retry isn't sent to them twice
+	if err := s.dispatchWebhooks(context.Background(), event); err != nil {
+		return fmt.Errorf("failed to queue update %d for webhooks - err: %w", event.Sequence, err)
 	}
 
-	// If the username matches an existing users, check we havn't matched with ourself
-	if existingUser != nil && existingUser.ID != req.ID {
-		err = fmt.Errorf("no users found with the given users, cannot update user, inputted user: %v", req)
-		return nil, err
+	s.updates.Publish(&event)
+	return nil
+}
+
+// followUpdates sends our watchers the updates logged by every instance while another instance is the relay,
+// every relayInterval until ctx is done. Watchers skip any update they've already been sent.
+func (s *UserService) followUpdates(ctx context.Context) {
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+
+	last := int64(-1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			last = s.follow(ctx, last)
+		}
 	}
+}
 
-	// ensure we have a correctly formatted uuid string
-	err = uuid.Validate(req.ID)
-	if err != nil {
-		return nil, err
+// follow publishes the updates logged after the last one we followed, returning the new last one.
+// The relay publishes them itself while we hold the lease, so then we only start following again once we lose it, from -1.
+func (s *UserService) follow(ctx context.Context, last int64) int64 {
+	if s.relay.Stats().Leader {
+		return -1
 	}
 
-	user := data.User{
-		ID:        req.ID,
-		FirstName: req.FirstName,
-		LastName:  req.LastName,
-		Nickname:  req.Nickname,
-		Password:  req.Password,
-		Country:   req.Country,
-		Email:     req.Email,
+	var err error
+	if last < 0 {
+		// Start from the latest update, watchers catch up on anything before it from the log
+		if last, err = db.CurrentEventSequence(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to follow updates", "error", err)
+			return -1
+		}
+		return last
 	}
 
-	// Set the UpdatedAt field
-	user.UpdatedAt = timeNow()
+	for {
+		events, err := db.GetEventsAfter(ctx, last, replayPageSize)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to follow updates", "after", last, "error", err)
+			return last
+		}
 
-	updatedUser, err := db.UpdateUser(&user)
-	if err != nil {
-		return nil, err
+		for i := range events {
+			s.updates.Publish(&events[i])
+			last = events[i].Sequence
+		}
+
+		if len(events) < replayPageSize {
+			return last
+		}
 	}
+}
 
-	// Spawn a go routine, so we dont impact the request
-	go func() {
-		s.NotifyUpdate(user.ID, updateUPDATED, convertToProtoUser(updatedUser))
-	}()
+//################################################################
+// Message broker
+// Updates are published to Kafka or NATS for the services consuming them from our bus, see the publisher package.
+//################################################################
 
-	return convertToProtoUser(updatedUser), nil
-}
+var (
+	// publisherKind is the broker updates are published to, kafka or nats, or nowhere when empty
+	publisherKind = ""
+	// publisherAddr lists the Kafka brokers, or the NATS server URLs, separated by commas. Empty uses the broker's default on localhost
+	publisherAddr     = ""
+	publisherTopic    = "user.updates"
+	publisherEncoding = publisher.Protobuf
+	// publishTimeout is how long the broker has to take an update, before it's retried
+	publishTimeout = 10 * time.Second
+)
 
-// DeleteUser deletes the user from the database with a given id
-func (s *UserService) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.Empty, error) {
-	if req.ID == "" {
-		err := fmt.Errorf("no userid provided to delete, user: %v", &req)
-		return nil, err
+// newPublisher creates the publisher for the configured broker, or nil when there isn't one
+func newPublisher() (publisher.Publisher, error) {
+	switch publisherKind {
+	case "":
+		return nil, nil
+	case "kafka":
+		addr := publisherAddr
+		if addr == "" {
+			addr = "localhost:9092"
+		}
+		return publisher.NewKafka(strings.Split(addr, ","), publisherTopic, publisherEncoding), nil
+	case "nats":
+		addr := publisherAddr
+		if addr == "" {
+			addr = "nats://localhost:4222"
+		}
+		return publisher.NewNATS(addr, publisherTopic, publisherEncoding)
 	}
+	return nil, fmt.Errorf("unknown publisher %q, expected kafka or nats", publisherKind)
+}
 
-	// ensure we have a correctly formatted uuid string
-	err := uuid.Validate(req.ID)
+//################################################################
+// Webhooks
+// Other services are POSTed user updates as they happen, see the webhook package for how they're signed and retried.
+//################################################################
+
+var (
+	// webhookAttempts is how many times a delivery is tried, before it's dead-lettered
+	webhookAttempts = 8
+	// webhookBackoff is the wait before the first retry, doubling with every attempt up to webhookMaxBackoff
+	webhookBackoff    = 5 * time.Second
+	webhookMaxBackoff = 10 * time.Minute
+	// webhookTimeout is how long receivers have to respond
+	webhookTimeout = 10 * time.Second
+	// webhookAllowPrivate lets webhooks be delivered to localhost and private addresses, for local development
+	webhookAllowPrivate = false
+)
+
+const (
+	webhookWorkers = 4
+
+	// maxDeliveryPageSize caps how many deliveries or dead letters can be listed at once
+	maxDeliveryPageSize = 100
+)
+
+// newWebhookDispatcher creates the dispatcher, recording every attempt in the delivery log and every delivery given up on as a dead letter
+func newWebhookDispatcher() *webhook.Dispatcher {
+	return webhook.NewDispatcher(webhook.Config{
+		Client:      webhook.NewClient(webhookTimeout, webhookAllowPrivate),
+		Store:       newWebhookStore(),
+		Workers:     webhookWorkers,
+		MaxAttempts: webhookAttempts,
+		BaseDelay:   webhookBackoff,
+		MaxDelay:    webhookMaxBackoff,
+		Record: func(delivery data.WebhookDelivery) {
+			if err := db.InsertWebhookDelivery(context.Background(), delivery); err != nil {
+				slog.Error("failed to log webhook delivery attempt", "attempt", delivery.Attempt, "delivery_id", delivery.DeliveryID, "webhook_id", delivery.WebhookID, "error", err)
+			}
+		},
+		DeadLetter: func(deadLetter data.WebhookDeadLetter) error {
+			slog.Warn("gave up delivering update to webhook", "sequence", deadLetter.Event.Sequence, "webhook_id", deadLetter.WebhookID, "attempts", deadLetter.Attempts, "last_error", deadLetter.LastError)
+			return db.InsertDeadLetter(context.Background(), deadLetter)
+		},
+	})
+}
+
+// newWebhookStore creates the store for deliveries still to be made, tests keep theirs in memory
+var newWebhookStore = func() webhook.Store {
+	return webhookStore{}
+}
+
+// webhookStore keeps deliveries still to be made in mongo, shared by every instance's workers
+type webhookStore struct{}
+
+func (webhookStore) Add(ctx context.Context, deliveries []data.PendingWebhookDelivery) error {
+	return db.AddPendingDeliveries(ctx, deliveries)
+}
+
+func (webhookStore) Claim(ctx context.Context, now time.Time, lease time.Duration) (data.PendingWebhookDelivery, bool, error) {
+	delivery, err := db.ClaimPendingDelivery(ctx, now, lease)
+	if errors.Is(err, db.ErrNoDeliveryDue) {
+		return data.PendingWebhookDelivery{}, false, nil
+	}
 	if err != nil {
-		return nil, err
+		return data.PendingWebhookDelivery{}, false, err
 	}
+	return *delivery, true, nil
+}
+
+func (webhookStore) Reschedule(ctx context.Context, id string, attempt int, at time.Time) error {
+	return db.ReschedulePendingDelivery(ctx, id, attempt, at)
+}
 
-	err = db.DeleteUser(req.ID)
+func (webhookStore) Remove(ctx context.Context, id string) error {
+	return db.RemovePendingDelivery(ctx, id)
+}
+
+// dispatchWebhooks queues an update for delivery to every webhook that wants it.
+// The deliveries are stored before it returns, so the relay can mark the update delivered without them being lost.
+func (s *UserService) dispatchWebhooks(ctx context.Context, event data.UserEvent) error {
+	hooks, err := db.ListWebhooks(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Spawn a go routine, so we dont impact the request
-	go func() {
-		s.NotifyUpdate(req.ID, updateDELETED, &pb.User{ID: req.ID})
-	}()
+	wanted := make([]data.Webhook, 0, len(hooks))
+	for i := range hooks {
+		if webhook.Wants(&hooks[i], event.UpdateType) {
+			wanted = append(wanted, hooks[i])
+		}
+	}
 
-	return nil, nil
+	return s.webhooks.Dispatch(ctx, event, wanted)
 }
 
-// WatchUsers is the gRPC user update watcher, which notifies any watchers of updates to users
-func (s *UserService) WatchUsers(req *pb.WatchRequest, stream pb.UserService_WatchUsersServer) error {
-	// Create a personal chan for the connected watcher
-	updateChan := make(chan *pb.UserUpdate)
-	s.mu.Lock()
+// webhookRequest is the body used to add, update or delete a webhook
+// The secret can be set, but is never returned
+type webhookRequest struct {
+	ID         string   `json:"id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret"`
+}
 
-	// Add to our directory of watchers, so we can notify them all
-	s.watchers[updateChan] = struct{}{}
-	s.mu.Unlock()
+// webhook validates the request, and builds the webhook it describes.
+// The secret is optional when updating, to keep the existing one.
+func (req *webhookRequest) webhook(requireSecret bool) (data.Webhook, error) {
+	eventTypes := make([]string, len(req.EventTypes))
+	for i, eventType := range req.EventTypes {
+		eventTypes[i] = strings.ToUpper(eventType)
+	}
 
-	defer func() {
-		// Clean up
-		s.mu.Lock()
-		delete(s.watchers, updateChan)
-		s.mu.Unlock()
-		close(updateChan)
-	}()
+	if err := validation.Webhook(req.URL, eventTypes, updateTypes, webhookAllowPrivate); err != nil {
+		return data.Webhook{}, err
+	}
+	if requireSecret || req.Secret != "" {
+		if err := validation.WebhookSecret(req.Secret); err != nil {
+			return data.Webhook{}, err
+		}
+	}
 
-	// Listen and distribute updates
-	for update := range updateChan {
-		if err := stream.Send(update); err != nil {
+	return data.Webhook{ID: req.ID, URL: req.URL, EventTypes: eventTypes, Secret: req.Secret}, nil
+}
+
+//################################################################
+// Subcommands
+// One-off tasks ran against the database, e.g. `userapi import -format=csv -in=users.csv`
+//################################################################
+
+// runExport writes every user to a file (or stdout) as CSV or NDJSON
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	formatFlag := flags.String("format", string(transfer.NDJSON), "the file format, csv or ndjson")
+	out := flags.String("out", "-", "the file to write to, - for stdout")
+	fieldsFlag := flags.String("fields", "", "comma separated user fields to export, defaults to every field")
+	mappingFlag := flags.String("map", "", "rename columns, as column=field,column=field")
+	flags.Parse(args)
+
+	format, err := transfer.ParseFormat(*formatFlag)
+	if err != nil {
+		return err
+	}
+	fields, err := transfer.ParseFields(*fieldsFlag)
+	if err != nil {
+		return err
+	}
+	mapping, err := transfer.ParseMapping(*mappingFlag)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Init(); err != nil {
+		return err
+	}
+
+	file := os.Stdout
+	if *out != "-" {
+		if file, err = os.Create(*out); err != nil {
 			return err
 		}
+		defer file.Close()
+	}
+
+	writer, err := transfer.NewWriter(file, format, fields, mapping)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = db.ExportUsers(context.Background(), func(user *data.User) error {
+		count++
+		return writer.Write(user)
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
 	}
 
+	slog.Info("exported users", "count", count)
 	return nil
 }
 
-const (
-	updateCREATED    = "CREATED"
-	updateDELETED    = "DELETED"
-	updateUPDATED    = "UPDATED"
-	updateALLDELETED = "ALL_DELETED"
-)
+// runImport reads users from a file (or stdin) as CSV or NDJSON, keeping their IDs, timestamps and versions.
+// Rejected rows are logged (or written to -rejects), and an interrupted import can be carried on with -resumeafter.
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	formatFlag := flags.String("format", string(transfer.NDJSON), "the file format, csv or ndjson")
+	in := flags.String("in", "-", "the file to read from, - for stdin")
+	mappingFlag := flags.String("map", "", "rename columns, as column=field,column=field")
+	rejectsFlag := flags.String("rejects", "", "write rejected rows to this file as NDJSON, rather than logging them")
+	resumeAfter := flags.Int("resumeafter", 0, "skip every row up to and including this one, as they were imported by a previous run")
+	batchSize := flags.Int("batchsize", transfer.DefaultBatchSize, fmt.Sprintf("how many users to write at once, up to %d", maxBatchSize))
+	var opts batchAddOptions
+	flags.BoolVar(&opts.dryRun, "dryrun", false, "report what would be imported, without writing anything")
+	flags.BoolVar(&opts.passwordHashes, "passwordhashes", false, "import passwords as they are, for passwords that are already hashed")
+	flags.Parse(args)
+	opts.preserve = true
+
+	if *batchSize > maxBatchSize {
+		return errBatchTooLarge
+	}
 
-// NotifyUpdate will spawn and notify all our watchers of an update
-func (s *UserService) NotifyUpdate(userID, updateType string, user *pb.User) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	for ch := range s.watchers {
-		select {
-		case ch <- &pb.UserUpdate{UserId: userID, UpdateType: updateType, User: user}:
-		default:
-			log.Printf("Dropping update for user %s: channel is full", userID)
+	format, err := transfer.ParseFormat(*formatFlag)
+	if err != nil {
+		return err
+	}
+	mapping, err := transfer.ParseMapping(*mappingFlag)
+	if err != nil {
+		return err
+	}
+
+	file := os.Stdin
+	if *in != "-" {
+		if file, err = os.Open(*in); err != nil {
+			return err
 		}
+		defer file.Close()
 	}
-}
 
-// Convert a data.User to a protobuf User.
-func convertToProtoUser(user *data.User) *pb.User {
-	return &pb.User{
-		ID:        user.ID,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
-		Nickname:  user.Nickname,
-		Password:  user.Password,
-		Email:     user.Email,
-		Country:   user.Country,
-		CreatedAt: timestamppb.New(user.CreatedAt),
-		UpdatedAt: timestamppb.New(user.UpdatedAt),
+	reader, err := transfer.NewReader(file, format, mapping)
+	if err != nil {
+		return err
+	}
+
+	onRejected := func(rejection transfer.Rejection) {
+		slog.Warn("row rejected", "row", rejection.Row, "status", rejection.Status, "reason", rejection.Reason)
+	}
+	if *rejectsFlag != "" {
+		rejects, err := os.Create(*rejectsFlag)
+		if err != nil {
+			return err
+		}
+		defer rejects.Close()
+
+		encoder := json.NewEncoder(rejects)
+		onRejected = func(rejection transfer.Rejection) {
+			if err := encoder.Encode(rejection); err != nil {
+				slog.Error("failed to record rejected row", "row", rejection.Row, "error", err)
+			}
+		}
+	}
+
+	if err := db.Init(); err != nil {
+		return err
+	}
+	userService = NewUserService()
+
+	// Every user imported shares a request ID, tying their audit entries and updates to this run
+	ctx := requestid.NewContext(context.Background(), requestid.New())
+	src := cliAuditSource(ctx)
+	report, err := transfer.Import(reader, func(users []data.User) ([]data.BatchResult, error) {
+		return userService.batchAddUsers(ctx, src, users, opts)
+	}, transfer.ImportOptions{
+		ResumeAfter: *resumeAfter,
+		BatchSize:   *batchSize,
+		OnRejected:  onRejected,
+	})
+	if err != nil {
+		return fmt.Errorf("stopped after row %d, run again with -resumeafter=%d to carry on - err: %v", report.LastRow, report.LastRow, err)
 	}
+
+	slog.Info("imported users", "imported", report.Imported, "rejected", report.Rejected, "skipped", report.Skipped, "dry_run", opts.dryRun, "request_id", requestid.FromContext(ctx))
+	return nil
 }
@@ -1,30 +1,66 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"userapi/auth"
+	"userapi/broadcast"
 	"userapi/data"
 	"userapi/db"
+	"userapi/metrics"
 	"userapi/mocks"
 	"userapi/pb"
+	"userapi/publisher"
+	"userapi/ratelimit"
+	"userapi/requestid"
+	"userapi/tracing"
+	"userapi/webhook"
 
+	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-var grpcTestService = &UserService{}
+var grpcTestService = NewUserService()
 
 const bufSize = 1024 * 1024
 
@@ -34,13 +70,205 @@ var (
 	client         pb.UserServiceClient
 )
 
+// noopCollection accepts every bulk write, for tests that don't check the audit log or user history
+var noopCollection = &mocks.MongoCollection{
+	BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+		return &mongo.BulkWriteResult{InsertedCount: int64(len(models))}, nil
+	},
+}
+
+// testLeases grants every lease asked for, tests only run one relay at a time
+var testLeases = &mocks.MongoCollection{
+	FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+		return mongo.NewSingleResultFromDocument(bson.M{"_id": "outbox_relay"}, nil, nil)
+	},
+}
+
+// runRelay runs the service's relay until the test finishes.
+// Relays read the collections and clock tests swap out, so they're only run by the tests that need them.
+func runRelay(t *testing.T, service *UserService) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		service.relay.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// notifyUpdate logs an update as if it was written through the db package, and has the service deliver it straight away.
+// It's logged as delivered, so the relay doesn't deliver it again.
+func notifyUpdate(t *testing.T, eventLog *testEventLog, service *UserService, updateType string, user *data.User, fields []string) {
+	t.Helper()
+	deliveredAt := timeNow()
+	event := eventLog.record(data.UserEvent{UserID: user.ID, UpdateType: updateType, User: user, ChangedFields: fields, CreatedAt: timeNow(), DeliveredAt: &deliveredAt})
+	if err := service.deliverUpdate(event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// noWebhooks has no webhooks registered, so updates aren't delivered anywhere
+var noWebhooks = &mocks.MongoCollection{
+	FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+		return mocks.NewMockCursor([]interface{}{}).Cursor, nil
+	},
+}
+
+// testEventLog is an in memory event log and sequence counter, so watchers can replay updates in tests
+type testEventLog struct {
+	mu       sync.Mutex
+	sequence int64
+	events   []data.UserEvent
+}
+
+var testEvents = &testEventLog{}
+
+// swapEventLog gives the test a fresh event log, putting the shared one back afterwards
+func swapEventLog(t *testing.T) *testEventLog {
+	eventLog := &testEventLog{}
+	db.SetEventCollection(eventLog.collection())
+	db.SetCounterCollection(eventLog.counters())
+	t.Cleanup(func() {
+		db.SetEventCollection(testEvents.collection())
+		db.SetCounterCollection(testEvents.counters())
+	})
+	return eventLog
+}
+
+// head is the last sequence handed out
+func (l *testEventLog) head() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sequence
+}
+
+// settle waits for updates still being sent by earlier tests to be logged
+func (l *testEventLog) settle() {
+	for last := int64(-1); last != l.head(); {
+		last = l.head()
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// record logs an event with the next sequence, as if it was written through the db package, returning it with its sequence
+func (l *testEventLog) record(event data.UserEvent) data.UserEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sequence++
+	event.Sequence = l.sequence
+	l.events = append(l.events, event)
+	return event
+}
+
+// trim drops every event before the given sequence, as if they had expired
+func (l *testEventLog) trim(before int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := []data.UserEvent{}
+	for _, event := range l.events {
+		if event.Sequence >= before {
+			kept = append(kept, event)
+		}
+	}
+	l.events = kept
+}
+
+// counters mocks the counter collection, handing out sequences
+func (l *testEventLog) counters() *mocks.MongoCollection {
+	return &mocks.MongoCollection{
+		FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.sequence += update.(bson.M)["$inc"].(bson.M)["sequence"].(int64)
+			return mongo.NewSingleResultFromDocument(bson.M{"_id": "user_events", "sequence": l.sequence}, nil, nil)
+		},
+		FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			return mongo.NewSingleResultFromDocument(bson.M{"_id": "user_events", "sequence": l.sequence}, nil, nil)
+		},
+	}
+}
+
+// collection mocks the event collection, storing and listing events in sequence order
+func (l *testEventLog) collection() *mocks.MongoCollection {
+	return &mocks.MongoCollection{
+		BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, model := range models {
+				l.events = append(l.events, model.(*mongo.InsertOneModel).Document.(data.UserEvent))
+			}
+			return &mongo.BulkWriteResult{InsertedCount: int64(len(models))}, nil
+		},
+		// Lists either the events after a sequence, or those the relay hasn't delivered
+		FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			_, undelivered := filter.(bson.M)["delivered_at"]
+			found := []interface{}{}
+			for _, event := range l.events {
+				matches := event.DeliveredAt == nil
+				if !undelivered {
+					matches = event.Sequence > filter.(bson.M)["_id"].(bson.M)["$gt"].(int64)
+				}
+				if matches && int64(len(found)) < *opts[0].Limit {
+					found = append(found, event)
+				}
+			}
+			return mocks.NewMockCursor(found).Cursor, nil
+		},
+		UpdateManyFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			deliveredAt := update.(bson.M)["$set"].(bson.M)["delivered_at"].(time.Time)
+			for _, sequence := range filter.(bson.M)["_id"].(bson.M)["$in"].([]int64) {
+				for i := range l.events {
+					if l.events[i].Sequence == sequence {
+						l.events[i].DeliveredAt = &deliveredAt
+					}
+				}
+			}
+			return &mongo.UpdateResult{}, nil
+		},
+		FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if len(l.events) == 0 {
+				return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+			}
+			return mongo.NewSingleResultFromDocument(l.events[0], nil, nil)
+		},
+	}
+}
+
 func init() {
 	// Prevent all the error logs from showing up, even when expected
 	// Comment this out if need to debug any issues
 	// log.Default().SetOutput(io.Discard)
 
+	// Audit events and revisions are recorded for every change, tests checking them swap in their own collection
+	db.SetAuditCollection(noopCollection)
+	db.SetRevisionCollection(noopCollection)
+	db.SetEventCollection(testEvents.collection())
+	db.SetCounterCollection(testEvents.counters())
+	db.SetWebhookCollection(noWebhooks)
+	db.SetLeaseCollection(testLeases)
+
 	lis = bufconn.Listen(bufSize)
-	grpcTestServer = grpc.NewServer()
+	// RPCs are identified by their API key, as they are when we're running
+	testKeys, err := auth.ParseKeys(strings.NewReader("support:support-key\nops:ops-key:admin"))
+	if err != nil {
+		panic(err)
+	}
+	grpcTestServer = grpc.NewServer(grpc.ChainUnaryInterceptor(testKeys.UnaryServerInterceptor), grpc.ChainStreamInterceptor(testKeys.StreamServerInterceptor))
+	// Relay updates quickly, including those made by services that aren't running their own relay
+	relayInterval = 10 * time.Millisecond
+	// Each service keeps its webhook deliveries to itself, so a test running deliveries never makes another test's
+	newWebhookStore = func() webhook.Store { return webhook.NewMemoryStore() }
 	userService = NewUserService()
 	pb.RegisterUserServiceServer(grpcTestServer, userService)
 	go func() {
@@ -99,13 +327,13 @@ func TestGetAllUsersHandler(t *testing.T) {
 					"password": "suP3rS3cret", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
 			},
 			wantStatus: http.StatusOK,
-			wantBody:   `[{"id":"1","first_name":"John","last_name":"Doe","nickname":"jdoe","password":"moneyMoneyM0n3y","email":"john.doe@example.com","country":"USA","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z"},{"id":"2","first_name":"Jane","last_name":"Smith","nickname":"jsmith","password":"suP3rS3cret","email":"jane.smith@example.com","country":"UK","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z"}]`,
+			wantBody:   `[{"id":"1","first_name":"John","last_name":"Doe","nickname":"jdoe","password":"moneyMoneyM0n3y","email":"john.doe@example.com","country":"USA","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z","version":0,"deleted_at":null},{"id":"2","first_name":"Jane","last_name":"Smith","nickname":"jsmith","password":"suP3rS3cret","email":"jane.smith@example.com","country":"UK","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z","version":0,"deleted_at":null}]`,
 		},
 		{
 			name:       "Successful fetch Cache Hit",
 			method:     http.MethodGet,
 			wantStatus: http.StatusOK,
-			wantBody:   `[{"id":"1","first_name":"John","last_name":"Doe","nickname":"jdoe","password":"moneyMoneyM0n3y","email":"john.doe@example.com","country":"USA","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z"},{"id":"2","first_name":"Jane","last_name":"Smith","nickname":"jsmith","password":"suP3rS3cret","email":"jane.smith@example.com","country":"UK","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z"}]`,
+			wantBody:   `[{"id":"1","first_name":"John","last_name":"Doe","nickname":"jdoe","password":"moneyMoneyM0n3y","email":"john.doe@example.com","country":"USA","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z","version":0,"deleted_at":null},{"id":"2","first_name":"Jane","last_name":"Smith","nickname":"jsmith","password":"suP3rS3cret","email":"jane.smith@example.com","country":"UK","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z","version":0,"deleted_at":null}]`,
 		},
 	}
 
@@ -182,6 +410,7 @@ func TestGetUsersHandler(t *testing.T) {
 				"country":    bson.M{`$options`: `i`, `$regex`: `UK`},
 				"created_at": bson.M{`$gt`: time.Date(2024, time.June, 15, 18, 37, 47, 572000000, time.UTC)},
 				"nickname":   bson.M{`$options`: `i`, `$regex`: `j`},
+				"deleted_at": nil,
 			},
 			expectedPage:  1,
 			expectedLimit: 50,
@@ -190,7 +419,7 @@ func TestGetUsersHandler(t *testing.T) {
 					"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
 			},
 			wantStatus: http.StatusOK,
-			wantBody:   `[{"id":"1","first_name":"John","last_name":"Doe","nickname":"jdoe","password":"moneyMoneyM0n3y","email":"john.doe@example.com","country":"USA","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z"}]`,
+			wantBody:   `[{"id":"1","first_name":"John","last_name":"Doe","nickname":"jdoe","password":"moneyMoneyM0n3y","email":"john.doe@example.com","country":"USA","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z","version":0,"deleted_at":null}]`,
 		},
 		{
 			name:   "Successful fetch",
@@ -200,6 +429,7 @@ func TestGetUsersHandler(t *testing.T) {
 				"country":    bson.M{`$options`: `i`, `$regex`: `Germany`},
 				"created_at": bson.M{`$gt`: time.Date(2024, time.February, 15, 18, 37, 47, 572000000, time.UTC)},
 				"nickname":   bson.M{`$options`: `i`, `$regex`: `jdoe`},
+				"deleted_at": nil,
 			},
 			expectedPage:  1,
 			expectedLimit: 25,
@@ -208,7 +438,7 @@ func TestGetUsersHandler(t *testing.T) {
 					"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
 			},
 			wantStatus: http.StatusOK,
-			wantBody:   `[{"id":"1","first_name":"John","last_name":"Doe","nickname":"jdoe","password":"moneyMoneyM0n3y","email":"john.doe@example.com","country":"USA","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z"}]`,
+			wantBody:   `[{"id":"1","first_name":"John","last_name":"Doe","nickname":"jdoe","password":"moneyMoneyM0n3y","email":"john.doe@example.com","country":"USA","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z","version":0,"deleted_at":null}]`,
 		},
 	}
 
@@ -391,7 +621,7 @@ func TestAddUserHandler(t *testing.T) {
 				"email": "Razzil.Darkbrew@example.com",
 				"country": "UK"
 			}`),
-			expectedFilters: bson.M{"nickname": `Alchemist`},
+			expectedFilters: bson.M{"nickname": `Alchemist`, "deleted_at": nil},
 			expectedUser:    &data.User{},
 			mockData: bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "Alchemist", "Email": "john.doe@example.com", "Country": "USA",
 				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
@@ -408,12 +638,12 @@ func TestAddUserHandler(t *testing.T) {
 				"email": "Razzil.Darkbrew@example.com",
 				"country": "UK"
 			}`),
-			expectedFilters: bson.M{"nickname": `Alchemist`},
-			expectedUser:    &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)},
+			expectedFilters: bson.M{"nickname": `Alchemist`, "deleted_at": nil},
+			expectedUser:    &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), Version: 1},
 			mockData: bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
 				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
 			wantStatus: http.StatusOK,
-			wantBody:   `{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Alchemist","password":"moneyMoneyM0n3y","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-17T19:49:18.3688893Z","updated_at":"2024-06-17T19:49:18.3688893Z"}`,
+			wantBody:   `{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Alchemist","password":"moneyMoneyM0n3y","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-17T19:49:18.3688893Z","updated_at":"2024-06-17T19:49:18.3688893Z","version":1,"deleted_at":null}`,
 		},
 	}
 
@@ -467,6 +697,261 @@ func TestAddUserHandler(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
+			req.Header.Set("Content-Type", "application/json")
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			addUserHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestDecodeJSON tests request bodies must be a single JSON value, sent as application/json, no larger than the limit,
+// and with no fields the route doesn't use
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    updateUserRequest
+		wantStatus  int
+	}{
+		{
+			name:        "Valid body",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Meepo"}`,
+			expected:    updateUserRequest{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", addUserRequest: addUserRequest{Nickname: "Meepo"}},
+		},
+		{
+			name:        "Trailing whitespace",
+			contentType: "application/json",
+			body:        "{\"nickname\": \"Meepo\"}\n",
+			expected:    updateUserRequest{addUserRequest: addUserRequest{Nickname: "Meepo"}},
+		},
+		{
+			name:       "No content type",
+			body:       `{"nickname": "Meepo"}`,
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "Form content type",
+			contentType: "application/x-www-form-urlencoded",
+			body:        `{"nickname": "Meepo"}`,
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "Unknown field",
+			contentType: "application/json",
+			body:        `{"nickname": "Meepo", "version": 3}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "Trailing data",
+			contentType: "application/json",
+			body:        `{"nickname": "Meepo"} {"nickname": "Dazzle"}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "Wrong type",
+			contentType: "application/json",
+			body:        `[{"nickname": "Meepo"}]`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "Too large",
+			contentType: "application/json",
+			body:        `{"nickname": "` + strings.Repeat("a", maxBodyBytes) + `"}`,
+			wantStatus:  http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/userapi/update", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+
+			var got updateUserRequest
+			err := decodeJSON(httptest.NewRecorder(), req, maxBodyBytes, &got)
+			if tt.wantStatus != 0 {
+				if err == nil || httpStatus(err) != tt.wantStatus {
+					t.Fatalf("expected status %d, got error %v", tt.wantStatus, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestAddUserHandlerIdempotency(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	newUUID = func() string {
+		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	}
+
+	body := []byte(`{
+		"first_name": "Razzil",
+		"last_name": "Darkbrew",
+		"nickname": "Alchemist",
+		"password": "moneyMoneyM0n3y",
+		"email": "Razzil.Darkbrew@example.com",
+		"country": "UK"
+	}`)
+
+	requestHash := idempotencyHash(&data.User{FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Email: "Razzil.Darkbrew@example.com", Country: "UK"})
+
+	// Define test cases
+	tests := []struct {
+		name            string
+		client          string
+		idempotencyKey  string
+		mockRecord      interface{}
+		mockReserveErr  error
+		mockInsertErr   error
+		wantCompleted   bool
+		wantReleased    bool
+		wantStatus      int
+		wantBody        string
+		wantReplayedHdr string
+	}{
+		{
+			name:           "New key creates the user and stores it against the key",
+			idempotencyKey: "retry-me",
+			wantCompleted:  true,
+			wantStatus:     http.StatusOK,
+			wantBody:       `{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Alchemist","password":"moneyMoneyM0n3y","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-17T19:49:18.3688893Z","updated_at":"2024-06-17T19:49:18.3688893Z","version":1,"deleted_at":null}`,
+		},
+		{
+			name:           "Repeated key replays the original user",
+			idempotencyKey: "retry-me",
+			mockRecord: bson.M{"_id": ":retry-me", "request_hash": requestHash, "user": bson.M{"_id": "0d0f9944-d902-4db1-b83b-6b25a61f89e2", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "",
+				"email": "Razzil.Darkbrew@example.com", "country": "UK", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z", "version": 1}},
+			mockInsertErr:   errors.New("user should not be inserted on a replay"),
+			wantStatus:      http.StatusOK,
+			wantBody:        `{"id":"0d0f9944-d902-4db1-b83b-6b25a61f89e2","first_name":"Razzil","last_name":"Darkbrew","nickname":"Alchemist","password":"","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z","version":1,"deleted_at":null}`,
+			wantReplayedHdr: "true",
+		},
+		{
+			name:           "Repeated key whose original request is still running",
+			idempotencyKey: "retry-me",
+			mockRecord:     bson.M{"_id": ":retry-me", "request_hash": requestHash},
+			wantStatus:     http.StatusConflict,
+		},
+		{
+			name:           "Repeated key for a different user",
+			idempotencyKey: "retry-me",
+			mockRecord: bson.M{"_id": ":retry-me", "request_hash": "another-request", "user": bson.M{"_id": "0d0f9944-d902-4db1-b83b-6b25a61f89e2", "nickname": "Meepo",
+				"created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z", "version": 1}},
+			mockInsertErr: errors.New("user should not be inserted for a reused key"),
+			wantStatus:    http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "Keys are scoped to the client",
+			client:         "support",
+			idempotencyKey: "retry-me",
+			wantCompleted:  true,
+			wantStatus:     http.StatusOK,
+			wantBody:       `{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Alchemist","password":"moneyMoneyM0n3y","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-17T19:49:18.3688893Z","updated_at":"2024-06-17T19:49:18.3688893Z","version":1,"deleted_at":null}`,
+		},
+		{
+			name:           "Key reserved concurrently",
+			idempotencyKey: "retry-me",
+			mockReserveErr: mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}},
+			wantStatus:     http.StatusConflict,
+		},
+		{
+			name:           "Failed create releases the key",
+			idempotencyKey: "retry-me",
+			mockInsertErr:  errors.New("mock error"),
+			wantReleased:   true,
+			wantStatus:     http.StatusInternalServerError,
+		},
+		{
+			name:           "Key too long",
+			idempotencyKey: strings.Repeat("k", 256),
+			wantStatus:     http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var completedUser *data.User
+			var released bool
+
+			db.SetCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+				},
+				InsertOneFunc: func(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
+					return nil, tt.mockInsertErr
+				},
+			})
+			db.SetIdempotencyCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if bsonFilter, ok := filter.(bson.M); !ok || bsonFilter["_id"] != tt.client+":"+tt.idempotencyKey {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filter on idempotency key, got %#v", filter), nil)
+					}
+					if tt.mockRecord == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(tt.mockRecord, nil, nil)
+				},
+				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+					set := update.(bson.M)["$set"].(bson.M)
+
+					// Completing the key stores the user, reserving it doesn't
+					if user, ok := set["user"].(*data.User); ok {
+						completedUser = user
+						return mongo.NewSingleResultFromDocument(bson.M{}, nil, nil)
+					}
+
+					// Reserving the key fingerprints the request, so it can't be reused for a different user
+					if set["request_hash"] != requestHash {
+						t.Errorf("unexpected request hash reserved, want: %v, got: %v", requestHash, set["request_hash"])
+					}
+					if tt.mockReserveErr != nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockReserveErr, nil)
+					}
+					return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+				},
+				DeleteOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+					released = true
+					return &mongo.DeleteResult{DeletedCount: 1}, nil
+				},
+			})
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(http.MethodPost, "/userapi/add", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", tt.idempotencyKey)
+			if tt.client != "" {
+				req = req.WithContext(auth.NewContext(req.Context(), auth.Client{Name: tt.client}))
+			}
 
 			// Create a ResponseRecorder to record the response
 			rr := httptest.NewRecorder()
@@ -483,10 +968,77 @@ func TestAddUserHandler(t *testing.T) {
 			if rr.Body.String() != tt.wantBody {
 				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
 			}
+
+			if replayed := rr.Header().Get("Idempotent-Replayed"); replayed != tt.wantReplayedHdr {
+				t.Errorf("handler returned unexpected Idempotent-Replayed header: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", replayed, tt.wantReplayedHdr)
+			}
+
+			if (completedUser != nil) != tt.wantCompleted {
+				t.Errorf("idempotency key completed: %v, want: %v", completedUser != nil, tt.wantCompleted)
+			}
+
+			// The key is kept for the whole window, so it mustn't keep the password with it
+			if completedUser != nil && completedUser.Password != "" {
+				t.Errorf("idempotency key completed with the user's password: %+v", completedUser)
+			}
+
+			if released != tt.wantReleased {
+				t.Errorf("idempotency key released: %v, want: %v", released, tt.wantReleased)
+			}
 		})
 	}
 }
 
+// TestAddUserTraced tests the validation, duplicate check and insert are traced as part of the caller's trace.
+func TestAddUserTraced(t *testing.T) {
+	exporter := tracing.InitInMemory()
+	swapEventLog(t)
+
+	newUUID = func() string {
+		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	}
+
+	db.SetCollection(&mocks.MongoCollection{
+		FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+			return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+		},
+		InsertOneFunc: func(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
+			return nil, nil
+		},
+	})
+
+	body := []byte(`{
+		"first_name": "Razzil",
+		"last_name": "Darkbrew",
+		"nickname": "Alchemist",
+		"password": "moneyMoneyM0n3y",
+		"email": "Razzil.Darkbrew@example.com",
+		"country": "UK"
+	}`)
+	req := httptest.NewRequest(http.MethodPost, "/userapi/add", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	rr := httptest.NewRecorder()
+	otelhttp.NewHandler(http.HandlerFunc(addUserHandler), "/userapi/add").ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the user to be added, got status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	spans := map[string]bool{}
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID().String() == traceID {
+			spans[span.Name] = true
+		}
+	}
+	for _, name := range []string{"/userapi/add", "validation.User", "db.GetUser", "db.InsertUser"} {
+		if !spans[name] {
+			t.Errorf("expected a %q span in the caller's trace, got %v", name, spans)
+		}
+	}
+}
+
 func TestUpdateUserHandler(t *testing.T) {
 
 	// Set out timenow function, to ensure our test is static
@@ -504,13 +1056,16 @@ func TestUpdateUserHandler(t *testing.T) {
 		method                string
 		body                  []byte
 		mockDataExisting      interface{}
-		mockDataUpdated       interface{}
+		mockDataPrevious      interface{}
 		mockError             error
 		expectedFilters       bson.M
 		expectedUserID        string
 		expectedUpdateRequest bson.M
+		ifMatch               string
+		expectedVersion       interface{}
 		wantStatus            int
 		wantBody              string
+		wantETag              string
 	}{
 		{
 			name:       "Incorrect Method",
@@ -522,7 +1077,7 @@ func TestUpdateUserHandler(t *testing.T) {
 			name:   "Database error",
 			method: http.MethodPost,
 			body: []byte(`{
-				"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+				"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
 				"first_name": "Razzil",
 				"last_name": "Darkbrew",
 				"nickname": "Alchemist",
@@ -604,7 +1159,7 @@ func TestUpdateUserHandler(t *testing.T) {
 				"email": "Razzil.Darkbrew@example.com",
 				"country": "UK"
 			}`),
-			expectedFilters: bson.M{"nickname": `Alchemist`},
+			expectedFilters: bson.M{"nickname": `Alchemist`, "deleted_at": nil},
 			mockDataExisting: bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "Alchemist", "Email": "john.doe@example.com", "Country": "USA",
 				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
 			wantStatus: http.StatusInternalServerError,
@@ -621,15 +1176,94 @@ func TestUpdateUserHandler(t *testing.T) {
 				"email": "Razzil.Darkbrew@example.com",
 				"country": "UK"
 			}`),
-			expectedFilters:       bson.M{"nickname": `Meepo`},
+			expectedFilters:       bson.M{"nickname": `Meepo`, "deleted_at": nil},
 			expectedUserID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-			expectedUpdateRequest: bson.M{"$set": bson.M{"country": "UK", "email": "Razzil.Darkbrew@example.com", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Meepo", "password": "moneyMoneyM0n3y", "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)}},
+			expectedUpdateRequest: bson.M{"$set": bson.M{"country": "UK", "email": "Razzil.Darkbrew@example.com", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Meepo", "password": "moneyMoneyM0n3y", "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)}, "$inc": bson.M{"version": 1}},
 			mockDataExisting: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
 				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
-			mockDataUpdated: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Meepo", "Email": "john.doe@example.com", "Country": "USA",
+			mockDataPrevious: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
 				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
 			wantStatus: http.StatusOK,
-			wantBody:   `{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"John","last_name":"Doe","nickname":"Meepo","password":"moneyMoneyM0n3y","email":"john.doe@example.com","country":"USA","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-16T17:32:28.2136171Z"}`,
+			wantBody:   `{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Meepo","password":"moneyMoneyM0n3y","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-17T19:49:18.3688893Z","version":1,"deleted_at":null}`,
+			wantETag:   `"1"`,
+		},
+		{
+			name:   "Updated User successfully with matching version",
+			method: http.MethodPost,
+			body: []byte(`{
+				"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+				"first_name": "Razzil",
+				"last_name": "Darkbrew",
+				"nickname": "Meepo",
+				"password": "moneyMoneyM0n3y",
+				"email": "Razzil.Darkbrew@example.com",
+				"country": "UK"
+			}`),
+			ifMatch:               `"3"`,
+			expectedVersion:       int64(3),
+			expectedFilters:       bson.M{"nickname": `Meepo`, "deleted_at": nil},
+			expectedUserID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			expectedUpdateRequest: bson.M{"$set": bson.M{"country": "UK", "email": "Razzil.Darkbrew@example.com", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Meepo", "password": "moneyMoneyM0n3y", "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)}, "$inc": bson.M{"version": 1}},
+			mockDataExisting: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z", "version": 3},
+			mockDataPrevious: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z", "version": 3},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Meepo","password":"moneyMoneyM0n3y","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-16T17:32:28.2136171Z","updated_at":"2024-06-17T19:49:18.3688893Z","version":4,"deleted_at":null}`,
+			wantETag:   `"4"`,
+		},
+		{
+			name:   "Failed update, version mismatch",
+			method: http.MethodPost,
+			body: []byte(`{
+				"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+				"first_name": "Razzil",
+				"last_name": "Darkbrew",
+				"nickname": "Meepo",
+				"password": "moneyMoneyM0n3y",
+				"email": "Razzil.Darkbrew@example.com",
+				"country": "UK"
+			}`),
+			ifMatch:               `"2"`,
+			expectedVersion:       int64(2),
+			expectedUserID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			expectedUpdateRequest: bson.M{"$set": bson.M{"country": "UK", "email": "Razzil.Darkbrew@example.com", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Meepo", "password": "moneyMoneyM0n3y", "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)}, "$inc": bson.M{"version": 1}},
+			mockDataExisting: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z", "version": 3},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:   "Failed update, no user with the id",
+			method: http.MethodPost,
+			body: []byte(`{
+				"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+				"first_name": "Razzil",
+				"last_name": "Darkbrew",
+				"nickname": "Meepo",
+				"password": "moneyMoneyM0n3y",
+				"email": "Razzil.Darkbrew@example.com",
+				"country": "UK"
+			}`),
+			expectedFilters:       bson.M{"nickname": `Meepo`, "deleted_at": nil},
+			expectedUserID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			expectedUpdateRequest: bson.M{"$set": bson.M{"country": "UK", "email": "Razzil.Darkbrew@example.com", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Meepo", "password": "moneyMoneyM0n3y", "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)}, "$inc": bson.M{"version": 1}},
+			mockDataExisting: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Meepo", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Failed update, malformed If-Match",
+			method:     http.MethodPost,
+			body:       []byte(`{}`),
+			ifMatch:    `"abc"`,
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "Failed update, weak If-Match",
+			method:     http.MethodPost,
+			body:       []byte(`{}`),
+			ifMatch:    `W/"3"`,
+			wantStatus: http.StatusPreconditionFailed,
 		},
 	}
 
@@ -674,6 +1308,10 @@ func TestUpdateUserHandler(t *testing.T) {
 						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("id filter incorrect, does not match expected userid"), nil)
 					}
 
+					if bsonFilter["version"] != tt.expectedVersion {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("version filter incorrect, want: %v, got: %v", tt.expectedVersion, bsonFilter["version"]), nil)
+					}
+
 					user, ok := document.(bson.M)
 					if !ok {
 						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("user document does not match expected type"), nil)
@@ -683,7 +1321,12 @@ func TestUpdateUserHandler(t *testing.T) {
 						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected user doest not match, want: %#v, got: %#v", tt.expectedUpdateRequest, user), nil)
 					}
 
-					return mongo.NewSingleResultFromDocument(tt.mockDataUpdated, nil, nil)
+					// Nothing matched our filter, the stored user must be on a different version
+					if tt.mockDataPrevious == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+
+					return mongo.NewSingleResultFromDocument(tt.mockDataPrevious, nil, nil)
 				},
 			})
 
@@ -692,6 +1335,8 @@ func TestUpdateUserHandler(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("If-Match", tt.ifMatch)
 
 			// Create a ResponseRecorder to record the response
 			rr := httptest.NewRecorder()
@@ -708,19 +1353,62 @@ func TestUpdateUserHandler(t *testing.T) {
 			if rr.Body.String() != tt.wantBody {
 				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
 			}
+
+			// Check the ETag header is what we expect
+			if etag := rr.Header().Get("ETag"); etag != tt.wantETag {
+				t.Errorf("handler returned unexpected ETag: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", etag, tt.wantETag)
+			}
 		})
 	}
 }
 
-func TestDeleteUserHandler(t *testing.T) {
-
-	// Define test cases
+// TestParseIfMatch tests only the strong ETags we issue are accepted, including the "0" served for users stored without a version
+func TestParseIfMatch(t *testing.T) {
 	tests := []struct {
-		name            string
+		ifMatch string
+		want    int64
+		wantErr bool
+	}{
+		{ifMatch: "", want: db.AnyVersion},
+		{ifMatch: "*", want: db.AnyVersion},
+		{ifMatch: `"3"`, want: 3},
+		{ifMatch: ` "3" `, want: 3},
+		{ifMatch: `"0"`, want: 0},
+		{ifMatch: `W/"3"`, wantErr: true},
+		{ifMatch: `3`, wantErr: true},
+		{ifMatch: `"3`, wantErr: true},
+		{ifMatch: `"-1"`, wantErr: true},
+		{ifMatch: `"3", "4"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/userapi/update", nil)
+		req.Header.Set("If-Match", tt.ifMatch)
+		got, err := parseIfMatch(req)
+		if tt.wantErr {
+			if !errors.Is(err, db.ErrVersionMismatch) {
+				t.Errorf("unexpected error for %q, want: %v, got: %v", tt.ifMatch, db.ErrVersionMismatch, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("unexpected version for %q, want: %v, got: %v, %v", tt.ifMatch, tt.want, got, err)
+		}
+	}
+}
+
+func TestDeleteUserHandler(t *testing.T) {
+
+	// Define test cases
+	tests := []struct {
+		name            string
 		method          string
 		body            []byte
 		expectedUserID  string
+		ifMatch         string
+		expectedVersion interface{}
 		mockDeleteCount int
+		mockDataStored  interface{}
 		mockError       error
 		wantStatus      int
 		wantBody        string
@@ -759,7 +1447,32 @@ func TestDeleteUserHandler(t *testing.T) {
 			}`),
 			expectedUserID:  "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
 			mockDeleteCount: 0,
-			wantStatus:      http.StatusInternalServerError,
+			wantStatus:      http.StatusNotFound,
+		},
+		{
+			name:   "Delete User successfully with matching version",
+			method: http.MethodPost,
+			body: []byte(`{
+				"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+			}`),
+			ifMatch:         `"2"`,
+			expectedVersion: int64(2),
+			expectedUserID:  "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			mockDeleteCount: 1,
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:   "Failed delete, version mismatch",
+			method: http.MethodPost,
+			body: []byte(`{
+				"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+			}`),
+			ifMatch:         `"2"`,
+			expectedVersion: int64(2),
+			expectedUserID:  "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			mockDeleteCount: 0,
+			mockDataStored:  bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Meepo", "version": 3},
+			wantStatus:      http.StatusPreconditionFailed,
 		},
 	}
 
@@ -767,23 +1480,44 @@ func TestDeleteUserHandler(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// Mock the userCollection.Find method
 			db.SetCollection(&mocks.MongoCollection{
-				DeleteOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+				// Deletes are soft, so the user is updated rather than removed
+				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
 					if tt.mockError != nil {
-						return nil, tt.mockError
+						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockError, nil)
 					}
 
 					bsonFilter, ok := filter.(bson.M)
 					if !ok {
-						return nil, fmt.Errorf("no filters sent, expected filter on userid")
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("no filters sent, expected filter on userid"), nil)
 					}
 
 					if bsonFilter["_id"] != tt.expectedUserID {
-						return nil, fmt.Errorf("id filter incorrect, does not match expected userid")
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("id filter incorrect, does not match expected userid"), nil)
 					}
 
-					return &mongo.DeleteResult{
-						DeletedCount: int64(tt.mockDeleteCount),
-					}, nil
+					if bsonFilter["version"] != tt.expectedVersion {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("version filter incorrect, want: %v, got: %v", tt.expectedVersion, bsonFilter["version"]), nil)
+					}
+
+					if deletedAt, ok := bsonFilter["deleted_at"]; !ok || deletedAt != nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filter on users that aren't already deleted, got: %#v", bsonFilter), nil)
+					}
+
+					if _, ok := update.(bson.M)["$set"].(bson.M)["deleted_at"].(time.Time); !ok {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected the update to set deleted_at, got: %#v", update), nil)
+					}
+
+					if tt.mockDeleteCount == 0 {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(bson.M{"_id": tt.expectedUserID}, nil, nil)
+				},
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if tt.mockDataStored == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+
+					return mongo.NewSingleResultFromDocument(tt.mockDataStored, nil, nil)
 				},
 			})
 
@@ -792,6 +1526,8 @@ func TestDeleteUserHandler(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("If-Match", tt.ifMatch)
 
 			// Create a ResponseRecorder to record the response
 			rr := httptest.NewRecorder()
@@ -867,15 +1603,24 @@ func TestDeleteAllUserHandler(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// Mock the userCollection.Find method
 			db.SetCollection(&mocks.MongoCollection{
-				DeleteManyFunc: func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+				// Deletes are soft, so the users are updated rather than removed
+				UpdateManyFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
 					if tt.mockError != nil {
 						return nil, tt.mockError
 					}
 
-					return &mongo.DeleteResult{
-						DeletedCount: int64(tt.mockDeleteCount),
+					if !reflect.DeepEqual(filter, bson.M{"deleted_at": nil}) {
+						return nil, fmt.Errorf("expected filter on users that aren't already deleted, got: %#v", filter)
+					}
+
+					return &mongo.UpdateResult{
+						ModifiedCount: int64(tt.mockDeleteCount),
 					}, nil
 				},
+				// The deleted users are then snapshot into their history
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					return mocks.NewMockCursor(nil).Cursor, nil
+				},
 			})
 
 			// Create a request to pass to the handler
@@ -903,719 +1648,3480 @@ func TestDeleteAllUserHandler(t *testing.T) {
 	}
 }
 
-//################################################################
-// gRPC Handler Tests
-//################################################################
-
-func TestGetAllUsersGRPCHandler(t *testing.T) {
-
-	// reset our cache
-	db.UserStore.Clear()
-
-	// Set out timenow function, to ensure our test is static
-	timeNow = func() time.Time {
-		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
-	}
+func TestRestoreUserHandler(t *testing.T) {
 
-	newUUID = func() string {
-		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
-	}
+	deletedUser := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y",
+		"email": "Razzil.Darkbrew@example.com", "country": "UK", "created_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC),
+		"version": 2, "deleted_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)}
+	restoredUser := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y",
+		"email": "Razzil.Darkbrew@example.com", "country": "UK", "created_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), "updated_at": time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC),
+		"version": 3}
 
 	// Define test cases
 	tests := []struct {
-		name          string
-		mockData      []interface{}
-		mockError     error
-		expectedUsers []*pb.User
-		expectedError bool
+		name             string
+		method           string
+		body             []byte
+		mockDeletedUser  interface{}
+		mockNicknameUser interface{}
+		mockError        error
+		wantStatus       int
+		wantETag         string
+		wantBody         string
 	}{
 		{
-			name:          "Database error",
-			mockData:      nil,
-			mockError:     errors.New("mock error"),
-			expectedError: true,
+			name:       "Incorrect Method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusInternalServerError,
 		},
-		{ // This test should be last, because it saturates the cache
-			name: "Successful fetch",
-			mockData: []interface{}{
-				bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "jdoe", "Email": "john.doe@example.com", "Country": "USA",
-					"password": "moneyMoneyM0n3y", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
-				bson.M{"_id": "2", "first_name": "Jane", "last_name": "Smith", "nickname": "jsmith", "Email": "jane.smith@example.com", "Country": "UK",
-					"password": "suP3rS3cret", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
-			},
-			expectedUsers: []*pb.User{
-				{ID: "1", FirstName: "John", LastName: "Doe", Nickname: "jdoe", Password: "moneyMoneyM0n3y", Email: "john.doe@example.com", Country: "USA", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
-				{ID: "2", FirstName: "Jane", LastName: "Smith", Nickname: "jsmith", Password: "suP3rS3cret", Email: "jane.smith@example.com", Country: "UK", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
-			},
+		{
+			name:       "Invalid id",
+			method:     http.MethodPost,
+			body:       []byte(`{"id": "1"}`),
+			wantStatus: http.StatusInternalServerError,
 		},
 		{
-			name: "Successful fetch Cache Hit",
-			expectedUsers: []*pb.User{
-				{ID: "1", FirstName: "John", LastName: "Doe", Nickname: "jdoe", Password: "moneyMoneyM0n3y", Email: "john.doe@example.com", Country: "USA", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
-				{ID: "2", FirstName: "Jane", LastName: "Smith", Nickname: "jsmith", Password: "suP3rS3cret", Email: "jane.smith@example.com", Country: "UK", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
-			},
+			name:       "Database error",
+			method:     http.MethodPost,
+			body:       []byte(`{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"}`),
+			mockError:  errors.New("mock error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "No deleted user found",
+			method:     http.MethodPost,
+			body:       []byte(`{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"}`),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:             "Nickname taken since the user was deleted",
+			method:           http.MethodPost,
+			body:             []byte(`{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"}`),
+			mockDeletedUser:  deletedUser,
+			mockNicknameUser: bson.M{"_id": "0d0f9944-d902-4db1-b83b-6b25a61f89e2", "nickname": "Alchemist"},
+			wantStatus:       http.StatusConflict,
+		},
+		{
+			name:            "Restored user successfully",
+			method:          http.MethodPost,
+			body:            []byte(`{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"}`),
+			mockDeletedUser: deletedUser,
+			wantStatus:      http.StatusOK,
+			wantETag:        `"3"`,
+			wantBody:        `{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Alchemist","password":"moneyMoneyM0n3y","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-16T17:32:28Z","updated_at":"2024-06-18T09:00:00Z","version":3,"deleted_at":null}`,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Mock the userCollection.Find method
 			db.SetCollection(&mocks.MongoCollection{
-				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
 					if tt.mockError != nil {
-						return nil, tt.mockError
+						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockError, nil)
 					}
-					return mocks.NewMockCursor(tt.mockData).Cursor, nil
+
+					// Looking up the deleted user, or checking whether their nickname has been taken
+					mockData := tt.mockNicknameUser
+					if _, ok := filter.(bson.M)["_id"]; ok {
+						mockData = tt.mockDeletedUser
+					}
+					if mockData == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(mockData, nil, nil)
 				},
-			})
+				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+					expectedFilter := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "deleted_at": bson.M{"$ne": nil}, "version": int64(2)}
+					if !reflect.DeepEqual(filter, expectedFilter) {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %#v, got %#v", expectedFilter, filter), nil)
+					}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
+					if !reflect.DeepEqual(update.(bson.M)["$unset"], bson.M{"deleted_at": ""}) {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected deleted_at to be unset, got %#v", update), nil)
+					}
 
-			response, err := grpcTestService.GetAllUsers(ctx, nil)
-			// If we got an error, but we didn't expect it. Then we error.
-			// If we didn't get an error, but we expect one. Then we error.
-			if (err != nil && !tt.expectedError) || (err == nil && tt.expectedError) {
-				t.Errorf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
+					return mongo.NewSingleResultFromDocument(restoredUser, nil, nil)
+				},
+			})
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/restore", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
 			}
+			req.Header.Set("Content-Type", "application/json")
 
-			// Exit early, because its an error scenario.
-			if tt.expectedError {
-				return
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			restoreUserHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
 			}
 
-			if len(response.Users) != len(tt.expectedUsers) {
-				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response.Users, tt.expectedUsers)
+			if etag := rr.Header().Get("ETag"); etag != tt.wantETag {
+				t.Errorf("handler returned wrong ETag: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", etag, tt.wantETag)
 			}
 
-			if !reflect.DeepEqual(response.Users, tt.expectedUsers) {
-				for i := range response.Users {
-					t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response.Users[i], tt.expectedUsers[i])
-				}
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
 			}
 		})
 	}
 }
 
-func TestGetUsersGRPCHandler(t *testing.T) {
-	// Define test cases
-	tests := []struct {
-		name            string
-		req             *pb.GetUsersRequest
-		mockData        []interface{}
-		mockError       error
-		expectedFilters bson.M
-		expectedError   bool
-		expectedPage    int64
-		expectedLimit   int64
-		expectedUsers   []*pb.User
-	}{
-		{
-			name:          "Database error",
-			req:           &pb.GetUsersRequest{},
-			mockData:      nil,
-			mockError:     errors.New("mock error"),
-			expectedError: true,
+func TestPurgeDeletedUsers(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	deletedBefore := time.Date(2024, time.June, 16, 19, 49, 18, 368889300, time.UTC)
+	ids := []string{"8711e364-c83d-46fc-a3db-d6b2aee00d0f", "0d0f9944-d902-4db1-b83b-6b25a61f89e2"}
+
+	purged := make(chan interface{}, 1)
+	db.SetCollection(&mocks.MongoCollection{
+		FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+			expectedFilter := bson.M{"deleted_at": bson.M{"$lte": deletedBefore}}
+			if !reflect.DeepEqual(filter, expectedFilter) {
+				return nil, fmt.Errorf("expected filters: %#v, got %#v", expectedFilter, filter)
+			}
+			return mongo.NewCursorFromDocuments([]interface{}{bson.M{"_id": ids[0]}, bson.M{"_id": ids[1]}}, nil, nil)
 		},
-		{
-			name: "Successful fetch",
-			req: &pb.GetUsersRequest{
-				Country:      "UK",
-				Nickname:     "j",
-				CreatedAfter: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)),
-				Page:         1,
-				Limit:        50,
-			},
-			expectedFilters: bson.M{
-				"country":    bson.M{`$options`: `i`, `$regex`: `UK`},
-				"created_at": bson.M{`$gt`: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)},
-				"nickname":   bson.M{`$options`: `i`, `$regex`: `j`},
-			},
-			expectedPage:  1,
-			expectedLimit: 50,
-			mockData: []interface{}{
-				bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "jdoe", "Email": "john.doe@example.com", "Country": "USA",
-					"password": "moneyMoneyM0n3y", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
-			},
-			expectedError: false,
-			expectedUsers: []*pb.User{
-				{ID: "1", FirstName: "John", LastName: "Doe", Nickname: "jdoe", Password: "moneyMoneyM0n3y", Email: "john.doe@example.com", Country: "USA", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
-			},
+		DeleteManyFunc: func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+			purged <- filter
+			return &mongo.DeleteResult{DeletedCount: 2}, nil
 		},
-		{
-			name: "Successful fetch 2",
-			req: &pb.GetUsersRequest{
-				Country:      "Germany",
-				Nickname:     "jdoe",
-				CreatedAfter: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)),
-				Page:         1,
-				Limit:        25,
-			},
-			expectedFilters: bson.M{
-				"country":    bson.M{`$options`: `i`, `$regex`: `Germany`},
-				"created_at": bson.M{`$gt`: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)},
-				"nickname":   bson.M{`$options`: `i`, `$regex`: `jdoe`},
-			},
-			expectedPage:  1,
-			expectedLimit: 25,
-			expectedError: false,
-			mockData: []interface{}{
-				bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "jdoe", "Email": "john.doe@example.com", "Country": "USA",
-					"password": "moneyMoneyM0n3y", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
-			},
-			expectedUsers: []*pb.User{
-				{ID: "1", FirstName: "John", LastName: "Doe", Nickname: "jdoe", Password: "moneyMoneyM0n3y", Email: "john.doe@example.com", Country: "USA", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
-			},
+	})
+
+	// The purged users' history goes with them
+	purgedRevisions := make(chan interface{}, 1)
+	db.SetRevisionCollection(&mocks.MongoCollection{
+		DeleteManyFunc: func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+			purgedRevisions <- filter
+			return &mongo.DeleteResult{DeletedCount: 5}, nil
 		},
-	}
+	})
+	defer db.SetRevisionCollection(noopCollection)
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Mock the userCollection.Find method
-			db.SetCollection(&mocks.MongoCollection{
-				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
-					if tt.mockError != nil {
-						return nil, tt.mockError
-					}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		purgeDeletedUsers(ctx, 24*time.Hour, time.Hour)
+		close(done)
+	}()
 
-					// Compare our filters to  ensure the request to mongo is correct
-					if tt.expectedFilters != nil {
-						if filter == nil {
-							return nil, fmt.Errorf("expected filters: %v, got %v", tt.expectedFilters, filter)
-						}
+	// The first purge runs straight away
+	select {
+	case filter := <-purged:
+		expectedFilter := bson.M{"_id": bson.M{"$in": ids}, "deleted_at": bson.M{"$lte": deletedBefore}}
+		if !reflect.DeepEqual(filter, expectedFilter) {
+			t.Errorf("expected filters: %#v, got %#v", expectedFilter, filter)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the purge")
+	}
+	select {
+	case filter := <-purgedRevisions:
+		expectedFilter := bson.M{"user_id": bson.M{"$in": ids}}
+		if !reflect.DeepEqual(filter, expectedFilter) {
+			t.Errorf("expected revision filters: %#v, got %#v", expectedFilter, filter)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the purged users' revisions to be removed")
+	}
+
+	// and stops once cancelled
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("purge did not stop when cancelled")
+	}
+}
+
+func TestChangesRecorded(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	newUUID = func() string {
+		return "0d0f9944-d902-4db1-b83b-6b25a61f89e2"
+	}
+
+	var recorded []data.AuditEvent
+	db.SetAuditCollection(&mocks.MongoCollection{
+		BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+			for _, model := range models {
+				recorded = append(recorded, *model.(*mongo.InsertOneModel).Document.(*data.AuditEvent))
+			}
+			return &mongo.BulkWriteResult{InsertedCount: int64(len(models))}, nil
+		},
+	})
+	defer db.SetAuditCollection(noopCollection)
+
+	var revisions []data.UserRevision
+	db.SetRevisionCollection(&mocks.MongoCollection{
+		BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+			for _, model := range models {
+				revisions = append(revisions, *model.(*mongo.UpdateOneModel).Update.(bson.M)["$setOnInsert"].(*data.UserRevision))
+			}
+			return &mongo.BulkWriteResult{UpsertedCount: int64(len(models))}, nil
+		},
+	})
+	defer db.SetRevisionCollection(noopCollection)
+
+	// The update sent to watchers says who made it too
+	eventLog := swapEventLog(t)
+	lastEvent := func() data.UserEvent {
+		eventLog.mu.Lock()
+		defer eventLog.mu.Unlock()
+		if len(eventLog.events) == 0 {
+			t.Fatal("no update was logged")
+		}
+		return eventLog.events[len(eventLog.events)-1]
+	}
+
+	t.Run("Update over http", func(t *testing.T) {
+		recorded = nil
+		revisions = nil
+		previousUser := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Meepo", "password": "d1gD1gD1g",
+			"email": "john.doe@example.com", "country": "USA", "version": 1}
+		db.SetCollection(&mocks.MongoCollection{
+			FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+				return mongo.NewSingleResultFromDocument(previousUser, nil, nil)
+			},
+			FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+				return mongo.NewSingleResultFromDocument(previousUser, nil, nil)
+			},
+		})
+
+		req, err := http.NewRequest(http.MethodPost, "/userapi/update", strings.NewReader(`{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "Razzil", "last_name": "Darkbrew",
+			"nickname": "Meepo", "password": "moneyMoneyM0n3y", "email": "Razzil.Darkbrew@example.com", "country": "UK"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.10:52100"
+		req.Header.Set("X-Request-ID", "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10")
+		// Who made the change comes from their API key, not anything they claim
+		req.Header.Set("X-Actor", "someone-else@example.com")
+		req = req.WithContext(auth.NewContext(req.Context(), auth.Client{Name: "support@example.com"}))
+
+		rr := httptest.NewRecorder()
+		requestid.Middleware(http.HandlerFunc(updateUserHandler)).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: %v", rr.Code)
+		}
+		if requestID := rr.Header().Get("X-Request-ID"); requestID != "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10" {
+			t.Errorf("expected the request ID to be echoed, got %q", requestID)
+		}
+
+		expected := []data.AuditEvent{{
+			ID:        "0d0f9944-d902-4db1-b83b-6b25a61f89e2",
+			UserID:    "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			Action:    data.AuditUpdate,
+			Actor:     "support@example.com",
+			SourceIP:  "192.0.2.10:52100",
+			Transport: data.TransportHTTP,
+			RequestID: "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10",
+			Changes: []data.FieldChange{
+				{Field: "first_name", Before: "John", After: "Razzil"},
+				{Field: "last_name", Before: "Doe", After: "Darkbrew"},
+				{Field: "password", Before: "[REDACTED]", After: "[REDACTED]"},
+				{Field: "email", Before: "john.doe@example.com", After: "Razzil.Darkbrew@example.com"},
+				{Field: "country", Before: "USA", After: "UK"},
+				{Field: "version", Before: "1", After: "2"},
+			},
+			CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC),
+		}}
+		if !reflect.DeepEqual(recorded, expected) {
+			t.Errorf("unexpected audit events: \n\rgot: \n\r%+v \n\rwant: \n\r%+v\n\r", recorded, expected)
+		}
+
+		// The user as it was is stored too, in case it was last changed before history was recorded.
+		// Neither is stored with a password, history can be read by anyone who can read users.
+		expectedRevisions := []data.UserRevision{
+			{
+				ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f:1", UserID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Version: 1,
+				User: data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "John", LastName: "Doe", Nickname: "Meepo", Email: "john.doe@example.com", Country: "USA", Version: 1},
+			},
+			{
+				ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f:2", UserID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Version: 2, Action: data.AuditUpdate,
+				User: data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Meepo", Email: "Razzil.Darkbrew@example.com", Country: "UK",
+					UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), Version: 2},
+				RecordedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC),
+			},
+		}
+		if !reflect.DeepEqual(revisions, expectedRevisions) {
+			t.Errorf("unexpected revisions: \n\rgot: \n\r%+v \n\rwant: \n\r%+v\n\r", revisions, expectedRevisions)
+		}
+
+		expectedPrevious := expectedRevisions[0].User
+		expectedPrevious.Password = "d1gD1gD1g"
+		event := lastEvent()
+		if event.Actor != "support@example.com" || event.RequestID != "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10" || event.PreviousUser == nil || !reflect.DeepEqual(*event.PreviousUser, expectedPrevious) {
+			t.Errorf("unexpected update logged: %+v", event)
+		}
+	})
+
+	t.Run("Delete over grpc", func(t *testing.T) {
+		recorded = nil
+		db.SetCollection(&mocks.MongoCollection{
+			FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+				return mongo.NewSingleResultFromDocument(bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Meepo", "version": 2}, nil, nil)
+			},
+		})
+
+		ctx := auth.NewContext(context.Background(), auth.Client{Name: "ops"})
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.20"), Port: 41000}})
+		_, err := grpcTestService.DeleteUser(ctx, &pb.DeleteUserRequest{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Without a request ID, one is generated
+		expected := []data.AuditEvent{{
+			ID:        "0d0f9944-d902-4db1-b83b-6b25a61f89e2",
+			UserID:    "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			Action:    data.AuditDelete,
+			Actor:     "ops",
+			SourceIP:  "192.0.2.20:41000",
+			Transport: data.TransportGRPC,
+			RequestID: "0d0f9944-d902-4db1-b83b-6b25a61f89e2",
+			Changes: []data.FieldChange{
+				{Field: "version", Before: "2", After: "3"},
+				{Field: "deleted_at", After: "2024-06-17T19:49:18.3688893Z"},
+			},
+			CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC),
+		}}
+		if !reflect.DeepEqual(recorded, expected) {
+			t.Errorf("unexpected audit events: \n\rgot: \n\r%+v \n\rwant: \n\r%+v\n\r", recorded, expected)
+		}
+
+		event := lastEvent()
+		if event.Actor != "ops" || event.UpdateType != updateDELETED || event.PreviousUser == nil || event.PreviousUser.DeletedAt != nil {
+			t.Errorf("unexpected update logged: %+v", event)
+		}
+	})
+
+	t.Run("Audit fails", func(t *testing.T) {
+		db.SetAuditCollection(&mocks.MongoCollection{
+			BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+				return nil, errors.New("audit collection unavailable")
+			},
+		})
+		db.SetCollection(&mocks.MongoCollection{
+			FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+				return mongo.NewSingleResultFromDocument(bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Meepo", "version": 2}, nil, nil)
+			},
+		})
+
+		// A change we can't audit isn't made at all
+		_, err := grpcTestService.DeleteUser(context.Background(), &pb.DeleteUserRequest{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"})
+		if err == nil {
+			t.Error("expected the delete to fail when it can't be audited")
+		}
+	})
+}
+
+// TestConvertToProtoUpdate tests updates carry their type as an enum, as well as the string older consumers read.
+func TestConvertToProtoUpdate(t *testing.T) {
+	createdAt := time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)
+	before := &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Alchemist", Version: 1, CreatedAt: createdAt, UpdatedAt: createdAt}
+	after := &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Meepo", Version: 2, CreatedAt: createdAt, UpdatedAt: createdAt}
+
+	tests := []struct {
+		name     string
+		event    data.UserEvent
+		expected *pb.UserUpdate
+	}{
+		{
+			name: "Updated",
+			event: data.UserEvent{Sequence: 42, UserID: after.ID, UpdateType: updateUPDATED, User: after, PreviousUser: before,
+				ChangedFields: []string{"nickname", "version"}, Actor: "support@example.com", RequestID: "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10", CreatedAt: createdAt},
+			expected: &pb.UserUpdate{Sequence: 42, UserId: after.ID, UpdateType: "UPDATED", Type: pb.UpdateType_UPDATE_TYPE_UPDATED,
+				User: convertToProtoUser(after), PreviousUser: convertToProtoUser(before), ChangedFields: []string{"nickname", "version"},
+				Actor: "support@example.com", RequestId: "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10", Timestamp: timestamppb.New(createdAt)},
+		},
+		{
+			name:  "Created",
+			event: data.UserEvent{Sequence: 1, UserID: after.ID, UpdateType: updateCREATED, User: after, CreatedAt: createdAt},
+			expected: &pb.UserUpdate{Sequence: 1, UserId: after.ID, UpdateType: "CREATED", Type: pb.UpdateType_UPDATE_TYPE_CREATED,
+				User: convertToProtoUser(after), Timestamp: timestamppb.New(createdAt)},
+		},
+		{
+			name:  "All deleted",
+			event: data.UserEvent{Sequence: 2, UpdateType: updateALLDELETED, ChangedFields: []string{"version", "deleted_at"}, Actor: "ops"},
+			expected: &pb.UserUpdate{Sequence: 2, UpdateType: "ALL_DELETED", Type: pb.UpdateType_UPDATE_TYPE_ALL_DELETED,
+				ChangedFields: []string{"version", "deleted_at"}, Actor: "ops"},
+		},
+		{
+			name:     "Restored",
+			event:    data.UserEvent{Sequence: 3, UserID: after.ID, UpdateType: updateRESTORED},
+			expected: &pb.UserUpdate{Sequence: 3, UserId: after.ID, UpdateType: "RESTORED", Type: pb.UpdateType_UPDATE_TYPE_RESTORED},
+		},
+		{
+			name:     "Unknown type",
+			event:    data.UserEvent{Sequence: 4, UpdateType: "RENAMED"},
+			expected: &pb.UserUpdate{Sequence: 4, UpdateType: "RENAMED", Type: pb.UpdateType_UPDATE_TYPE_UNSPECIFIED},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if update := convertToProtoUpdate(&tt.event); !proto.Equal(update, tt.expected) {
+				t.Errorf("unexpected update: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", update, tt.expected)
+			}
+		})
+	}
+
+	// Consumers built before the enum still find the type as a string, in field 2
+	b, err := proto.Marshal(convertToProtoUpdate(&tests[0].event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		if num == 2 {
+			value, _ := protowire.ConsumeBytes(b)
+			if typ != protowire.BytesType || string(value) != "UPDATED" {
+				t.Errorf("unexpected field 2, wire type %v: %q", typ, value)
+			}
+			return
+		}
+		b = b[protowire.ConsumeFieldValue(num, typ, b):]
+	}
+	t.Error("field 2 is missing from the update")
+}
+
+func TestListAuditEventsHandler(t *testing.T) {
+
+	mockEvent := bson.M{"_id": "0d0f9944-d902-4db1-b83b-6b25a61f89e2", "user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "action": "update", "actor": "support@example.com",
+		"source_ip": "192.0.2.10:52100", "transport": "http", "request_id": "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10",
+		"changes":    bson.A{bson.M{"field": "nickname", "before": "Alchemist", "after": "Meepo"}},
+		"created_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)}
+
+	// Define test cases
+	tests := []struct {
+		name            string
+		method          string
+		params          string
+		mockData        []interface{}
+		mockError       error
+		expectedFilters bson.M
+		expectedPage    int64
+		expectedLimit   int64
+		wantStatus      int
+		wantBody        string
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodPost,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Invalid user id",
+			method:     http.MethodGet,
+			params:     `?userId=1`,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Invalid since",
+			method:     http.MethodGet,
+			params:     `?since=yesterday`,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Database error",
+			method:     http.MethodGet,
+			mockError:  errors.New("mock error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:            "Everything, newest first",
+			method:          http.MethodGet,
+			expectedFilters: bson.M{},
+			expectedPage:    1,
+			expectedLimit:   100,
+			wantStatus:      http.StatusOK,
+			wantBody:        `[]`,
+		},
+		{
+			name:   "Filtered on user and time range",
+			method: http.MethodGet,
+			params: `?userId=8711e364-c83d-46fc-a3db-d6b2aee00d0f&since=2024-06-17T00%3A00%3A00Z&until=2024-06-18T00%3A00%3A00Z&page=2&limit=10`,
+			expectedFilters: bson.M{
+				"$or": bson.A{
+					bson.M{"user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"},
+					bson.M{"action": "delete_all"},
+				},
+				"created_at": bson.M{"$gte": time.Date(2024, time.June, 17, 0, 0, 0, 0, time.UTC), "$lt": time.Date(2024, time.June, 18, 0, 0, 0, 0, time.UTC)},
+			},
+			expectedPage:  2,
+			expectedLimit: 10,
+			mockData:      []interface{}{mockEvent},
+			wantStatus:    http.StatusOK,
+			wantBody:      `[{"id":"0d0f9944-d902-4db1-b83b-6b25a61f89e2","user_id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","action":"update","actor":"support@example.com","source_ip":"192.0.2.10:52100","transport":"http","request_id":"5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10","changes":[{"field":"nickname","before":"Alchemist","after":"Meepo"}],"created_at":"2024-06-17T19:49:18Z"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetAuditCollection(&mocks.MongoCollection{
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					if tt.mockError != nil {
+						return nil, tt.mockError
+					}
+
+					// Compare our filters to ensure the request to mongo is correct
+					if !reflect.DeepEqual(filter, tt.expectedFilters) {
+						return nil, fmt.Errorf("expected filters: %#v, got %#v", tt.expectedFilters, filter)
+					}
+
+					if !reflect.DeepEqual(opts[0].Sort, bson.D{{Key: "created_at", Value: -1}}) {
+						return nil, fmt.Errorf("expected newest first, got sort %#v", opts[0].Sort)
+					}
+
+					if *opts[0].Skip != (tt.expectedPage-1)*tt.expectedLimit {
+						return nil, fmt.Errorf("expected skip %#v, got %#v", (tt.expectedPage-1)*tt.expectedLimit, *opts[0].Skip)
+					}
+
+					if *opts[0].Limit != tt.expectedLimit {
+						return nil, fmt.Errorf("expected limit %#v, got %#v", tt.expectedLimit, *opts[0].Limit)
+					}
+
+					return mocks.NewMockCursor(tt.mockData).Cursor, nil
+				},
+			})
+			defer db.SetAuditCollection(noopCollection)
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/audit"+tt.params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			listAuditEventsHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestUserHistoryHandler(t *testing.T) {
+
+	// Stored before passwords were left out of revisions, it is still listed without one
+	mockRevision := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f:2", "user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 2, "action": "update",
+		"user": bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y",
+			"email": "Razzil.Darkbrew@example.com", "country": "UK", "created_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC), "version": 2},
+		"recorded_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)}
+
+	// Define test cases
+	tests := []struct {
+		name          string
+		method        string
+		params        string
+		mockData      []interface{}
+		mockError     error
+		expectedPage  int64
+		expectedLimit int64
+		wantStatus    int
+		wantBody      string
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodPost,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Invalid id",
+			method:     http.MethodGet,
+			params:     `?id=1`,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Database error",
+			method:     http.MethodGet,
+			params:     `?id=8711e364-c83d-46fc-a3db-d6b2aee00d0f`,
+			mockError:  errors.New("mock error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:          "Listed revisions, newest first",
+			method:        http.MethodGet,
+			params:        `?id=8711e364-c83d-46fc-a3db-d6b2aee00d0f&page=2&limit=1`,
+			mockData:      []interface{}{mockRevision},
+			expectedPage:  2,
+			expectedLimit: 1,
+			wantStatus:    http.StatusOK,
+			wantBody:      `[{"user_id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","version":2,"action":"update","user":{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Alchemist","password":"","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-16T17:32:28Z","updated_at":"2024-06-17T19:49:18Z","version":2,"deleted_at":null},"recorded_at":"2024-06-17T19:49:18Z"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetRevisionCollection(&mocks.MongoCollection{
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					if tt.mockError != nil {
+						return nil, tt.mockError
+					}
+
+					expectedFilter := bson.M{"user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"}
+					if !reflect.DeepEqual(filter, expectedFilter) {
+						return nil, fmt.Errorf("expected filters: %#v, got %#v", expectedFilter, filter)
+					}
+
+					if !reflect.DeepEqual(opts[0].Sort, bson.D{{Key: "version", Value: -1}}) {
+						return nil, fmt.Errorf("expected newest first, got sort %#v", opts[0].Sort)
+					}
+
+					if *opts[0].Skip != (tt.expectedPage-1)*tt.expectedLimit {
+						return nil, fmt.Errorf("expected skip %#v, got %#v", (tt.expectedPage-1)*tt.expectedLimit, *opts[0].Skip)
+					}
+
+					if *opts[0].Limit != tt.expectedLimit {
+						return nil, fmt.Errorf("expected limit %#v, got %#v", tt.expectedLimit, *opts[0].Limit)
+					}
+
+					return mocks.NewMockCursor(tt.mockData).Cursor, nil
+				},
+			})
+			defer db.SetRevisionCollection(noopCollection)
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/history"+tt.params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			userHistoryHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestUserAtHandler(t *testing.T) {
+
+	mockRevision := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f:3", "user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 3, "action": "delete",
+		"user": bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Alchemist", "created_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC),
+			"updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC), "version": 3, "deleted_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)},
+		"recorded_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)}
+
+	// Define test cases
+	tests := []struct {
+		name         string
+		method       string
+		params       string
+		mockRevision interface{}
+		wantStatus   int
+		wantBody     string
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodPost,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Invalid time",
+			method:     http.MethodGet,
+			params:     `?id=8711e364-c83d-46fc-a3db-d6b2aee00d0f&at=yesterday`,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "User didn't exist yet",
+			method:     http.MethodGet,
+			params:     `?id=8711e364-c83d-46fc-a3db-d6b2aee00d0f&at=2024-06-18T00%3A00%3A00Z`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:         "Found the user as they were, deleted",
+			method:       http.MethodGet,
+			params:       `?id=8711e364-c83d-46fc-a3db-d6b2aee00d0f&at=2024-06-18T00%3A00%3A00Z`,
+			mockRevision: mockRevision,
+			wantStatus:   http.StatusOK,
+			wantBody:     `{"user_id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","version":3,"action":"delete","user":{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"","last_name":"","nickname":"Alchemist","password":"","email":"","country":"","created_at":"2024-06-16T17:32:28Z","updated_at":"2024-06-17T19:49:18Z","version":3,"deleted_at":"2024-06-17T19:49:18Z"},"recorded_at":"2024-06-17T19:49:18Z"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetRevisionCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					expectedFilter := bson.M{"user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "recorded_at": bson.M{"$lte": time.Date(2024, time.June, 18, 0, 0, 0, 0, time.UTC)}}
+					if !reflect.DeepEqual(filter, expectedFilter) {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %#v, got %#v", expectedFilter, filter), nil)
+					}
+
+					if tt.mockRevision == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(tt.mockRevision, nil, nil)
+				},
+			})
+			defer db.SetRevisionCollection(noopCollection)
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/history/at"+tt.params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			userAtHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRevertUserHandler(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC)
+	}
+
+	// Stored before passwords were left out of revisions, reverting to it still keeps the current password
+	revision := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f:2", "user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 2, "action": "update",
+		"user": bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y",
+			"email": "Razzil.Darkbrew@example.com", "country": "UK", "created_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), "updated_at": time.Date(2024, time.June, 17, 9, 0, 0, 0, time.UTC), "version": 2},
+		"recorded_at": time.Date(2024, time.June, 17, 9, 0, 0, 0, time.UTC)}
+	deletedRevision := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f:2", "user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 2, "action": "delete",
+		"user": bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Alchemist", "version": 2, "deleted_at": time.Date(2024, time.June, 17, 9, 0, 0, 0, time.UTC)}}
+	currentUser := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Meepo", "password": "d1gD1gD1g",
+		"email": "Razzil.Darkbrew@example.com", "country": "UK", "created_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC), "version": 4}
+
+	// Define test cases
+	tests := []struct {
+		name             string
+		method           string
+		body             []byte
+		ifMatch          string
+		expectedVersion  interface{}
+		mockRevision     interface{}
+		mockNicknameUser interface{}
+		wantStatus       int
+		wantETag         string
+		wantBody         string
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Invalid id",
+			method:     http.MethodPost,
+			body:       []byte(`{"id": "1", "version": 2}`),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "No such revision",
+			method:     http.MethodPost,
+			body:       []byte(`{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 2}`),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:         "User was deleted at the revision",
+			method:       http.MethodPost,
+			body:         []byte(`{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 2}`),
+			mockRevision: deletedRevision,
+			wantStatus:   http.StatusConflict,
+		},
+		{
+			name:             "Nickname taken since the revision",
+			method:           http.MethodPost,
+			body:             []byte(`{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 2}`),
+			mockRevision:     revision,
+			mockNicknameUser: bson.M{"_id": "0d0f9944-d902-4db1-b83b-6b25a61f89e2", "nickname": "Alchemist"},
+			wantStatus:       http.StatusConflict,
+		},
+		{
+			name:            "Reverted user successfully",
+			method:          http.MethodPost,
+			body:            []byte(`{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 2}`),
+			ifMatch:         `"4"`,
+			expectedVersion: int64(4),
+			mockRevision:    revision,
+			wantStatus:      http.StatusOK,
+			wantETag:        `"5"`,
+			wantBody:        `{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Alchemist","password":"d1gD1gD1g","email":"Razzil.Darkbrew@example.com","country":"UK","created_at":"2024-06-16T17:32:28Z","updated_at":"2024-06-18T09:00:00Z","version":5,"deleted_at":null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetRevisionCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					expectedFilter := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f:2"}
+					if !reflect.DeepEqual(filter, expectedFilter) {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %#v, got %#v", expectedFilter, filter), nil)
+					}
+
+					if tt.mockRevision == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(tt.mockRevision, nil, nil)
+				},
+				BulkWriteFunc: noopCollection.BulkWriteFunc,
+			})
+			defer db.SetRevisionCollection(noopCollection)
+
+			db.SetCollection(&mocks.MongoCollection{
+				// Checking whether the revision's nickname has been taken
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if tt.mockNicknameUser == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(tt.mockNicknameUser, nil, nil)
+				},
+				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+					if version := filter.(bson.M)["version"]; version != tt.expectedVersion {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("version filter incorrect, want: %v, got: %v", tt.expectedVersion, version), nil)
+					}
+
+					expectedSet := bson.M{"first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "email": "Razzil.Darkbrew@example.com",
+						"country": "UK", "updated_at": time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC)}
+					if !reflect.DeepEqual(update.(bson.M)["$set"], expectedSet) {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected update: %#v, got %#v", expectedSet, update), nil)
+					}
+
+					return mongo.NewSingleResultFromDocument(currentUser, nil, nil)
+				},
+			})
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/revert", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("If-Match", tt.ifMatch)
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			revertUserHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			if etag := rr.Header().Get("ETag"); etag != tt.wantETag {
+				t.Errorf("handler returned wrong ETag: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", etag, tt.wantETag)
+			}
+
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestWatchUsersSSEHandler(t *testing.T) {
+
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)
+	}
+
+	updated := func(sequence int) string {
+		return fmt.Sprintf(`{"sequence":%d,"user_id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","update_type":"UPDATED","user":{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"Razzil","last_name":"Darkbrew","nickname":"Alchemist","password":"","email":"","country":"UK","created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z","version":%d,"deleted_at":null},"changed_fields":["version"],"previous_user":null,"actor":"","request_id":"","created_at":"2024-06-17T19:49:18Z"}`, sequence, sequence)
+	}
+
+	// Define test cases
+	tests := []struct {
+		name          string
+		method        string
+		params        string
+		lastEventID   string
+		expiredBefore int64
+		wantStatus    int
+		wantBody      string
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodPost,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Malformed filter",
+			method:     http.MethodGet,
+			params:     `?filter=type`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "Malformed Last-Event-ID",
+			method:      http.MethodGet,
+			lastEventID: "abc",
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:          "Missed updates have expired",
+			method:        http.MethodGet,
+			lastEventID:   "1",
+			expiredBefore: 3,
+			wantStatus:    http.StatusGone,
+		},
+		{
+			name:        "Resume from the Last-Event-ID",
+			method:      http.MethodGet,
+			lastEventID: "1",
+			wantStatus:  http.StatusOK,
+			wantBody:    "id: 2\ndata: " + updated(2) + "\n\nid: 3\ndata: " + updated(3) + "\n\nid: 4\ndata: " + updated(4) + "\n\n",
+		},
+		{
+			name:        "Last-Event-ID takes priority",
+			method:      http.MethodGet,
+			params:      `?resume_after=0&filter=type=UPDATED+country=uk`,
+			lastEventID: "2",
+			wantStatus:  http.StatusOK,
+			wantBody:    "id: 3\ndata: " + updated(3) + "\n\nid: 4\ndata: " + updated(4) + "\n\n",
+		},
+		{
+			name:       "Only matching updates are sent",
+			method:     http.MethodGet,
+			params:     `?resume_after=0&filter=country=FR`,
+			wantStatus: http.StatusOK,
+			wantBody:   ": keep-alive\n\n",
+		},
+	}
+
+	watchKeepAlive = 50 * time.Millisecond
+	defer func() {
+		watchKeepAlive = 30 * time.Second
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(watchUsersHandler))
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Start from a fresh log, holding 3 updates
+			testEvents.settle()
+			eventLog := swapEventLog(t)
+			notify := func(version int64) {
+				notifyUpdate(t, eventLog, userService, updateUPDATED, &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew",
+					Nickname: "Alchemist", Country: "UK", Version: version}, []string{"version"})
+			}
+			for i := int64(1); i <= 3; i++ {
+				notify(i)
+			}
+			eventLog.trim(tt.expiredBefore)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequestWithContext(ctx, tt.method, server.URL+tt.params, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.lastEventID != "" {
+				req.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// Check the status code is what we expect
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+				t.Errorf("handler returned wrong content type: %v", contentType)
+			}
+
+			// A live update, sent once we've resumed
+			notify(4)
+
+			body := make([]byte, len(tt.wantBody))
+			if _, err := io.ReadFull(resp.Body, body); err != nil {
+				t.Fatalf("failed reading events, got %q: %v", body, err)
+			}
+
+			// Check the response body is what we expect
+			if string(body) != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", string(body), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestWatchUsersWebSocketHandler(t *testing.T) {
+
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(watchUsersWebSocketHandler))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	testEvents.settle()
+	eventLog := swapEventLog(t)
+	for _, updateType := range []string{updateCREATED, updateUPDATED} {
+		notifyUpdate(t, eventLog, userService, updateType, &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"}, []string{"version"})
+	}
+
+	// Malformed filters are rejected before upgrading
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?filter=colour=red", nil)
+	if err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the filter to be rejected, got: %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?resume_after=0&filter=type=UPDATED,DELETED", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The replayed update, then a live one
+	notifyUpdate(t, eventLog, userService, updateDELETED, &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"}, []string{"deleted_at"})
+
+	wantMessages := []string{
+		`{"sequence":2,"user_id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","update_type":"UPDATED","user":{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"","last_name":"","nickname":"","password":"","email":"","country":"","created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z","version":0,"deleted_at":null},"changed_fields":["version"],"previous_user":null,"actor":"","request_id":"","created_at":"2024-06-17T19:49:18Z"}`,
+		`{"sequence":3,"user_id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","update_type":"DELETED","user":{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"","last_name":"","nickname":"","password":"","email":"","country":"","created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z","version":0,"deleted_at":null},"changed_fields":["deleted_at"],"previous_user":null,"actor":"","request_id":"","created_at":"2024-06-17T19:49:18Z"}`,
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i, want := range wantMessages {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed reading message %d: %v", i, err)
+		}
+		if messageType != websocket.TextMessage || string(message) != want {
+			t.Errorf("unexpected message %d: \n\rgot: \n\r%s \n\rwant: \n\r%s\n\r", i, message, want)
+		}
+	}
+}
+
+func TestAddWebhookHandler(t *testing.T) {
+
+	// Set out timenow and uuid functions, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)
+	}
+	newUUID = func() string {
+		return "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f"
+	}
+
+	// Define test cases
+	tests := []struct {
+		name       string
+		method     string
+		body       []byte
+		mockErr    error
+		wantStatus int
+		wantBody   string
+		wantStored interface{}
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Malformed body",
+			method:     http.MethodPost,
+			body:       []byte(`{"url": `),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Invalid url",
+			method:     http.MethodPost,
+			body:       []byte(`{"url": "hooks.example.com/users", "secret": "0123456789abcdef"}`),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Unknown event type",
+			method:     http.MethodPost,
+			body:       []byte(`{"url": "https://hooks.example.com/users", "event_types": ["MOVED"], "secret": "0123456789abcdef"}`),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Secret too short",
+			method:     http.MethodPost,
+			body:       []byte(`{"url": "https://hooks.example.com/users", "secret": "hunter2"}`),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Failed to store",
+			method:     http.MethodPost,
+			body:       []byte(`{"url": "https://hooks.example.com/users", "secret": "0123456789abcdef"}`),
+			mockErr:    errors.New("connection lost"),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Added webhook successfully",
+			method:     http.MethodPost,
+			body:       []byte(`{"url": "https://hooks.example.com/users", "event_types": ["created", "DELETED"], "secret": "0123456789abcdef"}`),
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":"3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f","url":"https://hooks.example.com/users","event_types":["CREATED","DELETED"],"created_at":"2024-06-17T19:49:18Z","updated_at":"2024-06-17T19:49:18Z"}`,
+			wantStored: data.Webhook{ID: "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", URL: "https://hooks.example.com/users", EventTypes: []string{"CREATED", "DELETED"}, Secret: "0123456789abcdef",
+				CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC), UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)},
+		},
+		{
+			name:       "Every event type",
+			method:     http.MethodPost,
+			body:       []byte(`{"url": "http://hooks.example.com:9000/hook", "secret": "0123456789abcdef"}`),
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":"3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f","url":"http://hooks.example.com:9000/hook","event_types":[],"created_at":"2024-06-17T19:49:18Z","updated_at":"2024-06-17T19:49:18Z"}`,
+		},
+		{
+			name:       "Private address",
+			method:     http.MethodPost,
+			body:       []byte(`{"url": "http://169.254.169.254/latest/meta-data", "secret": "0123456789abcdef"}`),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stored interface{}
+			db.SetWebhookCollection(&mocks.MongoCollection{
+				InsertOneFunc: func(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
+					stored = document
+					return &mongo.InsertOneResult{}, tt.mockErr
+				},
+				FindFunc: noWebhooks.FindFunc,
+			})
+			defer db.SetWebhookCollection(noWebhooks)
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/webhooks/add", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			addWebhookHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			// Check the response body is what we expect, the secret is never returned
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+
+			if tt.wantStored != nil && !reflect.DeepEqual(stored, tt.wantStored) {
+				t.Errorf("unexpected webhook stored: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestUpdateWebhookHandler(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC)
+	}
+
+	stored := bson.M{"_id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", "url": "https://hooks.example.com/v2/users", "event_types": bson.A{"UPDATED"}, "secret": "0123456789abcdef",
+		"created_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC), "updated_at": time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC)}
+
+	// Define test cases
+	tests := []struct {
+		name        string
+		method      string
+		body        []byte
+		expectedSet bson.M
+		notFound    bool
+		wantStatus  int
+		wantBody    string
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Invalid id",
+			method:     http.MethodPost,
+			body:       []byte(`{"id": "1", "url": "https://hooks.example.com/v2/users"}`),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Invalid url",
+			method:     http.MethodPost,
+			body:       []byte(`{"id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", "url": "ftp://hooks.example.com"}`),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "New secret too short",
+			method:     http.MethodPost,
+			body:       []byte(`{"id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", "url": "https://hooks.example.com/v2/users", "secret": "hunter2"}`),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "No such webhook",
+			method:      http.MethodPost,
+			body:        []byte(`{"id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", "url": "https://hooks.example.com/v2/users"}`),
+			expectedSet: bson.M{"url": "https://hooks.example.com/v2/users", "event_types": []string{}, "updated_at": time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC)},
+			notFound:    true,
+			wantStatus:  http.StatusNotFound,
+		},
+		{
+			name:        "Updated keeping the secret",
+			method:      http.MethodPost,
+			body:        []byte(`{"id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", "url": "https://hooks.example.com/v2/users", "event_types": ["updated"]}`),
+			expectedSet: bson.M{"url": "https://hooks.example.com/v2/users", "event_types": []string{"UPDATED"}, "updated_at": time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC)},
+			wantStatus:  http.StatusOK,
+			wantBody:    `{"id":"3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f","url":"https://hooks.example.com/v2/users","event_types":["UPDATED"],"created_at":"2024-06-17T19:49:18Z","updated_at":"2024-06-18T09:00:00Z"}`,
+		},
+		{
+			name:   "Updated with a new secret",
+			method: http.MethodPost,
+			body:   []byte(`{"id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", "url": "https://hooks.example.com/v2/users", "event_types": ["UPDATED"], "secret": "fedcba9876543210"}`),
+			expectedSet: bson.M{"url": "https://hooks.example.com/v2/users", "event_types": []string{"UPDATED"}, "secret": "fedcba9876543210",
+				"updated_at": time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC)},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":"3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f","url":"https://hooks.example.com/v2/users","event_types":["UPDATED"],"created_at":"2024-06-17T19:49:18Z","updated_at":"2024-06-18T09:00:00Z"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetWebhookCollection(&mocks.MongoCollection{
+				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+					expectedFilter := bson.M{"_id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f"}
+					if !reflect.DeepEqual(filter, expectedFilter) {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %#v, got %#v", expectedFilter, filter), nil)
+					}
+					if !reflect.DeepEqual(update.(bson.M)["$set"], tt.expectedSet) {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected update: %#v, got %#v", tt.expectedSet, update), nil)
+					}
+
+					if tt.notFound {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(stored, nil, nil)
+				},
+				FindFunc: noWebhooks.FindFunc,
+			})
+			defer db.SetWebhookCollection(noWebhooks)
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/webhooks/update", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			updateWebhookHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRedeliverWebhookHandler(t *testing.T) {
+
+	deadLetter := bson.M{"_id": "9b2e4f7a-1c3d-4e5f-8a9b-0c1d2e3f4a5b", "webhook_id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", "attempts": 8, "last_error": "receiver responded with 503 Service Unavailable",
+		"event": bson.M{"_id": int64(42), "user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "update_type": "DELETED"}}
+	hook := bson.M{"_id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", "url": "https://hooks.example.com/users", "event_types": bson.A{}, "secret": "0123456789abcdef"}
+
+	// Define test cases
+	tests := []struct {
+		name           string
+		method         string
+		body           []byte
+		mockDeadLetter interface{}
+		mockWebhook    interface{}
+		alreadyTaken   bool
+		wantStatus     int
+		wantDeleted    bool
+		wantQueued     int64
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "No such dead letter",
+			method:     http.MethodPost,
+			body:       []byte(`{"id": "9b2e4f7a-1c3d-4e5f-8a9b-0c1d2e3f4a5b"}`),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Webhook has been deleted",
+			method:         http.MethodPost,
+			body:           []byte(`{"id": "9b2e4f7a-1c3d-4e5f-8a9b-0c1d2e3f4a5b"}`),
+			mockDeadLetter: deadLetter,
+			wantStatus:     http.StatusNotFound,
+		},
+		{
+			name:           "Already redelivered",
+			method:         http.MethodPost,
+			body:           []byte(`{"id": "9b2e4f7a-1c3d-4e5f-8a9b-0c1d2e3f4a5b"}`),
+			mockDeadLetter: deadLetter,
+			mockWebhook:    hook,
+			alreadyTaken:   true,
+			wantStatus:     http.StatusNotFound,
+			wantDeleted:    true,
+		},
+		{
+			name:           "Redelivered",
+			method:         http.MethodPost,
+			body:           []byte(`{"id": "9b2e4f7a-1c3d-4e5f-8a9b-0c1d2e3f4a5b"}`),
+			mockDeadLetter: deadLetter,
+			mockWebhook:    hook,
+			wantStatus:     http.StatusAccepted,
+			wantDeleted:    true,
+			wantQueued:     1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted := false
+			db.SetDeadLetterCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if tt.mockDeadLetter == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(tt.mockDeadLetter, nil, nil)
+				},
+				DeleteOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+					deleted = true
+					if tt.alreadyTaken {
+						return &mongo.DeleteResult{}, nil
+					}
+					return &mongo.DeleteResult{DeletedCount: 1}, nil
+				},
+			})
+			db.SetWebhookCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if tt.mockWebhook == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(tt.mockWebhook, nil, nil)
+				},
+				FindFunc: noWebhooks.FindFunc,
+			})
+			defer db.SetWebhookCollection(noWebhooks)
+
+			// Nothing is delivering, so redeliveries stay queued
+			queued := userService.webhooks.Stats().Queued
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/webhooks/redeliver", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			redeliverWebhookHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			if deleted != tt.wantDeleted {
+				t.Errorf("dead letter deleted: %v, want: %v", deleted, tt.wantDeleted)
+			}
+			if got := userService.webhooks.Stats().Queued - queued; got != tt.wantQueued {
+				t.Errorf("unexpected deliveries queued, want: %d, got: %d", tt.wantQueued, got)
+			}
+		})
+	}
+}
+
+func TestWebhookDelivered(t *testing.T) {
+
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)
+	}
+
+	// The receiver fails the first delivery, then accepts the retry
+	var (
+		mu       sync.Mutex
+		received []*http.Request
+	)
+	bodies := make(chan []byte, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, r)
+		attempt := len(received)
+		mu.Unlock()
+
+		if err := webhook.Verify("0123456789abcdef", r.Header, body, time.Minute); err != nil {
+			t.Errorf("delivery isn't signed: %v", err)
+		}
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	// Both updates look up the webhooks, wait for them before putting the collection back
+	var listed sync.WaitGroup
+	listed.Add(2)
+
+	db.SetWebhookCollection(&mocks.MongoCollection{
+		FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+			defer listed.Done()
+			hook := bson.M{"_id": "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f", "url": receiver.URL, "event_types": bson.A{"UPDATED"}, "secret": "0123456789abcdef"}
+			return mocks.NewMockCursor([]interface{}{hook}).Cursor, nil
+		},
+	})
+	defer db.SetWebhookCollection(noWebhooks)
+	defer listed.Wait()
+
+	deliveries := make(chan data.WebhookDelivery, 10)
+	db.SetDeliveryCollection(&mocks.MongoCollection{
+		InsertOneFunc: func(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
+			deliveries <- document.(data.WebhookDelivery)
+			return &mongo.InsertOneResult{}, nil
+		},
+	})
+
+	// Retry straight away, to a receiver on localhost
+	webhookBackoff, webhookAllowPrivate = time.Millisecond, true
+	service := NewUserService()
+	webhookBackoff, webhookAllowPrivate = 5*time.Second, false
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go service.webhooks.Run(ctx)
+
+	testEvents.settle()
+	eventLog := swapEventLog(t)
+
+	// Only updates are wanted, so the creation isn't delivered
+	user := &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Alchemist", Password: "$2a$10$hash", Version: 2}
+	notifyUpdate(t, eventLog, service, updateCREATED, user, []string{"id"})
+	notifyUpdate(t, eventLog, service, updateUPDATED, user, []string{"nickname", "version"})
+
+	wantBody := `{"sequence":2,"user_id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","update_type":"UPDATED","user":{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"","last_name":"","nickname":"Alchemist","password":"","email":"","country":"","created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z","version":2,"deleted_at":null},"changed_fields":["nickname","version"],"previous_user":null,"actor":"","request_id":"","created_at":"2024-06-17T19:49:18Z"}`
+	select {
+	case body := <-bodies:
+		if string(body) != wantBody {
+			t.Errorf("unexpected delivery: \n\rgot: \n\r%s \n\rwant: \n\r%s\n\r", body, wantBody)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the delivery")
+	}
+
+	// Both attempts are logged under the same delivery
+	for i, wantStatus := range []string{data.DeliveryRetrying, data.DeliverySucceeded} {
+		delivery := <-deliveries
+		if delivery.Attempt != i+1 || delivery.Status != wantStatus || delivery.Sequence != 2 || delivery.WebhookID != "3f1d2a6c-5b7e-4c8d-9e0f-1a2b3c4d5e6f" {
+			t.Errorf("unexpected delivery logged: %+v", delivery)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].Header.Get(webhook.DeliveryHeader) != received[1].Header.Get(webhook.DeliveryHeader) {
+		t.Errorf("expected the same delivery to be tried twice, got %d requests", len(received))
+	}
+}
+
+func TestBatchAddUsersHandler(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	newUUID = func() string {
+		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	}
+
+	tooLarge := make([]string, maxBatchSize+1)
+	for i := range tooLarge {
+		tooLarge[i] = "{}"
+	}
+
+	// Define test cases
+	tests := []struct {
+		name              string
+		method            string
+		body              []byte
+		mockExisting      []interface{}
+		mockFindError     error
+		mockWriteError    error
+		expectedNicknames []string
+		expectedWrites    int
+		wantStatus        int
+		wantBody          string
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Invalid json",
+			method:     http.MethodPost,
+			body:       []byte(`{"first_name": "Razzil"}`),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Batch too large",
+			method:     http.MethodPost,
+			body:       []byte("[" + strings.Join(tooLarge, ",") + "]"),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "Database error",
+			method: http.MethodPost,
+			body: []byte(`[
+				{"first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y", "email": "Razzil.Darkbrew@example.com", "country": "UK"}
+			]`),
+			mockFindError: errors.New("mock error"),
+			wantStatus:    http.StatusInternalServerError,
+		},
+		{
+			name:   "Mixed batch reports each user",
+			method: http.MethodPost,
+			body: []byte(`[
+				{"first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y", "email": "Razzil.Darkbrew@example.com", "country": "UK"},
+				{"first_name": "Meepo", "last_name": "Geomancer", "nickname": "Meepo", "password": "hello", "email": "meepo@example.com", "country": "UK"},
+				{"first_name": "Rylai", "last_name": "Crestfall", "nickname": "Crystal", "password": "fr0stB1teFr0st", "email": "rylai@example.com", "country": "UK"},
+				{"first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y", "email": "Razzil.Darkbrew@example.com", "country": "UK"},
+				{"first_name": "Aiushtha", "last_name": "Enchantress", "nickname": "Enchantress", "password": "n4turesAtt3ndants", "email": "aiushtha@example.com", "country": "UK"}
+			]`),
+			mockExisting:      []interface{}{bson.M{"_id": "1", "nickname": "Crystal"}},
+			mockWriteError:    mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Index: 1, Code: 121, Message: "Document failed validation"}}}},
+			expectedNicknames: []string{"Alchemist", "Meepo", "Crystal", "Alchemist", "Enchantress"},
+			expectedWrites:    2,
+			wantStatus:        http.StatusOK,
+			wantBody: `[{"index":0,"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","status":"created","error":"","version":1},` +
+				`{"index":1,"id":"","status":"invalid","error":"invalid password","version":0},` +
+				`{"index":2,"id":"","status":"conflict","error":"a user with this username already exists","version":0},` +
+				`{"index":3,"id":"","status":"conflict","error":"a user with this username already exists","version":0},` +
+				`{"index":4,"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","status":"failed","error":"Document failed validation","version":0}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writes := 0
+			db.SetCollection(&mocks.MongoCollection{
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					if tt.mockFindError != nil {
+						return nil, tt.mockFindError
+					}
+
+					expectedFilter := bson.M{"nickname": bson.M{"$in": tt.expectedNicknames}, "deleted_at": nil}
+					if !reflect.DeepEqual(filter, expectedFilter) {
+						return nil, fmt.Errorf("expected filters: %#v, got %#v", expectedFilter, filter)
+					}
+
+					return mongo.NewCursorFromDocuments(tt.mockExisting, nil, nil)
+				},
+				BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+					// The writes that failed are dropped, and the rest written again
+					writes++
+					if writes > 1 {
+						return &mongo.BulkWriteResult{InsertedCount: int64(len(models))}, nil
+					}
+					if len(models) != tt.expectedWrites {
+						return nil, fmt.Errorf("expected %d writes, got %d", tt.expectedWrites, len(models))
+					}
+
+					return &mongo.BulkWriteResult{}, tt.mockWriteError
+				},
+			})
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/batch/add", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			batchAddUsersHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestBatchDeleteUsersHandler tests a version on a user is checked like If-Match, 0 being a version to check rather than no version at all
+func TestBatchDeleteUsersHandler(t *testing.T) {
+
+	meepoID := "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	razzilID := "0d0f9944-d902-4db1-b83b-6b25a61f89e2"
+
+	body := []byte(`[
+		{"id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 0},
+		{"id": "0d0f9944-d902-4db1-b83b-6b25a61f89e2"}
+	]`)
+
+	finds := 0
+	mockFinds := [][]interface{}{
+		// The stored users
+		{
+			bson.M{"_id": meepoID, "version": 1},
+			bson.M{"_id": razzilID, "version": 4},
+		},
+		// The users left after the delete
+		{},
+	}
+
+	db.SetCollection(&mocks.MongoCollection{
+		FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+			if finds >= len(mockFinds) {
+				return nil, fmt.Errorf("unexpected find: %#v", filter)
+			}
+			finds++
+			return mongo.NewCursorFromDocuments(mockFinds[finds-1], nil, nil)
+		},
+		BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+			// Without a version the user is deleted at whichever version was just read
+			expectedFilter := bson.M{"_id": razzilID, "version": int64(4), "deleted_at": nil}
+			if len(models) != 1 || !reflect.DeepEqual(models[0].(*mongo.UpdateOneModel).Filter, expectedFilter) {
+				return nil, fmt.Errorf("expected a single delete of %#v", expectedFilter)
+			}
+
+			return &mongo.BulkWriteResult{MatchedCount: 1, ModifiedCount: 1}, nil
+		},
+	})
+
+	// Create a request to pass to the handler
+	req, err := http.NewRequest(http.MethodPost, "/userapi/batch/delete", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Create a ResponseRecorder to record the response
+	rr := httptest.NewRecorder()
+
+	// Call the handler directly with the request and recorder
+	batchDeleteUsersHandler(rr, req)
+
+	// Check the status code is what we expect
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, http.StatusOK)
+	}
+
+	// Check the response body is what we expect
+	wantBody := `[{"index":0,"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","status":"conflict","error":"user version does not match the expected version","version":0},` +
+		`{"index":1,"id":"0d0f9944-d902-4db1-b83b-6b25a61f89e2","status":"deleted","error":"","version":0}]`
+	if rr.Body.String() != wantBody {
+		t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), wantBody)
+	}
+}
+
+func TestExportUsersHandler(t *testing.T) {
+
+	// Define test cases
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		mockData   []interface{}
+		mockError  error
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodPost,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Unknown format",
+			method:     http.MethodGet,
+			query:      "?format=xml",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Database error",
+			method:     http.MethodGet,
+			mockError:  errors.New("mock error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:   "Export as ndjson",
+			method: http.MethodGet,
+			query:  "?fields=id,nickname,version",
+			mockData: []interface{}{
+				bson.M{"_id": "1", "nickname": "Alchemist", "version": 2},
+				bson.M{"_id": "2", "nickname": "Meepo", "version": 1},
+			},
+			wantStatus: http.StatusOK,
+			wantType:   "application/x-ndjson",
+			wantBody:   "{\"id\":\"1\",\"nickname\":\"Alchemist\",\"version\":2}\n{\"id\":\"2\",\"nickname\":\"Meepo\",\"version\":1}\n",
+		},
+		{
+			name:   "Export as csv with renamed columns",
+			method: http.MethodGet,
+			query:  "?format=csv&fields=id,nickname,created_at&map=handle=nickname",
+			mockData: []interface{}{
+				bson.M{"_id": "1", "nickname": "Alchemist", "created_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC)},
+			},
+			wantStatus: http.StatusOK,
+			wantType:   "text/csv",
+			wantBody:   "id,handle,created_at\n1,Alchemist,2024-06-16T17:32:28Z\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetCollection(&mocks.MongoCollection{
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					if tt.mockError != nil {
+						return nil, tt.mockError
+					}
+					return mongo.NewCursorFromDocuments(tt.mockData, nil, nil)
+				},
+			})
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/admin/export"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			exportUsersHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			if tt.wantType != "" && rr.Header().Get("Content-Type") != tt.wantType {
+				t.Errorf("handler returned wrong content type: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Header().Get("Content-Type"), tt.wantType)
+			}
+
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestImportUsersHandler(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	newUUID = func() string {
+		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	}
+
+	body := "id,first_name,surname,nickname,password,email,country,created_at,version\n" +
+		"0d0f9944-d902-4db1-b83b-6b25a61f89e2,Razzil,Darkbrew,Alchemist,$2a$10$hash,Razzil.Darkbrew@example.com,UK,2024-06-16T17:32:28Z,4\n" +
+		",Meepo,Geomancer,Meepo,$2a$10$hash,meepo@example.com,UK,,\n" +
+		",Rylai,Crestfall,Crystal,$2a$10$hash,not-an-email,UK,,\n" +
+		"5b0d3c3e-8f4b-4f4e-9f0e-3c1c0f2d9a11,Aiushtha,Enchantress,Enchantress,$2a$10$hash,aiushtha@example.com,UK,,\n"
+
+	// Define test cases
+	tests := []struct {
+		name           string
+		method         string
+		query          string
+		body           string
+		mockExisting   []interface{}
+		expectedWrites []data.User
+		wantStatus     int
+		wantBody       string
+	}{
+		{
+			name:       "Incorrect Method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "Unknown column",
+			method:     http.MethodPost,
+			query:      "?format=csv",
+			body:       "shoe_size\n9\n",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:         "Import keeps ids, timestamps and hashed passwords",
+			method:       http.MethodPost,
+			query:        "?format=csv&map=surname=last_name&passwordhashes=true",
+			body:         body,
+			mockExisting: []interface{}{bson.M{"_id": "5b0d3c3e-8f4b-4f4e-9f0e-3c1c0f2d9a11", "nickname": "Aiushtha"}},
+			expectedWrites: []data.User{
+				{ID: "0d0f9944-d902-4db1-b83b-6b25a61f89e2", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "$2a$10$hash", Email: "Razzil.Darkbrew@example.com", Country: "UK",
+					CreatedAt: time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), UpdatedAt: time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), Version: 4},
+				{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Meepo", LastName: "Geomancer", Nickname: "Meepo", Password: "$2a$10$hash", Email: "meepo@example.com", Country: "UK",
+					CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), Version: 1},
+			},
+			wantStatus: http.StatusOK,
+			wantBody: `{"dry_run":false,"report":{"rows":4,"skipped":0,"imported":2,"rejected":2,"last_row":4},"rejections":[` +
+				`{"row":3,"id":"","nickname":"Crystal","status":"invalid","reason":"invalid email"},` +
+				`{"row":4,"id":"5b0d3c3e-8f4b-4f4e-9f0e-3c1c0f2d9a11","nickname":"Enchantress","status":"conflict","reason":"a user with this id already exists"}]}`,
+		},
+		{
+			name:         "Dry run writes nothing",
+			method:       http.MethodPost,
+			query:        "?format=csv&map=surname=last_name&passwordhashes=true&dryrun=true",
+			body:         body,
+			mockExisting: []interface{}{bson.M{"_id": "5b0d3c3e-8f4b-4f4e-9f0e-3c1c0f2d9a11", "nickname": "Aiushtha"}},
+			wantStatus:   http.StatusOK,
+			wantBody: `{"dry_run":true,"report":{"rows":4,"skipped":0,"imported":2,"rejected":2,"last_row":4},"rejections":[` +
+				`{"row":3,"id":"","nickname":"Crystal","status":"invalid","reason":"invalid email"},` +
+				`{"row":4,"id":"5b0d3c3e-8f4b-4f4e-9f0e-3c1c0f2d9a11","nickname":"Enchantress","status":"conflict","reason":"a user with this id already exists"}]}`,
+		},
+		{
+			name:       "Passwords are checked against the policy, unless they are hashes",
+			method:     http.MethodPost,
+			query:      "?format=csv&map=surname=last_name&dryrun=true&resumeafter=2",
+			body:       body,
+			wantStatus: http.StatusOK,
+			wantBody: `{"dry_run":true,"report":{"rows":4,"skipped":2,"imported":0,"rejected":2,"last_row":4},"rejections":[` +
+				`{"row":3,"id":"","nickname":"Crystal","status":"invalid","reason":"invalid password"},` +
+				`{"row":4,"id":"5b0d3c3e-8f4b-4f4e-9f0e-3c1c0f2d9a11","nickname":"Enchantress","status":"invalid","reason":"invalid password"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetCollection(&mocks.MongoCollection{
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					// Only the ID lookup finds anything
+					if _, ok := filter.(bson.M)["_id"]; ok {
+						return mongo.NewCursorFromDocuments(tt.mockExisting, nil, nil)
+					}
+					return mongo.NewCursorFromDocuments([]interface{}{}, nil, nil)
+				},
+				BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+					var users []data.User
+					for _, model := range models {
+						users = append(users, *model.(*mongo.InsertOneModel).Document.(*data.User))
+					}
+
+					if !reflect.DeepEqual(users, tt.expectedWrites) {
+						return nil, fmt.Errorf("expected writes: %#v, got %#v", tt.expectedWrites, users)
+					}
+					return &mongo.BulkWriteResult{InsertedCount: int64(len(models))}, nil
+				},
+			})
+
+			// Create a request to pass to the handler
+			req, err := http.NewRequest(tt.method, "/userapi/admin/import"+tt.query, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Create a ResponseRecorder to record the response
+			rr := httptest.NewRecorder()
+
+			// Call the handler directly with the request and recorder
+			importUsersHandler(rr, req)
+
+			// Check the status code is what we expect
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status, tt.wantStatus)
+			}
+
+			// Check the response body is what we expect
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("handler returned unexpected body: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+//################################################################
+// gRPC Handler Tests
+//################################################################
+
+func TestGetAllUsersGRPCHandler(t *testing.T) {
+
+	// reset our cache
+	db.UserStore.Clear()
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	newUUID = func() string {
+		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	}
+
+	// Define test cases
+	tests := []struct {
+		name          string
+		mockData      []interface{}
+		mockError     error
+		expectedUsers []*pb.User
+		expectedError bool
+	}{
+		{
+			name:          "Database error",
+			mockData:      nil,
+			mockError:     errors.New("mock error"),
+			expectedError: true,
+		},
+		{ // This test should be last, because it saturates the cache
+			name: "Successful fetch",
+			mockData: []interface{}{
+				bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "jdoe", "Email": "john.doe@example.com", "Country": "USA",
+					"password": "moneyMoneyM0n3y", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
+				bson.M{"_id": "2", "first_name": "Jane", "last_name": "Smith", "nickname": "jsmith", "Email": "jane.smith@example.com", "Country": "UK",
+					"password": "suP3rS3cret", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
+			},
+			expectedUsers: []*pb.User{
+				{ID: "1", FirstName: "John", LastName: "Doe", Nickname: "jdoe", Password: "moneyMoneyM0n3y", Email: "john.doe@example.com", Country: "USA", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
+				{ID: "2", FirstName: "Jane", LastName: "Smith", Nickname: "jsmith", Password: "suP3rS3cret", Email: "jane.smith@example.com", Country: "UK", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
+			},
+		},
+		{
+			name: "Successful fetch Cache Hit",
+			expectedUsers: []*pb.User{
+				{ID: "1", FirstName: "John", LastName: "Doe", Nickname: "jdoe", Password: "moneyMoneyM0n3y", Email: "john.doe@example.com", Country: "USA", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
+				{ID: "2", FirstName: "Jane", LastName: "Smith", Nickname: "jsmith", Password: "suP3rS3cret", Email: "jane.smith@example.com", Country: "UK", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Mock the userCollection.Find method
+			db.SetCollection(&mocks.MongoCollection{
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					if tt.mockError != nil {
+						return nil, tt.mockError
+					}
+					return mocks.NewMockCursor(tt.mockData).Cursor, nil
+				},
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			response, err := grpcTestService.GetAllUsers(ctx, nil)
+			// If we got an error, but we didn't expect it. Then we error.
+			// If we didn't get an error, but we expect one. Then we error.
+			if (err != nil && !tt.expectedError) || (err == nil && tt.expectedError) {
+				t.Errorf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
+			}
+
+			// Exit early, because its an error scenario.
+			if tt.expectedError {
+				return
+			}
+
+			if len(response.Users) != len(tt.expectedUsers) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response.Users, tt.expectedUsers)
+			}
+
+			if !reflect.DeepEqual(response.Users, tt.expectedUsers) {
+				for i := range response.Users {
+					t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response.Users[i], tt.expectedUsers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetUsersGRPCHandler(t *testing.T) {
+	// Define test cases
+	tests := []struct {
+		name            string
+		req             *pb.GetUsersRequest
+		mockData        []interface{}
+		mockError       error
+		expectedFilters bson.M
+		expectedError   bool
+		expectedPage    int64
+		expectedLimit   int64
+		expectedUsers   []*pb.User
+	}{
+		{
+			name:          "Database error",
+			req:           &pb.GetUsersRequest{},
+			mockData:      nil,
+			mockError:     errors.New("mock error"),
+			expectedError: true,
+		},
+		{
+			name: "Successful fetch",
+			req: &pb.GetUsersRequest{
+				Country:      "UK",
+				Nickname:     "j",
+				CreatedAfter: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)),
+				Page:         1,
+				Limit:        50,
+			},
+			expectedFilters: bson.M{
+				"country":    bson.M{`$options`: `i`, `$regex`: `UK`},
+				"created_at": bson.M{`$gt`: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)},
+				"nickname":   bson.M{`$options`: `i`, `$regex`: `j`},
+				"deleted_at": nil,
+			},
+			expectedPage:  1,
+			expectedLimit: 50,
+			mockData: []interface{}{
+				bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "jdoe", "Email": "john.doe@example.com", "Country": "USA",
+					"password": "moneyMoneyM0n3y", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
+			},
+			expectedError: false,
+			expectedUsers: []*pb.User{
+				{ID: "1", FirstName: "John", LastName: "Doe", Nickname: "jdoe", Password: "moneyMoneyM0n3y", Email: "john.doe@example.com", Country: "USA", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
+			},
+		},
+		{
+			name: "Successful fetch 2",
+			req: &pb.GetUsersRequest{
+				Country:      "Germany",
+				Nickname:     "jdoe",
+				CreatedAfter: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)),
+				Page:         1,
+				Limit:        25,
+			},
+			expectedFilters: bson.M{
+				"country":    bson.M{`$options`: `i`, `$regex`: `Germany`},
+				"created_at": bson.M{`$gt`: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)},
+				"nickname":   bson.M{`$options`: `i`, `$regex`: `jdoe`},
+				"deleted_at": nil,
+			},
+			expectedPage:  1,
+			expectedLimit: 25,
+			expectedError: false,
+			mockData: []interface{}{
+				bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "jdoe", "Email": "john.doe@example.com", "Country": "USA",
+					"password": "moneyMoneyM0n3y", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
+			},
+			expectedUsers: []*pb.User{
+				{ID: "1", FirstName: "John", LastName: "Doe", Nickname: "jdoe", Password: "moneyMoneyM0n3y", Email: "john.doe@example.com", Country: "USA", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Mock the userCollection.Find method
+			db.SetCollection(&mocks.MongoCollection{
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					if tt.mockError != nil {
+						return nil, tt.mockError
+					}
+
+					// Compare our filters to  ensure the request to mongo is correct
+					if tt.expectedFilters != nil {
+						if filter == nil {
+							return nil, fmt.Errorf("expected filters: %v, got %v", tt.expectedFilters, filter)
+						}
+
+						bsonFilter, ok := filter.(bson.M)
+						if !ok {
+							return nil, fmt.Errorf("failed to cast filters to bson: %v", filter)
+						}
+
+						if !reflect.DeepEqual(bsonFilter, tt.expectedFilters) {
+							return nil, fmt.Errorf("expected filters: %#v, got %#v", tt.expectedFilters, bsonFilter)
+						}
+					}
+
+					if opts == nil {
+						return nil, errors.New("no opts were provided")
+					}
+
+					if *opts[0].Skip != int64((tt.expectedPage-1)*tt.expectedLimit) {
+						return nil, fmt.Errorf("expected skip %#v, got %#v", tt.expectedPage, *opts[0].Skip)
+					}
+
+					if *opts[0].Limit != tt.expectedLimit {
+						return nil, fmt.Errorf("expected limit %#v, got %#v", tt.expectedLimit, *opts[0].Limit)
+					}
+
+					return mocks.NewMockCursor(tt.mockData).Cursor, nil
+				},
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			response, err := grpcTestService.GetUsers(ctx, tt.req)
+			// If we got an error, but we didn't expect it. Then we error.
+			// If we didn't get an error, but we expect one. Then we error.
+			if (err != nil && !tt.expectedError) || (err == nil && tt.expectedError) {
+				t.Errorf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
+			}
+
+			// Exit early, because its an error scenario.
+			if tt.expectedError {
+				return
+			}
+
+			if len(response.Users) != len(tt.expectedUsers) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response.Users, tt.expectedUsers)
+			}
+
+			if !reflect.DeepEqual(response.Users, tt.expectedUsers) {
+				for i := range response.Users {
+					t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response.Users[i], tt.expectedUsers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAddUserGRPCHandler(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	newUUID = func() string {
+		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	}
+
+	// Define test cases
+	tests := []struct {
+		name             string
+		req              *pb.AddUserRequest
+		mockData         interface{}
+		mockError        error
+		expectedError    bool
+		expectedFilters  bson.M
+		expectedUser     *data.User
+		expectedResponse *pb.User
+	}{
+		{
+			name: "Database error",
+			req: &pb.AddUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "Razzil.Darkbrew@example.com",
+				Country:   "UK",
+			},
+			mockError:     errors.New("mock error"),
+			expectedError: true,
+		},
+		{
+			name:          "Failed add, no first_name",
+			req:           &pb.AddUserRequest{},
+			expectedError: true,
+		},
+		{
+			name: "Failed add, no last_name",
+			req: &pb.AddUserRequest{
+				FirstName: "Razzil",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed add, no nickname",
+			req: &pb.AddUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed add, no valid pass",
+			req: &pb.AddUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "testing",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed add, no valid email",
+			req: &pb.AddUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "hello.hello",
+				Country:   "UK",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed add, no country",
+			req: &pb.AddUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "Razzil.Darkbrew@example.com",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed add, username already exists",
+			req: &pb.AddUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "Razzil.Darkbrew@example.com",
+				Country:   "UK",
+			},
+			expectedFilters: bson.M{"nickname": `Alchemist`, "deleted_at": nil},
+			expectedUser:    &data.User{},
+			mockData: bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "Alchemist", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
+			expectedError: true,
+		},
+		{
+			name: "Add user Successfully",
+			req: &pb.AddUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "Razzil.Darkbrew@example.com",
+				Country:   "UK",
+			},
+			expectedFilters: bson.M{"nickname": `Alchemist`, "deleted_at": nil},
+			expectedUser:    &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), Version: 1},
+			mockData: bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
+			expectedResponse: &pb.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), Version: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Mock the userCollection.Find method
+			db.SetCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if tt.mockError != nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockError, nil)
+					}
+
+					// Compare our filters to  ensure the request to mongo is correct
+					if tt.expectedFilters != nil {
+						if filter == nil {
+							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %v, got %v", tt.expectedFilters, filter), nil)
+						}
+
+						bsonFilter, ok := filter.(bson.M)
+						if !ok {
+							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("failed to cast filters to bson: %v", filter), nil)
+						}
+
+						if !reflect.DeepEqual(bsonFilter, tt.expectedFilters) {
+							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %#v, got %#v", tt.expectedFilters, bsonFilter), nil)
+						}
+					}
+
+					return mongo.NewSingleResultFromDocument(tt.mockData, nil, nil)
+				},
+				InsertOneFunc: func(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
+					if document == nil {
+						return nil, fmt.Errorf("document must not be nil")
+					}
+
+					user, ok := document.(*data.User)
+					if !ok {
+						return nil, fmt.Errorf("user document does not match expected type")
+					}
+
+					if !reflect.DeepEqual(user, tt.expectedUser) {
+						return nil, fmt.Errorf("expected user doest not match, want: %#v, got: %#v", tt.expectedUser, user)
+					}
+
+					return nil, nil
+				},
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			response, err := grpcTestService.AddUser(ctx, tt.req)
+			// If we got an error, but we didn't expect it. Then we error.
+			// If we didn't get an error, but we expect one. Then we error.
+			if (err != nil && !tt.expectedError) || (err == nil && tt.expectedError) {
+				t.Errorf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
+			}
+
+			// Exit early, because its an error scenario.
+			if tt.expectedError {
+				return
+			}
+
+			if !reflect.DeepEqual(response, tt.expectedResponse) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response, tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestAddUserGRPCHandlerIdempotency(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	req := &pb.AddUserRequest{
+		FirstName: "Razzil",
+		LastName:  "Darkbrew",
+		Nickname:  "Alchemist",
+		Password:  "moneyMoneyM0n3y",
+		Email:     "Razzil.Darkbrew@example.com",
+		Country:   "UK",
+	}
+
+	requestHash := idempotencyHash(&data.User{FirstName: req.FirstName, LastName: req.LastName, Nickname: req.Nickname, Email: req.Email, Country: req.Country})
+
+	storedUser := bson.M{"_id": "0d0f9944-d902-4db1-b83b-6b25a61f89e2", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "",
+		"email": "Razzil.Darkbrew@example.com", "country": "UK", "created_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), "updated_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), "version": 1}
+
+	// Define test cases
+	tests := []struct {
+		name             string
+		ctx              context.Context
+		requestKey       string
+		mockRecord       interface{}
+		expectedKey      string
+		expectedCode     codes.Code
+		expectedResponse *pb.User
+	}{
+		{
+			name:        "Key on the request replays the original user",
+			ctx:         context.Background(),
+			requestKey:  "retry-me",
+			mockRecord:  bson.M{"_id": ":retry-me", "request_hash": requestHash, "user": storedUser},
+			expectedKey: ":retry-me",
+			expectedResponse: &pb.User{ID: "0d0f9944-d902-4db1-b83b-6b25a61f89e2", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Email: "Razzil.Darkbrew@example.com", Country: "UK",
+				CreatedAt: timestamppb.New(time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC)), Version: 1},
+		},
+		{
+			name:        "Key in metadata replays the original user",
+			ctx:         metadata.NewIncomingContext(context.Background(), metadata.Pairs("idempotency-key", "from-metadata")),
+			mockRecord:  bson.M{"_id": ":from-metadata", "request_hash": requestHash, "user": storedUser},
+			expectedKey: ":from-metadata",
+			expectedResponse: &pb.User{ID: "0d0f9944-d902-4db1-b83b-6b25a61f89e2", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Email: "Razzil.Darkbrew@example.com", Country: "UK",
+				CreatedAt: timestamppb.New(time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC)), Version: 1},
+		},
+		{
+			name:         "Key still in progress",
+			ctx:          context.Background(),
+			requestKey:   "retry-me",
+			mockRecord:   bson.M{"_id": ":retry-me", "request_hash": requestHash},
+			expectedKey:  ":retry-me",
+			expectedCode: codes.Aborted,
+		},
+		{
+			name:         "Key used for a different user",
+			ctx:          auth.NewContext(context.Background(), auth.Client{Name: "support"}),
+			requestKey:   "retry-me",
+			mockRecord:   bson.M{"_id": "support:retry-me", "request_hash": "another-request", "user": storedUser},
+			expectedKey:  "support:retry-me",
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "Key too long",
+			ctx:          context.Background(),
+			requestKey:   strings.Repeat("k", 256),
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetCollection(&mocks.MongoCollection{
+				InsertOneFunc: func(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
+					return nil, errors.New("user should not be inserted")
+				},
+			})
+			db.SetIdempotencyCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if bsonFilter, ok := filter.(bson.M); !ok || bsonFilter["_id"] != tt.expectedKey {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filter on idempotency key %q, got %#v", tt.expectedKey, filter), nil)
+					}
+					return mongo.NewSingleResultFromDocument(tt.mockRecord, nil, nil)
+				},
+			})
+
+			in := proto.Clone(req).(*pb.AddUserRequest)
+			in.IdempotencyKey = tt.requestKey
+
+			response, err := grpcTestService.AddUser(tt.ctx, in)
+			if status.Code(err) != tt.expectedCode {
+				t.Fatalf("handler returned unexpected error: \n\rgot: \n\r%v \n\rwant code: \n\r%v\n\r", err, tt.expectedCode)
+			}
+
+			if !proto.Equal(response, tt.expectedResponse) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response, tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestUpdateUserGRPCHandler(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	newUUID = func() string {
+		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	}
+
+	// Define test cases
+	tests := []struct {
+		name                  string
+		req                   *pb.UpdateUserRequest
+		mockDataExisting      interface{}
+		mockDataPrevious      interface{}
+		mockError             error
+		expectedError         bool
+		expectedFilters       bson.M
+		expectedUserID        string
+		expectedUpdateRequest bson.M
+		expectedUser          *data.User
+		expectedResponse      *pb.User
+		expectedVersion       interface{}
+		expectedCode          codes.Code
+	}{
+		{
+			name: "Database error",
+			req: &pb.UpdateUserRequest{
+				ID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "Razzil.Darkbrew@example.com",
+				Country:   "UK",
+			},
+			mockError:     errors.New("mock error"),
+			expectedError: true,
+		},
+		{
+			name:          "Failed update, no first_name",
+			req:           &pb.UpdateUserRequest{},
+			expectedError: true,
+		},
+		{
+			name: "Failed update, no last_name",
+			req: &pb.UpdateUserRequest{
+				FirstName: "Razzil",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed update, no nickname",
+			req: &pb.UpdateUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed update, no valid pass",
+			req: &pb.UpdateUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "testing",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed update, no valid email",
+			req: &pb.UpdateUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "hello.hello",
+				Country:   "UK",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed update, no country",
+			req: &pb.UpdateUserRequest{
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "Razzil.Darkbrew@example.com",
+			},
+			expectedError: true,
+		},
+		{
+			name: "Failed update, username already exists",
+			req: &pb.UpdateUserRequest{
+				ID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "Razzil.Darkbrew@example.com",
+				Country:   "UK",
+			},
+			expectedFilters: bson.M{"nickname": `Alchemist`, "deleted_at": nil},
+			expectedUser:    &data.User{},
+			mockDataExisting: bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "Alchemist", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
+			expectedError: true,
+		},
+		{
+			name: "Updated User successfully",
+			req: &pb.UpdateUserRequest{
+				ID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+				FirstName: "Razzil",
+				LastName:  "Darkbrew",
+				Nickname:  "Alchemist",
+				Password:  "moneyMoneyM0n3y",
+				Email:     "Razzil.Darkbrew@example.com",
+				Country:   "UK",
+			},
+			expectedFilters:       bson.M{"nickname": `Alchemist`, "deleted_at": nil},
+			expectedUserID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			expectedUpdateRequest: bson.M{"$set": bson.M{"country": "UK", "email": "Razzil.Darkbrew@example.com", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y", "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)}, "$inc": bson.M{"version": 1}},
+			expectedUser:          &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)},
+			mockDataExisting: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
+			mockDataPrevious: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Meepo", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
+			expectedResponse: &pb.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), Version: 1},
+		},
+		{
+			name: "Failed update, version mismatch",
+			req: &pb.UpdateUserRequest{
+				ID:              "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+				FirstName:       "Razzil",
+				LastName:        "Darkbrew",
+				Nickname:        "Alchemist",
+				Password:        "moneyMoneyM0n3y",
+				Email:           "Razzil.Darkbrew@example.com",
+				Country:         "UK",
+				ExpectedVersion: 2,
+			},
+			expectedUserID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			expectedVersion:       int64(2),
+			expectedUpdateRequest: bson.M{"$set": bson.M{"country": "UK", "email": "Razzil.Darkbrew@example.com", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y", "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)}, "$inc": bson.M{"version": 1}},
+			mockDataExisting: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Alchemist", "Email": "john.doe@example.com", "Country": "USA",
+				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z", "version": 3},
+			expectedError: true,
+			expectedCode:  codes.Aborted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Mock the userCollection.Find method
+			db.SetCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if tt.mockError != nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockError, nil)
+					}
+
+					// Compare our filters to  ensure the request to mongo is correct
+					if tt.expectedFilters != nil {
+						if filter == nil {
+							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %v, got %v", tt.expectedFilters, filter), nil)
+						}
 
 						bsonFilter, ok := filter.(bson.M)
 						if !ok {
-							return nil, fmt.Errorf("failed to cast filters to bson: %v", filter)
+							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("failed to cast filters to bson: %v", filter), nil)
 						}
 
 						if !reflect.DeepEqual(bsonFilter, tt.expectedFilters) {
-							return nil, fmt.Errorf("expected filters: %#v, got %#v", tt.expectedFilters, bsonFilter)
+							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %#v, got %#v", tt.expectedFilters, bsonFilter), nil)
 						}
 					}
 
-					if opts == nil {
-						return nil, errors.New("no opts were provided")
+					return mongo.NewSingleResultFromDocument(tt.mockDataExisting, nil, nil)
+				},
+				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, document interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+					if document == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("document must not be nil"), nil)
 					}
 
-					if *opts[0].Skip != int64((tt.expectedPage-1)*tt.expectedLimit) {
-						return nil, fmt.Errorf("expected skip %#v, got %#v", tt.expectedPage, *opts[0].Skip)
+					bsonFilter, ok := filter.(bson.M)
+					if !ok {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("no filters sent, expected filter on userid"), nil)
 					}
 
-					if *opts[0].Limit != tt.expectedLimit {
-						return nil, fmt.Errorf("expected limit %#v, got %#v", tt.expectedLimit, *opts[0].Limit)
+					if bsonFilter["_id"] != tt.expectedUserID {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("id filter incorrect, does not match expected userid"), nil)
 					}
 
-					return mocks.NewMockCursor(tt.mockData).Cursor, nil
+					if bsonFilter["version"] != tt.expectedVersion {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("version filter incorrect, want: %v, got: %v", tt.expectedVersion, bsonFilter["version"]), nil)
+					}
+
+					user, ok := document.(bson.M)
+					if !ok {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("user document does not match expected type"), nil)
+					}
+
+					if !reflect.DeepEqual(user, tt.expectedUpdateRequest) {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected user doest not match, want: %#v, got: %#v", tt.expectedUpdateRequest, user), nil)
+					}
+
+					// Nothing matched our filter, the stored user must be on a different version
+					if tt.mockDataPrevious == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+
+					return mongo.NewSingleResultFromDocument(tt.mockDataPrevious, nil, nil)
 				},
 			})
 
 			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 			defer cancel()
 
-			response, err := grpcTestService.GetUsers(ctx, tt.req)
+			response, err := grpcTestService.UpdateUser(ctx, tt.req)
+			// If we got an error, but we didn't expect it. Then we error.
+			// If we didn't get an error, but we expect one. Then we error.
+			if (err != nil && !tt.expectedError) || (err == nil && tt.expectedError) {
+				t.Errorf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
+			}
+
+			if tt.expectedCode != codes.OK && status.Code(err) != tt.expectedCode {
+				t.Errorf("handler returned unexpected status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status.Code(err), tt.expectedCode)
+			}
+
+			// Exit early, because its an error scenario.
+			if tt.expectedError {
+				return
+			}
+
+			if !reflect.DeepEqual(response, tt.expectedResponse) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response, tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestDeleteUserGRPCHandler(t *testing.T) {
+
+	// Define test cases
+	tests := []struct {
+		name            string
+		req             *pb.DeleteUserRequest
+		expectedUserID  string
+		expectedError   bool
+		expectedVersion interface{}
+		expectedCode    codes.Code
+		mockDeleteCount int
+		mockDataStored  interface{}
+		mockError       error
+		wantStatus      int
+		wantBody        string
+	}{
+		{
+			name: "Database error",
+			req: &pb.DeleteUserRequest{
+				ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			},
+			mockError:     errors.New("mock error"),
+			expectedError: true,
+			wantBody:      "",
+		},
+		{
+			name: "Delete User successfully",
+			req: &pb.DeleteUserRequest{
+				ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			},
+			expectedUserID:  "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			mockDeleteCount: 1,
+			expectedError:   false,
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name: "No users found to delete",
+			req: &pb.DeleteUserRequest{
+				ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			},
+			expectedUserID:  "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			mockDeleteCount: 0,
+			expectedError:   true,
+			wantStatus:      http.StatusInternalServerError,
+		},
+		{
+			name: "Failed delete, version mismatch",
+			req: &pb.DeleteUserRequest{
+				ID:              "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+				ExpectedVersion: 2,
+			},
+			expectedUserID:  "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			expectedVersion: int64(2),
+			mockDeleteCount: 0,
+			mockDataStored:  bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Meepo", "version": 3},
+			expectedError:   true,
+			expectedCode:    codes.Aborted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Mock the userCollection.Find method
+			db.SetCollection(&mocks.MongoCollection{
+				// Deletes are soft, so the user is updated rather than removed
+				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+					if tt.mockError != nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockError, nil)
+					}
+
+					bsonFilter, ok := filter.(bson.M)
+					if !ok {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("no filters sent, expected filter on userid"), nil)
+					}
+
+					if bsonFilter["_id"] != tt.expectedUserID {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("id filter incorrect, does not match expected userid"), nil)
+					}
+
+					if bsonFilter["version"] != tt.expectedVersion {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("version filter incorrect, want: %v, got: %v", tt.expectedVersion, bsonFilter["version"]), nil)
+					}
+
+					if deletedAt, ok := bsonFilter["deleted_at"]; !ok || deletedAt != nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filter on users that aren't already deleted, got: %#v", bsonFilter), nil)
+					}
+
+					if _, ok := update.(bson.M)["$set"].(bson.M)["deleted_at"].(time.Time); !ok {
+						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected the update to set deleted_at, got: %#v", update), nil)
+					}
+
+					if tt.mockDeleteCount == 0 {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(bson.M{"_id": tt.expectedUserID}, nil, nil)
+				},
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if tt.mockDataStored == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+
+					return mongo.NewSingleResultFromDocument(tt.mockDataStored, nil, nil)
+				},
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			_, err := grpcTestService.DeleteUser(ctx, tt.req)
 			// If we got an error, but we didn't expect it. Then we error.
 			// If we didn't get an error, but we expect one. Then we error.
 			if (err != nil && !tt.expectedError) || (err == nil && tt.expectedError) {
 				t.Errorf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
 			}
 
+			if tt.expectedCode != codes.OK && status.Code(err) != tt.expectedCode {
+				t.Errorf("handler returned unexpected status code: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", status.Code(err), tt.expectedCode)
+			}
+
 			// Exit early, because its an error scenario.
 			if tt.expectedError {
 				return
 			}
-
-			if len(response.Users) != len(tt.expectedUsers) {
-				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response.Users, tt.expectedUsers)
-			}
-
-			if !reflect.DeepEqual(response.Users, tt.expectedUsers) {
-				for i := range response.Users {
-					t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response.Users[i], tt.expectedUsers[i])
-				}
-			}
 		})
 	}
 }
 
-func TestAddUserGRPCHandler(t *testing.T) {
-
-	// Set out timenow function, to ensure our test is static
-	timeNow = func() time.Time {
-		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
-	}
+func TestRestoreUserGRPCHandler(t *testing.T) {
 
-	newUUID = func() string {
-		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
-	}
+	deletedUser := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Alchemist", "version": 2, "deleted_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)}
+	restoredUser := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Alchemist", "version": 3,
+		"created_at": time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC), "updated_at": time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC)}
 
 	// Define test cases
 	tests := []struct {
 		name             string
-		req              *pb.AddUserRequest
-		mockData         interface{}
-		mockError        error
-		expectedError    bool
-		expectedFilters  bson.M
-		expectedUser     *data.User
+		req              *pb.RestoreUserRequest
+		mockDeletedUser  interface{}
+		mockNicknameUser interface{}
+		mockRestoreError error
+		expectedCode     codes.Code
 		expectedResponse *pb.User
 	}{
 		{
-			name: "Database error",
-			req: &pb.AddUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "Razzil.Darkbrew@example.com",
-				Country:   "UK",
-			},
-			mockError:     errors.New("mock error"),
-			expectedError: true,
+			name:         "Invalid id",
+			req:          &pb.RestoreUserRequest{ID: "1"},
+			expectedCode: codes.Unknown,
 		},
 		{
-			name:          "Failed add, no first_name",
-			req:           &pb.AddUserRequest{},
-			expectedError: true,
+			name:         "No deleted user found",
+			req:          &pb.RestoreUserRequest{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"},
+			expectedCode: codes.NotFound,
 		},
 		{
-			name: "Failed add, no last_name",
-			req: &pb.AddUserRequest{
-				FirstName: "Razzil",
-			},
-			expectedError: true,
+			name:             "Nickname taken since the user was deleted",
+			req:              &pb.RestoreUserRequest{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"},
+			mockDeletedUser:  deletedUser,
+			mockNicknameUser: bson.M{"_id": "0d0f9944-d902-4db1-b83b-6b25a61f89e2", "nickname": "Alchemist"},
+			expectedCode:     codes.AlreadyExists,
 		},
 		{
-			name: "Failed add, no nickname",
-			req: &pb.AddUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-			},
-			expectedError: true,
+			name:             "User restored or purged in the meantime",
+			req:              &pb.RestoreUserRequest{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"},
+			mockDeletedUser:  deletedUser,
+			mockRestoreError: mongo.ErrNoDocuments,
+			expectedCode:     codes.Aborted,
 		},
 		{
-			name: "Failed add, no valid pass",
-			req: &pb.AddUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "testing",
-			},
-			expectedError: true,
+			name:            "Restored user successfully",
+			req:             &pb.RestoreUserRequest{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"},
+			mockDeletedUser: deletedUser,
+			expectedResponse: &pb.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Alchemist", Version: 3,
+				CreatedAt: timestamppb.New(time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC))},
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					// Looking up the deleted user, or checking whether their nickname has been taken
+					mockData := tt.mockNicknameUser
+					if _, ok := filter.(bson.M)["_id"]; ok {
+						mockData = tt.mockDeletedUser
+					}
+					if mockData == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+					}
+					return mongo.NewSingleResultFromDocument(mockData, nil, nil)
+				},
+				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+					if tt.mockRestoreError != nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockRestoreError, nil)
+					}
+					return mongo.NewSingleResultFromDocument(restoredUser, nil, nil)
+				},
+			})
+
+			response, err := grpcTestService.RestoreUser(context.Background(), tt.req)
+			if status.Code(err) != tt.expectedCode {
+				t.Fatalf("handler returned unexpected error: \n\rgot: \n\r%v \n\rwant code: \n\r%v\n\r", err, tt.expectedCode)
+			}
+
+			if !proto.Equal(response, tt.expectedResponse) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", response, tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestBatchUpdateUsersGRPCHandler(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	now := time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	timeNow = func() time.Time {
+		return now
+	}
+
+	before := time.Date(2024, time.June, 16, 17, 32, 28, 0, time.UTC)
+	meepoID := "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	razzilID := "0d0f9944-d902-4db1-b83b-6b25a61f89e2"
+	rylaiID := "5b0d3c3e-8f4b-4f4e-9f0e-3c1c0f2d9a11"
+
+	update := func(id, nickname string, expectedVersion int64) *pb.UpdateUserRequest {
+		return &pb.UpdateUserRequest{ID: id, FirstName: "First", LastName: "Last", Nickname: nickname, Password: "moneyMoneyM0n3y",
+			Email: "someone@example.com", Country: "UK", ExpectedVersion: expectedVersion}
+	}
+
+	tooLarge := make([]*pb.UpdateUserRequest, maxBatchSize+1)
+	for i := range tooLarge {
+		tooLarge[i] = update(meepoID, "Meepo", 0)
+	}
+
+	// Define test cases
+	tests := []struct {
+		name             string
+		req              *pb.BatchUpdateUsersRequest
+		mockFinds        [][]interface{}
+		mockMatched      int64
+		expectedVersions []int64
+		expectedCode     codes.Code
+		expectedResponse *pb.BatchResponse
+	}{
 		{
-			name: "Failed add, no valid email",
-			req: &pb.AddUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "hello.hello",
-				Country:   "UK",
-			},
-			expectedError: true,
+			name: "Invalid and missing users",
+			req: &pb.BatchUpdateUsersRequest{Users: []*pb.UpdateUserRequest{
+				update("not-a-uuid", "Meepo", 0),
+				update(meepoID, "Meepo", 0),
+				update(meepoID, "Meepo", 0),
+			}},
+			mockFinds: [][]interface{}{{}, {}},
+			expectedResponse: &pb.BatchResponse{Results: []*pb.BatchItemResult{
+				{Index: 0, ID: "not-a-uuid", Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_INVALID, Error: "invalid UUID length: 10"},
+				{Index: 1, ID: meepoID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_NOT_FOUND, Error: db.ErrUserNotFound.Error()},
+				{Index: 2, ID: meepoID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_INVALID, Error: "user appears more than once in the batch"},
+			}},
 		},
 		{
-			name: "Failed add, no country",
-			req: &pb.AddUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "Razzil.Darkbrew@example.com",
+			name: "Updates, conflicts and concurrent changes",
+			req: &pb.BatchUpdateUsersRequest{Users: []*pb.UpdateUserRequest{
+				update(meepoID, "Meepo", 2),
+				update(razzilID, "Alchemist", 5),
+				update(rylaiID, "Meepo", 0),
+			}},
+			mockFinds: [][]interface{}{
+				// The stored users
+				{
+					bson.M{"_id": meepoID, "nickname": "Meepo", "version": 2, "updated_at": before},
+					bson.M{"_id": razzilID, "nickname": "Alchemist", "version": 3, "updated_at": before},
+					bson.M{"_id": rylaiID, "nickname": "Crystal", "version": 7, "updated_at": before},
+				},
+				// The nickname owners
+				{
+					bson.M{"_id": meepoID, "nickname": "Meepo"},
+					bson.M{"_id": razzilID, "nickname": "Alchemist"},
+				},
+				// The users still at the expected version, within the transaction
+				{
+					bson.M{"_id": meepoID, "nickname": "Meepo", "version": 2, "updated_at": before},
+				},
 			},
-			expectedError: true,
+			mockMatched:      1,
+			expectedVersions: []int64{2},
+			expectedResponse: &pb.BatchResponse{Results: []*pb.BatchItemResult{
+				{Index: 0, ID: meepoID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_UPDATED, Version: 3},
+				{Index: 1, ID: razzilID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_CONFLICT, Error: db.ErrVersionMismatch.Error()},
+				{Index: 2, ID: rylaiID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_CONFLICT, Error: "a user with this username already exists"},
+			}},
 		},
 		{
-			name: "Failed add, username already exists",
-			req: &pb.AddUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "Razzil.Darkbrew@example.com",
-				Country:   "UK",
+			name: "User changed between the read and the write",
+			req: &pb.BatchUpdateUsersRequest{Users: []*pb.UpdateUserRequest{
+				update(meepoID, "Meepo", 0),
+			}},
+			mockFinds: [][]interface{}{
+				{bson.M{"_id": meepoID, "nickname": "Meepo", "version": 2, "updated_at": before}},
+				{bson.M{"_id": meepoID, "nickname": "Meepo"}},
+				{bson.M{"_id": meepoID, "nickname": "Meepo", "version": 3, "updated_at": before}},
 			},
-			expectedFilters: bson.M{"nickname": `Alchemist`},
-			expectedUser:    &data.User{},
-			mockData: bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "Alchemist", "Email": "john.doe@example.com", "Country": "USA",
-				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
-			expectedError: true,
+			expectedResponse: &pb.BatchResponse{Results: []*pb.BatchItemResult{
+				{Index: 0, ID: meepoID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_CONFLICT, Error: db.ErrVersionMismatch.Error()},
+			}},
 		},
 		{
-			name: "Add user Successfully",
-			req: &pb.AddUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "Razzil.Darkbrew@example.com",
-				Country:   "UK",
+			name: "User changed between the check and the write",
+			req: &pb.BatchUpdateUsersRequest{Users: []*pb.UpdateUserRequest{
+				update(meepoID, "Meepo", 0),
+			}},
+			mockFinds: [][]interface{}{
+				{bson.M{"_id": meepoID, "nickname": "Meepo", "version": 2, "updated_at": before}},
+				{bson.M{"_id": meepoID, "nickname": "Meepo"}},
+				{bson.M{"_id": meepoID, "nickname": "Meepo", "version": 2, "updated_at": before}},
 			},
-			expectedFilters: bson.M{"nickname": `Alchemist`},
-			expectedUser:    &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)},
-			mockData: bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
-				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
-			expectedResponse: &pb.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
+			expectedVersions: []int64{2},
+			expectedResponse: &pb.BatchResponse{Results: []*pb.BatchItemResult{
+				{Index: 0, ID: meepoID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_CONFLICT, Error: db.ErrVersionMismatch.Error()},
+			}},
+		},
+		{
+			name:         "Batch too large",
+			req:          &pb.BatchUpdateUsersRequest{Users: tooLarge},
+			expectedCode: codes.InvalidArgument,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Mock the userCollection.Find method
+			finds := 0
 			db.SetCollection(&mocks.MongoCollection{
-				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
-					if tt.mockError != nil {
-						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockError, nil)
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					if finds >= len(tt.mockFinds) {
+						return nil, fmt.Errorf("unexpected find: %#v", filter)
+					}
+					finds++
+					return mongo.NewCursorFromDocuments(tt.mockFinds[finds-1], nil, nil)
+				},
+				BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+					if len(models) != len(tt.expectedVersions) {
+						return nil, fmt.Errorf("expected %d writes, got %d", len(tt.expectedVersions), len(models))
 					}
 
-					// Compare our filters to  ensure the request to mongo is correct
-					if tt.expectedFilters != nil {
-						if filter == nil {
-							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %v, got %v", tt.expectedFilters, filter), nil)
-						}
-
-						bsonFilter, ok := filter.(bson.M)
-						if !ok {
-							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("failed to cast filters to bson: %v", filter), nil)
-						}
-
-						if !reflect.DeepEqual(bsonFilter, tt.expectedFilters) {
-							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %#v, got %#v", tt.expectedFilters, bsonFilter), nil)
+					for i, model := range models {
+						filter := model.(*mongo.UpdateOneModel).Filter.(bson.M)
+						if filter["version"] != tt.expectedVersions[i] {
+							return nil, fmt.Errorf("version filter incorrect, want: %v, got: %v", tt.expectedVersions[i], filter["version"])
 						}
 					}
 
-					return mongo.NewSingleResultFromDocument(tt.mockData, nil, nil)
+					return &mongo.BulkWriteResult{MatchedCount: tt.mockMatched, ModifiedCount: tt.mockMatched}, nil
 				},
-				InsertOneFunc: func(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
-					if document == nil {
-						return nil, fmt.Errorf("document must not be nil")
-					}
+			})
 
-					user, ok := document.(*data.User)
-					if !ok {
-						return nil, fmt.Errorf("user document does not match expected type")
-					}
+			response, err := grpcTestService.BatchUpdateUsers(context.Background(), tt.req)
+			if status.Code(err) != tt.expectedCode {
+				t.Fatalf("handler returned unexpected error: \n\rgot: \n\r%v \n\rwant code: \n\r%v\n\r", err, tt.expectedCode)
+			}
+
+			if !proto.Equal(response, tt.expectedResponse) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", response, tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestBatchDeleteUsersGRPCHandler(t *testing.T) {
+
+	meepoID := "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	razzilID := "0d0f9944-d902-4db1-b83b-6b25a61f89e2"
+	rylaiID := "5b0d3c3e-8f4b-4f4e-9f0e-3c1c0f2d9a11"
+
+	req := &pb.BatchDeleteUsersRequest{Users: []*pb.DeleteUserRequest{
+		{ID: meepoID},
+		{ID: razzilID, ExpectedVersion: 2},
+		{ID: rylaiID},
+		{ID: "not-a-uuid"},
+	}}
+
+	finds := 0
+	mockFinds := [][]interface{}{
+		// The stored users
+		{
+			bson.M{"_id": meepoID, "version": 1},
+			bson.M{"_id": razzilID, "version": 4},
+		},
+		// The users left after the delete
+		{},
+	}
+
+	db.SetCollection(&mocks.MongoCollection{
+		FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+			if finds >= len(mockFinds) {
+				return nil, fmt.Errorf("unexpected find: %#v", filter)
+			}
+			finds++
+			return mongo.NewCursorFromDocuments(mockFinds[finds-1], nil, nil)
+		},
+		BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+			// Deletes are soft, so the users are updated rather than removed
+			expectedFilter := bson.M{"_id": meepoID, "version": int64(1), "deleted_at": nil}
+			if len(models) != 1 || !reflect.DeepEqual(models[0].(*mongo.UpdateOneModel).Filter, expectedFilter) {
+				return nil, fmt.Errorf("expected a single delete of %#v", expectedFilter)
+			}
+
+			return &mongo.BulkWriteResult{ModifiedCount: 1}, nil
+		},
+	})
+
+	expectedResponse := &pb.BatchResponse{Results: []*pb.BatchItemResult{
+		{Index: 0, ID: meepoID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_DELETED},
+		{Index: 1, ID: razzilID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_CONFLICT, Error: db.ErrVersionMismatch.Error()},
+		{Index: 2, ID: rylaiID, Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_NOT_FOUND, Error: db.ErrUserNotFound.Error()},
+		{Index: 3, ID: "not-a-uuid", Status: pb.BatchItemStatus_BATCH_ITEM_STATUS_INVALID, Error: "invalid UUID length: 10"},
+	}}
+
+	response, err := grpcTestService.BatchDeleteUsers(context.Background(), req)
+	if err != nil {
+		t.Fatalf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
+	}
+
+	if !proto.Equal(response, expectedResponse) {
+		t.Errorf("handler returned unexpected response: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", response, expectedResponse)
+	}
+}
+
+func TestImportUsersGRPCHandler(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
+	}
+
+	newUUID = func() string {
+		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
+	}
+
+	// Enough users to span more than one batch, every other one is invalid
+	total := maxBatchSize + 2
+	inserted := 0
+	db.SetCollection(&mocks.MongoCollection{
+		FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+			return mongo.NewCursorFromDocuments([]interface{}{}, nil, nil)
+		},
+		BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+			inserted += len(models)
+			return &mongo.BulkWriteResult{InsertedCount: int64(len(models))}, nil
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Only admin clients can import
+	ctx = metadata.AppendToOutgoingContext(ctx, auth.APIKeyMetadataKey, "ops-key")
+	stream, err := client.ImportUsers(ctx)
+	if err != nil {
+		t.Fatalf("failed to open import stream: %v", err)
+	}
+
+	for i := 0; i < total; i++ {
+		req := &pb.AddUserRequest{FirstName: "Meepo", LastName: "Geomancer", Nickname: fmt.Sprintf("Meepo%d", i), Password: "moneyMoneyM0n3y",
+			Email: "meepo@example.com", Country: "UK"}
+		if i%2 == 1 {
+			req.Password = "hello"
+		}
+
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("failed to send user %d: %v", i, err)
+		}
+	}
+
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
+	}
+
+	if len(response.Results) != total {
+		t.Fatalf("expected %d results, got %d", total, len(response.Results))
+	}
+
+	for i, result := range response.Results {
+		want := pb.BatchItemStatus_BATCH_ITEM_STATUS_CREATED
+		if i%2 == 1 {
+			want = pb.BatchItemStatus_BATCH_ITEM_STATUS_INVALID
+		}
+
+		if result.Index != int64(i) || result.Status != want {
+			t.Errorf("unexpected result for user %d: %v", i, result)
+		}
+	}
+
+	if inserted != total/2 {
+		t.Errorf("expected %d users to be inserted, got %d", total/2, inserted)
+	}
+}
+
+// TestImportUsersGRPCHandlerAdminOnly tests imports are turned away unless they come from an admin client
+func TestImportUsersGRPCHandlerAdminOnly(t *testing.T) {
+	db.SetCollection(&mocks.MongoCollection{
+		BulkWriteFunc: func(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+			return nil, errors.New("users should not be imported")
+		},
+	})
+
+	for key, want := range map[string]codes.Code{"": codes.Unauthenticated, "made-up": codes.Unauthenticated, "support-key": codes.PermissionDenied} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if key != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, auth.APIKeyMetadataKey, key)
+		}
+
+		stream, err := client.ImportUsers(ctx)
+		if err != nil {
+			t.Fatalf("failed to open import stream: %v", err)
+		}
+		stream.Send(&pb.AddUserRequest{FirstName: "Meepo", LastName: "Geomancer", Nickname: "Meepo", Password: "moneyMoneyM0n3y", Email: "meepo@example.com", Country: "UK"})
+		_, err = stream.CloseAndRecv()
+		if status.Code(err) != want {
+			t.Errorf("unexpected error for key %q, want: %v, got: %v", key, want, err)
+		}
+		cancel()
+	}
+}
+func TestListAuditEventsGRPCHandler(t *testing.T) {
+
+	mockEvent := bson.M{"_id": "0d0f9944-d902-4db1-b83b-6b25a61f89e2", "action": "delete_all", "actor": "ops", "source_ip": "192.0.2.20:41000", "transport": "grpc",
+		"request_id": "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10", "changes": bson.A{}, "created_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)}
+
+	// Define test cases
+	tests := []struct {
+		name             string
+		req              *pb.ListAuditEventsRequest
+		expectedFilters  bson.M
+		expectedCode     codes.Code
+		expectedResponse *pb.ListAuditEventsResponse
+	}{
+		{
+			name:         "Invalid user id",
+			req:          &pb.ListAuditEventsRequest{UserId: "1"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name: "Unset timestamps leave the range open",
+			req:  &pb.ListAuditEventsRequest{UserId: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Since: timestamppb.New(time.Date(2024, time.June, 17, 0, 0, 0, 0, time.UTC))},
+			expectedFilters: bson.M{
+				"$or": bson.A{
+					bson.M{"user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f"},
+					bson.M{"action": "delete_all"},
+				},
+				"created_at": bson.M{"$gte": time.Date(2024, time.June, 17, 0, 0, 0, 0, time.UTC)},
+			},
+			expectedResponse: &pb.ListAuditEventsResponse{Events: []*pb.AuditEvent{{
+				ID: "0d0f9944-d902-4db1-b83b-6b25a61f89e2", Action: "delete_all", Actor: "ops", SourceIp: "192.0.2.20:41000", Transport: "grpc",
+				RequestId: "5f3c1b7e-0e2a-4d8b-9c61-2f4a8d9e7b10", Changes: []*pb.FieldChange{}, CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)),
+			}}},
+		},
+	}
 
-					if !reflect.DeepEqual(user, tt.expectedUser) {
-						return nil, fmt.Errorf("expected user doest not match, want: %#v, got: %#v", tt.expectedUser, user)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.SetAuditCollection(&mocks.MongoCollection{
+				FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+					if !reflect.DeepEqual(filter, tt.expectedFilters) {
+						return nil, fmt.Errorf("expected filters: %#v, got %#v", tt.expectedFilters, filter)
 					}
-
-					return nil, nil
+					return mocks.NewMockCursor([]interface{}{mockEvent}).Cursor, nil
 				},
 			})
+			defer db.SetAuditCollection(noopCollection)
 
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-
-			response, err := grpcTestService.AddUser(ctx, tt.req)
-			// If we got an error, but we didn't expect it. Then we error.
-			// If we didn't get an error, but we expect one. Then we error.
-			if (err != nil && !tt.expectedError) || (err == nil && tt.expectedError) {
-				t.Errorf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
-			}
-
-			// Exit early, because its an error scenario.
-			if tt.expectedError {
-				return
+			response, err := grpcTestService.ListAuditEvents(context.Background(), tt.req)
+			if status.Code(err) != tt.expectedCode {
+				t.Fatalf("handler returned unexpected error: \n\rgot: \n\r%v \n\rwant code: \n\r%v\n\r", err, tt.expectedCode)
 			}
 
-			if !reflect.DeepEqual(response, tt.expectedResponse) {
-				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response, tt.expectedResponse)
+			if !proto.Equal(response, tt.expectedResponse) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", response, tt.expectedResponse)
 			}
 		})
 	}
 }
 
-func TestUpdateUserGRPCHandler(t *testing.T) {
-
-	// Set out timenow function, to ensure our test is static
-	timeNow = func() time.Time {
-		return time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)
-	}
+func TestGetUserAtGRPCHandler(t *testing.T) {
 
-	newUUID = func() string {
-		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
-	}
+	mockRevision := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f:3", "user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 3, "action": "delete",
+		"user":        bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Alchemist", "version": 3, "deleted_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)},
+		"recorded_at": time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)}
 
 	// Define test cases
 	tests := []struct {
-		name                  string
-		req                   *pb.UpdateUserRequest
-		mockDataExisting      interface{}
-		mockDataUpdated       interface{}
-		mockError             error
-		expectedError         bool
-		expectedFilters       bson.M
-		expectedUserID        string
-		expectedUpdateRequest bson.M
-		expectedUser          *data.User
-		expectedResponse      *pb.User
+		name             string
+		req              *pb.GetUserAtRequest
+		mockRevision     interface{}
+		expectedCode     codes.Code
+		expectedResponse *pb.UserRevision
 	}{
 		{
-			name: "Database error",
-			req: &pb.UpdateUserRequest{
-				ID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "Razzil.Darkbrew@example.com",
-				Country:   "UK",
-			},
-			mockError:     errors.New("mock error"),
-			expectedError: true,
-		},
-		{
-			name:          "Failed update, no first_name",
-			req:           &pb.UpdateUserRequest{},
-			expectedError: true,
-		},
-		{
-			name: "Failed update, no last_name",
-			req: &pb.UpdateUserRequest{
-				FirstName: "Razzil",
-			},
-			expectedError: true,
-		},
-		{
-			name: "Failed update, no nickname",
-			req: &pb.UpdateUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-			},
-			expectedError: true,
-		},
-		{
-			name: "Failed update, no valid pass",
-			req: &pb.UpdateUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "testing",
-			},
-			expectedError: true,
-		},
-		{
-			name: "Failed update, no valid email",
-			req: &pb.UpdateUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "hello.hello",
-				Country:   "UK",
-			},
-			expectedError: true,
+			name:         "Invalid id",
+			req:          &pb.GetUserAtRequest{UserId: "1", At: timestamppb.New(time.Date(2024, time.June, 18, 0, 0, 0, 0, time.UTC))},
+			expectedCode: codes.InvalidArgument,
 		},
 		{
-			name: "Failed update, no country",
-			req: &pb.UpdateUserRequest{
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "Razzil.Darkbrew@example.com",
-			},
-			expectedError: true,
+			name:         "No time given",
+			req:          &pb.GetUserAtRequest{UserId: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"},
+			expectedCode: codes.InvalidArgument,
 		},
 		{
-			name: "Failed update, username already exists",
-			req: &pb.UpdateUserRequest{
-				ID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "Razzil.Darkbrew@example.com",
-				Country:   "UK",
-			},
-			expectedFilters: bson.M{"nickname": `Alchemist`},
-			expectedUser:    &data.User{},
-			mockDataExisting: bson.M{"_id": "1", "first_name": "John", "last_name": "Doe", "nickname": "Alchemist", "Email": "john.doe@example.com", "Country": "USA",
-				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
-			expectedError: true,
+			name:         "User didn't exist yet",
+			req:          &pb.GetUserAtRequest{UserId: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", At: timestamppb.New(time.Date(2024, time.June, 18, 0, 0, 0, 0, time.UTC))},
+			expectedCode: codes.NotFound,
 		},
 		{
-			name: "Updated User successfully",
-			req: &pb.UpdateUserRequest{
-				ID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-				FirstName: "Razzil",
-				LastName:  "Darkbrew",
-				Nickname:  "Alchemist",
-				Password:  "moneyMoneyM0n3y",
-				Email:     "Razzil.Darkbrew@example.com",
-				Country:   "UK",
+			name:         "Found the user as they were, deleted",
+			req:          &pb.GetUserAtRequest{UserId: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", At: timestamppb.New(time.Date(2024, time.June, 18, 0, 0, 0, 0, time.UTC))},
+			mockRevision: mockRevision,
+			expectedResponse: &pb.UserRevision{
+				UserId:  "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+				Version: 3,
+				Action:  "delete",
+				User: &pb.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Alchemist", Version: 3,
+					CreatedAt: timestamppb.New(time.Time{}), UpdatedAt: timestamppb.New(time.Time{})},
+				RecordedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)),
+				DeletedAt:  timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)),
 			},
-			expectedFilters:       bson.M{"nickname": `Alchemist`},
-			expectedUserID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-			expectedUpdateRequest: bson.M{"$set": bson.M{"country": "UK", "email": "Razzil.Darkbrew@example.com", "first_name": "Razzil", "last_name": "Darkbrew", "nickname": "Alchemist", "password": "moneyMoneyM0n3y", "updated_at": time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)}},
-			expectedUser:          &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "Razzil", LastName: "Darkbrew", Nickname: "Alchemist", Password: "moneyMoneyM0n3y", Email: "Razzil.Darkbrew@example.com", Country: "UK", CreatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC), UpdatedAt: time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)},
-			mockDataExisting: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Dazzle", "Email": "john.doe@example.com", "Country": "USA",
-				"password": "moneyMoneyM0n3y", "created_at": "2024-06-16T17:32:28.2136171Z", "updated_at": "2024-06-16T17:32:28.2136171Z"},
-			mockDataUpdated: bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "first_name": "John", "last_name": "Doe", "nickname": "Meepo", "Email": "john.doe@example.com", "Country": "USA",
-				"password": "moneyMoneyM0n3y", "created_at": "2024-06-17T19:49:18.368889300Z", "updated_at": "2024-06-17T19:49:18.368889300Z"},
-			expectedResponse: &pb.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", FirstName: "John", LastName: "Doe", Nickname: "Meepo", Password: "moneyMoneyM0n3y", Email: "john.doe@example.com", Country: "USA", CreatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC)), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 17, 19, 49, 18, 368889300, time.UTC))},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Mock the userCollection.Find method
-			db.SetCollection(&mocks.MongoCollection{
+			db.SetRevisionCollection(&mocks.MongoCollection{
 				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
-					if tt.mockError != nil {
-						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockError, nil)
-					}
-
-					// Compare our filters to  ensure the request to mongo is correct
-					if tt.expectedFilters != nil {
-						if filter == nil {
-							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %v, got %v", tt.expectedFilters, filter), nil)
-						}
-
-						bsonFilter, ok := filter.(bson.M)
-						if !ok {
-							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("failed to cast filters to bson: %v", filter), nil)
-						}
-
-						if !reflect.DeepEqual(bsonFilter, tt.expectedFilters) {
-							return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected filters: %#v, got %#v", tt.expectedFilters, bsonFilter), nil)
-						}
-					}
-
-					return mongo.NewSingleResultFromDocument(tt.mockDataExisting, nil, nil)
-				},
-				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, document interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
-					if document == nil {
-						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("document must not be nil"), nil)
-					}
-
-					bsonFilter, ok := filter.(bson.M)
-					if !ok {
-						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("no filters sent, expected filter on userid"), nil)
-					}
-
-					if bsonFilter["_id"] != tt.expectedUserID {
-						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("id filter incorrect, does not match expected userid"), nil)
-					}
-
-					user, ok := document.(bson.M)
-					if !ok {
-						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("user document does not match expected type"), nil)
+					if tt.mockRevision == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
 					}
-
-					if !reflect.DeepEqual(user, tt.expectedUpdateRequest) {
-						return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("expected user doest not match, want: %#v, got: %#v", tt.expectedUpdateRequest, user), nil)
-					}
-
-					return mongo.NewSingleResultFromDocument(tt.mockDataUpdated, nil, nil)
+					return mongo.NewSingleResultFromDocument(tt.mockRevision, nil, nil)
 				},
 			})
+			defer db.SetRevisionCollection(noopCollection)
 
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-
-			response, err := grpcTestService.UpdateUser(ctx, tt.req)
-			// If we got an error, but we didn't expect it. Then we error.
-			// If we didn't get an error, but we expect one. Then we error.
-			if (err != nil && !tt.expectedError) || (err == nil && tt.expectedError) {
-				t.Errorf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
-			}
-
-			// Exit early, because its an error scenario.
-			if tt.expectedError {
-				return
+			response, err := grpcTestService.GetUserAt(context.Background(), tt.req)
+			if status.Code(err) != tt.expectedCode {
+				t.Fatalf("handler returned unexpected error: \n\rgot: \n\r%v \n\rwant code: \n\r%v\n\r", err, tt.expectedCode)
 			}
 
-			if !reflect.DeepEqual(response, tt.expectedResponse) {
-				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%#v \n\rwant: \n\r%#v\n\r", response, tt.expectedResponse)
+			if !proto.Equal(response, tt.expectedResponse) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", response, tt.expectedResponse)
 			}
 		})
 	}
 }
 
-func TestDeleteUserGRPCHandler(t *testing.T) {
+func TestRevertUserGRPCHandler(t *testing.T) {
+
+	// Set out timenow function, to ensure our test is static
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC)
+	}
+
+	revision := bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f:2", "user_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "version": 2,
+		"user": bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Alchemist", "version": 2}}
 
 	// Define test cases
 	tests := []struct {
-		name            string
-		req             *pb.DeleteUserRequest
-		expectedUserID  string
-		expectedError   bool
-		mockDeleteCount int
-		mockError       error
-		wantStatus      int
-		wantBody        string
+		name             string
+		req              *pb.RevertUserRequest
+		mockRevision     interface{}
+		mockUpdateError  error
+		expectedCode     codes.Code
+		expectedResponse *pb.User
 	}{
 		{
-			name: "Database error",
-			req: &pb.DeleteUserRequest{
-				ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-			},
-			mockError:     errors.New("mock error"),
-			expectedError: true,
-			wantBody:      "",
+			name:         "Invalid id",
+			req:          &pb.RevertUserRequest{UserId: "1", Version: 2},
+			expectedCode: codes.InvalidArgument,
 		},
 		{
-			name: "Delete User successfully",
-			req: &pb.DeleteUserRequest{
-				ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-			},
-			expectedUserID:  "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-			mockDeleteCount: 1,
-			expectedError:   false,
-			wantStatus:      http.StatusOK,
+			name:         "No such revision",
+			req:          &pb.RevertUserRequest{UserId: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Version: 2},
+			expectedCode: codes.NotFound,
 		},
 		{
-			name: "No users found to delete",
-			req: &pb.DeleteUserRequest{
-				ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-			},
-			expectedUserID:  "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
-			mockDeleteCount: 0,
-			expectedError:   true,
-			wantStatus:      http.StatusInternalServerError,
+			name:            "User has since been deleted",
+			req:             &pb.RevertUserRequest{UserId: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Version: 2},
+			mockRevision:    revision,
+			mockUpdateError: mongo.ErrNoDocuments,
+			expectedCode:    codes.NotFound,
+		},
+		{
+			name:         "Reverted user successfully",
+			req:          &pb.RevertUserRequest{UserId: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Version: 2},
+			mockRevision: revision,
+			expectedResponse: &pb.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Alchemist", Version: 5,
+				CreatedAt: timestamppb.New(time.Time{}), UpdatedAt: timestamppb.New(time.Date(2024, time.June, 18, 9, 0, 0, 0, time.UTC))},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Mock the userCollection.Find method
-			db.SetCollection(&mocks.MongoCollection{
-				DeleteOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
-					if tt.mockError != nil {
-						return nil, tt.mockError
-					}
-
-					bsonFilter, ok := filter.(bson.M)
-					if !ok {
-						return nil, fmt.Errorf("no filters sent, expected filter on userid")
-					}
-
-					if bsonFilter["_id"] != tt.expectedUserID {
-						return nil, fmt.Errorf("id filter incorrect, does not match expected userid")
+			db.SetRevisionCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					if tt.mockRevision == nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
 					}
+					return mongo.NewSingleResultFromDocument(tt.mockRevision, nil, nil)
+				},
+				BulkWriteFunc: noopCollection.BulkWriteFunc,
+			})
+			defer db.SetRevisionCollection(noopCollection)
 
-					return &mongo.DeleteResult{
-						DeletedCount: int64(tt.mockDeleteCount),
-					}, nil
+			db.SetCollection(&mocks.MongoCollection{
+				FindOneFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+					return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+				},
+				FindOneAndUpdateFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+					if tt.mockUpdateError != nil {
+						return mongo.NewSingleResultFromDocument(bson.M{}, tt.mockUpdateError, nil)
+					}
+					return mongo.NewSingleResultFromDocument(bson.M{"_id": "8711e364-c83d-46fc-a3db-d6b2aee00d0f", "nickname": "Meepo", "version": 4}, nil, nil)
 				},
 			})
 
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-
-			_, err := grpcTestService.DeleteUser(ctx, tt.req)
-			// If we got an error, but we didn't expect it. Then we error.
-			// If we didn't get an error, but we expect one. Then we error.
-			if (err != nil && !tt.expectedError) || (err == nil && tt.expectedError) {
-				t.Errorf("handler returned an unexpected error: \n\rgot: \n\r%v", err)
+			response, err := grpcTestService.RevertUser(context.Background(), tt.req)
+			if status.Code(err) != tt.expectedCode {
+				t.Fatalf("handler returned unexpected error: \n\rgot: \n\r%v \n\rwant code: \n\r%v\n\r", err, tt.expectedCode)
 			}
 
-			// Exit early, because its an error scenario.
-			if tt.expectedError {
-				return
+			if !proto.Equal(response, tt.expectedResponse) {
+				t.Errorf("handler returned unexpected response: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", response, tt.expectedResponse)
 			}
 		})
 	}
@@ -1634,6 +5140,9 @@ func TestWatchUsersHandler(t *testing.T) {
 		return "8711e364-c83d-46fc-a3db-d6b2aee00d0f"
 	}
 
+	// Updates reach the watchers through the relay, as they're logged
+	runRelay(t, userService)
+
 	// Define test cases
 	tests := []struct {
 		name            string
@@ -1676,11 +5185,13 @@ func TestWatchUsersHandler(t *testing.T) {
 						FirstName: "Razzil",
 						LastName:  "Darkbrew",
 						Nickname:  "Alchemist",
-						Password:  "moneyMoneyM0n3y",
+						// Watchers are never sent the password hash
+						Password:  "",
 						Email:     "Razzil.Darkbrew@example.com",
 						Country:   "UK",
 						CreatedAt: timestamppb.New(timeNow()),
 						UpdatedAt: timestamppb.New(timeNow()),
+						Version:   1,
 					},
 				},
 			},
@@ -1710,6 +5221,7 @@ func TestWatchUsersHandler(t *testing.T) {
 				if err != nil {
 					return err
 				}
+				req.Header.Set("Content-Type", "application/json")
 				rr := httptest.NewRecorder()
 				addUserHandler(rr, req)
 				if rr.Code != http.StatusOK {
@@ -1726,11 +5238,13 @@ func TestWatchUsersHandler(t *testing.T) {
 						FirstName: "Razzil",
 						LastName:  "Darkbrew",
 						Nickname:  "Alchemist",
-						Password:  "moneyMoneyM0n3y",
+						// Watchers are never sent the password hash
+						Password:  "",
 						Email:     "Razzil.Darkbrew@example.com",
 						Country:   "UK",
 						CreatedAt: timestamppb.New(timeNow()),
 						UpdatedAt: timestamppb.New(timeNow()),
+						Version:   1,
 					},
 				},
 			},
@@ -1779,11 +5293,13 @@ func TestWatchUsersHandler(t *testing.T) {
 						FirstName: "Razzil",
 						LastName:  "Darkbrew",
 						Nickname:  "Meepo",
-						Password:  "newPassword123",
+						// Watchers are never sent the password hash
+						Password:  "",
 						Email:     "Razzil.Darkbrew@example.com",
 						Country:   "UK",
 						CreatedAt: timestamppb.New(timeNow()),
 						UpdatedAt: timestamppb.New(timeNow()),
+						Version:   1,
 					},
 				},
 			},
@@ -1824,6 +5340,7 @@ func TestWatchUsersHandler(t *testing.T) {
 				if err != nil {
 					return err
 				}
+				req.Header.Set("Content-Type", "application/json")
 				rr := httptest.NewRecorder()
 				updateUserHandler(rr, req)
 				if rr.Code != http.StatusOK {
@@ -1840,11 +5357,13 @@ func TestWatchUsersHandler(t *testing.T) {
 						FirstName: "Razzil",
 						LastName:  "Darkbrew",
 						Nickname:  "Meepo",
-						Password:  "newPassword123",
+						// Watchers are never sent the password hash
+						Password:  "",
 						Email:     "Razzil.Darkbrew@example.com",
 						Country:   "UK",
 						CreatedAt: timestamppb.New(timeNow()),
 						UpdatedAt: timestamppb.New(timeNow()),
+						Version:   1,
 					},
 				},
 			},
@@ -1854,8 +5373,12 @@ func TestWatchUsersHandler(t *testing.T) {
 			name: "Delete All Users via HTTP",
 			setupFunc: func() error {
 				db.SetCollection(&mocks.MongoCollection{
-					DeleteManyFunc: func(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
-						return &mongo.DeleteResult{DeletedCount: 3}, nil
+					// Deletes are soft, so the users are updated rather than removed
+					UpdateManyFunc: func(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+						return &mongo.UpdateResult{ModifiedCount: 3}, nil
+					},
+					FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+						return mocks.NewMockCursor([]interface{}{}).Cursor, nil
 					},
 				})
 				req, err := http.NewRequest(http.MethodGet, "/userapi/deleteall", nil)
@@ -1884,7 +5407,10 @@ func TestWatchUsersHandler(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 			defer cancel()
 
-			stream, err := client.WatchUsers(ctx, &pb.WatchRequest{})
+			// Resume from the current sequence, so no update is missed while the stream is being set up
+			testEvents.settle()
+			resumeAfter := testEvents.head()
+			stream, err := client.WatchUsers(ctx, &pb.WatchRequest{ResumeAfter: proto.Int64(resumeAfter)})
 			if err != nil {
 				t.Fatalf("WatchUsers failed: %v", err)
 			}
@@ -1922,7 +5448,717 @@ func TestWatchUsersHandler(t *testing.T) {
 				if !reflect.DeepEqual(update.User, tt.expectedUpdates[i].User) {
 					t.Errorf("Update %d did not match expected: got %#v\n\r want %#v", i, update.User, tt.expectedUpdates[i].User)
 				}
+				if update.Sequence != resumeAfter+int64(i)+1 {
+					t.Errorf("Expected sequence %v, got %v", resumeAfter+int64(i)+1, update.Sequence)
+				}
+			}
+		})
+	}
+}
+
+// fakeWatchStream collects the updates sent to a watcher
+type fakeWatchStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	updates chan *pb.UserUpdate
+	// release, when set, holds each Send until it's closed
+	release chan struct{}
+}
+
+func (f *fakeWatchStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeWatchStream) Send(update *pb.UserUpdate) error {
+	f.updates <- update
+	if f.release != nil {
+		<-f.release
+	}
+	return nil
+}
+
+func TestWatchUsersResume(t *testing.T) {
+
+	timeNow = func() time.Time {
+		return time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC)
+	}
+
+	// Define test cases
+	tests := []struct {
+		name          string
+		resumeAfter   *int64
+		filter        string
+		expiredBefore int64
+		otherInstance bool
+		wantCode      codes.Code
+		wantSequences []int64
+	}{
+		{
+			name:          "Live updates only",
+			wantSequences: []int64{4},
+		},
+		{
+			name:          "Replay the whole log",
+			resumeAfter:   proto.Int64(0),
+			wantSequences: []int64{1, 2, 3, 4},
+		},
+		{
+			name:          "Resume after the last update received",
+			resumeAfter:   proto.Int64(2),
+			wantSequences: []int64{3, 4},
+		},
+		{
+			name:          "Resume with the first missed update still logged",
+			resumeAfter:   proto.Int64(1),
+			expiredBefore: 2,
+			wantSequences: []int64{2, 3, 4},
+		},
+		{
+			name:          "Missed updates have expired",
+			resumeAfter:   proto.Int64(1),
+			expiredBefore: 3,
+			wantCode:      codes.OutOfRange,
+		},
+		{
+			name:          "Replay only the updates matching the filter",
+			resumeAfter:   proto.Int64(0),
+			filter:        "type=deleted changed=deleted_at",
+			wantSequences: []int64{4},
+		},
+		{
+			name:     "Malformed filter",
+			filter:   "type=DELETED nickname",
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:          "Filter out updates only found in the log",
+			otherInstance: true,
+			filter:        "id=8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			wantSequences: []int64{5},
+		},
+		{
+			name:          "Fill in updates only found in the log",
+			otherInstance: true,
+			wantSequences: []int64{4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Start from a fresh log, holding 3 updates
+			eventLog := swapEventLog(t)
+
+			service := NewUserService()
+			for i := 0; i < 3; i++ {
+				notifyUpdate(t, eventLog, service, updateUPDATED, &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Version: int64(i + 1)}, []string{"version"})
+			}
+			eventLog.trim(tt.expiredBefore)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stream := &fakeWatchStream{ctx: ctx, updates: make(chan *pb.UserUpdate, 10)}
+			watchErr := make(chan error, 1)
+			go func() {
+				watchErr <- service.WatchUsers(&pb.WatchRequest{ResumeAfter: tt.resumeAfter, Filter: tt.filter}, stream)
+			}()
+
+			// Wait for the watcher to be registered, before sending the live update
+			for registered := false; !registered; {
+				select {
+				case err := <-watchErr:
+					if status.Code(err) != tt.wantCode {
+						t.Fatalf("WatchUsers returned unexpected error: \n\rgot: \n\r%v \n\rwant code: \n\r%v\n\r", err, tt.wantCode)
+					}
+					return
+				case <-time.After(time.Millisecond):
+					registered = service.updates.Stats().Subscribers == 1
+				}
+			}
+
+			if tt.otherInstance {
+				// Logged by another instance, and relayed by whichever instance holds the lease, never this one
+				eventLog.record(data.UserEvent{UserID: "0d0f9944-d902-4db1-b83b-6b25a61f89e2", UpdateType: updateCREATED})
+			}
+			notifyUpdate(t, eventLog, service, updateDELETED, &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f"}, []string{"version", "deleted_at"})
+
+			var sequences []int64
+			for len(sequences) < len(tt.wantSequences) {
+				select {
+				case update := <-stream.updates:
+					sequences = append(sequences, update.Sequence)
+				case err := <-watchErr:
+					t.Fatalf("WatchUsers stopped early: %v", err)
+				case <-ctx.Done():
+					t.Fatalf("timed out waiting for updates, got sequences %v", sequences)
+				}
+			}
+
+			if !reflect.DeepEqual(sequences, tt.wantSequences) {
+				t.Errorf("watcher received unexpected sequences: \n\rgot: \n\r%v \n\rwant: \n\r%v\n\r", sequences, tt.wantSequences)
+			}
+
+			// Nothing else should be sent, such as a duplicate of a replayed update
+			select {
+			case update := <-stream.updates:
+				t.Errorf("watcher received unexpected update: %v", update)
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			cancel()
+			if err := <-watchErr; err != nil {
+				t.Errorf("WatchUsers returned unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// TestFollowUpdates tests instances without the lease publish the updates logged by others, to their own watchers.
+func TestFollowUpdates(t *testing.T) {
+	eventLog := swapEventLog(t)
+	service := NewUserService()
+
+	record := func(count int) {
+		for i := 0; i < count; i++ {
+			eventLog.record(data.UserEvent{UserID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", UpdateType: updateUPDATED})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sub := service.updates.Subscribe(ctx)
+	defer sub.Close()
+
+	// Updates logged before we started following are left to the watchers to replay
+	record(2)
+	last := service.follow(context.Background(), -1)
+	if last != 2 {
+		t.Fatalf("expected to start following after sequence 2, got %d", last)
+	}
+
+	record(2)
+	if last = service.follow(context.Background(), last); last != 4 {
+		t.Fatalf("expected to have followed up to sequence 4, got %d", last)
+	}
+
+	var sequences []int64
+	for len(sequences) < 2 {
+		select {
+		case update := <-sub.Updates():
+			sequences = append(sequences, update.Sequence)
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for updates, got sequences %v", sequences)
+		}
+	}
+	if want := []int64{3, 4}; !reflect.DeepEqual(sequences, want) {
+		t.Errorf("unexpected sequences published, want: %v, got: %v", want, sequences)
+	}
+}
+
+// TestDeliverUpdatePublishes tests updates are published to the broker, without passwords, before watchers hear about them, and retried if the broker fails.
+func TestDeliverUpdatePublishes(t *testing.T) {
+	eventLog := swapEventLog(t)
+	service := NewUserService()
+	broker := publisher.NewMemory("user.updates", publisher.JSON)
+	service.publisher = broker
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sub := service.updates.Subscribe(ctx)
+	defer sub.Close()
+
+	event := eventLog.record(data.UserEvent{
+		UserID:       "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+		UpdateType:   updateUPDATED,
+		User:         &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Password: "new-hash"},
+		PreviousUser: &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Password: "old-hash"},
+	})
+
+	// Watchers aren't sent updates the broker didn't take, the relay retries them
+	broker.FailWith(errors.New("mock error"))
+	if err := service.deliverUpdate(event); err == nil {
+		t.Fatal("expected deliverUpdate to fail, while the broker is failing")
+	}
+	select {
+	case update := <-sub.Updates():
+		t.Fatalf("watcher was sent an update the broker didn't take: %v", update)
+	default:
+	}
+
+	broker.FailWith(nil)
+	if err := service.deliverUpdate(event); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := broker.Messages()
+	if len(messages) != 1 || messages[0].Key != event.UserID {
+		t.Fatalf("unexpected messages published: %+v", messages)
+	}
+	update := &pb.UserUpdate{}
+	if err := protojson.Unmarshal(messages[0].Value, update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Sequence != event.Sequence || update.UpdateType != updateUPDATED {
+		t.Errorf("unexpected update published: %v", update)
+	}
+	if update.GetUser().GetPassword() != "" || update.GetPreviousUser().GetPassword() != "" {
+		t.Errorf("expected the password hashes to be stripped from the published update, got: %v", update)
+	}
+
+	select {
+	case update := <-sub.Updates():
+		if update.Sequence != event.Sequence {
+			t.Errorf("watcher was sent unexpected update: %v", update)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the watcher to be sent the update")
+	}
+}
+
+func TestWatchUsersSlowConsumer(t *testing.T) {
+	eventLog := swapEventLog(t)
+
+	// Disconnect watchers as soon as a second update queues up behind the first
+	watchBufferSize, watchOverflowPolicy = 1, broadcast.Disconnect
+	service := NewUserService()
+	watchBufferSize, watchOverflowPolicy = 64, broadcast.DropOldest
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The watcher gets stuck sending the first update, until it's released
+	stream := &fakeWatchStream{ctx: ctx, updates: make(chan *pb.UserUpdate), release: make(chan struct{})}
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- service.WatchUsers(&pb.WatchRequest{}, stream)
+	}()
+	for service.updates.Stats().Subscribers != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	notify := func(version int64) {
+		notifyUpdate(t, eventLog, service, updateUPDATED, &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Version: version}, []string{"version"})
+	}
+	notify(1)
+	if update := <-stream.updates; update.Sequence != 1 {
+		t.Errorf("expected the first update, got sequence %d", update.Sequence)
+	}
+
+	// The second update queues up, the third overflows, then the watcher finds it has been disconnected
+	notify(2)
+	notify(3)
+	close(stream.release)
+
+	err := <-watchErr
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("WatchUsers returned unexpected error: \n\rgot: \n\r%v \n\rwant code: \n\r%v\n\r", err, codes.ResourceExhausted)
+	}
+	if !strings.Contains(err.Error(), "resume after sequence 1") {
+		t.Errorf("error should say where to resume from, got: %v", err)
+	}
+
+	if stats := service.updates.Stats(); stats.Disconnected != 1 || stats.Subscribers != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+// TestNewLimiter tests the -ratelimits flag overrides the default route limits, and adds to them
+func TestNewLimiter(t *testing.T) {
+	limiter, err := newLimiter("/userapi/deleteall=0,/userapi/get=10:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		route    string
+		expected ratelimit.Limit
+	}{
+		{route: "/userapi/deleteall", expected: ratelimit.Unlimited},
+		{route: "/userapi/get", expected: ratelimit.Limit{Rate: 10, Burst: 10}},
+		{route: "/userapi/add", expected: routeRateLimits["/userapi/add"]},
+		{route: "/userapi/getall", expected: ratelimit.Limit{Rate: 50, Burst: 100}},
+	}
+	for _, tt := range tests {
+		if limit := limiter.Limit(tt.route); limit != tt.expected {
+			t.Errorf("%s: expected limit %+v, got %+v", tt.route, tt.expected, limit)
+		}
+	}
+
+	if routeRateLimits["/userapi/deleteall"] == ratelimit.Unlimited {
+		t.Error("overrides should not change the default route limits")
+	}
+	if _, err := newLimiter("/userapi/get"); err == nil {
+		t.Error("expected an error for a malformed limit")
+	}
+}
+
+// TestLiftDeadlines tests a stream isn't cut off by the server's write timeout, when its response writer is wrapped by the middleware
+func TestLiftDeadlines(t *testing.T) {
+	stream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("still streaming"))
+	})
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		wantErr bool
+	}{
+		{name: "Lifted", handler: liftDeadlines(metrics.InstrumentHandler("/test", stream))},
+		{name: "Not lifted", handler: metrics.InstrumentHandler("/test", stream), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(tt.handler)
+			server.Config.WriteTimeout = 50 * time.Millisecond
+			server.Start()
+			defer server.Close()
+
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if tt.wantErr {
+				if err == nil && string(body) == "still streaming" {
+					t.Error("expected the write timeout to cut the stream off")
+				}
+				return
+			}
+			if err != nil || string(body) != "still streaming" {
+				t.Errorf("expected the stream to finish, got %q, %v", body, err)
+			}
+		})
+	}
+}
+
+// TestWatchUsersShutdown tests watchers are told we're shutting down, and where to resume from elsewhere
+func TestWatchUsersShutdown(t *testing.T) {
+	eventLog := swapEventLog(t)
+	service := NewUserService()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := &fakeWatchStream{ctx: ctx, updates: make(chan *pb.UserUpdate, 1)}
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- service.WatchUsers(&pb.WatchRequest{}, stream)
+	}()
+	for service.updates.Stats().Subscribers != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	notifyUpdate(t, eventLog, service, updateUPDATED, &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Version: 1}, []string{"version"})
+	if update := <-stream.updates; update.Sequence != 1 {
+		t.Errorf("expected the first update, got sequence %d", update.Sequence)
+	}
+
+	service.closeWatches()
+
+	err := <-watchErr
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("WatchUsers returned unexpected error: \n\rgot: \n\r%v \n\rwant code: \n\r%v\n\r", err, codes.Unavailable)
+	}
+	if !strings.Contains(err.Error(), "resume after sequence 1") {
+		t.Errorf("error should say where to resume from, got: %v", err)
+	}
+
+	// New watchers are turned away before their stream starts
+	err = service.WatchUsers(&pb.WatchRequest{}, &fakeWatchStream{ctx: ctx, updates: make(chan *pb.UserUpdate, 1)})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("WatchUsers returned unexpected error for a new watcher, want code: %v, got: %v", codes.Unavailable, err)
+	}
+
+	defer func(s *UserService) { userService = s }(userService)
+	userService = service
+	for path, handler := range map[string]http.HandlerFunc{"/userapi/watch": watchUsersHandler, "/userapi/watch/ws": watchUsersWebSocketHandler} {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("unexpected status for a new watcher on %s, want: %v, got: %v", path, http.StatusServiceUnavailable, rr.Code)
+		}
+	}
+	if subscribers := service.updates.Stats().Subscribers; subscribers != 0 {
+		t.Errorf("expected no new watchers to be subscribed, got %d", subscribers)
+	}
+}
+
+// TestStopServers tests requests in flight are let finish, and streams still open at the deadline are cut off
+func TestStopServers(t *testing.T) {
+	// An HTTP request that's nearly done
+	started := make(chan struct{})
+	httpServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	httpServer.Start()
+	defer httpServer.Close()
+
+	// A gRPC stream that would never end
+	grpcServer := grpc.NewServer()
+	healthSrv := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthSrv)
+	lis := bufconn.Listen(1024 * 1024)
+	go grpcServer.Serve(lis)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	watch, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(httpServer.URL)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	stopServers(ctx, httpServer.Config, grpcServer)
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the servers to stop at the deadline, took %s", elapsed)
+	}
+	if got := <-body; got != "done" {
+		t.Errorf("expected the request in flight to finish, got %q", got)
+	}
+	if _, err := watch.Recv(); err == nil {
+		t.Error("expected the open stream to be cut off")
+	}
+}
+
+// TestWarmUserCache tests the cache check fails until the users have been loaded, and stops loading them once they have
+func TestWarmUserCache(t *testing.T) {
+	db.UserStore.Clear()
+	defer db.UserStore.Clear()
+
+	finds := 0
+	available := false
+	db.SetCollection(&mocks.MongoCollection{
+		FindFunc: func(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+			finds++
+			if !available {
+				return nil, errors.New("mongo unavailable")
 			}
+			return mocks.NewMockCursor([]interface{}{}).Cursor, nil
+		},
+	})
+
+	check := warmUserCache()
+	if err := check(context.Background()); err == nil {
+		t.Fatal("expected the check to fail while the users can't be loaded")
+	}
+
+	available = true
+	for i := 0; i < 2; i++ {
+		db.UserStore.Clear()
+		if err := check(context.Background()); err != nil {
+			t.Fatalf("expected the check to pass once the users were loaded, got: %v", err)
+		}
+	}
+	if finds != 2 {
+		t.Errorf("expected the users to be loaded only until they had been once, loaded %d times", finds)
+	}
+}
+
+// TestWatchersRedactPasswords tests neither user's password hash reaches SSE or WebSocket watchers, whether the update is replayed or live
+func TestWatchersRedactPasswords(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/watch", watchUsersHandler)
+	mux.HandleFunc("/watch/ws", watchUsersWebSocketHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	testEvents.settle()
+	eventLog := swapEventLog(t)
+	notifyUpdated := func() {
+		t.Helper()
+		deliveredAt := timeNow()
+		event := eventLog.record(data.UserEvent{
+			UserID:        "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+			UpdateType:    updateUPDATED,
+			User:          &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Meepo", Password: "$2a$10$new", Version: 2},
+			PreviousUser:  &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Alchemist", Password: "$2a$10$old", Version: 1},
+			ChangedFields: []string{"nickname", "password", "version"},
+			CreatedAt:     timeNow(),
+			DeliveredAt:   &deliveredAt,
 		})
+		if err := userService.deliverUpdate(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replayed to both watchers
+	notifyUpdated()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/watch?resume_after=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/watch/ws?resume_after=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Sent live, once both have caught up
+	for userService.updates.Stats().Subscribers < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	notifyUpdated()
+
+	var payloads [][]byte
+	scanner := bufio.NewScanner(resp.Body)
+	for len(payloads) < 2 && scanner.Scan() {
+		if payload, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			payloads = append(payloads, []byte(payload))
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; i < 2; i++ {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed reading message %d: %v", i, err)
+		}
+		payloads = append(payloads, message)
+	}
+	if len(payloads) != 4 {
+		t.Fatalf("expected 2 updates over each transport, got %d", len(payloads))
+	}
+
+	for i, payload := range payloads {
+		var update struct {
+			User         struct{ Nickname, Password string } `json:"user"`
+			PreviousUser struct{ Nickname, Password string } `json:"previous_user"`
+		}
+		if err := json.Unmarshal(payload, &update); err != nil {
+			t.Fatalf("failed decoding update %d: %v", i, err)
+		}
+		if update.User.Nickname != "Meepo" || update.PreviousUser.Nickname != "Alchemist" {
+			t.Errorf("expected update %d to carry both users, got: %s", i, payload)
+		}
+		if update.User.Password != "" || update.PreviousUser.Password != "" {
+			t.Errorf("expected update %d to have no password hashes, got: %s", i, payload)
+		}
+	}
+}
+
+// TestHealthCheckMTLS tests /healthz still passes when gRPC clients must present a certificate, which the health check doesn't have
+func TestHealthCheckMTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile)
+
+	defer func(cert, key, clientCA string) { tlsCert, tlsKey, tlsClientCA = cert, key, clientCA }(tlsCert, tlsKey, tlsClientCA)
+	// The certificate is self signed, so it's its own client CA
+	tlsCert, tlsKey, tlsClientCA = certFile, keyFile, certFile
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, grpcTLS, err := newServerTLS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	healthSrv := health.NewServer()
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(grpcTLS)))
+	healthpb.RegisterHealthServer(server, healthSrv)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(lis)
+	defer server.Stop()
+
+	// A client without a certificate is turned away
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkCtx, checkCancel := context.WithTimeout(ctx, time.Second)
+	defer checkCancel()
+	if _, err := healthpb.NewHealthClient(conn).Check(checkCtx, &healthpb.HealthCheckRequest{}); err == nil {
+		t.Fatal("expected a client without a certificate to be rejected")
+	}
+
+	checker := newHealthChecker(healthSrv)
+	rr := httptest.NewRecorder()
+	checker.CheckHandler(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status, want: %v, got: %v", http.StatusOK, rr.Code)
+	}
+
+	healthSrv.Shutdown()
+	rr = httptest.NewRecorder()
+	checker.CheckHandler(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status once shutting down, want: %v, got: %v", http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+// writeTestCertificate writes a self signed certificate, fit for both servers and clients, and its key
+func writeTestCertificate(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "userapi"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
 	}
 }
@@ -2,7 +2,10 @@ package validation
 
 import (
 	"errors"
+	"net/netip"
+	"net/url"
 	"regexp"
+	"strings"
 	"unicode"
 )
 
@@ -14,8 +17,15 @@ var (
 	ErrInvalidPassword  = errors.New("invalid password")
 	ErrInvalidEmail     = errors.New("invalid email")
 	ErrInvalidCountry   = errors.New("invalid country")
+
+	ErrInvalidWebhookURL    = errors.New("invalid webhook url")
+	ErrInvalidEventType     = errors.New("invalid webhook event type")
+	ErrInvalidWebhookSecret = errors.New("invalid webhook secret")
 )
 
+// minWebhookSecretLength keeps webhook signatures from being guessed
+const minWebhookSecretLength = 16
+
 // Number checks if the input string is a valid integer without converting it.
 func Number(inputs ...string) bool {
 	for _, s := range inputs {
@@ -35,6 +45,17 @@ func Number(inputs ...string) bool {
 
 // User takes in a user object, and enforces validation rules on the user.
 func User(firstName, lastName, nickName, password, country, email string) error {
+	return checkUser(firstName, lastName, nickName, isValidPassword(password), country, email)
+}
+
+// UserWithPasswordHash enforces the same rules as User, for users whose password has already been hashed elsewhere.
+// A hash can't be checked against our password policy, so it only needs to be present.
+func UserWithPasswordHash(firstName, lastName, nickName, passwordHash, country, email string) error {
+	return checkUser(firstName, lastName, nickName, passwordHash != "", country, email)
+}
+
+// checkUser enforces the validation rules shared by User and UserWithPasswordHash
+func checkUser(firstName, lastName, nickName string, validPassword bool, country, email string) error {
 	if !isValidName(firstName) {
 		return ErrInvalidFirstName
 	}
@@ -44,7 +65,7 @@ func User(firstName, lastName, nickName, password, country, email string) error
 	if nickName == "" {
 		return ErrInvalidNickname
 	}
-	if !isValidPassword(password) {
+	if !validPassword {
 		return ErrInvalidPassword
 	}
 	if !isValidEmail(email) {
@@ -56,6 +77,82 @@ func User(firstName, lastName, nickName, password, country, email string) error
 	return nil
 }
 
+// Webhook enforces validation rules on where a webhook is delivered, and which updates it's sent.
+// updateTypes lists every kind of update, eventTypes has to be a subset of them.
+// Unless allowPrivate, the URL can't name localhost or an address that isn't public.
+func Webhook(rawURL string, eventTypes, updateTypes []string, allowPrivate bool) error {
+	if !isValidWebhookURL(rawURL, allowPrivate) {
+		return ErrInvalidWebhookURL
+	}
+	for _, eventType := range eventTypes {
+		if !contains(updateTypes, eventType) {
+			return ErrInvalidEventType
+		}
+	}
+	return nil
+}
+
+// WebhookSecret ensures a webhook secret is long enough to sign deliveries with
+func WebhookSecret(secret string) error {
+	if len(secret) < minWebhookSecretLength {
+		return ErrInvalidWebhookSecret
+	}
+	return nil
+}
+
+// isValidWebhookURL ensures webhooks are delivered over http(s) to an absolute URL.
+// Names that resolve to a private address are only caught when they're delivered to, this turns away the obvious ones up front.
+func isValidWebhookURL(rawURL string, allowPrivate bool) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	if allowPrivate {
+		return true
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return PublicIP(ip)
+	}
+	return true
+}
+
+// nonPublicPrefixes are the ranges PublicIP turns away, that the netip package doesn't already know about
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // this network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which can reach any of the IPv4 ranges
+}
+
+// PublicIP reports whether ip is on the public internet, rather than loopback, link-local, private, multicast or otherwise reserved
+func PublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // isValidName ensures the name is not empty
 func isValidName(name string) bool {
 	return name != ""
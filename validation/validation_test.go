@@ -1,6 +1,9 @@
 package validation
 
-import "testing"
+import (
+	"net/netip"
+	"testing"
+)
 
 // pkg: userapi/validation
 // cpu: AMD Ryzen 7 5800X3D 8-Core Processor
@@ -89,3 +92,135 @@ func TestUser(t *testing.T) {
 		})
 	}
 }
+
+// TestUserWithPasswordHash tests the UserWithPasswordHash function.
+func TestUserWithPasswordHash(t *testing.T) {
+	tests := []struct {
+		firstName    string
+		lastName     string
+		nickName     string
+		passwordHash string
+		country      string
+		email        string
+		expected     error
+	}{
+		// Valid user, the hash doesn't need to meet the password policy
+		{"John", "Doe", "jdoe", "$2a$10$N9qo8uLOickgx2ZMRZoMye", "USA", "john.doe@csgo.com", nil},
+		{"Zeus", "Elektra", "thunder", "short", "Greece", "zeus@csgo.com", nil},
+		// Password tests
+		{"Pudge", "Butcher", "meathook", "", "Ukraine", "pudge@dota2.com", ErrInvalidPassword},
+		// Every other rule still applies
+		{"", "Inferno", "smokeMaster", "hash", "Italy", "inferno@csgo.com", ErrInvalidFirstName},
+		{"Kenny", "S", "", "hash", "France", "kenny.s@csgo.com", ErrInvalidNickname},
+		{"Neo", "Pro", "neopro", "hash", "Denmark", "invalid-email", ErrInvalidEmail},
+		{"Sniper", "Billy", "sharpshooter", "hash", "", "sniper@csgo.com", ErrInvalidCountry},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			err := UserWithPasswordHash(test.firstName, test.lastName, test.nickName, test.passwordHash, test.country, test.email)
+			if err != test.expected {
+				t.Errorf("TestCase UserWithPasswordHash %q, %q, %q, %q, %q, %q Got Validation Response = %v; want %v",
+					test.firstName, test.lastName, test.nickName, test.passwordHash, test.country, test.email, err, test.expected)
+			}
+		})
+	}
+}
+
+// TestWebhook tests the Webhook function.
+func TestWebhook(t *testing.T) {
+	updateTypes := []string{"CREATED", "UPDATED", "DELETED"}
+
+	tests := []struct {
+		url          string
+		eventTypes   []string
+		allowPrivate bool
+		expected     error
+	}{
+		// Valid webhooks, no event types means every update
+		{"https://hooks.example.com/users", nil, false, nil},
+		{"http://93.184.216.34:9000/hook?team=growth", []string{"CREATED", "DELETED"}, false, nil},
+		// URL tests
+		{"", nil, false, ErrInvalidWebhookURL},
+		{"hooks.example.com/users", nil, false, ErrInvalidWebhookURL},
+		{"ftp://hooks.example.com/users", nil, false, ErrInvalidWebhookURL},
+		{"https:///users", nil, false, ErrInvalidWebhookURL},
+		{"https://hooks.example.com/%zz", nil, false, ErrInvalidWebhookURL},
+		// Our own network is turned away, unless it's allowed
+		{"http://localhost:9000/hook", nil, false, ErrInvalidWebhookURL},
+		{"http://api.LOCALHOST./hook", nil, false, ErrInvalidWebhookURL},
+		{"http://127.0.0.1:9000/hook", nil, false, ErrInvalidWebhookURL},
+		{"http://10.0.0.8/hook", nil, false, ErrInvalidWebhookURL},
+		{"http://169.254.169.254/latest/meta-data", nil, false, ErrInvalidWebhookURL},
+		{"http://[::1]:9000/hook", nil, false, ErrInvalidWebhookURL},
+		{"http://[::ffff:192.168.1.1]/hook", nil, false, ErrInvalidWebhookURL},
+		{"http://localhost:9000/hook", nil, true, nil},
+		{"http://10.0.0.8/hook", nil, true, nil},
+		// Event type tests
+		{"https://hooks.example.com/users", []string{"CREATED", "MOVED"}, false, ErrInvalidEventType},
+		{"https://hooks.example.com/users", []string{"created"}, false, ErrInvalidEventType},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			err := Webhook(test.url, test.eventTypes, updateTypes, test.allowPrivate)
+			if err != test.expected {
+				t.Errorf("TestCase Webhook %q, %v, %v Got Validation Response = %v; want %v", test.url, test.eventTypes, test.allowPrivate, err, test.expected)
+			}
+		})
+	}
+}
+
+// TestPublicIP tests the PublicIP function.
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"0.1.2.3", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00:ec2::254", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+
+	for _, test := range tests {
+		if got := PublicIP(netip.MustParseAddr(test.ip)); got != test.expected {
+			t.Errorf("TestCase PublicIP %q Got = %v; want %v", test.ip, got, test.expected)
+		}
+	}
+}
+
+// TestWebhookSecret tests the WebhookSecret function.
+func TestWebhookSecret(t *testing.T) {
+	tests := []struct {
+		secret   string
+		expected error
+	}{
+		{"0123456789abcdef", nil},
+		{"a much longer secret, with spaces", nil},
+		{"0123456789abcde", ErrInvalidWebhookSecret},
+		{"", ErrInvalidWebhookSecret},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			if err := WebhookSecret(test.secret); err != test.expected {
+				t.Errorf("WebhookSecret(%q) = %v; want %v", test.secret, err, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Package watchfilter lets watchers pick which user updates they are sent.
+//
+// A filter is a list of clauses separated by spaces, an update has to match every clause.
+// Each clause is a key and a comma separated list of values, of which the update has to match any:
+//
+//	type=UPDATED,DELETED   the kind of update
+//	id=<user id>           the user that was updated
+//	country=UK,FR          the user's country, ignoring case
+//	nickname=Alchemist     the user's nickname
+//	nickname^=Alc          the start of the user's nickname
+//	changed=email,nickname a field that was changed by the update
+//
+// Updates made to every user, such as deleting them all, match any id, country or nickname.
+// An empty filter matches every update.
+package watchfilter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"userapi/audit"
+	"userapi/data"
+)
+
+// ErrInvalidFilter is returned for filters which can't be parsed
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Filter decides whether a watcher is sent an update
+// Each field holds the values of one clause, nil when the clause isn't used
+type Filter struct {
+	types            []string
+	ids              []string
+	countries        []string
+	nicknames        []string
+	nicknamePrefixes []string
+	changed          []string
+}
+
+// Parse parses a filter, updateTypes lists the values allowed in a type clause.
+func Parse(expr string, updateTypes []string) (*Filter, error) {
+	filter := &Filter{}
+	seen := map[string]bool{}
+
+	for _, clause := range strings.Fields(expr) {
+		key, values, ok := strings.Cut(clause, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: %q should look like key=value", ErrInvalidFilter, clause)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%w: %q is used more than once", ErrInvalidFilter, key)
+		}
+		seen[key] = true
+
+		list := strings.Split(values, ",")
+		for _, value := range list {
+			if value == "" {
+				return nil, fmt.Errorf("%w: %q has an empty value", ErrInvalidFilter, clause)
+			}
+		}
+
+		switch key {
+		case "type":
+			for i, value := range list {
+				if !containsFold(updateTypes, value) {
+					return nil, fmt.Errorf("%w: unknown update type %q", ErrInvalidFilter, value)
+				}
+				list[i] = strings.ToUpper(value)
+			}
+			filter.types = list
+		case "id":
+			filter.ids = list
+		case "country":
+			filter.countries = list
+		case "nickname":
+			filter.nicknames = list
+		case "nickname^":
+			filter.nicknamePrefixes = list
+		case "changed":
+			for _, value := range list {
+				if !contains(audit.Fields, value) {
+					return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidFilter, value)
+				}
+			}
+			filter.changed = list
+		default:
+			return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidFilter, strings.TrimSuffix(key, "^"))
+		}
+	}
+
+	return filter, nil
+}
+
+// Match reports whether an update passes every clause of the filter
+func (f *Filter) Match(event *data.UserEvent) bool {
+	if f.types != nil && !contains(f.types, event.UpdateType) {
+		return false
+	}
+	if f.changed != nil && !containsAny(f.changed, event.ChangedFields) {
+		return false
+	}
+
+	// Updates to every user match whoever the watcher is interested in
+	if event.UserID == "" {
+		return true
+	}
+	if f.ids != nil && !contains(f.ids, event.UserID) {
+		return false
+	}
+
+	var user data.User
+	if event.User != nil {
+		user = *event.User
+	}
+	if f.countries != nil && !containsFold(f.countries, user.Country) {
+		return false
+	}
+	if f.nicknames != nil && !contains(f.nicknames, user.Nickname) {
+		return false
+	}
+	if f.nicknamePrefixes != nil && !hasAnyPrefix(user.Nickname, f.nicknamePrefixes) {
+		return false
+	}
+
+	return true
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list, values []string) bool {
+	for _, value := range values {
+		if contains(list, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
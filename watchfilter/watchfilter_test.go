@@ -0,0 +1,88 @@
+package watchfilter
+
+import (
+	"errors"
+	"testing"
+	"userapi/data"
+)
+
+var updateTypes = []string{"CREATED", "UPDATED", "DELETED", "ALL_DELETED", "RESTORED"}
+
+// TestParse tests the Parse function.
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{name: "Empty", expr: ""},
+		{name: "Every clause", expr: "type=UPDATED,deleted id=1 country=UK nickname=Alchemist nickname^=Alc changed=email,deleted_at"},
+		{name: "Extra spaces", expr: "  type=CREATED   country=UK "},
+		{name: "Missing value", expr: "type", wantErr: true},
+		{name: "Missing key", expr: "=UK", wantErr: true},
+		{name: "Empty value", expr: "country=", wantErr: true},
+		{name: "Empty value in list", expr: "country=UK,,FR", wantErr: true},
+		{name: "Unknown key", expr: "email=a@example.com", wantErr: true},
+		{name: "Prefix on another key", expr: "country^=U", wantErr: true},
+		{name: "Unknown update type", expr: "type=MOVED", wantErr: true},
+		{name: "Unknown field", expr: "changed=created_at", wantErr: true},
+		{name: "Repeated key", expr: "country=UK country=FR", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.expr, updateTypes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidFilter) {
+				t.Errorf("Parse(%q) error = %v, want ErrInvalidFilter", tt.expr, err)
+			}
+		})
+	}
+}
+
+// TestMatch tests the Filter.Match function.
+func TestMatch(t *testing.T) {
+	updated := &data.UserEvent{UserID: "1", UpdateType: "UPDATED", User: &data.User{ID: "1", Nickname: "Alchemist", Country: "UK"}, ChangedFields: []string{"nickname", "version"}}
+	deletedAll := &data.UserEvent{UpdateType: "ALL_DELETED", ChangedFields: []string{"version", "deleted_at"}}
+
+	tests := []struct {
+		name  string
+		expr  string
+		event *data.UserEvent
+		want  bool
+	}{
+		{name: "Empty filter", expr: "", event: updated, want: true},
+		{name: "Type", expr: "type=created,updated", event: updated, want: true},
+		{name: "Other type", expr: "type=DELETED", event: updated, want: false},
+		{name: "ID", expr: "id=2,1", event: updated, want: true},
+		{name: "Other ID", expr: "id=2", event: updated, want: false},
+		{name: "Country ignores case", expr: "country=uk", event: updated, want: true},
+		{name: "Other country", expr: "country=FR", event: updated, want: false},
+		{name: "Nickname", expr: "nickname=Alchemist", event: updated, want: true},
+		{name: "Nickname isn't a prefix", expr: "nickname=Alc", event: updated, want: false},
+		{name: "Nickname prefix", expr: "nickname^=Meep,Alc", event: updated, want: true},
+		{name: "Other nickname prefix", expr: "nickname^=alc", event: updated, want: false},
+		{name: "Changed field", expr: "changed=email,nickname", event: updated, want: true},
+		{name: "Unchanged field", expr: "changed=email", event: updated, want: false},
+		{name: "Every clause has to match", expr: "type=UPDATED country=FR", event: updated, want: false},
+		{name: "Updates to every user match any user", expr: "id=2 country=FR nickname^=Meep", event: deletedAll, want: true},
+		{name: "Updates to every user still need the right type", expr: "type=DELETED country=FR", event: deletedAll, want: false},
+		{name: "Updates to every user still need the right fields", expr: "changed=deleted_at", event: deletedAll, want: true},
+		{name: "No user to match", expr: "country=UK", event: &data.UserEvent{UserID: "1", UpdateType: "DELETED"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := Parse(tt.expr, updateTypes)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned unexpected error: %v", tt.expr, err)
+			}
+
+			if got := filter.Match(tt.event); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
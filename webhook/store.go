@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"context"
+	"sync"
+	"time"
+	"userapi/data"
+)
+
+// Store keeps the deliveries still to be made. Every instance's workers share it, so deliveries outlive the instance that queued them.
+type Store interface {
+	// Add stores deliveries, leaving any already stored with the same ID as they are
+	Add(ctx context.Context, deliveries []data.PendingWebhookDelivery) error
+	// Claim takes the delivery that's been due longest, pushing it back until lease from now so no one else attempts it meanwhile.
+	// It returns false when none are due.
+	Claim(ctx context.Context, now time.Time, lease time.Duration) (data.PendingWebhookDelivery, bool, error)
+	// Reschedule has a delivery attempted again at the given time
+	Reschedule(ctx context.Context, id string, attempt int, at time.Time) error
+	// Remove drops a delivery once it's succeeded or been dead-lettered
+	Remove(ctx context.Context, id string) error
+}
+
+// MemoryStore keeps deliveries in memory, so any still to be made when the service stops are lost. It's for tests.
+type MemoryStore struct {
+	mu         sync.Mutex
+	deliveries map[string]data.PendingWebhookDelivery
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{deliveries: make(map[string]data.PendingWebhookDelivery)}
+}
+
+// Add stores deliveries, leaving any already stored with the same ID as they are
+func (s *MemoryStore) Add(ctx context.Context, deliveries []data.PendingWebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, delivery := range deliveries {
+		if _, ok := s.deliveries[delivery.ID]; !ok {
+			s.deliveries[delivery.ID] = delivery
+		}
+	}
+	return nil
+}
+
+// Claim takes the delivery that's been due longest, pushing it back until lease from now
+func (s *MemoryStore) Claim(ctx context.Context, now time.Time, lease time.Duration) (data.PendingWebhookDelivery, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due *data.PendingWebhookDelivery
+	for id := range s.deliveries {
+		delivery := s.deliveries[id]
+		if !delivery.NextAttemptAt.After(now) && (due == nil || delivery.NextAttemptAt.Before(due.NextAttemptAt)) {
+			due = &delivery
+		}
+	}
+	if due == nil {
+		return data.PendingWebhookDelivery{}, false, nil
+	}
+
+	claimed := *due
+	claimed.NextAttemptAt = now.Add(lease)
+	s.deliveries[claimed.ID] = claimed
+	return *due, true, nil
+}
+
+// Reschedule has a delivery attempted again at the given time
+func (s *MemoryStore) Reschedule(ctx context.Context, id string, attempt int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if delivery, ok := s.deliveries[id]; ok {
+		delivery.Attempt, delivery.NextAttemptAt = attempt, at
+		s.deliveries[id] = delivery
+	}
+	return nil
+}
+
+// Remove drops a delivery
+func (s *MemoryStore) Remove(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deliveries, id)
+	return nil
+}
+
+// Pending lists the deliveries still to be made, in no particular order
+func (s *MemoryStore) Pending() []data.PendingWebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := make([]data.PendingWebhookDelivery, 0, len(s.deliveries))
+	for _, delivery := range s.deliveries {
+		pending = append(pending, delivery)
+	}
+	return pending
+}
@@ -0,0 +1,429 @@
+// Package webhook delivers user updates to webhooks, as JSON POSTs signed with each webhook's secret.
+// Deliveries are kept in a Store until they're made, so none are lost when the service stops.
+// Failed deliveries are retried with exponential backoff, until they run out of attempts and are dead-lettered.
+//
+// Every attempt carries these headers:
+//
+//	X-Userapi-Delivery   the delivery's ID, the same for every attempt so receivers can ignore repeats
+//	X-Userapi-Event      the kind of update
+//	X-Userapi-Timestamp  when the attempt was made, in unix seconds
+//	X-Userapi-Signature  sha256=<hex HMAC-SHA256 of "<timestamp>.<body>", keyed with the secret>
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"userapi/data"
+	"userapi/validation"
+
+	"github.com/bet365/jingo"
+	"github.com/google/uuid"
+)
+
+// Headers sent with every delivery
+const (
+	DeliveryHeader  = "X-Userapi-Delivery"
+	EventHeader     = "X-Userapi-Event"
+	TimestampHeader = "X-Userapi-Timestamp"
+	SignatureHeader = "X-Userapi-Signature"
+)
+
+var (
+	// ErrInvalidSignature is returned by Verify for deliveries that weren't signed with the secret
+	ErrInvalidSignature = errors.New("webhook signature doesn't match")
+	// ErrStaleDelivery is returned by Verify for deliveries signed too long ago, which may be replayed
+	ErrStaleDelivery = errors.New("webhook delivery is too old")
+	// ErrPrivateAddress is returned for deliveries to an address that isn't on the public internet
+	ErrPrivateAddress = errors.New("webhook address is not public")
+)
+
+// Sign signs a delivery's body, along with the time it was sent so it can't be replayed later on
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a delivery was signed with the secret, no longer than tolerance ago.
+// It's what receivers written in Go should call, a tolerance of 0 accepts deliveries of any age.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: missing or malformed timestamp", ErrInvalidSignature)
+	}
+
+	if !hmac.Equal([]byte(header.Get(SignatureHeader)), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+
+	if age := time.Since(time.Unix(timestamp, 0)); tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return ErrStaleDelivery
+	}
+
+	return nil
+}
+
+// Wants reports whether a webhook is sent the given kind of update
+func Wants(hook *data.Webhook, updateType string) bool {
+	if len(hook.EventTypes) == 0 {
+		return true
+	}
+	for _, eventType := range hook.EventTypes {
+		if eventType == updateType {
+			return true
+		}
+	}
+	return false
+}
+
+// NewClient creates a client for making deliveries, giving receivers timeout to respond.
+// Unless allowPrivate, it refuses to connect to any address that isn't public, so a webhook can't be pointed at our own network.
+// The address is checked as it's dialled, after the name's been resolved, so a name changed to resolve somewhere private after the
+// webhook was added is caught too, as are redirects.
+func NewClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		dialer.Control = publicOnly
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// A proxy would be dialled instead of the receiver, getting around the check
+	transport.Proxy = nil
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// publicOnly refuses connections to addresses that aren't public
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPrivateAddress, err)
+	}
+	if !validation.PublicIP(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+// Backoff is how long to wait before retrying the given attempt, doubling from base with every attempt up to max
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// retryable reports whether a failed attempt is worth trying again.
+// The receiver may come back after errors on their side, or a timeout, but will keep refusing a bad request,
+// and we'll keep refusing to connect to a private address.
+func retryable(statusCode int, err error) bool {
+	if errors.Is(err, ErrPrivateAddress) {
+		return false
+	}
+	return statusCode == 0 || statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+}
+
+// Config controls how a Dispatcher makes its deliveries
+type Config struct {
+	// Client sends the deliveries, its Timeout limits how long receivers have to respond
+	Client *http.Client
+	// Store keeps the deliveries still to be made, in memory when it's nil
+	Store Store
+	// Workers is how many deliveries are made at once
+	Workers int
+	// PollInterval is how often idle workers look for deliveries that have come due, without being woken
+	PollInterval time.Duration
+	// Lease is how long a worker has to make an attempt, before the delivery can be claimed by another
+	Lease time.Duration
+	// MaxAttempts is how many times a delivery is tried, before it's dead-lettered
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, doubling with every attempt up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Record is called after every attempt, for the delivery log
+	Record func(delivery data.WebhookDelivery)
+	// DeadLetter is called with every delivery that was given up on. The delivery is kept and tried again later if it fails.
+	DeadLetter func(deadLetter data.WebhookDeadLetter) error
+}
+
+// Stats counts what the dispatcher has done, for metrics
+type Stats struct {
+	Queued    int64 `json:"queued"`
+	Succeeded int64 `json:"succeeded"`
+	Retried   int64 `json:"retried"`
+	Dead      int64 `json:"dead"`
+}
+
+// Dispatcher delivers updates to webhooks in the background.
+// Deliveries are kept in the store until they succeed or are dead-lettered, so any waiting when the service stops are made once it's back.
+type Dispatcher struct {
+	cfg  Config
+	wake chan struct{}
+
+	queued    atomic.Int64
+	succeeded atomic.Int64
+	retried   atomic.Int64
+	dead      atomic.Int64
+}
+
+// NewDispatcher creates a dispatcher, which makes no deliveries until it's Run
+func NewDispatcher(cfg Config) *Dispatcher {
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryStore()
+	}
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.Lease <= cfg.Client.Timeout {
+		cfg.Lease = cfg.Client.Timeout + time.Minute
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.Record == nil {
+		cfg.Record = func(data.WebhookDelivery) {}
+	}
+	if cfg.DeadLetter == nil {
+		cfg.DeadLetter = func(data.WebhookDeadLetter) error { return nil }
+	}
+
+	return &Dispatcher{cfg: cfg, wake: make(chan struct{}, cfg.Workers)}
+}
+
+// Run makes deliveries until ctx is done, whenever they come due
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < d.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// Dispatch stores an update's delivery to each of the webhooks, to be made in the background.
+// Once it returns the deliveries will be made even if the service stops, so the update needn't be dispatched again.
+// An update dispatched again to the same webhook isn't delivered twice, as long as its first delivery is still to be made.
+func (d *Dispatcher) Dispatch(ctx context.Context, event data.UserEvent, hooks []data.Webhook) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	// Receivers never need the password hashes, so they aren't stored either
+	event = event.Redacted()
+	now := time.Now()
+	deliveries := make([]data.PendingWebhookDelivery, len(hooks))
+	for i, hook := range hooks {
+		deliveries[i] = data.PendingWebhookDelivery{ID: deliveryID(hook.ID, event.Sequence), Webhook: hook, Event: event, Attempt: 1, NextAttemptAt: now, CreatedAt: now}
+	}
+	return d.add(ctx, deliveries...)
+}
+
+// Redeliver stores a dead letter to be delivered again, with a fresh set of attempts
+func (d *Dispatcher) Redeliver(ctx context.Context, hook data.Webhook, deadLetter data.WebhookDeadLetter) error {
+	now := time.Now()
+	return d.add(ctx, data.PendingWebhookDelivery{ID: deadLetter.ID, Webhook: hook, Event: deadLetter.Event, Attempt: 1, NextAttemptAt: now, CreatedAt: now})
+}
+
+// Stats counts the deliveries queued by this instance, and every attempt that succeeded, will be retried, or was given up on
+func (d *Dispatcher) Stats() Stats {
+	return Stats{
+		Queued:    d.queued.Load(),
+		Succeeded: d.succeeded.Load(),
+		Retried:   d.retried.Load(),
+		Dead:      d.dead.Load(),
+	}
+}
+
+// deliveryID is the same every time an update is dispatched to a webhook, so the store only keeps one delivery of it
+func deliveryID(webhookID string, sequence int64) string {
+	return uuid.NewSHA1(deliveryNamespace, []byte(webhookID+":"+strconv.FormatInt(sequence, 10))).String()
+}
+
+// deliveryNamespace namespaces the delivery IDs, so they don't look like any other IDs made from the same webhook and sequence
+var deliveryNamespace = uuid.MustParse("5b0a4bd6-4b41-4a55-a0a2-9e64a4f1f2c3")
+
+// add stores the deliveries, then wakes the workers to make them
+func (d *Dispatcher) add(ctx context.Context, deliveries ...data.PendingWebhookDelivery) error {
+	if err := d.cfg.Store.Add(ctx, deliveries); err != nil {
+		return fmt.Errorf("failed to queue webhook deliveries: %w", err)
+	}
+	d.queued.Add(int64(len(deliveries)))
+	for range deliveries {
+		d.Wake()
+	}
+	return nil
+}
+
+// Wake has an idle worker look for due deliveries straight away. It never blocks.
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work makes due deliveries one at a time until ctx is done, waiting for more whenever none are due
+func (d *Dispatcher) work(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		delivery, ok, err := d.cfg.Store.Claim(ctx, time.Now(), d.cfg.Lease)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("failed to claim a webhook delivery", "error", err)
+		}
+		if ok {
+			d.attempt(ctx, delivery)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// attempt makes a delivery, then records it and decides whether to try again
+func (d *Dispatcher) attempt(ctx context.Context, pending data.PendingWebhookDelivery) {
+	statusCode, err := d.send(ctx, &pending)
+
+	delivery := data.WebhookDelivery{
+		ID:         uuid.NewString(),
+		DeliveryID: pending.ID,
+		WebhookID:  pending.Webhook.ID,
+		Sequence:   pending.Event.Sequence,
+		UpdateType: pending.Event.UpdateType,
+		Attempt:    pending.Attempt,
+		Status:     data.DeliverySucceeded,
+		StatusCode: statusCode,
+		CreatedAt:  time.Now(),
+	}
+
+	switch {
+	case err == nil:
+		d.succeeded.Add(1)
+		d.cfg.Record(delivery)
+		d.remove(pending)
+	case ctx.Err() != nil:
+		// Stopped mid attempt, the delivery is made again once its lease runs out
+	case pending.Attempt < d.cfg.MaxAttempts && retryable(statusCode, err):
+		delivery.Status, delivery.Error = data.DeliveryRetrying, err.Error()
+		d.retried.Add(1)
+		d.cfg.Record(delivery)
+		d.retry(pending, pending.Attempt+1, Backoff(pending.Attempt, d.cfg.BaseDelay, d.cfg.MaxDelay))
+	default:
+		delivery.Status, delivery.Error = data.DeliveryDead, err.Error()
+		d.cfg.Record(delivery)
+		d.giveUp(pending, err)
+	}
+}
+
+// retry has the delivery attempted again after delay.
+// If it can't be rescheduled, it's attempted again once its lease runs out instead.
+func (d *Dispatcher) retry(pending data.PendingWebhookDelivery, attempt int, delay time.Duration) {
+	if err := d.cfg.Store.Reschedule(context.Background(), pending.ID, attempt, time.Now().Add(delay)); err != nil {
+		slog.Error("failed to reschedule webhook delivery, it will be retried once its lease runs out", "delivery_id", pending.ID, "error", err)
+		return
+	}
+	time.AfterFunc(delay, d.Wake)
+}
+
+// giveUp dead-letters a delivery after its last attempt. It's kept to be dead-lettered again later, if that fails.
+func (d *Dispatcher) giveUp(pending data.PendingWebhookDelivery, err error) {
+	deadLetter := data.WebhookDeadLetter{
+		ID:        pending.ID,
+		WebhookID: pending.Webhook.ID,
+		Event:     pending.Event,
+		Attempts:  pending.Attempt,
+		LastError: err.Error(),
+		CreatedAt: time.Now(),
+	}
+	if err := d.cfg.DeadLetter(deadLetter); err != nil {
+		slog.Error("failed to dead-letter webhook delivery, it will be tried again", "delivery_id", pending.ID, "error", err)
+		d.retry(pending, pending.Attempt, d.cfg.MaxDelay)
+		return
+	}
+	d.dead.Add(1)
+	d.remove(pending)
+}
+
+// remove drops a delivery that's been made or dead-lettered.
+// If it can't be dropped, it's made again once its lease runs out, which receivers can spot by its ID.
+func (d *Dispatcher) remove(pending data.PendingWebhookDelivery) {
+	if err := d.cfg.Store.Remove(context.Background(), pending.ID); err != nil {
+		slog.Error("failed to remove finished webhook delivery, it may be made again", "delivery_id", pending.ID, "error", err)
+	}
+}
+
+var eventEncoder = jingo.NewStructEncoder(data.UserEvent{})
+
+// maxResponseSize caps how much of a response is read, so the connection can be reused
+const maxResponseSize = 64 << 10
+
+// send POSTs the signed update to the webhook, returning the status code the receiver responded with
+func (d *Dispatcher) send(ctx context.Context, pending *data.PendingWebhookDelivery) (int, error) {
+	// Receivers never need the password hashes, dead letters queued before they were stripped may still have them
+	event := pending.Event.Redacted()
+
+	buf := jingo.NewBufferFromPool()
+	defer buf.ReturnToPool()
+	eventEncoder.Marshal(&event, buf)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pending.Webhook.URL, bytes.NewReader(buf.Bytes))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "userapi-webhook")
+	req.Header.Set(DeliveryHeader, pending.ID)
+	req.Header.Set(EventHeader, event.UpdateType)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(pending.Webhook.Secret, timestamp, buf.Bytes))
+
+	resp, err := d.cfg.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
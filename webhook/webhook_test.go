@@ -0,0 +1,503 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"userapi/data"
+)
+
+const testSecret = "0123456789abcdef"
+
+// TestVerify tests that Verify only accepts deliveries signed with the secret, recently.
+func TestVerify(t *testing.T) {
+	body := []byte(`{"sequence":1}`)
+	now := time.Now().Unix()
+
+	signed := func(secret string, timestamp int64, body []byte) http.Header {
+		header := http.Header{}
+		header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+		header.Set(SignatureHeader, Sign(secret, timestamp, body))
+		return header
+	}
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		tolerance time.Duration
+		wantErr   error
+	}{
+		{name: "Signed", header: signed(testSecret, now, body), tolerance: time.Minute},
+		{name: "Wrong secret", header: signed("fedcba9876543210", now, body), tolerance: time.Minute, wantErr: ErrInvalidSignature},
+		{name: "Different body", header: signed(testSecret, now, []byte(`{"sequence":2}`)), tolerance: time.Minute, wantErr: ErrInvalidSignature},
+		{name: "Missing timestamp", header: http.Header{SignatureHeader: {Sign(testSecret, now, body)}}, wantErr: ErrInvalidSignature},
+		{name: "Too old", header: signed(testSecret, now-600, body), tolerance: time.Minute, wantErr: ErrStaleDelivery},
+		{name: "Any age", header: signed(testSecret, now-600, body)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(testSecret, tt.header, body, tt.tolerance); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The timestamp is signed too, so it can't be moved on
+	header := signed(testSecret, now-600, body)
+	header.Set(TimestampHeader, strconv.FormatInt(now, 10))
+	if err := Verify(testSecret, header, body, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() with a changed timestamp = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+// TestBackoff tests the Backoff function.
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := Backoff(tt.attempt, time.Second, time.Minute); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+// TestWants tests the Wants function.
+func TestWants(t *testing.T) {
+	every := &data.Webhook{}
+	some := &data.Webhook{EventTypes: []string{"CREATED", "DELETED"}}
+
+	if !Wants(every, "UPDATED") {
+		t.Error("a webhook without event types should want every update")
+	}
+	if !Wants(some, "DELETED") || Wants(some, "UPDATED") {
+		t.Error("a webhook should only want its event types")
+	}
+}
+
+// receiver is a webhook receiver, responding with each status in turn then 200 OK
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, string(body))
+
+	if len(rc.statuses) > 0 {
+		w.WriteHeader(rc.statuses[0])
+		rc.statuses = rc.statuses[1:]
+	}
+}
+
+// TestDispatcher tests deliveries are retried until they succeed, or are given up on.
+func TestDispatcher(t *testing.T) {
+	event := data.UserEvent{
+		Sequence:   7,
+		UserID:     "8711e364-c83d-46fc-a3db-d6b2aee00d0f",
+		UpdateType: "CREATED",
+		User:       &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Alchemist", Password: "$2a$10$hash"},
+		CreatedAt:  time.Date(2024, time.June, 17, 19, 49, 18, 0, time.UTC),
+	}
+	wantBody := `{"sequence":7,"user_id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","update_type":"CREATED","user":{"id":"8711e364-c83d-46fc-a3db-d6b2aee00d0f","first_name":"","last_name":"","nickname":"Alchemist","password":"","email":"","country":"","created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z","version":0,"deleted_at":null},"changed_fields":[],"previous_user":null,"actor":"","request_id":"","created_at":"2024-06-17T19:49:18Z"}`
+
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantStatuses []string
+		wantDead     bool
+	}{
+		{
+			name:         "Delivered first time",
+			wantStatuses: []string{data.DeliverySucceeded},
+		},
+		{
+			name:         "Delivered after retrying",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			wantStatuses: []string{data.DeliveryRetrying, data.DeliveryRetrying, data.DeliverySucceeded},
+		},
+		{
+			name:         "Out of attempts",
+			statuses:     []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusBadGateway},
+			wantStatuses: []string{data.DeliveryRetrying, data.DeliveryRetrying, data.DeliveryDead},
+			wantDead:     true,
+		},
+		{
+			name:         "Refused",
+			statuses:     []int{http.StatusGone},
+			wantStatuses: []string{data.DeliveryDead},
+			wantDead:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &receiver{statuses: tt.statuses}
+			server := httptest.NewServer(rc)
+			defer server.Close()
+
+			deliveries := make(chan data.WebhookDelivery, 10)
+			deadLetters := make(chan data.WebhookDeadLetter, 1)
+			d := NewDispatcher(Config{
+				MaxAttempts: 3,
+				BaseDelay:   time.Millisecond,
+				MaxDelay:    5 * time.Millisecond,
+				Record:      func(delivery data.WebhookDelivery) { deliveries <- delivery },
+				DeadLetter:  func(deadLetter data.WebhookDeadLetter) error { deadLetters <- deadLetter; return nil },
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go d.Run(ctx)
+
+			hook := data.Webhook{ID: "hook-1", URL: server.URL + "/users", Secret: testSecret}
+			if err := d.Dispatch(ctx, event, []data.Webhook{hook}); err != nil {
+				t.Fatal(err)
+			}
+
+			var deliveryID string
+			for i, wantStatus := range tt.wantStatuses {
+				var delivery data.WebhookDelivery
+				select {
+				case delivery = <-deliveries:
+				case <-ctx.Done():
+					t.Fatalf("timed out waiting for attempt %d", i+1)
+				}
+
+				if delivery.Status != wantStatus || delivery.Attempt != i+1 || delivery.WebhookID != hook.ID || delivery.Sequence != event.Sequence {
+					t.Errorf("unexpected attempt %d: %+v", i+1, delivery)
+				}
+				if deliveryID == "" {
+					deliveryID = delivery.DeliveryID
+				} else if delivery.DeliveryID != deliveryID {
+					t.Errorf("attempt %d has a different delivery id, want: %s, got: %s", i+1, deliveryID, delivery.DeliveryID)
+				}
+				if (wantStatus == data.DeliverySucceeded) != (delivery.Error == "") {
+					t.Errorf("unexpected error for attempt %d: %q", i+1, delivery.Error)
+				}
+			}
+
+			if tt.wantDead {
+				select {
+				case deadLetter := <-deadLetters:
+					if deadLetter.ID != deliveryID || deadLetter.Attempts != len(tt.wantStatuses) || deadLetter.Event.Sequence != event.Sequence {
+						t.Errorf("unexpected dead letter: %+v", deadLetter)
+					}
+				case <-ctx.Done():
+					t.Fatal("timed out waiting for the dead letter")
+				}
+			}
+
+			rc.mu.Lock()
+			defer rc.mu.Unlock()
+			if len(rc.requests) != len(tt.wantStatuses) {
+				t.Fatalf("unexpected number of requests, want: %d, got: %d", len(tt.wantStatuses), len(rc.requests))
+			}
+			for i, r := range rc.requests {
+				if r.Method != http.MethodPost || r.URL.Path != "/users" || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("unexpected request: %s %s %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+				}
+				if r.Header.Get(DeliveryHeader) != deliveryID || r.Header.Get(EventHeader) != event.UpdateType {
+					t.Errorf("unexpected headers: %v", r.Header)
+				}
+				if err := Verify(testSecret, r.Header, []byte(rc.bodies[i]), time.Minute); err != nil {
+					t.Errorf("delivery isn't signed: %v", err)
+				}
+				if rc.bodies[i] != wantBody {
+					t.Errorf("unexpected body: \n\rgot: \n\r%s \n\rwant: \n\r%s\n\r", rc.bodies[i], wantBody)
+				}
+			}
+		})
+	}
+}
+
+// TestDispatcherRedeliver tests a dead letter is redelivered under its original delivery id.
+func TestDispatcherRedeliver(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	deliveries := make(chan data.WebhookDelivery, 1)
+	d := NewDispatcher(Config{Record: func(delivery data.WebhookDelivery) { deliveries <- delivery }})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go d.Run(ctx)
+
+	hook := data.Webhook{ID: "hook-1", URL: server.URL, Secret: testSecret}
+	if err := d.Redeliver(ctx, hook, data.WebhookDeadLetter{ID: "delivery-1", WebhookID: hook.ID, Event: data.UserEvent{Sequence: 3, UpdateType: "DELETED"}, Attempts: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case delivery := <-deliveries:
+		if delivery.DeliveryID != "delivery-1" || delivery.Attempt != 1 || delivery.Status != data.DeliverySucceeded {
+			t.Errorf("unexpected delivery: %+v", delivery)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the redelivery")
+	}
+}
+
+// TestDispatcherRedactsPasswords tests an update's delivery carries neither the user's new password hash, nor their previous one.
+func TestDispatcherRedactsPasswords(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	deliveries := make(chan data.WebhookDelivery, 1)
+	d := NewDispatcher(Config{Record: func(delivery data.WebhookDelivery) { deliveries <- delivery }})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go d.Run(ctx)
+
+	event := data.UserEvent{
+		Sequence:     4,
+		UpdateType:   "UPDATED",
+		User:         &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Meepo", Password: "$2a$10$new"},
+		PreviousUser: &data.User{ID: "8711e364-c83d-46fc-a3db-d6b2aee00d0f", Nickname: "Alchemist", Password: "$2a$10$old"},
+	}
+	if err := d.Dispatch(ctx, event, []data.Webhook{{ID: "hook-1", URL: server.URL, Secret: testSecret}}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-deliveries:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the delivery")
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var body struct {
+		User         struct{ Nickname, Password string } `json:"user"`
+		PreviousUser struct{ Nickname, Password string } `json:"previous_user"`
+	}
+	if err := json.Unmarshal([]byte(rc.bodies[0]), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.User.Nickname != "Meepo" || body.PreviousUser.Nickname != "Alchemist" {
+		t.Errorf("expected both users to be delivered, got: %s", rc.bodies[0])
+	}
+	if body.User.Password != "" || body.PreviousUser.Password != "" {
+		t.Errorf("expected no password hashes, got: %s", rc.bodies[0])
+	}
+	if event.User.Password == "" || event.PreviousUser.Password == "" {
+		t.Error("expected the event dispatched to be left alone")
+	}
+}
+
+// TestDispatcherKeepsDeliveries tests deliveries are kept in the store until they're made, so another dispatcher picks them up after a restart.
+func TestDispatcherKeepsDeliveries(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	store := NewMemoryStore()
+	hook := data.Webhook{ID: "hook-1", URL: server.URL, Secret: testSecret}
+	event := data.UserEvent{Sequence: 5, UpdateType: "CREATED", User: &data.User{Password: "$2a$10$hash"}}
+
+	// Nothing is running yet, and dispatching the same update again doesn't queue a second delivery
+	stopped := NewDispatcher(Config{Store: store})
+	for i := 0; i < 2; i++ {
+		if err := stopped.Dispatch(context.Background(), event, []data.Webhook{hook}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := store.Pending()
+	if len(pending) != 1 || pending[0].Event.Sequence != event.Sequence || pending[0].Attempt != 1 {
+		t.Fatalf("unexpected deliveries stored: %+v", pending)
+	}
+	if pending[0].Event.User.Password != "" {
+		t.Error("expected the password hash not to be stored with the delivery")
+	}
+
+	deliveries := make(chan data.WebhookDelivery, 1)
+	d := NewDispatcher(Config{Store: store, Record: func(delivery data.WebhookDelivery) { deliveries <- delivery }})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go d.Run(ctx)
+
+	select {
+	case delivery := <-deliveries:
+		if delivery.DeliveryID != pending[0].ID || delivery.Status != data.DeliverySucceeded {
+			t.Errorf("unexpected delivery: %+v", delivery)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the stored delivery to be made")
+	}
+
+	// The delivery is removed once it's made, so it isn't made again
+	for deadline := time.Now().Add(time.Second); len(store.Pending()) > 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pending := store.Pending(); len(pending) != 0 {
+		t.Errorf("expected the delivery to be removed once made, got: %+v", pending)
+	}
+}
+
+// TestDispatcherDeadLetterFails tests a delivery that can't be dead-lettered is kept, to be dead-lettered later.
+func TestDispatcherDeadLetterFails(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusGone}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	store := NewMemoryStore()
+	attempted := make(chan struct{}, 1)
+	d := NewDispatcher(Config{
+		Store:    store,
+		MaxDelay: time.Hour,
+		Record:   func(data.WebhookDelivery) { attempted <- struct{}{} },
+		DeadLetter: func(data.WebhookDeadLetter) error {
+			return errors.New("mock error")
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go d.Run(ctx)
+
+	if err := d.Dispatch(ctx, data.UserEvent{Sequence: 6}, []data.Webhook{{ID: "hook-1", URL: server.URL, Secret: testSecret}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-attempted:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the attempt")
+	}
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if pending := store.Pending(); len(pending) == 1 && pending[0].NextAttemptAt.After(time.Now().Add(30*time.Minute)) {
+			if stats := d.Stats(); stats.Dead != 0 {
+				t.Errorf("expected nothing to be counted as dead-lettered, got: %+v", stats)
+			}
+			return
+		}
+	}
+	t.Fatalf("expected the delivery to be kept until it can be dead-lettered, got: %+v", store.Pending())
+}
+
+// TestMemoryStoreClaim tests a claimed delivery isn't claimed again until its lease runs out, or it's rescheduled.
+func TestMemoryStoreClaim(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.Add(context.Background(), []data.PendingWebhookDelivery{
+		{ID: "later", NextAttemptAt: now.Add(time.Minute)},
+		{ID: "due", NextAttemptAt: now.Add(-time.Second)},
+	})
+
+	if delivery, ok, _ := store.Claim(context.Background(), now, 90*time.Second); !ok || delivery.ID != "due" {
+		t.Fatalf("expected the due delivery to be claimed, got: %+v, %v", delivery, ok)
+	}
+	if delivery, ok, _ := store.Claim(context.Background(), now, time.Minute); ok {
+		t.Fatalf("expected nothing else to be due, got: %+v", delivery)
+	}
+
+	// Once the lease runs out, whichever has been due longest goes first
+	if delivery, ok, _ := store.Claim(context.Background(), now.Add(2*time.Minute), time.Minute); !ok || delivery.ID != "later" {
+		t.Fatalf("expected the longest due delivery to be claimed, got: %+v, %v", delivery, ok)
+	}
+
+	store.Reschedule(context.Background(), "due", 2, now)
+	if delivery, ok, _ := store.Claim(context.Background(), now, time.Minute); !ok || delivery.ID != "due" || delivery.Attempt != 2 {
+		t.Fatalf("expected the rescheduled delivery to be claimed, got: %+v, %v", delivery, ok)
+	}
+}
+
+// TestNewClient tests the client refuses to connect anywhere that isn't public, by name or by address, unless it's allowed to.
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(&receiver{})
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	for _, url := range []string{server.URL, "http://localhost:" + port} {
+		_, err := NewClient(time.Second, false).Get(url)
+		if !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("expected %s to be refused, got: %v", url, err)
+		}
+	}
+
+	// Redirects are dialled through the same check
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+	client := NewClient(time.Second, false)
+	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		// Pretend the redirecting server is public, by skipping the check when dialling it
+		if address == redirect.Listener.Addr().String() {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}
+		return (&net.Dialer{Control: publicOnly}).DialContext(ctx, network, address)
+	}
+	if _, err := client.Get(redirect.URL); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected the redirect to be refused, got: %v", err)
+	}
+
+	resp, err := NewClient(time.Second, true).Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the server to be reachable when private addresses are allowed, got: %v", err)
+	}
+	resp.Body.Close()
+}
+
+// TestDispatcherPrivateAddress tests a delivery to a private address is given up on, rather than retried.
+func TestDispatcherPrivateAddress(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	deadLetters := make(chan data.WebhookDeadLetter, 1)
+	d := NewDispatcher(Config{
+		Client:      NewClient(time.Second, false),
+		MaxAttempts: 3,
+		DeadLetter:  func(deadLetter data.WebhookDeadLetter) error { deadLetters <- deadLetter; return nil },
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go d.Run(ctx)
+
+	if err := d.Dispatch(ctx, data.UserEvent{Sequence: 9}, []data.Webhook{{ID: "hook-1", URL: server.URL, Secret: testSecret}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case deadLetter := <-deadLetters:
+		if deadLetter.Attempts != 1 || !strings.Contains(deadLetter.LastError, ErrPrivateAddress.Error()) {
+			t.Errorf("unexpected dead letter: %+v", deadLetter)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the dead letter")
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.requests) != 0 {
+		t.Errorf("expected nothing to reach the receiver, got %d requests", len(rc.requests))
+	}
+}